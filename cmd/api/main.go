@@ -78,6 +78,18 @@ func Run(
 		return fmt.Errorf("error getting the application server: %s", err.Error())
 	}
 
+	/*
+		Background jobs (event reminders, list change notifications, claim alerts
+		and birthday events). These get their own context so they're stopped once the server
+		shuts down, regardless of which signal did it.
+	*/
+	schedulerCtx, stopSchedulers := context.WithCancel(ctx)
+	defer stopSchedulers()
+	reminders := server.StartReminders(schedulerCtx, getenv, db, logger, server.SetupEmailer(getenv))
+	notifications := server.StartNotifications(schedulerCtx, getenv, db, logger, server.SetupEmailer(getenv))
+	claimAlerts := server.StartClaimAlerts(schedulerCtx, getenv, db, logger, server.SetupEmailer(getenv))
+	birthdays := server.StartBirthdays(schedulerCtx, getenv, db, logger)
+
 	appServer := &http.Server{
 		Addr:         fmt.Sprintf(":%s", getenv("PORT")),
 		BaseContext:  func(_ net.Listener) context.Context { return ctx },
@@ -102,6 +114,11 @@ func Run(
 
 	/* Wait for the graceful shutdown to complete */
 	<-done
+	stopSchedulers()
+	<-reminders.Done()
+	<-notifications.Done()
+	<-claimAlerts.Done()
+	<-birthdays.Done()
 	logger.Info("Graceful shutdown complete.")
 	<-ctx.Done()
 
@@ -0,0 +1,94 @@
+/*
+Browser side of adding and signing in with passkeys. The server sends the
+WebAuthn options as JSON with the binary values base64url encoded, and gets
+the browser's response back as a regular form post through htmx so the
+returned HTML is swapped in like any other request.
+*/
+
+function fromBase64URL(value) {
+    const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    return Uint8Array.from(atob(base64), (c) => c.charCodeAt(0));
+}
+
+function toBase64URL(buffer) {
+    const bytes = new Uint8Array(buffer);
+    let binary = "";
+    bytes.forEach((b) => (binary += String.fromCharCode(b)));
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function showPasskeyError(selector, message) {
+    const error = document.querySelector(selector);
+    if (error) {
+        error.textContent = message;
+        error.hidden = false;
+    }
+}
+
+/* The page's CSRF token, the same header htmx sends from the body's hx-headers */
+function csrfHeaders() {
+    return JSON.parse(document.body.getAttribute("hx-headers") || "{}");
+}
+
+async function fetchOptions(url) {
+    const response = await fetch(url, { method: "POST", credentials: "same-origin", headers: csrfHeaders() });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+async function registerPasskey(form) {
+    if (!window.PublicKeyCredential) {
+        showPasskeyError("#passkey-error", "This browser doesn't support passkeys.");
+        return;
+    }
+
+    try {
+        const options = await fetchOptions("/profile/passkeys/options");
+        options.challenge = fromBase64URL(options.challenge);
+        options.user.id = fromBase64URL(options.user.id);
+        options.excludeCredentials.forEach((cred) => (cred.id = fromBase64URL(cred.id)));
+
+        const credential = await navigator.credentials.create({ publicKey: options });
+        htmx.ajax("POST", "/profile/passkeys", {
+            target: "#passkeys",
+            swap: "outerHTML",
+            values: {
+                name: form.elements["name"].value,
+                credentialId: toBase64URL(credential.rawId),
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                authenticatorData: toBase64URL(credential.response.getAuthenticatorData()),
+                publicKey: toBase64URL(credential.response.getPublicKey()),
+                publicKeyAlgorithm: credential.response.getPublicKeyAlgorithm(),
+            },
+        });
+    } catch (err) {
+        showPasskeyError("#passkey-error", "The passkey wasn't added. " + err.message);
+    }
+}
+
+async function signInWithPasskey() {
+    if (!window.PublicKeyCredential) {
+        showPasskeyError("#login-error", "This browser doesn't support passkeys.");
+        return;
+    }
+
+    try {
+        const options = await fetchOptions("/login/passkey/options");
+        options.challenge = fromBase64URL(options.challenge);
+
+        const credential = await navigator.credentials.get({ publicKey: options });
+        htmx.ajax("POST", "/login/passkey", {
+            target: "#login",
+            values: {
+                credentialId: toBase64URL(credential.rawId),
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                authenticatorData: toBase64URL(credential.response.authenticatorData),
+                signature: toBase64URL(credential.response.signature),
+            },
+        });
+    } catch (err) {
+        showPasskeyError("#login-error", "Passkey sign-in didn't finish. " + err.message);
+    }
+}
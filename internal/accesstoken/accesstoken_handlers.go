@@ -0,0 +1,236 @@
+// Package accesstoken manages personal access tokens, which let people's
+// scripts work with their gift lists without a browser session. Tokens are
+// named, scoped and expiring, and are added, listed and revoked from the
+// profile page. middleware.Auth is what accepts them.
+package accesstoken
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tokenList struct {
+	ErrorMessage string
+	/* Only set right after a token's created, it's never shown again */
+	NewToken string
+	Tokens   []tokenRow
+}
+
+type tokenRow struct {
+	CreatedOn  string
+	Expired    bool
+	ExpiresOn  string
+	ExternalID string
+	LastUsedOn string
+	Name       string
+	Scope      string
+}
+
+const (
+	dateFmt              = "January 2, 2006"
+	deleteTokenStatement = `DELETE FROM access_token WHERE external_id = ? AND person_id = ?`
+	insertTokenStatement = `INSERT INTO access_token (external_id, person_id, name, token_hash, scope, expiration)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	maxNameLength = 255
+	tokensQuery   = `SELECT external_id, name, scope, expiration, created_on, last_used_on
+		FROM access_token
+		WHERE person_id = ?
+		ORDER BY created_on, access_token_id`
+)
+
+var (
+	/* How long a new token can last, in days */
+	lifetimes = []int{7, 30, 90, 365}
+	scopes    = []string{middleware.ReadScope, middleware.WriteScope}
+)
+
+// ListHandler shows the logged-in person the access tokens they've created,
+// with the form for creating another.
+func ListHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("access_token_list")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		writeTokens(ctx, svr, res, personID, tokenList{})
+
+	})
+
+}
+
+// CreateHandler creates a new access token for the logged-in person. Only the
+// hash is saved, the token itself is shown once in the response.
+func CreateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("access_token_create")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		name := strings.TrimSpace(req.PostFormValue("name"))
+		if name == "" || len(name) > maxNameLength {
+			span.SetAttributes(attribute.String("error_message", "invalid access token name"))
+			writeTokens(ctx, svr, res, personID, tokenList{ErrorMessage: fmt.Sprintf("Give the token a name (up to %d characters) so you can tell it apart later.", maxNameLength)})
+			return
+		}
+
+		scope := req.PostFormValue("scope")
+		days, err := strconv.Atoi(req.PostFormValue("expiresIn"))
+		if !slices.Contains(scopes, scope) || err != nil || !slices.Contains(lifetimes, days) {
+			span.SetAttributes(attribute.String("error_message", "invalid access token scope or lifetime"))
+			writeTokens(ctx, svr, res, personID, tokenList{ErrorMessage: "Pick what the token can do and how long it lasts."})
+			return
+		}
+
+		token := rand.Text()
+		externalID := rand.Text()
+		expires := time.Now().AddDate(0, 0, days).UTC()
+		if _, err = svr.DB.Execute(ctx, insertTokenStatement, externalID, personID, name, util.HashSecret(svr, token), scope, expires); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error saving the access token",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeTokens(ctx, svr, res, personID, tokenList{ErrorMessage: "Could not create the access token."})
+			return
+		}
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Create,
+			After:    map[string]any{"expiration": expires, "name": name, "scope": scope},
+			Entity:   audit.AccessToken,
+			EntityID: externalID,
+		})
+
+		writeTokens(ctx, svr, res, personID, tokenList{NewToken: token})
+
+	})
+
+}
+
+// RevokeHandler deletes one of the logged-in person's access tokens, so
+// scripts using it stop working straight away.
+func RevokeHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("access_token_revoke")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("access_token_external_id", externalID),
+		)
+
+		list := tokenList{}
+		if result, err := svr.DB.Execute(ctx, deleteTokenStatement, externalID, personID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error deleting the access token",
+				slog.String("errorMessage", err.Error()),
+			)
+			list.ErrorMessage = "Could not revoke the access token."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		} else if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+			audit.Record(ctx, svr, personID, audit.Event{
+				Action:   audit.Revoke,
+				Entity:   audit.AccessToken,
+				EntityID: externalID,
+			})
+		}
+
+		writeTokens(ctx, svr, res, personID, list)
+
+	})
+
+}
+
+func writeTokens(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, personID int64, list tokenList) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/access_tokens.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the access tokens template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your access tokens"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	list.Tokens = []tokenRow{}
+	rows, err := svr.DB.Query(ctx, tokensQuery, personID)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the access tokens", slog.String("errorMessage", err.Error()))
+		list.ErrorMessage = "Could not look up your access tokens."
+	} else {
+
+		defer rows.Close()
+		now := time.Now().UTC()
+		for rows.Next() {
+
+			var (
+				row        tokenRow
+				expiration time.Time
+				createdOn  sql.NullTime
+				lastUsedOn sql.NullTime
+			)
+			if err := rows.Scan(&row.ExternalID, &row.Name, &row.Scope, &expiration, &createdOn, &lastUsedOn); err != nil {
+				svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+				continue
+			}
+			row.CreatedOn = createdOn.Time.Format(dateFmt)
+			row.Expired = expiration.Before(now)
+			row.ExpiresOn = expiration.Format(dateFmt)
+			if lastUsedOn.Valid {
+				row.LastUsedOn = lastUsedOn.Time.Format(dateFmt)
+			}
+			list.Tokens = append(list.Tokens, row)
+
+		}
+
+	}
+	span.SetAttributes(attribute.Int("access_token_count", len(list.Tokens)))
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "access-tokens", list); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
@@ -0,0 +1,215 @@
+package accesstoken_test
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+)
+
+// TestAccessTokens creates tokens from the profile page and checks scripts can
+// use them on the registry, within their scope, until they expire or are
+// revoked.
+func TestAccessTokens(t *testing.T) {
+	testData := []struct {
+		expectedStatus  int
+		expire          bool
+		externalIDStart string
+		form            url.Values
+		method          string
+		path            string
+		revoke          bool
+		scope           string
+		testName        string
+		wrongToken      bool
+	}{
+		{
+			expectedStatus:  http.StatusOK,
+			externalIDStart: "token-read",
+			method:          "GET",
+			path:            "/registry/items",
+			scope:           middleware.ReadScope,
+			testName:        "Read the registry",
+		},
+		{
+			expectedStatus:  http.StatusOK,
+			externalIDStart: "token-write",
+			form:            url.Values{"name": {"Scripted item"}},
+			method:          "POST",
+			path:            "/registry/items",
+			scope:           middleware.WriteScope,
+			testName:        "Add an item",
+		},
+		{
+			expectedStatus:  http.StatusForbidden,
+			externalIDStart: "token-read-only",
+			form:            url.Values{"name": {"Scripted item"}},
+			method:          "POST",
+			path:            "/registry/items",
+			scope:           middleware.ReadScope,
+			testName:        "Add an item with a read only token",
+		},
+		{
+			expectedStatus:  http.StatusForbidden,
+			externalIDStart: "token-profile",
+			method:          "GET",
+			path:            "/profile",
+			scope:           middleware.WriteScope,
+			testName:        "Outside the registry",
+		},
+		{
+			expectedStatus:  http.StatusUnauthorized,
+			expire:          true,
+			externalIDStart: "token-expired",
+			method:          "GET",
+			path:            "/registry/items",
+			scope:           middleware.ReadScope,
+			testName:        "Expired token",
+		},
+		{
+			expectedStatus:  http.StatusUnauthorized,
+			externalIDStart: "token-revoked",
+			method:          "GET",
+			path:            "/registry/items",
+			revoke:          true,
+			scope:           middleware.ReadScope,
+			testName:        "Revoked token",
+		},
+		{
+			expectedStatus:  http.StatusUnauthorized,
+			externalIDStart: "token-unknown",
+			method:          "GET",
+			path:            "/registry/items",
+			scope:           middleware.ReadScope,
+			testName:        "Unknown token",
+			wrongToken:      true,
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			userData := test.UserData{
+				CreateHousehold: true,
+				Email:           data.externalIDStart + "@localhost.com",
+				ExternalID:      data.externalIDStart + "-owner",
+				FirstName:       "Token",
+				HouseholdName:   data.externalIDStart + " household",
+				LastName:        "Owner",
+			}
+			session, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session", err)
+			}
+
+			res := sessionRequest(t, session, "POST", "/profile/tokens", url.Values{
+				"expiresIn": {"30"},
+				"name":      {data.testName},
+				"scope":     {data.scope},
+			})
+			doc, err := html.Parse(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+			tokenElem, found := test.CheckElement(*doc, "access-token-value")
+			if !found {
+				t.Fatal("Expected the new token to be shown")
+			}
+			token := ""
+			for _, attr := range tokenElem.Attr {
+				if attr.Key == "value" {
+					token = attr.Val
+				}
+			}
+
+			/* Only the hash is kept */
+			var externalID, tokenHash string
+			err = db.QueryRow(ctx, "SELECT t.external_id, t.token_hash FROM access_token t INNER JOIN person p ON p.person_id = t.person_id WHERE p.external_id = ?", userData.ExternalID).Scan(&externalID, &tokenHash)
+			if err != nil {
+				t.Fatal("Could not find the saved token", err)
+			} else if token == "" || tokenHash != test.HashSecret(token) {
+				t.Fatal("Expected the token's hash to be saved")
+			}
+
+			if data.expire {
+				if _, err = db.Execute(ctx, "UPDATE access_token SET expiration = ? WHERE external_id = ?", time.Now().UTC().Add(-time.Minute), externalID); err != nil {
+					t.Fatal("Could not expire the token", err)
+				}
+			}
+			if data.revoke {
+				res = sessionRequest(t, session, "POST", "/profile/tokens/"+externalID+"/revoke", url.Values{})
+				res.Body.Close()
+			}
+			if data.wrongToken {
+				token = "not-the-token"
+			}
+
+			/* Scripts don't send the Sec-Fetch-* headers or a CSRF token */
+			var body io.Reader
+			if data.form != nil {
+				body = strings.NewReader(data.form.Encode())
+			}
+			req, err := http.NewRequestWithContext(ctx, data.method, testServer.URL+data.path, body)
+			if err != nil {
+				t.Fatal("Error building the token request", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			if data.form != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+			res, err = client.Do(req)
+			if err != nil {
+				t.Fatal("Error calling", data.path, err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != data.expectedStatus {
+				t.Fatal("Expected a", data.expectedStatus, "but got", res.StatusCode)
+			}
+
+			if data.method == "POST" && data.path == "/registry/items" {
+				var items int
+				err = db.QueryRow(ctx, "SELECT COUNT(*) FROM item i INNER JOIN person p ON p.person_id = i.person_id WHERE p.external_id = ? AND i.name = ?", userData.ExternalID, "Scripted item").Scan(&items)
+				if err != nil {
+					t.Fatal("Could not count the items", err)
+				}
+				if (items == 1) != (data.expectedStatus == http.StatusOK) {
+					t.Fatal("Expected the item to be added =", data.expectedStatus == http.StatusOK, "but found", items)
+				}
+			}
+		})
+	}
+}
+
+/* Sends the request as the session's user, the way the profile page does */
+func sessionRequest(t *testing.T, token string, method string, path string, form url.Values) *http.Response {
+
+	req, err := http.NewRequestWithContext(ctx, method, testServer.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal("Error building the request", err)
+	}
+
+	req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: token})
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error calling", path, err)
+	}
+	return res
+
+}
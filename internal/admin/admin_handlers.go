@@ -0,0 +1,909 @@
+// Package admin is the site administrators' console for managing the instance:
+// people, households and who's signed in. Every route in it has to be wrapped
+// in middleware.Admin.
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type household struct {
+	ExternalID string
+	Members    int64
+	Name       string
+}
+
+type householdList struct {
+	ErrorMessage string
+	Households   []household
+}
+
+type person struct {
+	Disabled   bool
+	Email      string
+	ExternalID string
+	FirstName  string
+	Household  string
+	LastName   string
+	Sessions   int64
+	SiteAdmin  bool
+}
+
+type personList struct {
+	ErrorMessage string
+	Households   []household
+	People       []person
+	Search       string
+}
+
+type stats struct {
+	ActiveSessions       int64
+	ErrorMessage         string
+	PendingVerifications int64
+}
+
+const (
+	/*
+		Tells the stats (and, for household changes, the people list) to reload
+		after a change
+	*/
+	changedEvent                = "admin-changed"
+	deleteSessionsStatement     = `DELETE FROM session WHERE person_id = ?`
+	deleteVerificationStatement = `DELETE FROM verification WHERE person_id = ?`
+	disablePersonStatement      = `UPDATE person SET disabled_on = ? WHERE person_id = ?`
+	enablePersonStatement       = `UPDATE person SET disabled_on = NULL WHERE person_id = ?`
+	householdChangedEvent       = "admin-households-changed"
+	householdCountQuery         = `SELECT COUNT(*) FROM household WHERE name = ?`
+	householdQuery              = `SELECT household_id, name FROM household WHERE external_id = ? AND deleted_on IS NULL`
+	householdsQuery             = `SELECT h.external_id, h.name, COUNT(hp.person_id)
+		FROM household h
+			LEFT JOIN household_person hp ON hp.household_id = h.household_id
+		WHERE h.deleted_on IS NULL
+		GROUP BY h.household_id, h.external_id, h.name
+		ORDER BY h.name`
+	impersonateStatement = `UPDATE session SET impersonating_id = ? WHERE session_id = ?`
+	/* Only people who could log in themselves can be impersonated */
+	impersonatedQuery              = `SELECT person_id FROM person WHERE external_id = ? AND deleted_on IS NULL AND disabled_on IS NULL`
+	insertHouseholdPersonStatement = `INSERT INTO household_person (household_id, person_id)
+		SELECT h.household_id, p.person_id
+		FROM household h, person p
+		WHERE h.external_id = ?
+			AND h.deleted_on IS NULL
+			AND p.external_id = ?`
+	insertHouseholdStatement = `INSERT INTO household (external_id, name) VALUES (?, ?)`
+	insertPersonStatement    = `INSERT INTO person (external_id, email, first_name, last_name, display_name, type)
+		VALUES (?, ?, ?, ?, ?, 'NORMAL')`
+	mergeHouseholdStatement = `UPDATE household_person SET household_id = ? WHERE household_id = ?`
+	/* Blank searches match everyone */
+	peopleQuery = `SELECT p.external_id,
+			p.first_name,
+			p.last_name,
+			p.email,
+			COALESCE(h.name, ''),
+			p.site_admin,
+			p.disabled_on,
+			(SELECT COUNT(*) FROM session s WHERE s.person_id = p.person_id AND s.expiration > ?)
+		FROM person p
+			LEFT JOIN household_person hp ON hp.person_id = p.person_id
+			LEFT JOIN household h ON h.household_id = hp.household_id
+		WHERE p.deleted_on IS NULL
+			AND (? = ''
+				OR p.email LIKE '%' || ? || '%'
+				OR p.first_name LIKE '%' || ? || '%'
+				OR p.last_name LIKE '%' || ? || '%'
+				OR h.name LIKE '%' || ? || '%')
+		ORDER BY p.last_name, p.first_name
+		LIMIT ?`
+	personCountQuery         = `SELECT COUNT(*) FROM person WHERE email = ?`
+	personExternalIDQuery    = `SELECT external_id FROM person WHERE person_id = ?`
+	personLimit              = 200
+	personQuery              = `SELECT person_id FROM person WHERE external_id = ? AND deleted_on IS NULL`
+	renameHouseholdStatement = `UPDATE household SET name = ? WHERE household_id = ?`
+	retireHouseholdStatement = `UPDATE household SET deleted_on = ? WHERE household_id = ?`
+	statsQuery               = `SELECT
+			(SELECT COUNT(*) FROM session WHERE expiration > ?),
+			(SELECT COUNT(*) FROM verification WHERE token_expiration > ?)`
+	stopImpersonatingStatement = `UPDATE session SET impersonating_id = NULL WHERE session_id = ?`
+	varcharMaxLength           = 255
+)
+
+// ConsoleHandler renders the admin console. The stats come with the page,
+// the people and household sections load themselves.
+func ConsoleHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_console")
+
+		writeTemplate(ctx, svr, res, "admin-page", lookupStats(ctx, svr))
+
+	})
+
+}
+
+// HouseholdCreateHandler adds a new, empty household.
+func HouseholdCreateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_household_create")
+
+		adminID := actingAdmin(res, req)
+		name := strings.TrimSpace(req.FormValue("name"))
+		span.SetAttributes(attribute.String("household_name", name))
+
+		errorMessage := validateHouseholdName(ctx, svr, name)
+		if errorMessage == "" {
+
+			externalID := rand.Text()
+			if _, err := svr.DB.Execute(ctx, insertHouseholdStatement, externalID, name); err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error creating the household",
+					slog.String("errorMessage", err.Error()),
+				)
+				errorMessage = "Could not create the household."
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+			} else {
+				audit.Record(ctx, svr, adminID, audit.Event{
+					Action:   audit.Create,
+					After:    map[string]string{"name": name},
+					Entity:   audit.Household,
+					EntityID: externalID,
+				})
+				res.Header().Set("HX-Trigger", changedEvent+", "+householdChangedEvent)
+			}
+
+		}
+
+		writeHouseholds(ctx, svr, res, errorMessage)
+
+	})
+
+}
+
+// HouseholdMergeHandler moves everyone in a household into another one and
+// retires the emptied household.
+func HouseholdMergeHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_household_merge")
+
+		adminID := actingAdmin(res, req)
+		externalID := req.PathValue("externalID")
+		intoExtID := req.FormValue("into")
+		span.SetAttributes(
+			attribute.String("household_external_id", externalID),
+			attribute.String("into_household_external_id", intoExtID),
+		)
+
+		if externalID == intoExtID {
+			writeHouseholds(ctx, svr, res, "Choose a different household to merge into.")
+			return
+		}
+
+		var (
+			fromID   int64
+			fromName string
+			intoID   int64
+			intoName string
+		)
+		if err := svr.DB.QueryRow(ctx, householdQuery, externalID).Scan(&fromID, &fromName); err != nil {
+			logLookupError(ctx, svr, "Error looking up the household to merge", err)
+			writeHouseholds(ctx, svr, res, "Could not find that household.")
+			return
+		}
+		if err := svr.DB.QueryRow(ctx, householdQuery, intoExtID).Scan(&intoID, &intoName); err != nil {
+			logLookupError(ctx, svr, "Error looking up the household to merge into", err)
+			writeHouseholds(ctx, svr, res, "Could not find the household to merge into.")
+			return
+		}
+
+		statements := []string{mergeHouseholdStatement, retireHouseholdStatement}
+		params := [][]any{{intoID, fromID}, {time.Now().UTC(), fromID}}
+		_, errs := svr.DB.ExecuteBatch(ctx, statements, params)
+		for _, err := range errs {
+			if err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error merging the households",
+					slog.String("errorMessage", err.Error()),
+				)
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				writeHouseholds(ctx, svr, res, "Could not merge the households.")
+				return
+			}
+		}
+
+		audit.Record(ctx, svr, adminID, audit.Event{
+			Action:   audit.Merge,
+			After:    map[string]string{"into": intoExtID, "name": intoName},
+			Before:   map[string]string{"name": fromName},
+			Entity:   audit.Household,
+			EntityID: externalID,
+		})
+		res.Header().Set("HX-Trigger", changedEvent+", "+householdChangedEvent)
+		writeHouseholds(ctx, svr, res, "")
+
+	})
+
+}
+
+// HouseholdRenameHandler changes a household's name.
+func HouseholdRenameHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_household_rename")
+
+		adminID := actingAdmin(res, req)
+		externalID := req.PathValue("externalID")
+		name := strings.TrimSpace(req.FormValue("name"))
+		span.SetAttributes(
+			attribute.String("household_external_id", externalID),
+			attribute.String("household_name", name),
+		)
+
+		var (
+			householdID int64
+			oldName     string
+		)
+		if err := svr.DB.QueryRow(ctx, householdQuery, externalID).Scan(&householdID, &oldName); err != nil {
+			logLookupError(ctx, svr, "Error looking up the household to rename", err)
+			writeHouseholds(ctx, svr, res, "Could not find that household.")
+			return
+		}
+
+		if name == oldName {
+			writeHouseholds(ctx, svr, res, "")
+			return
+		}
+
+		errorMessage := validateHouseholdName(ctx, svr, name)
+		if errorMessage == "" {
+
+			if _, err := svr.DB.Execute(ctx, renameHouseholdStatement, name, householdID); err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error renaming the household",
+					slog.String("errorMessage", err.Error()),
+				)
+				errorMessage = "Could not rename the household."
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+			} else {
+				audit.Record(ctx, svr, adminID, audit.Event{
+					Action:   audit.Update,
+					After:    map[string]string{"name": name},
+					Before:   map[string]string{"name": oldName},
+					Entity:   audit.Household,
+					EntityID: externalID,
+				})
+				res.Header().Set("HX-Trigger", householdChangedEvent)
+			}
+
+		}
+
+		writeHouseholds(ctx, svr, res, errorMessage)
+
+	})
+
+}
+
+// HouseholdsHandler lists the households and how many people are in each.
+func HouseholdsHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_households")
+
+		writeHouseholds(ctx, svr, res, "")
+
+	})
+
+}
+
+// ImpersonateHandler starts viewing the app as someone else, so an admin can
+// see exactly what they see. Until ImpersonationStopHandler is called, the
+// admin's session acts as that person, with a banner on every page.
+func ImpersonateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_impersonate")
+
+		adminID := actingAdmin(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(attribute.String("person_external_id", externalID))
+
+		var personID int64
+		if err := svr.DB.QueryRow(ctx, impersonatedQuery, externalID).Scan(&personID); err != nil {
+			logLookupError(ctx, svr, "Error looking up the person to impersonate", err)
+			http.Error(res, "Could not find that person", http.StatusNotFound)
+			return
+		} else if personID == adminID {
+			http.Error(res, "You can't impersonate yourself", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := svr.DB.Execute(ctx, impersonateStatement, personID, currentSession(svr, req)); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error starting the impersonation",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			http.Error(res, "Could not view the registry as that person", http.StatusInternalServerError)
+			return
+		}
+
+		svr.Logger.InfoContext(ctx,
+			"Admin started impersonating",
+			slog.Int64("impersonatorID", adminID),
+			slog.Int64("personID", personID),
+		)
+		audit.Record(ctx, svr, adminID, audit.Event{
+			Action:   audit.Impersonate,
+			After:    map[string]string{"impersonating": externalID},
+			Entity:   audit.Person,
+			EntityID: externalID,
+		})
+		http.Redirect(res, req, "/registry/items", http.StatusSeeOther)
+
+	})
+
+}
+
+// ImpersonationStopHandler goes back to being the admin and returns to the
+// console.
+func ImpersonationStopHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_impersonation_stop")
+
+		adminID := middleware.Impersonator(ctx)
+		if adminID == 0 {
+			http.Redirect(res, req, "/admin", http.StatusSeeOther)
+			return
+		}
+
+		if _, err := svr.DB.Execute(ctx, stopImpersonatingStatement, currentSession(svr, req)); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error stopping the impersonation",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			http.Error(res, "Could not stop viewing the registry as someone else", http.StatusInternalServerError)
+			return
+		}
+
+		var externalID string
+		if err := svr.DB.QueryRow(ctx, personExternalIDQuery, middleware.PersonID(res, req)).Scan(&externalID); err != nil {
+			logLookupError(ctx, svr, "Error looking up the impersonated person", err)
+		}
+		audit.Record(ctx, svr, adminID, audit.Event{
+			Action:   audit.Impersonate,
+			Before:   map[string]string{"impersonating": externalID},
+			Entity:   audit.Person,
+			EntityID: externalID,
+		})
+		http.Redirect(res, req, "/admin", http.StatusSeeOther)
+
+	})
+
+}
+
+// PeopleHandler lists everyone with an account, optionally narrowed down by
+// a search on their name, email address or household.
+func PeopleHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_people")
+
+		writePeople(ctx, svr, res, req, "")
+
+	})
+
+}
+
+// PersonCreateHandler adds a person who can then log in with their email
+// address, optionally putting them in a household.
+func PersonCreateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_person_create")
+
+		adminID := actingAdmin(res, req)
+		email := strings.TrimSpace(req.FormValue("email"))
+		firstName := strings.TrimSpace(req.FormValue("firstName"))
+		lastName := strings.TrimSpace(req.FormValue("lastName"))
+		householdExtID := req.FormValue("household")
+		span.SetAttributes(attribute.String("household_external_id", householdExtID))
+
+		var existing int64
+		switch {
+		case firstName == "" || lastName == "" || email == "":
+			writePeople(ctx, svr, res, req, "First name, last name and email address are all required.")
+			return
+		case len(firstName) > varcharMaxLength || len(lastName) > varcharMaxLength || len(email) > varcharMaxLength:
+			writePeople(ctx, svr, res, req, fmt.Sprintf("Names and email addresses can't be more than %d characters.", varcharMaxLength))
+			return
+		}
+		/* The same check the login form uses, or they'd never be able to log in */
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			writePeople(ctx, svr, res, req, "Enter a valid email address.")
+			return
+		}
+		if householdExtID != "" {
+			var (
+				householdID   int64
+				householdName string
+			)
+			if err := svr.DB.QueryRow(ctx, householdQuery, householdExtID).Scan(&householdID, &householdName); err != nil {
+				logLookupError(ctx, svr, "Error looking up the new person's household", err)
+				writePeople(ctx, svr, res, req, "Could not find that household.")
+				return
+			}
+		}
+		if err := svr.DB.QueryRow(ctx, personCountQuery, email).Scan(&existing); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error checking the email address", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writePeople(ctx, svr, res, req, "Could not add that person.")
+			return
+		} else if existing > 0 {
+			writePeople(ctx, svr, res, req, "Someone already has that email address.")
+			return
+		}
+
+		externalID := rand.Text()
+		statements := []string{insertPersonStatement}
+		params := [][]any{{externalID, email, firstName, lastName, firstName}}
+		if householdExtID != "" {
+			statements = append(statements, insertHouseholdPersonStatement)
+			params = append(params, []any{householdExtID, externalID})
+		}
+		_, errs := svr.DB.ExecuteBatch(ctx, statements, params)
+		for _, err := range errs {
+			if err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error creating the person",
+					slog.String("errorMessage", err.Error()),
+				)
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				writePeople(ctx, svr, res, req, "Could not add that person.")
+				return
+			}
+		}
+
+		audit.Record(ctx, svr, adminID, audit.Event{
+			Action: audit.Create,
+			After: map[string]string{
+				"email":     email,
+				"firstName": firstName,
+				"household": householdExtID,
+				"lastName":  lastName,
+			},
+			Entity:   audit.Person,
+			EntityID: externalID,
+		})
+		res.Header().Set("HX-Trigger", changedEvent)
+		writePeople(ctx, svr, res, req, "")
+
+	})
+
+}
+
+// PersonDisableHandler stops a person from logging in, signing them out of
+// every device and throwing away any login code they have waiting. Admins
+// can't disable themselves.
+func PersonDisableHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_person_disable")
+
+		adminID := actingAdmin(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(attribute.String("person_external_id", externalID))
+
+		var personID int64
+		if err := svr.DB.QueryRow(ctx, personQuery, externalID).Scan(&personID); err != nil {
+			logLookupError(ctx, svr, "Error looking up the person to disable", err)
+			writePeople(ctx, svr, res, req, "Could not find that person.")
+			return
+		} else if personID == adminID {
+			writePeople(ctx, svr, res, req, "You can't disable your own account.")
+			return
+		}
+
+		statements := []string{disablePersonStatement, deleteSessionsStatement, deleteVerificationStatement}
+		params := [][]any{{time.Now().UTC(), personID}, {personID}, {personID}}
+		_, errs := svr.DB.ExecuteBatch(ctx, statements, params)
+		for _, err := range errs {
+			if err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error disabling the person",
+					slog.String("errorMessage", err.Error()),
+				)
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				writePeople(ctx, svr, res, req, "Could not disable that person.")
+				return
+			}
+		}
+
+		audit.Record(ctx, svr, adminID, audit.Event{
+			Action:   audit.Disable,
+			Entity:   audit.Person,
+			EntityID: externalID,
+		})
+		res.Header().Set("HX-Trigger", changedEvent)
+		writePeople(ctx, svr, res, req, "")
+
+	})
+
+}
+
+// PersonEnableHandler lets a disabled person log in again.
+func PersonEnableHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_person_enable")
+
+		adminID := actingAdmin(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(attribute.String("person_external_id", externalID))
+
+		var personID int64
+		if err := svr.DB.QueryRow(ctx, personQuery, externalID).Scan(&personID); err != nil {
+			logLookupError(ctx, svr, "Error looking up the person to enable", err)
+			writePeople(ctx, svr, res, req, "Could not find that person.")
+			return
+		}
+
+		if _, err := svr.DB.Execute(ctx, enablePersonStatement, personID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error enabling the person",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writePeople(ctx, svr, res, req, "Could not enable that person.")
+			return
+		}
+
+		audit.Record(ctx, svr, adminID, audit.Event{
+			Action:   audit.Enable,
+			Entity:   audit.Person,
+			EntityID: externalID,
+		})
+		writePeople(ctx, svr, res, req, "")
+
+	})
+
+}
+
+// PersonLogoutHandler signs a person out of every device they're logged in
+// on. Unlike disabling them, they can log straight back in.
+func PersonLogoutHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_person_logout")
+
+		adminID := actingAdmin(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(attribute.String("person_external_id", externalID))
+
+		var personID int64
+		if err := svr.DB.QueryRow(ctx, personQuery, externalID).Scan(&personID); err != nil {
+			logLookupError(ctx, svr, "Error looking up the person to log out", err)
+			writePeople(ctx, svr, res, req, "Could not find that person.")
+			return
+		}
+
+		result, err := svr.DB.Execute(ctx, deleteSessionsStatement, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error logging the person out",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writePeople(ctx, svr, res, req, "Could not log that person out.")
+			return
+		}
+
+		if revoked, err := result.RowsAffected(); err == nil && revoked > 0 {
+			span.SetAttributes(attribute.Int64("revoked_count", revoked))
+			audit.Record(ctx, svr, adminID, audit.Event{
+				Action:   audit.Revoke,
+				After:    map[string]any{"person": externalID, "revoked": revoked},
+				Entity:   audit.Session,
+				EntityID: externalID,
+			})
+		}
+		res.Header().Set("HX-Trigger", changedEvent)
+		writePeople(ctx, svr, res, req, "")
+
+	})
+
+}
+
+// StatsHandler renders the counts of active sessions and pending login codes.
+// Only the counts, the codes themselves are never shown.
+func StatsHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("admin_stats")
+
+		writeTemplate(ctx, svr, res, "admin-stats", lookupStats(ctx, svr))
+
+	})
+
+}
+
+/*
+The admin making the request. While impersonating, PersonID is the person
+being viewed as, not the admin.
+*/
+func actingAdmin(res http.ResponseWriter, req *http.Request) int64 {
+
+	if adminID := middleware.Impersonator(req.Context()); adminID != 0 {
+		return adminID
+	}
+	return middleware.PersonID(res, req)
+
+}
+
+/* The stored (hashed) ID of the session the request came in on */
+func currentSession(svr *util.ServerUtils, req *http.Request) string {
+
+	cookie, err := req.Cookie(middleware.SessionCookie)
+	if err != nil {
+		return ""
+	}
+	return util.HashSecret(svr, cookie.Value)
+
+}
+
+func logLookupError(ctx context.Context, svr *util.ServerUtils, message string, err error) {
+
+	if err == sql.ErrNoRows {
+		return
+	}
+	svr.Logger.ErrorContext(ctx, message, slog.String("errorMessage", err.Error()))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("error_message", err.Error()))
+
+}
+
+func lookupHouseholds(ctx context.Context, svr *util.ServerUtils) ([]household, error) {
+
+	households := []household{}
+	rows, err := svr.DB.Query(ctx, householdsQuery)
+	if err != nil {
+		return households, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var house household
+		if err = rows.Scan(&house.ExternalID, &house.Name, &house.Members); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		households = append(households, house)
+
+	}
+
+	return households, nil
+
+}
+
+func lookupPeople(ctx context.Context, svr *util.ServerUtils, search string) ([]person, error) {
+
+	people := []person{}
+	rows, err := svr.DB.Query(
+		ctx,
+		peopleQuery,
+		time.Now().UTC(),
+		search, search, search, search, search,
+		personLimit,
+	)
+	if err != nil {
+		return people, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			found      person
+			disabledOn sql.NullTime
+		)
+		err = rows.Scan(
+			&found.ExternalID,
+			&found.FirstName,
+			&found.LastName,
+			&found.Email,
+			&found.Household,
+			&found.SiteAdmin,
+			&disabledOn,
+			&found.Sessions,
+		)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		found.Disabled = disabledOn.Valid
+		people = append(people, found)
+
+	}
+
+	return people, nil
+
+}
+
+func lookupStats(ctx context.Context, svr *util.ServerUtils) stats {
+
+	var counts stats
+	now := time.Now().UTC()
+	if err := svr.DB.QueryRow(ctx, statsQuery, now, now).Scan(&counts.ActiveSessions, &counts.PendingVerifications); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error counting sessions and verification codes",
+			slog.String("errorMessage", err.Error()),
+		)
+		counts.ErrorMessage = "Could not count the sessions and login codes."
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("error_message", err.Error()))
+	}
+	return counts
+
+}
+
+/*
+Checks a new household name is usable. Names have to be unique, even against
+households that were merged away.
+*/
+func validateHouseholdName(ctx context.Context, svr *util.ServerUtils, name string) string {
+
+	if name == "" {
+		return "Household name is required."
+	} else if len(name) > varcharMaxLength {
+		return fmt.Sprintf("Household name can't be more than %d characters.", varcharMaxLength)
+	}
+
+	var existing int64
+	if err := svr.DB.QueryRow(ctx, householdCountQuery, name).Scan(&existing); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error checking the household name", slog.String("errorMessage", err.Error()))
+		return "Could not check the household name."
+	} else if existing > 0 {
+		return fmt.Sprintf("There's already a household named %s.", name)
+	}
+	return ""
+
+}
+
+func writeHouseholds(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, errorMessage string) {
+
+	list := householdList{ErrorMessage: errorMessage}
+	households, err := lookupHouseholds(ctx, svr)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the households", slog.String("errorMessage", err.Error()))
+		list.ErrorMessage = "Could not look up the households."
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("error_message", err.Error()))
+	}
+	list.Households = households
+
+	writeTemplate(ctx, svr, res, "admin-households", list)
+
+}
+
+func writePeople(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, req *http.Request, errorMessage string) {
+
+	span := trace.SpanFromContext(ctx)
+	list := personList{
+		ErrorMessage: errorMessage,
+		Search:       strings.TrimSpace(req.FormValue("q")),
+	}
+	span.SetAttributes(attribute.String("search", list.Search))
+
+	people, err := lookupPeople(ctx, svr, list.Search)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the people", slog.String("errorMessage", err.Error()))
+		list.ErrorMessage = "Could not look up the people."
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+	list.People = people
+	span.SetAttributes(attribute.Int("person_count", len(people)))
+
+	/* Only used for the new person form, so a failure isn't worth mentioning */
+	if list.Households, err = lookupHouseholds(ctx, svr); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the households", slog.String("errorMessage", err.Error()))
+	}
+
+	writeTemplate(ctx, svr, res, "admin-people", list)
+
+}
+
+/*
+Every section lives in the one template file, and the page uses the CSRF
+functions, so even the fragments are parsed with them
+*/
+func writeTemplate(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, name string, data any) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.New("admin.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/admin.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the admin template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error rendering the admin console"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, name, data); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
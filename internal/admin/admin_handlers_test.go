@@ -0,0 +1,510 @@
+package admin_test
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestConsole loads the console and the people search as an admin, and
+// checks regular people are turned away.
+func TestConsole(t *testing.T) {
+	testData := []struct {
+		admin          bool
+		expectedStatus int
+		externalID     string
+		missing        []string
+		path           string
+		shown          []string
+		testName       string
+	}{
+		{
+			admin:          true,
+			expectedStatus: http.StatusOK,
+			externalID:     "admin-console",
+			path:           "/admin",
+			shown:          []string{"admin-active-sessions", "admin-pending-verifications", "admin-people"},
+			testName:       "Console page",
+		},
+		{
+			admin:          true,
+			expectedStatus: http.StatusOK,
+			externalID:     "admin-search",
+			missing:        []string{"admin-person-admin-search-other"},
+			path:           "/admin/people?q=admin-search-match",
+			shown:          []string{"admin-person-admin-search-match"},
+			testName:       "Search people",
+		},
+		{
+			expectedStatus: http.StatusForbidden,
+			externalID:     "admin-denied",
+			path:           "/admin/people",
+			testName:       "Not an admin",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token := adminSession(t, data.externalID, data.admin)
+			for _, suffix := range []string{"-match", "-other"} {
+				_, err := test.CreateUser(ctx, logger, db, test.UserData{
+					Email:      data.externalID + suffix + "@localhost.com",
+					ExternalID: data.externalID + suffix,
+					FirstName:  "Listed",
+					LastName:   "Person",
+				})
+				if err != nil {
+					t.Fatal("Could not create a test person", err)
+				}
+			}
+
+			res := request(t, "GET", data.path, token, nil)
+			defer res.Body.Close()
+			if res.StatusCode != data.expectedStatus {
+				t.Fatal("Expected status", data.expectedStatus, "but got", res.StatusCode)
+			}
+			if data.expectedStatus != http.StatusOK {
+				return
+			}
+
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+			for _, id := range data.shown {
+				if _, found := test.CheckElement(*doc, id); !found {
+					t.Fatal("Expected", id, "to be shown")
+				}
+			}
+			for _, id := range data.missing {
+				if _, found := test.CheckElement(*doc, id); found {
+					t.Fatal(id, "should have been filtered out")
+				}
+			}
+		})
+	}
+}
+
+// TestHouseholds creates, renames and merges households.
+func TestHouseholds(t *testing.T) {
+
+	token := adminSession(t, "admin-households", true)
+	members := []string{"admin-household-from", "admin-household-into"}
+	for _, externalID := range members {
+		_, err := test.CreateUser(ctx, logger, db, test.UserData{
+			CreateHousehold: true,
+			Email:           externalID + "@localhost.com",
+			ExternalID:      externalID,
+			FirstName:       "Household",
+			HouseholdName:   externalID + " house",
+			LastName:        "Member",
+		})
+		if err != nil {
+			t.Fatal("Could not create a test household", err)
+		}
+	}
+
+	res := request(t, "POST", "/admin/households", token, url.Values{"name": {"Admin created house"}})
+	_ = res.Body.Close()
+	var created int64
+	if err := db.QueryRow(ctx, "SELECT COUNT(*) FROM household WHERE name = ?", "Admin created house").Scan(&created); err != nil || created != 1 {
+		t.Fatal("Expected the household to be created", err)
+	}
+
+	res = request(t, "POST", "/admin/households/admin-household-into/rename", token, url.Values{"name": {"Admin renamed house"}})
+	_ = res.Body.Close()
+	var name string
+	if err := db.QueryRow(ctx, "SELECT name FROM household WHERE external_id = ?", "admin-household-into").Scan(&name); err != nil {
+		t.Fatal("Could not look up the renamed household", err)
+	} else if name != "Admin renamed house" {
+		t.Fatal("Expected the household to be renamed but it's called", name)
+	}
+
+	res = request(t, "POST", "/admin/households/admin-household-into/rename", token, url.Values{"name": {"Admin created house"}})
+	_ = res.Body.Close()
+	if err := db.QueryRow(ctx, "SELECT name FROM household WHERE external_id = ?", "admin-household-into").Scan(&name); err != nil || name != "Admin renamed house" {
+		t.Fatal("Renaming to a name that's taken should have been refused, but it's called", name, err)
+	}
+
+	res = request(t, "POST", "/admin/households/admin-household-from/merge", token, url.Values{"into": {"admin-household-into"}})
+	_ = res.Body.Close()
+
+	var merged int64
+	err := db.QueryRow(ctx,
+		`SELECT COUNT(*)
+		FROM household_person hp
+			INNER JOIN household h ON h.household_id = hp.household_id
+			INNER JOIN person p ON p.person_id = hp.person_id
+		WHERE h.external_id = ?
+			AND p.external_id IN (?, ?)`,
+		"admin-household-into", members[0], members[1],
+	).Scan(&merged)
+	if err != nil || merged != 2 {
+		t.Fatal("Expected both people in the merged household but found", merged, err)
+	}
+
+	var retired sql.NullTime
+	if err = db.QueryRow(ctx, "SELECT deleted_on FROM household WHERE external_id = ?", "admin-household-from").Scan(&retired); err != nil || !retired.Valid {
+		t.Fatal("Expected the merged household to be retired", err)
+	}
+
+}
+
+// TestImpersonation views the registry as someone else, checking the banner
+// shows, nothing on their list or profile can be changed, and the admin can get
+// back to being themselves.
+func TestImpersonation(t *testing.T) {
+
+	token := adminSession(t, "admin-impersonator", true)
+	_, err := test.CreateUser(ctx, logger, db, test.UserData{
+		Email:      "admin-impersonated@localhost.com",
+		ExternalID: "admin-impersonated",
+		FirstName:  "Viewed",
+		LastName:   "Grandpa",
+	})
+	if err != nil {
+		t.Fatal("Could not create the person to impersonate", err)
+	}
+
+	res := request(t, "POST", "/admin/people/admin-impersonated/impersonate", token, nil)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/registry/items" {
+		t.Fatal("Expected to be sent to their list but got", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	res = request(t, "GET", "/registry/items", token, nil)
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatal("Error reading the list page", err)
+	}
+	if !strings.Contains(string(body), "impersonation-banner") || !strings.Contains(string(body), "Viewed Grandpa") {
+		t.Fatal("Expected the impersonation banner on the list page")
+	}
+
+	/* One of each kind of change, none of which the admin can make for them */
+	blocked := []string{
+		"/profile/admin-impersonated",
+		"/profile/admin-impersonated/delete",
+		"/profile/admin-impersonated/restore",
+		"/profile/calendar",
+		"/profile/calendar/revoke",
+		"/profile/devices/revoke-others",
+		"/profile/reminders/not-an-event/update",
+		"/profile/tokens",
+		"/profile/tokens/not-a-token/revoke",
+		"/registry/alerts/dismiss",
+		"/registry/items",
+		"/registry/items/not-an-item",
+		"/registry/items/not-an-item/claim",
+		"/registry/items/not-an-item/delete",
+		"/registry/items/not-an-item/purchase",
+		"/registry/items/not-an-item/restore",
+		"/registry/items/not-an-item/unclaim",
+		"/registry/items/not-an-item/withdraw",
+		"/registry/shares",
+		"/registry/shares/not-a-share/revoke",
+	}
+	for _, path := range blocked {
+		res = request(t, "POST", path, token, url.Values{"name": {"Impersonated item"}})
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatal("Expected", path, "to be blocked while impersonating but got", res.StatusCode)
+		}
+	}
+
+	var items int64
+	if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM item WHERE name = ?", "Impersonated item").Scan(&items); err != nil {
+		t.Fatal("Could not count the items", err)
+	} else if items != 0 {
+		t.Fatal("Expected no item to be added while impersonating but found", items)
+	}
+
+	var events int64
+	err = db.QueryRow(ctx,
+		`SELECT COUNT(*)
+		FROM audit_event a
+			INNER JOIN person p ON p.person_id = a.actor_id
+		WHERE a.action = 'IMPERSONATE'
+			AND a.entity_id = ?
+			AND p.external_id = ?`,
+		"admin-impersonated", "admin-impersonator",
+	).Scan(&events)
+	if err != nil || events != 1 {
+		t.Fatal("Expected the impersonation to be audited but found", events, err)
+	}
+
+	res = request(t, "POST", "/admin/impersonation/stop", token, nil)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatal("Expected to be sent back to the console but got", res.StatusCode)
+	}
+
+	var impersonating sql.NullInt64
+	if err = db.QueryRow(ctx, "SELECT impersonating_id FROM session WHERE session_id = ?", test.HashSecret(token)).Scan(&impersonating); err != nil {
+		t.Fatal("Could not look up the session", err)
+	} else if impersonating.Valid {
+		t.Fatal("Expected the impersonation to have ended")
+	}
+
+}
+
+// TestPeople adds people, then logs out and disables them, checking the
+// disabled person can't log in again.
+func TestPeople(t *testing.T) {
+	testData := []struct {
+		action          string
+		expectDisabled  bool
+		expectSessions  bool
+		externalIDStart string
+		self            bool
+		testName        string
+	}{
+		{
+			action:          "logout",
+			externalIDStart: "admin-logout",
+			testName:        "Force logout",
+		},
+		{
+			action:          "disable",
+			expectDisabled:  true,
+			externalIDStart: "admin-disable",
+			testName:        "Disable",
+		},
+		{
+			action:          "disable",
+			expectSessions:  true,
+			externalIDStart: "admin-disable-self",
+			self:            true,
+			testName:        "Disable yourself",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token := adminSession(t, data.externalIDStart+"-admin", true)
+			email := data.externalIDStart + "-person@localhost.com"
+
+			res := request(t, "POST", "/admin/people", token, url.Values{
+				"email":     {email},
+				"firstName": {"Managed"},
+				"lastName":  {"Person"},
+			})
+			_ = res.Body.Close()
+
+			var externalID string
+			if err := db.QueryRow(ctx, "SELECT external_id FROM person WHERE email = ?", email).Scan(&externalID); err != nil {
+				t.Fatal("Expected the person to be created", err)
+			}
+
+			/* Sign the new person in somewhere so there's something to revoke */
+			if _, err := db.Execute(ctx,
+				"INSERT INTO session (session_id, external_id, person_id, expiration, user_agent) SELECT ?, ?, person_id, ?, ? FROM person WHERE external_id = ?",
+				test.HashSecret(externalID), externalID, time.Now().UTC().Add(time.Hour), test.DefaultUserAgent, externalID,
+			); err != nil {
+				t.Fatal("Could not create a session for the person", err)
+			}
+
+			target := externalID
+			if data.self {
+				target = data.externalIDStart + "-admin"
+			}
+			res = request(t, "POST", "/admin/people/"+target+"/"+data.action, token, nil)
+			_ = res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 but got", res.StatusCode)
+			}
+
+			var sessions int64
+			if err := db.QueryRow(ctx, "SELECT COUNT(*) FROM session s INNER JOIN person p ON p.person_id = s.person_id WHERE p.external_id = ?", target).Scan(&sessions); err != nil {
+				t.Fatal("Could not count the sessions", err)
+			}
+			if (sessions > 0) != data.expectSessions {
+				t.Fatal("Expected sessions left", data.expectSessions, "but found", sessions)
+			}
+
+			var disabledOn sql.NullTime
+			if err := db.QueryRow(ctx, "SELECT disabled_on FROM person WHERE external_id = ?", target).Scan(&disabledOn); err != nil {
+				t.Fatal("Could not look up the person", err)
+			}
+			if disabledOn.Valid != data.expectDisabled {
+				t.Fatal("Expected disabled", data.expectDisabled, "but got", disabledOn.Valid)
+			}
+
+			if !data.expectDisabled {
+				return
+			}
+
+			res = request(t, "POST", "/login", "", url.Values{"email": {email}})
+			_ = res.Body.Close()
+			var codes int64
+			if err := db.QueryRow(ctx, "SELECT COUNT(*) FROM verification v INNER JOIN person p ON p.person_id = v.person_id WHERE p.email = ?", email).Scan(&codes); err != nil {
+				t.Fatal("Could not count the login codes", err)
+			} else if codes > 0 {
+				t.Fatal("A disabled person shouldn't get a login code")
+			}
+		})
+	}
+}
+
+// TestPersonCreate adds people through the console, checking the email address
+// gets the same check the login form does and the household has to exist.
+func TestPersonCreate(t *testing.T) {
+	testData := []struct {
+		email           string
+		expectedCreated bool
+		expectedError   string
+		externalIDStart string
+		household       string
+		testName        string
+	}{
+		{
+			email:           "admin-create-valid@localhost.com",
+			expectedCreated: true,
+			externalIDStart: "admin-create-valid",
+			household:       "admin-create-valid-household",
+			testName:        "Valid person",
+		},
+		{
+			email:           "admin-create-bad-email@",
+			expectedError:   "Enter a valid email address.",
+			externalIDStart: "admin-create-bad-email",
+			testName:        "Invalid email address",
+		},
+		{
+			email:           "Named <admin-create-named@localhost.com>",
+			expectedError:   "Enter a valid email address.",
+			externalIDStart: "admin-create-named",
+			testName:        "Email address with a name",
+		},
+		{
+			email:           "admin-create-no-household@localhost.com",
+			expectedError:   "Could not find that household.",
+			externalIDStart: "admin-create-no-household",
+			household:       "not-a-household",
+			testName:        "Unknown household",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token := adminSession(t, data.externalIDStart+"-admin", true)
+			if data.expectedCreated {
+				if _, err := db.Execute(ctx, "INSERT INTO household (external_id, name) VALUES (?, ?)", data.household, "New person's household"); err != nil {
+					t.Fatal("Could not create the household", err)
+				}
+			}
+
+			res := request(t, "POST", "/admin/people", token, url.Values{
+				"email":     {data.email},
+				"firstName": {"New"},
+				"household": {data.household},
+				"lastName":  {"Person"},
+			})
+			doc, err := html.Parse(res.Body)
+			_ = res.Body.Close()
+			if err != nil {
+				t.Fatal("Error parsing the people section", err)
+			}
+
+			errorElem, found := test.CheckElement(*doc, "admin-people-error")
+			if !found {
+				t.Fatal("The people section is missing its error message")
+			}
+			errorMessage := ""
+			if test.ElementVisible(errorElem) && errorElem.FirstChild != nil {
+				errorMessage = strings.TrimSpace(errorElem.FirstChild.Data)
+			}
+			if errorMessage != data.expectedError {
+				t.Fatal("Expected the error", data.expectedError, "but got", errorMessage)
+			}
+
+			var people, households int
+			err = db.QueryRow(ctx, `SELECT COUNT(*), COUNT(hp.household_id) FROM person p
+				LEFT JOIN household_person hp ON hp.person_id = p.person_id
+				WHERE p.first_name = 'New' AND p.email = ?`, data.email).Scan(&people, &households)
+			if err != nil {
+				t.Fatal("Could not count the new people", err)
+			} else if (people == 1) != data.expectedCreated {
+				t.Fatal("Expected the person to be created", data.expectedCreated, "but found", people)
+			} else if data.expectedCreated && households != 1 {
+				t.Fatal("Expected the person to be in their household but found", households)
+			}
+		})
+	}
+}
+
+/* Logs a new person in, making them a site admin if asked */
+func adminSession(t *testing.T, externalID string, admin bool) string {
+
+	token, err := test.CreateSession(ctx, logger, db, test.UserData{
+		Email:      externalID + "@localhost.com",
+		ExternalID: externalID,
+		FirstName:  "Site",
+		LastName:   "Admin",
+	}, 5*time.Minute, userAgent)
+	if err != nil {
+		t.Fatal("Could not create a test session", err)
+	}
+
+	if admin {
+		if _, err = db.Execute(ctx, "UPDATE person SET site_admin = TRUE WHERE external_id = ?", externalID); err != nil {
+			t.Fatal("Could not make the person an admin", err)
+		}
+	}
+	return token
+
+}
+
+/* Redirects are checked, not followed, the client has no cookie jar */
+var client = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func request(t *testing.T, method string, path string, token string, form url.Values) *http.Response {
+
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, testServer.URL+path, body)
+	if err != nil {
+		t.Fatal("Error building the request", err)
+	}
+
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: token})
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal("Error making the request", err)
+	}
+	return res
+
+}
@@ -0,0 +1,130 @@
+// Package audit keeps an append-only record of the changes people make across
+// the app (who changed what, from what, to what) so questions like "who
+// changed Grandma's email?" have an answer. Events are only ever inserted;
+// nothing in the app updates or deletes them.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Event describes a single change to record. Before and After are stored as
+// JSON, and either can be nil (nothing before a create, nothing after a
+// delete).
+type Event struct {
+	Action   string
+	After    any
+	Before   any
+	Entity   string
+	EntityID string
+}
+
+const (
+	Confirm     = "CONFIRM"
+	Create      = "CREATE"
+	Delete      = "DELETE"
+	Disable     = "DISABLE"
+	Enable      = "ENABLE"
+	Impersonate = "IMPERSONATE"
+	Login       = "LOGIN"
+	Logout      = "LOGOUT"
+	Merge       = "MERGE"
+	Release     = "RELEASE"
+	Restore     = "RESTORE"
+	Revoke      = "REVOKE"
+	Update      = "UPDATE"
+	Withdraw    = "WITHDRAW"
+
+	AccessToken   = "access_token"
+	CalendarLink  = "calendar_link"
+	Claim         = "claim"
+	EventReminder = "event_reminder"
+	GuestClaim    = "guest_claim"
+	Household     = "household"
+	Item          = "item"
+	Passkey       = "passkey"
+	Person        = "person"
+	Session       = "session"
+	ShareLink     = "share_link"
+
+	insertEventStatement = `INSERT INTO audit_event (actor_id, impersonator_id, action, entity, entity_id, before_data, after_data, trace_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+)
+
+var (
+	// Actions lists the recorded actions, for filtering the audit viewer
+	Actions = []string{Confirm, Create, Delete, Disable, Enable, Impersonate, Login, Logout, Merge, Release, Restore, Revoke, Update, Withdraw}
+	// Entities lists the kinds of records that get audited, for filtering the
+	// audit viewer
+	Entities = []string{AccessToken, CalendarLink, Claim, GuestClaim, Household, Item, Passkey, Person, Session, ShareLink}
+)
+
+// Record saves the event, attributed to the given person (0 for changes made
+// without an account, like guest claims) and the current request's trace.
+// Changes made by an admin impersonating the person also record the admin. A
+// failure is logged rather than returned, the change itself already happened
+// and shouldn't be failed over its audit record.
+func Record(ctx context.Context, svr *util.ServerUtils, actorID int64, event Event) {
+
+	var actor any
+	if actorID != 0 {
+		actor = actorID
+	}
+
+	var impersonator any
+	if adminID := middleware.Impersonator(ctx); adminID != 0 && adminID != actorID {
+		impersonator = adminID
+	}
+
+	traceID := ""
+	if spanCtx := trace.SpanFromContext(ctx).SpanContext(); spanCtx.HasTraceID() {
+		traceID = spanCtx.TraceID().String()
+	}
+
+	_, err := svr.DB.Execute(
+		ctx,
+		insertEventStatement,
+		actor,
+		impersonator,
+		event.Action,
+		event.Entity,
+		event.EntityID,
+		toJSON(ctx, svr, event.Before),
+		toJSON(ctx, svr, event.After),
+		traceID,
+	)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx,
+			"Error recording the audit event",
+			slog.String("action", event.Action),
+			slog.String("entity", event.Entity),
+			slog.String("entityID", event.EntityID),
+			slog.String("errorMessage", err.Error()),
+		)
+	}
+
+}
+
+/* Nil values are stored as NULL rather than the string "null" */
+func toJSON(ctx context.Context, svr *util.ServerUtils, value any) any {
+
+	if value == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		svr.Logger.WarnContext(ctx, "Could not convert audit data to JSON", slog.String("errorMessage", err.Error()))
+		return nil
+	}
+
+	return string(data)
+
+}
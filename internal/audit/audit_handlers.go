@@ -0,0 +1,192 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type auditEvent struct {
+	Action    string
+	Actor     string
+	After     string
+	Before    string
+	CreatedOn string
+	Entity    string
+	EntityID  string
+	ID        int64
+	/* The admin who made the change while impersonating the actor */
+	Impersonator string
+	TraceID      string
+}
+
+type auditFilters struct {
+	Action   string
+	Actor    string
+	Entity   string
+	EntityID string
+}
+
+type auditPage struct {
+	Actions      []string
+	Entities     []string
+	ErrorMessage string
+	Events       []auditEvent
+	Filters      auditFilters
+}
+
+const (
+	/*
+		Blank filters match everything, so the query doesn't need to be built up
+		from the filters that were set
+	*/
+	auditEventsQuery = `SELECT a.audit_event_id,
+			COALESCE(p.email, ''),
+			COALESCE(ip.email, ''),
+			a.action,
+			a.entity,
+			a.entity_id,
+			COALESCE(a.before_data, ''),
+			COALESCE(a.after_data, ''),
+			a.trace_id,
+			a.created_on
+		FROM audit_event a
+			LEFT JOIN person p ON p.person_id = a.actor_id
+			LEFT JOIN person ip ON ip.person_id = a.impersonator_id
+		WHERE (? = '' OR a.action = ?)
+			AND (? = '' OR a.entity = ?)
+			AND (? = '' OR a.entity_id = ?)
+			AND (? = '' OR p.email LIKE '%' || ? || '%')
+		ORDER BY a.created_on DESC, a.audit_event_id DESC
+		LIMIT ?`
+	eventLimit = 200
+	timeFmt    = "2006-01-02 15:04:05"
+)
+
+// ViewerHandler shows site admins the most recent audit events, optionally
+// filtered by action, entity, entity ID or the actor's email.
+func ViewerHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("audit_viewer")
+
+		tmpl, err := template.New("admin_audit.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/admin_audit.html")
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the audit template",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error rendering the audit log"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		query := req.URL.Query()
+		page := auditPage{
+			Actions:  Actions,
+			Entities: Entities,
+			Filters: auditFilters{
+				Action:   strings.TrimSpace(query.Get("action")),
+				Actor:    strings.TrimSpace(query.Get("actor")),
+				Entity:   strings.TrimSpace(query.Get("entity")),
+				EntityID: strings.TrimSpace(query.Get("entityID")),
+			},
+		}
+		span.SetAttributes(
+			attribute.String("filter_action", page.Filters.Action),
+			attribute.String("filter_entity", page.Filters.Entity),
+			attribute.String("filter_entity_id", page.Filters.EntityID),
+		)
+
+		page.Events, err = lookupEvents(ctx, svr, page.Filters)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the audit events",
+				slog.String("errorMessage", err.Error()),
+			)
+			page.ErrorMessage = "Could not look up the audit log."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+		span.SetAttributes(attribute.Int("event_count", len(page.Events)))
+
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "audit-page", page)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+	})
+
+}
+
+func lookupEvents(ctx context.Context, svr *util.ServerUtils, filters auditFilters) ([]auditEvent, error) {
+
+	events := []auditEvent{}
+	rows, err := svr.DB.Query(
+		ctx,
+		auditEventsQuery,
+		filters.Action, filters.Action,
+		filters.Entity, filters.Entity,
+		filters.EntityID, filters.EntityID,
+		filters.Actor, filters.Actor,
+		eventLimit,
+	)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			event     auditEvent
+			createdOn sql.NullTime
+		)
+		err = rows.Scan(
+			&event.ID,
+			&event.Actor,
+			&event.Impersonator,
+			&event.Action,
+			&event.Entity,
+			&event.EntityID,
+			&event.Before,
+			&event.After,
+			&event.TraceID,
+			&createdOn,
+		)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		if createdOn.Valid {
+			event.CreatedOn = createdOn.Time.In(time.UTC).Format(timeFmt)
+		}
+		events = append(events, event)
+
+	}
+
+	return events, nil
+
+}
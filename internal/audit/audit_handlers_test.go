@@ -0,0 +1,167 @@
+package audit_test
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+	"gift-registry/internal/util"
+
+	"golang.org/x/net/html"
+)
+
+// TestViewer records a couple of changes and loads the audit viewer as an
+// admin (with filters) and as a regular person, who shouldn't get in.
+func TestViewer(t *testing.T) {
+	testData := []struct {
+		admin           bool
+		expectedStatus  int
+		externalIDStart string
+		missing         []string
+		query           string
+		shown           []string
+		testName        string
+	}{
+		{
+			admin:           true,
+			expectedStatus:  http.StatusOK,
+			externalIDStart: "audit-entity",
+			missing:         []string{"audit-entity-item"},
+			query:           "?entity=person&entityID=audit-entity-person",
+			shown:           []string{"audit-entity-person"},
+			testName:        "Filter by entity",
+		},
+		{
+			admin:           true,
+			expectedStatus:  http.StatusOK,
+			externalIDStart: "audit-action",
+			missing:         []string{"audit-action-person"},
+			query:           "?action=DELETE&actor=audit-action-admin",
+			shown:           []string{"audit-action-item"},
+			testName:        "Filter by action and actor",
+		},
+		{
+			expectedStatus:  http.StatusForbidden,
+			externalIDStart: "audit-denied",
+			testName:        "Not an admin",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			userData := test.UserData{
+				Email:      data.externalIDStart + "-admin@localhost.com",
+				ExternalID: data.externalIDStart + "-admin",
+				FirstName:  "Site",
+				LastName:   "Admin",
+			}
+			token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session for ", data.testName, err)
+			}
+
+			var adminID int64
+			err = db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", userData.ExternalID).Scan(&adminID)
+			if err != nil {
+				t.Fatal("Could not look up the admin", err)
+			}
+			if data.admin {
+				if _, err = db.Execute(ctx, "UPDATE person SET site_admin = TRUE WHERE person_id = ?", adminID); err != nil {
+					t.Fatal("Could not make the person an admin", err)
+				}
+			}
+
+			svr := &util.ServerUtils{DB: db, Getenv: getenv, Logger: logger}
+			audit.Record(ctx, svr, adminID, audit.Event{
+				Action:   audit.Update,
+				After:    map[string]string{"email": "new@localhost.com"},
+				Before:   map[string]string{"email": "old@localhost.com"},
+				Entity:   audit.Person,
+				EntityID: data.externalIDStart + "-person",
+			})
+			audit.Record(ctx, svr, adminID, audit.Event{
+				Action:   audit.Delete,
+				Before:   map[string]string{"name": "Socks"},
+				Entity:   audit.Item,
+				EntityID: data.externalIDStart + "-item",
+			})
+
+			ids := map[string]int64{}
+			rows, err := db.Query(ctx, "SELECT audit_event_id, entity_id FROM audit_event WHERE actor_id = ?", adminID)
+			if err != nil {
+				t.Fatal("Could not look up the audit events", err)
+			}
+			for rows.Next() {
+				var id int64
+				var entityID string
+				if err = rows.Scan(&id, &entityID); err != nil {
+					t.Fatal(err)
+				}
+				ids[entityID] = id
+			}
+			rows.Close()
+			if len(ids) != 2 {
+				t.Fatal("Expected 2 audit events but found", len(ids))
+			}
+
+			sessCookie := http.Cookie{
+				HttpOnly: true,
+				MaxAge:   time.Now().UTC().Add(time.Minute * 1).Second(),
+				Name:     middleware.SessionCookie,
+				SameSite: http.SameSiteStrictMode,
+				Secure:   true,
+				Value:    token,
+			}
+
+			req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+"/admin/audit"+data.query, nil)
+			if err != nil {
+				t.Fatal("Error building the audit request", err)
+			}
+
+			req.AddCookie(&sessCookie)
+			req.Header.Set("User-Agent", userAgent)
+			req.Header.Set("Sec-Fetch-Dest", "document")
+			req.Header.Set("Sec-Fetch-Mode", "same-origin")
+			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			res, err := http.DefaultClient.Do(req)
+			defer func() {
+				if res != nil && res.Body != nil {
+					_ = res.Body.Close()
+				}
+			}()
+			if err != nil {
+				t.Fatal("Error getting the audit log!", err)
+			} else if res.StatusCode != data.expectedStatus {
+				t.Fatal("Expected status", data.expectedStatus, "but got", res.StatusCode)
+			}
+
+			if data.expectedStatus != http.StatusOK {
+				return
+			}
+
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+
+			for _, entityID := range data.shown {
+				elemID := "audit-event-" + strconv.FormatInt(ids[entityID], 10)
+				if _, found := test.CheckElement(*doc, elemID); !found {
+					t.Fatal("Expected the audit event for", entityID, "to be shown")
+				}
+			}
+			for _, entityID := range data.missing {
+				elemID := "audit-event-" + strconv.FormatInt(ids[entityID], 10)
+				if _, found := test.CheckElement(*doc, elemID); found {
+					t.Fatal("Audit event for", entityID, "should have been filtered out")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package audit_test
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gift-registry/internal/database"
+	"gift-registry/internal/server"
+	"gift-registry/internal/test"
+)
+
+// Connection details for the test database
+const (
+	dbName    = "audit_test"
+	userAgent = "test-user-agent"
+)
+
+// Test-specific values
+var (
+	ctx        context.Context
+	db         database.Database
+	getenv     func(string) string
+	logger     *slog.Logger
+	testServer *httptest.Server
+)
+
+// TestMain spins up 1 application instance for the audit test suite and
+// sets up the shared variables the tests re-use
+func TestMain(m *testing.M) {
+	ctx = context.Background()
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug, AddSource: true}
+	handler := slog.NewTextHandler(os.Stderr, options)
+	logger = slog.New(handler)
+
+	srcDB, err := filepath.Abs(filepath.Join("..", "test", "test.db"))
+	if err != nil {
+		log.Fatal("Could not find test database source: ", err)
+	}
+
+	dbPath, err := filepath.Abs(filepath.Join(".", dbName))
+	if err != nil {
+		log.Fatal("Could not get path for test database ", err)
+	}
+
+	copied, err := test.SetupTestDatabase(srcDB, dbPath)
+	if err != nil {
+		log.Fatal("Could not create test database ", dbPath, ": ", err)
+	}
+	logger.InfoContext(
+		ctx,
+		"Created test database",
+		slog.String("filename", dbPath),
+		slog.Int64("size", copied),
+	)
+
+	env := map[string]string{
+		"APP_BASE_URL":     "https://gift-registry.localhost",
+		"DB_NAME":          dbPath,
+		"MIGRATIONS_DIR":   filepath.Join("..", "..", "internal", "database", "migrations"),
+		"STATIC_FILES_DIR": filepath.Join("..", "..", "cmd", "web"),
+		"TEMPLATES_DIR":    filepath.Join("..", "..", "cmd", "web", "templates"),
+	}
+	getenv = func(name string) string { return env[name] }
+
+	db, err = database.Connect(ctx, logger, getenv)
+	if err != nil {
+		log.Fatal("database connection failure! ", err)
+	}
+
+	appHandler, err := server.NewServer(getenv, db, logger, nil)
+	if err != nil {
+		log.Fatal("Error setting up the test handler", err)
+	}
+
+	testServer = httptest.NewServer(appHandler)
+	defer testServer.Close()
+
+	exitCode := m.Run()
+
+	err = test.CleanupDatabase(dbPath)
+	if err != nil {
+		log.Fatal("Error cleaning up the test ", err)
+	}
+
+	os.Exit(exitCode)
+}
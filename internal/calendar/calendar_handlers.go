@@ -0,0 +1,320 @@
+// Package calendar serves the iCalendar feed of household events so people can
+// subscribe to them from their calendar apps, and manages the secret links
+// those feeds are served from.
+package calendar
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type calendarEntry struct {
+	date        time.Time
+	description string
+	summary     string
+	uid         string
+}
+
+type calendarLink struct {
+	Active       bool
+	ErrorMessage string
+	/* Only set right after the link's created, only its hash is saved */
+	URL string
+}
+
+const (
+	activeLinkQuery      = `SELECT EXISTS (SELECT 1 FROM calendar_token WHERE person_id = ?)`
+	deleteTokenStatement = `DELETE FROM calendar_token WHERE person_id = ?`
+	/*
+		Covers every event with someone from any of the person's households in it,
+		plus any the person is in directly (they may not be in a household yet).
+		The giver flag decides if the feed gets a shopping reminder for it too.
+		Birthdays for deleted profiles are left out.
+	*/
+	feedEventsQuery = `SELECT DISTINCT e.external_id,
+			e.name,
+			e.event_date,
+			e.reminder_days,
+			EXISTS (SELECT 1 FROM event_person g WHERE g.event_id = e.event_id AND g.person_id = ? AND g.role = 'GIVER')
+		FROM event e
+			INNER JOIN event_person ep ON ep.event_id = e.event_id
+			LEFT JOIN household_person hp ON hp.person_id = ep.person_id
+		WHERE e.event_date >= ?
+			AND (ep.person_id = ? OR hp.household_id IN (SELECT household_id FROM household_person WHERE person_id = ?))
+			AND NOT EXISTS (SELECT 1 FROM person b WHERE b.person_id = e.birthday_person_id AND b.deleted_on IS NOT NULL)
+		ORDER BY e.event_date, e.name`
+	feedExtension = ".ics"
+	/*
+		Replacing the token is how a leaked link gets revoked. Like sessions, only
+		the token's hash is saved, so a copy of the database can't read calendars.
+	*/
+	saveTokenStatement = `INSERT INTO calendar_token (person_id, token)
+		VALUES (?, ?)
+		ON CONFLICT (person_id) DO UPDATE SET token = excluded.token, created_on = CURRENT_TIMESTAMP`
+	tokenLookupQuery = `SELECT person_id FROM calendar_token WHERE token = ?`
+)
+
+// FeedHandler serves the iCalendar feed for the person owning the token in the
+// URL. Calendar apps can't log in, so the route is public and the token is the
+// only credential.
+func FeedHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("calendar_feed")
+
+		token, found := strings.CutSuffix(req.PathValue("file"), feedExtension)
+		if !found || token == "" {
+			res.WriteHeader(404)
+			res.Write([]byte("Calendar not found"))
+			return
+		}
+
+		var personID int64
+		err := svr.DB.QueryRow(ctx, tokenLookupQuery, util.HashSecret(svr, token)).Scan(&personID)
+		if err == sql.ErrNoRows {
+			svr.Logger.InfoContext(ctx, "Calendar requested with an unknown token")
+			res.WriteHeader(404)
+			res.Write([]byte("Calendar not found"))
+			return
+		} else if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the calendar token",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the calendar"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		now := time.Now().UTC()
+		entries, err := lookupEntries(ctx, svr, personID, now)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the calendar events",
+				slog.Int64("personID", personID),
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the calendar"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+		span.SetAttributes(attribute.Int("entry_count", len(entries)))
+
+		res.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		res.Header().Set("Content-Disposition", `inline; filename="gift-registry.ics"`)
+		res.WriteHeader(200)
+		if err = writeCalendar(res, entries, now); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing the calendar",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+	})
+
+}
+
+// LinkHandler shows the logged-in person whether their calendar feed link is
+// on. The link itself is only shown when it's created.
+func LinkHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("calendar_link")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		link := calendarLink{}
+		err := svr.DB.QueryRow(ctx, activeLinkQuery, personID).Scan(&link.Active)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the calendar link",
+				slog.String("errorMessage", err.Error()),
+			)
+			link.ErrorMessage = "Could not look up your calendar link."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+
+		writeLink(ctx, svr, res, link)
+
+	})
+
+}
+
+// LinkCreateHandler gives the logged-in person a new calendar feed link. Any
+// link they had before stops working.
+func LinkCreateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("calendar_link_create")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		link := calendarLink{}
+		token := rand.Text()
+		if _, err := svr.DB.Execute(ctx, saveTokenStatement, personID, util.HashSecret(svr, token)); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error saving the calendar token",
+				slog.String("errorMessage", err.Error()),
+			)
+			link.ErrorMessage = "Could not create a calendar link."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		} else {
+			link.Active = true
+			link.URL = feedURL(svr, token)
+			audit.Record(ctx, svr, personID, audit.Event{Action: audit.Create, Entity: audit.CalendarLink})
+		}
+
+		writeLink(ctx, svr, res, link)
+
+	})
+
+}
+
+// LinkRevokeHandler turns off the logged-in person's calendar feed link.
+func LinkRevokeHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("calendar_link_revoke")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		link := calendarLink{}
+		if _, err := svr.DB.Execute(ctx, deleteTokenStatement, personID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error deleting the calendar token",
+				slog.String("errorMessage", err.Error()),
+			)
+			link.ErrorMessage = "Could not turn off your calendar link."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		} else {
+			audit.Record(ctx, svr, personID, audit.Event{Action: audit.Revoke, Entity: audit.CalendarLink})
+		}
+
+		writeLink(ctx, svr, res, link)
+
+	})
+
+}
+
+/* Calendar apps need an absolute address to subscribe to */
+func feedURL(svr *util.ServerUtils, token string) string {
+	return util.AppURL(svr, "/calendar/"+token+feedExtension)
+}
+
+/*
+Reads the person's upcoming events, adding a shopping reminder entry for the
+ones they're buying for.
+*/
+func lookupEntries(ctx context.Context, svr *util.ServerUtils, personID int64, now time.Time) ([]calendarEntry, error) {
+
+	today := now.Truncate(24 * time.Hour)
+	rows, err := svr.DB.Query(ctx, feedEventsQuery, personID, today, personID, personID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying calendar events: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []calendarEntry{}
+	for rows.Next() {
+
+		var (
+			externalID   string
+			name         string
+			eventDate    time.Time
+			reminderDays int
+			giver        bool
+		)
+		if err := rows.Scan(&externalID, &name, &eventDate, &reminderDays, &giver); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+
+		entries = append(entries, calendarEntry{
+			date:    eventDate,
+			summary: name,
+			uid:     "event-" + externalID,
+		})
+
+		reminderDate := eventDate.AddDate(0, 0, -reminderDays)
+		if giver && !reminderDate.Before(today) {
+			entries = append(entries, calendarEntry{
+				date:        reminderDate,
+				description: fmt.Sprintf("%s is on %s. Time to finish your shopping!", name, eventDate.Format("January 2, 2006")),
+				summary:     "Gift reminder: " + name,
+				uid:         "reminder-" + externalID,
+			})
+		}
+
+	}
+
+	return entries, nil
+
+}
+
+func writeLink(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, link calendarLink) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/calendar_link.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the calendar link template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your calendar link"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "calendar-link", link); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
@@ -0,0 +1,320 @@
+package calendar_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestFeed requests the calendar the way a calendar app would (no session and
+// no Sec-Fetch headers) and checks the household's events come back.
+func TestFeed(t *testing.T) {
+	testData := []struct {
+		expectedStatus  int
+		expectedText    []string
+		externalIDStart string
+		path            string
+		testName        string
+		unexpectedText  []string
+	}{
+		{
+			expectedStatus: http.StatusOK,
+			expectedText: []string{
+				"BEGIN:VCALENDAR\r\n",
+				"SUMMARY:Family dinner\\, with gifts\r\n",
+				"SUMMARY:Gift reminder: Family dinner\\, with gifts\r\n",
+				"UID:event-feed-valid-event@gift-registry\r\n",
+				"SUMMARY:Gift swap\\nBEGIN:VEVENT\r\n",
+				"END:VCALENDAR\r\n",
+			},
+			externalIDStart: "feed-valid",
+			path:            "/calendar/feed-valid-token.ics",
+			testName:        "Valid token",
+			unexpectedText:  []string{"Past party", "\rBEGIN:VEVENT"},
+		},
+		{
+			expectedStatus:  http.StatusNotFound,
+			externalIDStart: "feed-unknown",
+			path:            "/calendar/not-a-real-token.ics",
+			testName:        "Unknown token",
+		},
+		{
+			expectedStatus:  http.StatusNotFound,
+			externalIDStart: "feed-extension",
+			path:            "/calendar/feed-extension-token",
+			testName:        "Missing extension",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			giverID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				CreateHousehold: true,
+				Email:           data.externalIDStart + "-giver@localhost.com",
+				ExternalID:      data.externalIDStart + "-giver",
+				FirstName:       "Calendar",
+				HouseholdName:   data.externalIDStart + " household",
+				LastName:        "Giver",
+			})
+			if err != nil {
+				t.Fatal("Could not create the giver", err)
+			}
+
+			if err = test.CreateCalendarToken(ctx, db, giverID, data.externalIDStart+"-token"); err != nil {
+				t.Fatal(err)
+			}
+
+			/* The recipient is in the household, which puts their events on the feed */
+			recipientID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:         data.externalIDStart + "-recipient@localhost.com",
+				ExternalID:    data.externalIDStart + "-recipient",
+				FirstName:     "Calendar",
+				HouseholdName: data.externalIDStart + " household",
+				LastName:      "Recipient",
+			})
+			if err != nil {
+				t.Fatal("Could not create the recipient", err)
+			}
+
+			/* A lone CR in a name can't end the content line early */
+			events := []test.EventData{
+				{
+					Date:       time.Now().UTC().AddDate(0, 0, 14),
+					ExternalID: data.externalIDStart + "-event",
+					Name:       "Family dinner, with gifts",
+				},
+				{
+					Date:       time.Now().UTC().AddDate(0, 0, 21),
+					ExternalID: data.externalIDStart + "-swap-event",
+					Name:       "Gift swap\rBEGIN:VEVENT",
+				},
+				{
+					Date:       time.Now().UTC().AddDate(0, 0, -14),
+					ExternalID: data.externalIDStart + "-past-event",
+					Name:       "Past party",
+				},
+			}
+			for _, event := range events {
+
+				eventID, err := test.CreateEvent(ctx, db, event)
+				if err != nil {
+					t.Fatal("Could not create the event", err)
+				}
+				if err = test.AddEventPerson(ctx, db, eventID, giverID, "GIVER"); err != nil {
+					t.Fatal(err)
+				}
+				if err = test.AddEventPerson(ctx, db, eventID, recipientID, "RECIPIENT"); err != nil {
+					t.Fatal(err)
+				}
+
+			}
+
+			req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+data.path, nil)
+			if err != nil {
+				t.Fatal("Error building the calendar request", err)
+			}
+
+			req.Header.Set("User-Agent", "calendar-app")
+			res, err := http.DefaultClient.Do(req)
+			defer func() {
+				if res != nil && res.Body != nil {
+					_ = res.Body.Close()
+				}
+			}()
+			if err != nil {
+				t.Fatal("Error getting the calendar!", err)
+			} else if res.StatusCode != data.expectedStatus {
+				t.Fatal("Expected status", data.expectedStatus, "but got", res.StatusCode)
+			}
+
+			if data.expectedStatus != http.StatusOK {
+				return
+			}
+
+			if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/calendar") {
+				t.Fatal("Unexpected content type", res.Header.Get("Content-Type"))
+			}
+
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal("Error reading the calendar", err)
+			}
+
+			for _, text := range data.expectedText {
+				if !strings.Contains(string(body), text) {
+					t.Fatal("Calendar is missing", text, "\n", string(body))
+				}
+			}
+			for _, text := range data.unexpectedText {
+				if strings.Contains(string(body), text) {
+					t.Fatal("Calendar shouldn't contain", text, "\n", string(body))
+				}
+			}
+		})
+	}
+}
+
+// TestLinkRevoke makes sure a revoked link stops serving the calendar
+func TestLinkRevoke(t *testing.T) {
+
+	userData := test.UserData{
+		Email:      "revoke@localhost.com",
+		ExternalID: "calendar-revoke",
+		FirstName:  "Revoke",
+		LastName:   "Link",
+	}
+	token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+	if err != nil {
+		t.Fatal("Could not create a test session", err)
+	}
+
+	var personID int64
+	err = db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", userData.ExternalID).Scan(&personID)
+	if err != nil {
+		t.Fatal("Could not look up the person", err)
+	}
+	if err = test.CreateCalendarToken(ctx, db, personID, "calendar-revoke-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	sessCookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   time.Now().UTC().Add(time.Minute * 1).Second(),
+		Name:     middleware.SessionCookie,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+		Value:    token,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+"/profile/calendar/revoke", nil)
+	if err != nil {
+		t.Fatal("Error building the revoke request", err)
+	}
+
+	req.AddCookie(&sessCookie)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error revoking the calendar link!", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Got an error status from the server!", res.StatusCode)
+	}
+
+	res, err = http.Get(testServer.URL + "/calendar/calendar-revoke-token.ics")
+	if err != nil {
+		t.Fatal("Error getting the calendar!", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatal("Revoked calendar link still works, got status", res.StatusCode)
+	}
+
+}
+
+// TestLinkCreate makes a link and checks only its hash is saved, the link
+// works, and it isn't shown again once the page reloads.
+func TestLinkCreate(t *testing.T) {
+
+	userData := test.UserData{
+		Email:      "create@localhost.com",
+		ExternalID: "calendar-create",
+		FirstName:  "Create",
+		LastName:   "Link",
+	}
+	token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+	if err != nil {
+		t.Fatal("Could not create a test session", err)
+	}
+
+	doc := linkPage(t, "POST", token, "/profile/calendar")
+	urlElem, found := test.CheckElement(*doc, "calendar-url")
+	if !found {
+		t.Fatal("New calendar link wasn't shown")
+	}
+	var feedURL string
+	for _, attr := range urlElem.Attr {
+		if attr.Key == "value" {
+			feedURL = attr.Val
+		}
+	}
+	file, found := strings.CutPrefix(feedURL, "https://gift-registry.localhost/calendar/")
+	if !found {
+		t.Fatal("Unexpected calendar link", feedURL)
+	}
+	feedToken := strings.TrimSuffix(file, ".ics")
+
+	var saved string
+	err = db.QueryRow(ctx, "SELECT ct.token FROM calendar_token ct INNER JOIN person p ON p.person_id = ct.person_id WHERE p.external_id = ?", userData.ExternalID).Scan(&saved)
+	if err != nil {
+		t.Fatal("Could not look up the calendar token", err)
+	} else if saved != test.HashSecret(feedToken) {
+		t.Fatal("Expected only the token's hash to be saved but found", saved)
+	}
+
+	res, err := http.Get(testServer.URL + "/calendar/" + file)
+	if err != nil {
+		t.Fatal("Error getting the calendar!", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("New calendar link doesn't work, got status", res.StatusCode)
+	}
+
+	err = test.ValidatePage(linkPage(t, "GET", token, "/profile/calendar"), map[string]test.ElementValidation{
+		"calendar-active": {Visible: true},
+		"calendar-none":   {Visible: false},
+		"calendar-revoke": {Visible: true},
+		"calendar-url":    {Visible: false},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+/* Calls one of the calendar link routes as the session's user */
+func linkPage(t *testing.T, method string, token string, path string) *html.Node {
+
+	req, err := http.NewRequestWithContext(ctx, method, testServer.URL+path, nil)
+	if err != nil {
+		t.Fatal("Error building the calendar link request", err)
+	}
+
+	req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: token})
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error calling", path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Got an error status from", path, res.StatusCode)
+	}
+
+	doc, err := html.Parse(res.Body)
+	if err != nil {
+		t.Fatal("Error parsing response body!", err)
+	}
+
+	return doc
+
+}
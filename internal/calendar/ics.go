@@ -0,0 +1,112 @@
+package calendar
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	icsDateFmt      = "20060102"
+	icsTimestampFmt = "20060102T150405Z"
+	/* RFC 5545 section 3.1: lines SHOULD NOT be longer than 75 octets */
+	maxLineOctets = 75
+	productID     = "-//gift-registry//calendar feed//EN"
+	uidDomain     = "gift-registry"
+)
+
+var icsEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\r", `\n`,
+	"\n", `\n`,
+)
+
+/*
+Writes the entries as an RFC 5545 iCalendar document. Every entry is an
+all-day event, so DTSTART/DTEND are plain dates and no time zone data is
+needed.
+*/
+func writeCalendar(out io.Writer, entries []calendarEntry, now time.Time) error {
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:" + productID,
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:Gift registry",
+	}
+
+	stamp := now.UTC().Format(icsTimestampFmt)
+	for _, entry := range entries {
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+escapeText(entry.uid)+"@"+uidDomain,
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+entry.date.Format(icsDateFmt),
+			"DTEND;VALUE=DATE:"+entry.date.AddDate(0, 0, 1).Format(icsDateFmt),
+			"SUMMARY:"+escapeText(entry.summary),
+		)
+		if entry.description != "" {
+			lines = append(lines, "DESCRIPTION:"+escapeText(entry.description))
+		}
+		lines = append(lines, "TRANSP:TRANSPARENT", "END:VEVENT")
+
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if _, err := io.WriteString(out, foldLine(line)+"\r\n"); err != nil {
+			return fmt.Errorf("error writing calendar line: %v", err)
+		}
+	}
+
+	return nil
+
+}
+
+// Escapes the characters RFC 5545 reserves in TEXT values. Every kind of line
+// break (CRLF, or a lone CR or LF) becomes an escaped newline, since a raw CR
+// would end the content line.
+func escapeText(value string) string {
+	return icsEscaper.Replace(value)
+}
+
+/*
+Splits a content line into 75 octet chunks, with each continuation starting
+with a single space. Splits never land in the middle of a multi-byte
+character.
+*/
+func foldLine(line string) string {
+
+	if len(line) <= maxLineOctets {
+		return line
+	}
+
+	var folded strings.Builder
+	limit := maxLineOctets
+	for len(line) > limit {
+
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		folded.WriteString(line[:cut])
+		folded.WriteString("\r\n ")
+		line = line[cut:]
+		/* The leading space counts toward the continuation line's length */
+		limit = maxLineOctets - 1
+
+	}
+	folded.WriteString(line)
+
+	return folded.String()
+
+}
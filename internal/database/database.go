@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,9 +40,51 @@ type DBConn struct {
 const (
 	/* DB cleanup happens every 5 minutes by default */
 	defaultTickInterval       = 300000
+	cleanupAccessTokens       = "DELETE FROM access_token WHERE expiration <= CURRENT_TIMESTAMP"
+	cleanupAccountDeletions   = "DELETE FROM account_deletion WHERE expiration <= CURRENT_TIMESTAMP"
+	cleanupEmailChanges       = "DELETE FROM email_change WHERE token_expiration <= CURRENT_TIMESTAMP"
+	cleanupOIDCLogins         = "DELETE FROM oidc_login WHERE expiration <= CURRENT_TIMESTAMP"
+	cleanupPasskeyChallenges  = "DELETE FROM passkey_challenge WHERE expiration <= CURRENT_TIMESTAMP"
 	cleanupSessions           = "DELETE FROM session WHERE expiration <= CURRENT_TIMESTAMP"
 	cleanupVerificationTokens = "DELETE FROM verification WHERE token_expiration <= CURRENT_TIMESTAMP"
-	name                      = "net.hydrick.gift-registry/database"
+	/* Soft-deleted rows can be restored for 30 days before they're purged */
+	defaultRetentionDays = 30
+	name                 = "net.hydrick.gift-registry/database"
+	/*
+		Deleted accounts are anonymized instead of removed (their claims and audit
+		history still point at them), so managed profiles are the only people
+		purged. Everything hanging off of them has to go first because of the
+		foreign keys.
+	*/
+	purgedPeople       = "SELECT person_id FROM person WHERE type = 'MANAGED' AND deleted_on <= ?"
+	purgedPeopleItems  = "SELECT item_id FROM item WHERE person_id IN (" + purgedPeople + ")"
+	purgeChangeNotices = "DELETE FROM notification WHERE change_id IN (SELECT change_id FROM item_change WHERE owner_id IN (" + purgedPeople + "))"
+	purgeChanges       = "DELETE FROM item_change WHERE owner_id IN (" + purgedPeople + ")"
+	purgeClaimAlerts   = `DELETE FROM claim_alert
+		WHERE owner_id IN (` + purgedPeople + `)
+			OR guest_claim_id IN (SELECT guest_claim_id FROM guest_claim WHERE item_id IN (` + purgedPeopleItems + `))`
+	purgeClaims           = "DELETE FROM claim WHERE item_id IN (" + purgedPeopleItems + ")"
+	purgeGuestClaims      = "DELETE FROM guest_claim WHERE item_id IN (" + purgedPeopleItems + ")"
+	purgeReminders        = "DELETE FROM reminder_sent WHERE person_id IN (" + purgedPeople + ")"
+	purgePeopleItems      = "DELETE FROM item WHERE person_id IN (" + purgedPeople + ")"
+	purgeEventPeople      = "DELETE FROM event_person WHERE person_id IN (" + purgedPeople + ")"
+	purgeBirthdays        = "UPDATE event SET birthday_person_id = NULL WHERE birthday_person_id IN (" + purgedPeople + ")"
+	purgePersonHouseholds = "DELETE FROM household_person WHERE person_id IN (" + purgedPeople + ")"
+	purgePeople           = "DELETE FROM person WHERE type = 'MANAGED' AND deleted_on <= ?"
+	purgeHouseholdMembers = "DELETE FROM household_person WHERE household_id IN (SELECT household_id FROM household WHERE deleted_on <= ?)"
+	purgeHouseholds       = "DELETE FROM household WHERE deleted_on <= ?"
+	/*
+		Someone may have already bought a deleted item, so claimed ones are
+		archived for the gift history instead of being purged.
+	*/
+	purgeArchiveClaimedItems = `UPDATE item SET archived_on = deleted_on, deleted_on = NULL
+		WHERE deleted_on <= ?
+			AND (EXISTS (SELECT 1 FROM claim c WHERE c.item_id = item.item_id)
+				OR EXISTS (SELECT 1 FROM guest_claim g WHERE g.item_id = item.item_id AND g.status = 'ACTIVE'))`
+	purgeItemAlerts = `DELETE FROM claim_alert
+		WHERE guest_claim_id IN (SELECT guest_claim_id FROM guest_claim WHERE item_id IN (SELECT item_id FROM item WHERE deleted_on <= ?))`
+	purgeItemGuestClaims = "DELETE FROM guest_claim WHERE item_id IN (SELECT item_id FROM item WHERE deleted_on <= ?)"
+	purgeItems           = "DELETE FROM item WHERE deleted_on <= ?"
 )
 
 var (
@@ -142,7 +186,7 @@ func (dbConn DBConn) ExecuteBatch(
 	tx, err := dbConn.db.BeginTx(ctx, nil)
 	if err != nil {
 		histogram.Record(ctx, float64(time.Since(start).Milliseconds()))
-		results = append(results, EmptyResult{})
+		fillEmptyResults(results, 0)
 		errors = append(errors, err)
 		span.End()
 		return
@@ -162,7 +206,8 @@ func (dbConn DBConn) ExecuteBatch(
 		if err != nil {
 			txFailure(ctx, tx, histogram, start, err)
 			histogram.Record(ctx, float64(time.Since(start).Milliseconds()))
-			results = append(results, EmptyResult{})
+			/* This statement and the ones after it never ran */
+			fillEmptyResults(results, idx)
 			errors = append(errors, err)
 			span.End()
 			return
@@ -173,6 +218,7 @@ func (dbConn DBConn) ExecuteBatch(
 			span.SetAttributes(attribute.Int64("modifiedCount", count))
 		}
 
+		results[idx] = res
 		errors = append(errors, nil)
 		histogram.Record(ctx, float64(time.Since(start).Milliseconds()))
 		span.End()
@@ -183,7 +229,6 @@ func (dbConn DBConn) ExecuteBatch(
 	if err != nil {
 		txFailure(ctx, tx, histogram, start, err)
 		histogram.Record(ctx, float64(time.Since(start).Milliseconds()))
-		results = append(results, EmptyResult{})
 		errors = append(errors, err)
 		span.End()
 		return
@@ -340,7 +385,13 @@ func Connect(ctx context.Context, logger *slog.Logger, getenv func(string) strin
 		interval = parsed
 	}
 	ticker := time.NewTicker(time.Millisecond * time.Duration(interval))
-	go cleanup(ctx, dbConn, ticker)
+
+	/* How long deleted items, profiles, and households can still be restored */
+	retentionDays := defaultRetentionDays
+	if parsed, err := strconv.Atoi(getenv("SOFT_DELETE_RETENTION_DAYS")); err == nil {
+		retentionDays = parsed
+	}
+	go cleanup(ctx, dbConn, ticker, time.Duration(retentionDays)*24*time.Hour)
 
 	/*
 		err is the error from running the migration, send that back in case it
@@ -365,15 +416,19 @@ func cleanup(
 	ctx context.Context,
 	db DBConn,
 	ticker *time.Ticker,
+	retention time.Duration,
 ) {
 	for {
 		select {
-		/* Time to clean up expired session and login verification tokens */
+		/*
+			Time to clean up expired session and login verification tokens, and purge
+			anything that's been soft-deleted for longer than the retention window
+		*/
 		case <-ticker.C:
 			db.logger.DebugContext(ctx, "CLEANING UP EXPIRED DATA")
-			deleteQueries := []string{cleanupVerificationTokens, cleanupSessions}
+			deleteQueries := []string{cleanupVerificationTokens, cleanupSessions, cleanupPasskeyChallenges, cleanupOIDCLogins, cleanupAccountDeletions, cleanupEmailChanges, cleanupAccessTokens}
 			deleteParams := []any{}
-			_, errList := db.ExecuteBatch(ctx, deleteQueries, [][]any{deleteParams, deleteParams})
+			_, errList := db.ExecuteBatch(ctx, deleteQueries, [][]any{deleteParams, deleteParams, deleteParams, deleteParams, deleteParams, deleteParams, deleteParams})
 			for _, err := range errList {
 				if err == nil {
 					continue
@@ -384,6 +439,7 @@ func cleanup(
 					slog.String("errorMessage", err.Error()),
 				)
 			}
+			purge(ctx, db, time.Now().UTC().Add(-retention))
 		/* The app is shutting down, stop polling to clean up old tokens */
 		case <-ctx.Done():
 			ticker.Stop()
@@ -391,6 +447,50 @@ func cleanup(
 	}
 }
 
+/*
+Hard-deletes the soft-deleted rows older than the cutoff. People go first,
+since purging them takes their items with them.
+*/
+func purge(ctx context.Context, db DBConn, cutoff time.Time) {
+
+	purgeQueries := []string{
+		purgeChangeNotices,
+		purgeChanges,
+		purgeClaimAlerts,
+		purgeClaims,
+		purgeGuestClaims,
+		purgeReminders,
+		purgePeopleItems,
+		purgeEventPeople,
+		purgeBirthdays,
+		purgePersonHouseholds,
+		purgePeople,
+		purgeHouseholdMembers,
+		purgeHouseholds,
+		purgeArchiveClaimedItems,
+		purgeItemAlerts,
+		purgeItemGuestClaims,
+		purgeItems,
+	}
+	purgeParams := make([][]any, len(purgeQueries))
+	for idx, query := range purgeQueries {
+		purgeParams[idx] = slices.Repeat([]any{cutoff}, strings.Count(query, "?"))
+	}
+
+	_, errList := db.ExecuteBatch(ctx, purgeQueries, purgeParams)
+	for _, err := range errList {
+		if err == nil {
+			continue
+		}
+		db.logger.ErrorContext(
+			ctx,
+			"Error purging soft-deleted data",
+			slog.String("errorMessage", err.Error()),
+		)
+	}
+
+}
+
 /*
 Opens a connection to the Postgres database and returns it.
 */
@@ -420,6 +520,17 @@ func (dbConn DBConn) open(
 	return db, nil
 }
 
+/*
+Sets the batch results from the given index on to an EmptyResult, for
+statements that never ran, so every result lines up with its statement and is
+safe to call.
+*/
+func fillEmptyResults(results []sql.Result, from int) {
+	for idx := from; idx < len(results); idx++ {
+		results[idx] = EmptyResult{}
+	}
+}
+
 /*
 Rolls back the given transaction if there's an error with a database
 operation. Include the original error so it's not lost if the rollback
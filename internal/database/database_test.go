@@ -219,6 +219,88 @@ func TestConnect(t *testing.T) {
 	}
 }
 
+// TestExecuteBatch validates the batch returns a result for each statement,
+// so callers can tell how many rows each one changed.
+func TestExecuteBatch(t *testing.T) {
+	testData := []struct {
+		email         string
+		errorExpected bool
+		expectedRows  []int64
+		secondEmail   string
+		testName      string
+	}{
+		{
+			email:        "batchfirst@localhost.com",
+			expectedRows: []int64{1, 1},
+			secondEmail:  "batchsecond@localhost.com",
+			testName:     "New rows",
+		},
+		{
+			email:        "batchrepeat@localhost.com",
+			expectedRows: []int64{1, 0},
+			secondEmail:  "batchrepeat@localhost.com",
+			testName:     "Conflicting row skipped",
+		},
+		{
+			email:         "batchfailed@localhost.com",
+			errorExpected: true,
+			secondEmail:   "",
+			testName:      "Failed statement",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			db, err := database.Connect(ctx, logger, func(name string) string { return env[name] })
+			if err != nil {
+				t.Fatal("Error setting up the database connection:", err)
+			}
+			defer func() { _ = db.Close() }()
+
+			statements := []string{
+				"INSERT INTO person (email, first_name, last_name, external_id, display_name) VALUES (?, 'Batch', 'Test', ?, 'Batch') ON CONFLICT DO NOTHING",
+				"INSERT INTO person (email, first_name, last_name, external_id, display_name) VALUES (?, 'Batch', 'Test', ?, 'Batch') ON CONFLICT DO NOTHING",
+			}
+			params := [][]any{
+				{data.email, data.email},
+				{data.secondEmail, data.secondEmail},
+			}
+
+			results, errs := db.ExecuteBatch(ctx, statements, params)
+			failed := false
+			for _, err := range errs {
+				if err != nil {
+					failed = true
+				}
+			}
+			if failed != data.errorExpected {
+				t.Fatal("Expected an error =", data.errorExpected, "but got", errs)
+			} else if len(results) != len(statements) {
+				t.Fatal("Expected a result for each of the", len(statements), "statements but got", len(results))
+			} else if failed {
+				/* Every result should still be safe to check */
+				for idx, result := range results {
+					if result == nil {
+						t.Fatal("Missing the result for statement", idx)
+					}
+					_, _ = result.RowsAffected()
+				}
+				return
+			}
+
+			for idx, expected := range data.expectedRows {
+				if results[idx] == nil {
+					t.Fatal("Missing the result for statement", idx)
+				} else if added, err := results[idx].RowsAffected(); err != nil || added != expected {
+					t.Fatal("Expected statement", idx, "to add", expected, "rows but got", added, err)
+				}
+			}
+		})
+	}
+}
+
 // TestRunMigrations validates the migrations runner and confirms the
 // migrations files are applied correctly and the transaction properly
 // rolls back in case of a problem
@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS event (
+    event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    external_id VARCHAR(40) UNIQUE NOT NULL
+        CONSTRAINT ext_id_not_empty CHECK (TRIM(external_id) <> ''),
+    name VARCHAR(255) NOT NULL
+        CONSTRAINT name_not_empty CHECK (TRIM(name) <> ''),
+    event_date TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS event_person (
+    event_id INTEGER NOT NULL REFERENCES event (event_id),
+    person_id INTEGER NOT NULL REFERENCES person (person_id),
+    role VARCHAR(20) NOT NULL DEFAULT 'GIVER'
+        CONSTRAINT valid_role CHECK (role IN ('GIVER', 'RECIPIENT')),
+    CONSTRAINT one_role_per_event UNIQUE(event_id, person_id)
+);
+CREATE INDEX IF NOT EXISTS event_person_person_id ON event_person (person_id);
+CREATE TABLE IF NOT EXISTS item (
+    item_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    external_id VARCHAR(40) UNIQUE NOT NULL
+        CONSTRAINT ext_id_not_empty CHECK (TRIM(external_id) <> ''),
+    person_id INTEGER NOT NULL REFERENCES person (person_id),
+    event_id INTEGER REFERENCES event (event_id),
+    name VARCHAR(255) NOT NULL
+        CONSTRAINT name_not_empty CHECK (TRIM(name) <> ''),
+    store VARCHAR(255) NOT NULL DEFAULT '',
+    url VARCHAR(2048) NOT NULL DEFAULT '',
+    price_cents INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS item_person_id ON item (person_id);
+CREATE TABLE IF NOT EXISTS claim (
+    claim_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    item_id INTEGER NOT NULL REFERENCES item (item_id),
+    person_id INTEGER NOT NULL REFERENCES person (person_id),
+    status VARCHAR(20) NOT NULL DEFAULT 'CLAIMED'
+        CONSTRAINT valid_status CHECK (status IN ('CLAIMED', 'PURCHASED')),
+    claimed_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT one_claim_per_person UNIQUE(item_id, person_id)
+);
+CREATE INDEX IF NOT EXISTS claim_person_id ON claim (person_id);
@@ -0,0 +1,7 @@
+ALTER TABLE event ADD COLUMN reminder_days INTEGER NOT NULL DEFAULT 7;
+CREATE TABLE IF NOT EXISTS reminder_sent (
+    event_id INTEGER NOT NULL REFERENCES event (event_id),
+    person_id INTEGER NOT NULL REFERENCES person (person_id),
+    sent_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT one_reminder_per_event UNIQUE(event_id, person_id)
+);
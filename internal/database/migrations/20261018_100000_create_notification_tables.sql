@@ -0,0 +1,24 @@
+ALTER TABLE person ADD COLUMN notification_frequency VARCHAR(20) NOT NULL DEFAULT 'DAILY'
+    CONSTRAINT valid_frequency CHECK (notification_frequency IN ('IMMEDIATE', 'DAILY', 'WEEKLY', 'OFF'));
+ALTER TABLE person ADD COLUMN last_notified TIMESTAMP;
+CREATE TABLE IF NOT EXISTS item_change (
+    change_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    external_id VARCHAR(40) UNIQUE NOT NULL
+        CONSTRAINT ext_id_not_empty CHECK (TRIM(external_id) <> ''),
+    owner_id INTEGER NOT NULL REFERENCES person (person_id),
+    actor_id INTEGER NOT NULL REFERENCES person (person_id),
+    item_external_id VARCHAR(40) NOT NULL,
+    item_name VARCHAR(255) NOT NULL,
+    change_type VARCHAR(20) NOT NULL
+        CONSTRAINT valid_change_type CHECK (change_type IN ('ADDED', 'EDITED', 'REMOVED')),
+    details VARCHAR(1024) NOT NULL DEFAULT '',
+    changed_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS notification (
+    notification_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    person_id INTEGER NOT NULL REFERENCES person (person_id),
+    change_id INTEGER NOT NULL REFERENCES item_change (change_id),
+    sent_on TIMESTAMP,
+    CONSTRAINT one_notification_per_change UNIQUE(person_id, change_id)
+);
+CREATE INDEX IF NOT EXISTS notification_person_id ON notification (person_id);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS calendar_token (
+    person_id INTEGER UNIQUE NOT NULL REFERENCES person (person_id),
+    token VARCHAR(64) UNIQUE NOT NULL
+        CONSTRAINT token_not_empty CHECK (TRIM(token) <> ''),
+    created_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
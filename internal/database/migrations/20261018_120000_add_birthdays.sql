@@ -0,0 +1,9 @@
+ALTER TABLE person ADD COLUMN birth_month INTEGER
+    CONSTRAINT valid_birth_month CHECK (birth_month BETWEEN 1 AND 12);
+ALTER TABLE person ADD COLUMN birth_day INTEGER
+    CONSTRAINT valid_birth_day CHECK (birth_day BETWEEN 1 AND 31);
+ALTER TABLE person ADD COLUMN birth_year INTEGER;
+ALTER TABLE event ADD COLUMN birthday_person_id INTEGER REFERENCES person (person_id);
+ALTER TABLE event ADD COLUMN birthday_year INTEGER;
+CREATE UNIQUE INDEX IF NOT EXISTS event_one_birthday_per_year ON event (birthday_person_id, birthday_year)
+    WHERE birthday_person_id IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE item ADD COLUMN archived_on TIMESTAMP;
+CREATE INDEX IF NOT EXISTS claim_item_id ON claim (item_id);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS share_link (
+    share_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    external_id VARCHAR(40) UNIQUE NOT NULL
+        CONSTRAINT ext_id_not_empty CHECK (TRIM(external_id) <> ''),
+    token VARCHAR(64) UNIQUE NOT NULL
+        CONSTRAINT token_not_empty CHECK (TRIM(token) <> ''),
+    person_id INTEGER NOT NULL REFERENCES person (person_id),
+    event_id INTEGER REFERENCES event (event_id),
+    created_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS share_link_person_id ON share_link (person_id);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS guest_claim (
+    guest_claim_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    external_id VARCHAR(40) UNIQUE NOT NULL
+        CONSTRAINT ext_id_not_empty CHECK (TRIM(external_id) <> ''),
+    item_id INTEGER NOT NULL REFERENCES item (item_id),
+    name VARCHAR(255) NOT NULL
+        CONSTRAINT name_not_empty CHECK (TRIM(name) <> ''),
+    email VARCHAR(255) NOT NULL
+        CONSTRAINT email_not_empty CHECK (TRIM(email) <> ''),
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING'
+        CONSTRAINT valid_status CHECK (status IN ('PENDING', 'ACTIVE', 'RELEASED')),
+    created_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    confirmed_on TIMESTAMP,
+    released_on TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS guest_claim_item_id ON guest_claim (item_id);
@@ -0,0 +1,16 @@
+ALTER TABLE item ADD COLUMN size VARCHAR(255) NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS claim_alert (
+    claim_alert_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    person_id INTEGER REFERENCES person (person_id),
+    guest_claim_id INTEGER REFERENCES guest_claim (guest_claim_id),
+    owner_id INTEGER NOT NULL REFERENCES person (person_id),
+    item_name VARCHAR(255) NOT NULL,
+    change_type VARCHAR(20) NOT NULL
+        CONSTRAINT valid_change_type CHECK (change_type IN ('EDITED', 'REMOVED', 'WITHDRAWN')),
+    details VARCHAR(1024) NOT NULL DEFAULT '',
+    created_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_on TIMESTAMP,
+    dismissed_on TIMESTAMP,
+    CONSTRAINT one_claimer CHECK ((person_id IS NULL) <> (guest_claim_id IS NULL))
+);
+CREATE INDEX IF NOT EXISTS claim_alert_person_id ON claim_alert (person_id);
@@ -0,0 +1,16 @@
+ALTER TABLE person ADD COLUMN site_admin BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS audit_event (
+    audit_event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    actor_id INTEGER REFERENCES person (person_id),
+    action VARCHAR(40) NOT NULL
+        CONSTRAINT action_not_empty CHECK (TRIM(action) <> ''),
+    entity VARCHAR(40) NOT NULL
+        CONSTRAINT entity_not_empty CHECK (TRIM(entity) <> ''),
+    entity_id VARCHAR(40) NOT NULL DEFAULT '',
+    before_data TEXT,
+    after_data TEXT,
+    trace_id VARCHAR(32) NOT NULL DEFAULT '',
+    created_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS audit_event_actor_id ON audit_event (actor_id);
+CREATE INDEX IF NOT EXISTS audit_event_entity ON audit_event (entity, entity_id);
@@ -0,0 +1,3 @@
+ALTER TABLE item ADD COLUMN deleted_on TIMESTAMP;
+ALTER TABLE person ADD COLUMN deleted_on TIMESTAMP;
+ALTER TABLE household ADD COLUMN deleted_on TIMESTAMP;
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS passkey (
+    passkey_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    external_id VARCHAR(40) UNIQUE NOT NULL
+        CONSTRAINT ext_id_not_empty CHECK (TRIM(external_id) <> ''),
+    person_id INTEGER NOT NULL REFERENCES person (person_id),
+    credential_id VARCHAR(1024) UNIQUE NOT NULL
+        CONSTRAINT credential_id_not_empty CHECK (TRIM(credential_id) <> ''),
+    public_key TEXT NOT NULL,
+    algorithm INTEGER NOT NULL,
+    sign_count INTEGER NOT NULL DEFAULT 0,
+    name VARCHAR(255) NOT NULL
+        CONSTRAINT name_not_empty CHECK (TRIM(name) <> ''),
+    created_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_on TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS passkey_person_id ON passkey (person_id);
+CREATE TABLE IF NOT EXISTS passkey_challenge (
+    challenge VARCHAR(64) PRIMARY KEY NOT NULL,
+    person_id INTEGER REFERENCES person (person_id),
+    expiration TIMESTAMP NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE verification ADD COLUMN browser_token VARCHAR(64);
@@ -0,0 +1,8 @@
+DELETE FROM session;
+ALTER TABLE session ADD COLUMN external_id VARCHAR(40);
+ALTER TABLE session ADD COLUMN device_name VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE session ADD COLUMN ip_address VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE session ADD COLUMN created_on TIMESTAMP;
+ALTER TABLE session ADD COLUMN last_seen_on TIMESTAMP;
+CREATE UNIQUE INDEX IF NOT EXISTS session_external_id ON session (external_id);
+CREATE INDEX IF NOT EXISTS session_person_id ON session (person_id);
@@ -0,0 +1,2 @@
+ALTER TABLE session ADD COLUMN absolute_expiration TIMESTAMP;
+ALTER TABLE session ADD COLUMN remembered BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+DELETE FROM session;
+DELETE FROM verification;
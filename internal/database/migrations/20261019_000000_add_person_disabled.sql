@@ -0,0 +1 @@
+ALTER TABLE person ADD COLUMN disabled_on TIMESTAMP;
@@ -0,0 +1,2 @@
+ALTER TABLE session ADD COLUMN impersonating_id INTEGER REFERENCES person (person_id);
+ALTER TABLE audit_event ADD COLUMN impersonator_id INTEGER REFERENCES person (person_id);
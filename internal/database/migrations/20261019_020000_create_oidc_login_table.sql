@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS oidc_login (
+    state VARCHAR(64) PRIMARY KEY NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    expiration TIMESTAMP NOT NULL
+);
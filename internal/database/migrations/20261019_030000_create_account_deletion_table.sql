@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS account_deletion (
+    person_id INTEGER PRIMARY KEY REFERENCES person (person_id),
+    token VARCHAR(64) NOT NULL,
+    expiration TIMESTAMP NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS email_change (
+    person_id INTEGER PRIMARY KEY REFERENCES person (person_id),
+    new_email VARCHAR(255) NOT NULL
+        CONSTRAINT new_email_not_empty CHECK (TRIM(new_email) <> ''),
+    token VARCHAR(255) NOT NULL,
+    token_expiration TIMESTAMP NOT NULL,
+    attempts SMALLINT DEFAULT 0
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS access_token (
+    access_token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    external_id VARCHAR(40) UNIQUE NOT NULL
+        CONSTRAINT ext_id_not_empty CHECK (TRIM(external_id) <> ''),
+    person_id INTEGER NOT NULL REFERENCES person (person_id),
+    name VARCHAR(255) NOT NULL
+        CONSTRAINT name_not_empty CHECK (TRIM(name) <> ''),
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    scope VARCHAR(8) NOT NULL
+        CONSTRAINT valid_scope CHECK (scope IN ('READ', 'WRITE')),
+    expiration TIMESTAMP NOT NULL,
+    created_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_on TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS access_token_person_id ON access_token (person_id);
@@ -0,0 +1 @@
+DELETE FROM calendar_token;
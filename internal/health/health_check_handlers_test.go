@@ -81,6 +81,7 @@ func TestMain(m *testing.M) {
 	port = test.FreePort()
 
 	env = map[string]string{
+		"APP_BASE_URL":   "https://gift-registry.localhost",
 		"DB_NAME":        dbPath,
 		"PORT":           strconv.Itoa(port),
 		"MIGRATIONS_DIR": filepath.Join("..", "..", "internal", "database", "migrations"),
@@ -266,6 +267,7 @@ func TestHealthCheck(t *testing.T) {
 // health check endpoint, and validating the output
 func TestHealthCheckInvalidTemplate(t *testing.T) {
 	env = map[string]string{
+		"APP_BASE_URL":   "https://gift-registry.localhost",
 		"DB_NAME":        dbName,
 		"PORT":           strconv.Itoa(port),
 		"MIGRATIONS_DIR": filepath.Join("..", "..", "internal", "database", "migrations"),
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+
+	"gift-registry/internal/util"
+)
+
+const (
+	SiteAdminQuery = "SELECT site_admin FROM person WHERE person_id = ?"
+)
+
+// Admin only lets site administrators through to the next handler. It relies
+// on the person Auth puts in the request context, so it has to be layered
+// after Auth (wrapping the handler, inside the mux). While impersonating, it's
+// the admin's own access that counts, so they can always get back to the
+// console.
+func Admin(svr *util.ServerUtils, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		personID, ok := ctx.Value(loggedInUser).(int64)
+		if !ok {
+			http.Redirect(res, req, "/login", http.StatusSeeOther)
+			return
+		}
+		if adminID := Impersonator(ctx); adminID != 0 {
+			personID = adminID
+		}
+
+		var siteAdmin bool
+		if err := svr.DB.QueryRow(ctx, SiteAdminQuery, personID).Scan(&siteAdmin); err != nil || !siteAdmin {
+			svr.Logger.WarnContext(ctx,
+				"Non-admin tried to reach an admin page",
+				slog.Int64("personID", personID),
+				slog.String("path", req.URL.Path),
+			)
+			res.WriteHeader(http.StatusForbidden)
+			res.Write([]byte("You don't have access to this page"))
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"regexp"
 	"slices"
 	"strings"
@@ -17,23 +18,44 @@ import (
 
 const (
 	DeleteSessionQuery = "DELETE FROM session WHERE session_id = ?"
-	ExtendSessionQuery = "UPDATE session SET expiration = ? WHERE session_id = ?"
-	LookupSessionQuery = "SELECT session_id, person_id, expiration, user_agent FROM session WHERE session_id = ?"
-	SessionCookie      = "gift-registry-session"
+	ExtendSessionQuery = "UPDATE session SET expiration = ?, last_seen_on = ? WHERE session_id = ?"
+	/*
+		Impersonation only counts while the session's owner is still a site
+		admin, and the person they're viewing as can still log in themselves
+	*/
+	LookupSessionQuery = `SELECT s.session_id, s.person_id, s.expiration, s.user_agent, s.absolute_expiration, s.remembered, s.created_on,
+			CASE WHEN p.site_admin THEN COALESCE(ip.person_id, 0) ELSE 0 END,
+			COALESCE(ip.first_name || ' ' || ip.last_name, '')
+		FROM session s
+			INNER JOIN person p ON p.person_id = s.person_id
+			LEFT JOIN person ip ON ip.person_id = s.impersonating_id
+				AND ip.deleted_on IS NULL
+				AND ip.disabled_on IS NULL
+		WHERE s.session_id = ?`
+	SessionCookie = "gift-registry-session"
 )
 
 type personKey int
 
+/* The session ID is the keyed hash of the cookie value, never the value itself */
 type session struct {
-	sessionID  string    `db:"session_id"`
-	personID   int64     `db:"person_id"`
-	expiration time.Time `db:"expiration"`
-	userAgent  string    `db:"user_agent"`
+	sessionID          string       `db:"session_id"`
+	personID           int64        `db:"person_id"`
+	expiration         time.Time    `db:"expiration"`
+	userAgent          string       `db:"user_agent"`
+	absoluteExpiration sql.NullTime `db:"absolute_expiration"`
+	remembered         bool         `db:"remembered"`
+	createdOn          sql.NullTime `db:"created_on"`
+	impersonatingID    int64        `db:"impersonating_id"`
+	impersonatingName  string
 }
 
 const (
 	_ personKey = iota
+	impersonatedName
+	impersonator
 	loggedInUser
+	sessionStarted
 )
 
 var (
@@ -41,17 +63,24 @@ var (
 	allowedModes  = []string{"cors", "navigate", "no-cors", "same-origin", "websocket"}
 	publicRoutes  []*regexp.Regexp
 	routePatterns = []string{"^/$", "/css/*", "/js/*", "/login", "/verify"}
+	/*
+		Token routes carry their own credential in the URL (calendar feeds, share
+		links, the "This wasn't me" link in sign-in emails) for clients that may
+		never have a session, like calendar apps or people without an account.
+		The handlers are responsible for validating the token.
+	*/
+	tokenRoutePatterns = []string{
+		"^/calendar/[^/]+\\.ics$",
+		"^/guest-claims/[^/]+/(confirm|release)$",
+		"^/share/[^/]+(/claim)?$",
+		"^/signin/revoke$",
+	}
+	tokenRoutes []*regexp.Regexp
 )
 
 func init() {
-	for _, pattern := range routePatterns {
-		r, err := regexp.Compile(pattern)
-		if err != nil {
-			log.Println("Error initializing pattern matcher for", pattern, ", skipping")
-			continue
-		}
-		publicRoutes = append(publicRoutes, r)
-	}
+	publicRoutes = compilePatterns(routePatterns)
+	tokenRoutes = compilePatterns(tokenRoutePatterns)
 }
 
 // Enforces valid login sessions for non-public endpoints
@@ -61,26 +90,62 @@ func Auth(svr *util.ServerUtils, next http.Handler) http.Handler {
 		pass := false
 
 		/*
-			Validate the various Sec-Fetch-* headers before forwarding the request.
+			Token routes skip the Sec-Fetch-* and session checks entirely (calendar
+			apps don't send the headers). The token is a secret, so make sure it
+			isn't cached or leaked in the Referer header of any links on the page.
 		*/
-		svr.Logger.DebugContext(ctx, "Validating Sec-Fetch* headers")
-		secFetchDest := strings.ToLower(req.Header.Get("Sec-Fetch-Dest"))
-		if !slices.Contains(allowedDests, secFetchDest) {
-			// Invalid fetch mode, redirect to login
-			authNext(ctx, svr, res, req, next, pass)
+		if isTokenRoute(ctx, svr, req) {
+			res.Header().Set("Cache-Control", "no-store")
+			res.Header().Set("Referrer-Policy", "no-referrer")
+			next.ServeHTTP(res, req)
 			return
 		}
-		secFetchMode := strings.ToLower(req.Header.Get("Sec-Fetch-Mode"))
-		if !slices.Contains(allowedModes, secFetchMode) {
-			// Invalid fetch mode, redirect to login
-			authNext(ctx, svr, res, req, next, pass)
+
+		/*
+			Personal access tokens come from scripts, not browsers, so they skip the
+			Sec-Fetch-* checks and the session lookup
+		*/
+		if token := bearerToken(req); token != "" {
+			accessTokenAuth(ctx, svr, res, req, next, token)
 			return
 		}
-		secFetchSite := strings.ToLower(req.Header.Get("Sec-Fetch-Site"))
-		if secFetchSite != "none" && secFetchSite != "same-origin" {
-			// Invalid header value, redirect to login
-			authNext(ctx, svr, res, req, next, pass)
-			return
+
+		/*
+			Validate the various Sec-Fetch-* headers before forwarding the request.
+			Browsers that don't send them at all fall back to having the Origin (or
+			Referer) checked on anything that changes data, with the CSRF token
+			covering the rest.
+		*/
+		if fetchMetadataMissing(req) {
+
+			svr.Logger.DebugContext(ctx, "No Sec-Fetch* headers, checking the origin instead")
+			if !slices.Contains(safeMethods, req.Method) && !sameOrigin(req) {
+				authNext(ctx, svr, res, req, next, pass)
+				return
+			}
+
+		} else {
+
+			svr.Logger.DebugContext(ctx, "Validating Sec-Fetch* headers")
+			secFetchDest := strings.ToLower(req.Header.Get("Sec-Fetch-Dest"))
+			if !slices.Contains(allowedDests, secFetchDest) {
+				// Invalid fetch mode, redirect to login
+				authNext(ctx, svr, res, req, next, pass)
+				return
+			}
+			secFetchMode := strings.ToLower(req.Header.Get("Sec-Fetch-Mode"))
+			if !slices.Contains(allowedModes, secFetchMode) {
+				// Invalid fetch mode, redirect to login
+				authNext(ctx, svr, res, req, next, pass)
+				return
+			}
+			secFetchSite := strings.ToLower(req.Header.Get("Sec-Fetch-Site"))
+			if secFetchSite != "none" && secFetchSite != "same-origin" {
+				// Invalid header value, redirect to login
+				authNext(ctx, svr, res, req, next, pass)
+				return
+			}
+
 		}
 		/*
 			The route is auth-protected, so query the DB to see if the session is
@@ -98,7 +163,6 @@ func Auth(svr *util.ServerUtils, next http.Handler) http.Handler {
 		if err != nil && err != sql.ErrNoRows {
 			svr.Logger.ErrorContext(ctx,
 				"Error loading session information",
-				slog.String("cookieValue", cookie.Value),
 				slog.String("errorMessage", err.Error()),
 			)
 			authNext(ctx, svr, res, req, next, pass)
@@ -107,7 +171,6 @@ func Auth(svr *util.ServerUtils, next http.Handler) http.Handler {
 
 			svr.Logger.InfoContext(ctx,
 				"No session info found, logging out",
-				slog.String("cookieValue", cookie.Value),
 			)
 			authNext(ctx, svr, res, req, next, pass)
 			return
@@ -119,7 +182,6 @@ func Auth(svr *util.ServerUtils, next http.Handler) http.Handler {
 
 			svr.Logger.InfoContext(ctx,
 				"Session has expired, logging out",
-				slog.String("cookieValue", cookie.Value),
 				slog.Int64("personID", sessInfo.personID),
 			)
 			err = deleteSession(ctx, svr, sessInfo.sessionID)
@@ -141,7 +203,6 @@ func Auth(svr *util.ServerUtils, next http.Handler) http.Handler {
 
 			svr.Logger.InfoContext(ctx,
 				"User agent doesn't match agent at sign-in. Logging out.",
-				slog.String("cookieValue", cookie.Value),
 				slog.Int64("personID", sessInfo.personID),
 			)
 			err = deleteSession(ctx, svr, sessInfo.sessionID)
@@ -158,9 +219,17 @@ func Auth(svr *util.ServerUtils, next http.Handler) http.Handler {
 
 		}
 
-		/* Session's valid, continue the request */
+		/*
+			Session's valid, continue the request. Activity keeps pushing the
+			expiration out by the idle lifetime, but never past the absolute one.
+			Remembered sessions just last until their absolute expiration.
+		*/
 		pass = true
-		newExp := time.Now().Add(5 * time.Minute).UTC()
+		newExp := now.Add(Lifetimes(svr).Idle)
+		if sessInfo.absoluteExpiration.Valid &&
+			(sessInfo.remembered || newExp.After(sessInfo.absoluteExpiration.Time)) {
+			newExp = sessInfo.absoluteExpiration.Time.UTC()
+		}
 		cookie.MaxAge = int(time.Until(newExp).Seconds())
 		http.SetCookie(res, cookie)
 		err = extendSession(ctx, svr, sessInfo.sessionID, newExp)
@@ -173,6 +242,12 @@ func Auth(svr *util.ServerUtils, next http.Handler) http.Handler {
 			)
 		}
 		ctx = context.WithValue(ctx, loggedInUser, sessInfo.personID)
+		if sessInfo.impersonatingID != 0 {
+			ctx = impersonate(ctx, svr, req, sessInfo)
+		}
+		if sessInfo.createdOn.Valid {
+			ctx = context.WithValue(ctx, sessionStarted, sessInfo.createdOn.Time)
+		}
 		req = req.WithContext(ctx)
 		authNext(ctx, svr, res, req, next, pass)
 	})
@@ -214,14 +289,28 @@ func authNext(
 	}
 }
 
-func deleteSession(ctx context.Context, svr *util.ServerUtils, sessionID string) error {
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	compiled := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Println("Error initializing pattern matcher for", pattern, ", skipping")
+			continue
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled
+}
+
+/* Takes the hashed session ID from the session record, not the cookie value */
+func deleteSession(ctx context.Context, svr *util.ServerUtils, sessionHash string) error {
 	svr.Logger.InfoContext(
 		ctx,
 		"Deleting existing session information",
-		slog.String("sessionID", sessionID),
+		slog.String("sessionID", sessionHash),
 	)
 
-	if result, err := svr.DB.Execute(ctx, DeleteSessionQuery, sessionID); err != nil {
+	if result, err := svr.DB.Execute(ctx, DeleteSessionQuery, sessionHash); err != nil {
 		return fmt.Errorf("could not delete session information from the database: %v", err)
 	} else if modified, err := result.RowsAffected(); err != nil {
 		/*
@@ -253,8 +342,9 @@ func deleteSession(ctx context.Context, svr *util.ServerUtils, sessionID string)
 	return nil
 }
 
-func extendSession(ctx context.Context, svr *util.ServerUtils, sessionID string, expires time.Time) error {
-	res, err := svr.DB.Execute(ctx, ExtendSessionQuery, expires, sessionID)
+/* Takes the hashed session ID from the session record, not the cookie value */
+func extendSession(ctx context.Context, svr *util.ServerUtils, sessionHash string, expires time.Time) error {
+	res, err := svr.DB.Execute(ctx, ExtendSessionQuery, expires, time.Now().UTC(), sessionHash)
 	if err != nil {
 		return fmt.Errorf("error setting extended session expiration: %v", err)
 	}
@@ -264,7 +354,7 @@ func extendSession(ctx context.Context, svr *util.ServerUtils, sessionID string,
 		svr.Logger.ErrorContext(
 			ctx,
 			"Error getting the number of rows modified from the update",
-			slog.String("sessionID", sessionID),
+			slog.String("sessionID", sessionHash),
 			slog.String("errorMessage", err.Error()),
 		)
 	} else if modified > 1 {
@@ -278,13 +368,20 @@ func extendSession(ctx context.Context, svr *util.ServerUtils, sessionID string,
 			ctx,
 			"Successfully set the updated expiration time in the database",
 			slog.Int64("updatedCount", modified),
-			slog.String("sessionID", sessionID),
+			slog.String("sessionID", sessionHash),
 		)
 	}
 
 	return nil
 }
 
+/* Older browsers don't send any of the Sec-Fetch-* headers */
+func fetchMetadataMissing(req *http.Request) bool {
+	return req.Header.Get("Sec-Fetch-Dest") == "" &&
+		req.Header.Get("Sec-Fetch-Mode") == "" &&
+		req.Header.Get("Sec-Fetch-Site") == ""
+}
+
 func isLogin(path string) bool {
 	loginPath, err := regexp.Compile("/login")
 	if err != nil {
@@ -317,16 +414,49 @@ func isPublic(ctx context.Context, svr *util.ServerUtils, req *http.Request) boo
 	return false
 }
 
+func isTokenRoute(ctx context.Context, svr *util.ServerUtils, req *http.Request) bool {
+	for _, allowed := range tokenRoutes {
+		if allowed.Match([]byte(req.URL.Path)) {
+
+			svr.Logger.InfoContext(ctx,
+				"Token path, the handler will check the token",
+				slog.String("pattern", allowed.String()),
+			)
+
+			return true
+
+		}
+	}
+
+	return false
+}
+
+/*
+Looks up the session for the ID in the cookie. Only the keyed hash of the ID
+is stored, so a copy of the database can't be used to log in. The lookup
+compares hashes, so how long it takes says nothing about the ID itself.
+*/
 func lookupSession(ctx context.Context, svr *util.ServerUtils, sessionID string) (session, error) {
+	sessionHash := util.HashSecret(svr, sessionID)
 	var sessRec session
 	err := svr.DB.
-		QueryRow(ctx, LookupSessionQuery, sessionID).
-		Scan(&sessRec.sessionID, &sessRec.personID, &sessRec.expiration, &sessRec.userAgent)
+		QueryRow(ctx, LookupSessionQuery, sessionHash).
+		Scan(
+			&sessRec.sessionID,
+			&sessRec.personID,
+			&sessRec.expiration,
+			&sessRec.userAgent,
+			&sessRec.absoluteExpiration,
+			&sessRec.remembered,
+			&sessRec.createdOn,
+			&sessRec.impersonatingID,
+			&sessRec.impersonatingName,
+		)
 	/* Just returning an empty session to since that's the same as sql.ErrNoRows */
 	if err != nil && err != sql.ErrNoRows {
 		svr.Logger.ErrorContext(ctx,
 			"Error looking up session information",
-			slog.String("sessionID", sessionID),
+			slog.String("sessionID", sessionHash),
 			slog.String("errorMessage", err.Error()),
 		)
 		return session{}, fmt.Errorf("error looking up session information: %v", err)
@@ -334,3 +464,23 @@ func lookupSession(ctx context.Context, svr *util.ServerUtils, sessionID string)
 
 	return sessRec, nil
 }
+
+/*
+Checks the request came from a page on this site, going by the Origin header
+or the Referer when there's no Origin. Privacy tools sometimes strip both,
+in which case the CSRF token is all there is to go on.
+*/
+func sameOrigin(req *http.Request) bool {
+
+	source := req.Header.Get("Origin")
+	if source == "" {
+		source = req.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(source)
+	return err == nil && parsed.Host == req.Host
+
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+
+	"gift-registry/internal/util"
+)
+
+const (
+	// CSRFCookie holds the browser's CSRF token. The __Host- prefix keeps
+	// other sites on the same domain from planting their own.
+	CSRFCookie = "__Host-gift-registry-csrf"
+	// CSRFField is the form field non-htmx forms send the token in
+	CSRFField = "csrf_token"
+	// CSRFHeader is the header htmx sends the token in (see csrfHeaders)
+	CSRFHeader = "X-CSRF-Token"
+)
+
+type csrfKey int
+
+const (
+	_ csrfKey = iota
+	csrfToken
+)
+
+var (
+	/* Methods that don't change anything, so they don't need a token */
+	safeMethods = []string{"GET", "HEAD", "OPTIONS"}
+	/* Static files never need a token */
+	staticPrefixes = []string{"/css/", "/js/"}
+)
+
+// CSRF protects form posts with double-submit tokens. Pages get a token in a
+// cookie and embed the same token (through the csrfHeaders or csrfToken
+// template functions), and anything that changes data has to send it back in
+// the X-CSRF-Token header or csrf_token field. Another site can make the
+// browser send the cookie, but can't read it to send the matching token.
+//
+// The token doesn't replace the Sec-Fetch-* checks in Auth, it covers the
+// browsers that don't send them.
+func CSRF(svr *util.ServerUtils, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		/*
+			Token routes carry their own secret instead of relying on a cookie,
+			so there's nothing for another site to ride along on.
+		*/
+		if isTokenRoute(ctx, svr, req) {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		/*
+			Same for personal access tokens. Browsers never add an Authorization
+			header on their own, so a bearer token has to come from a script that
+			already holds it.
+		*/
+		if bearerToken(req) != "" {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		token := ""
+		if cookie, err := req.Cookie(CSRFCookie); err == nil {
+			token = cookie.Value
+		}
+
+		if !slices.Contains(safeMethods, req.Method) {
+
+			submitted := req.Header.Get(CSRFHeader)
+			if submitted == "" {
+				submitted = req.PostFormValue(CSRFField)
+			}
+
+			if token == "" || !hmac.Equal([]byte(token), []byte(submitted)) {
+				svr.Logger.WarnContext(ctx,
+					"Rejected a request with a missing or mismatched CSRF token",
+					slog.String("method", req.Method),
+					slog.String("path", req.URL.Path),
+				)
+				forbidden(res, req, "This page has expired, reload it and try again.", "")
+				return
+			}
+
+		} else if token == "" && isPageLoad(req) {
+
+			/*
+				Only page loads hand out a new token. The requests for the page's
+				scripts and styles go out at the same time and would otherwise race
+				to set different tokens.
+			*/
+			token = rand.Text()
+			http.SetCookie(res, &http.Cookie{
+				Name:     CSRFCookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   true,
+				SameSite: http.SameSiteLaxMode,
+			})
+
+		}
+
+		ctx = context.WithValue(ctx, csrfToken, token)
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// TemplateFuncs returns the functions pages use to embed the request's CSRF
+// token: csrfToken for a hidden form field, and csrfHeaders for the body's
+// hx-headers attribute so every htmx request sends it. impersonationBanner
+// renders the "viewing as" banner (or nothing) at the top of the page. Any
+// template file that uses them has to be parsed with them, even when only
+// rendering a fragment.
+func TemplateFuncs(ctx context.Context) template.FuncMap {
+
+	token, _ := ctx.Value(csrfToken).(string)
+	return template.FuncMap{
+		"csrfHeaders":         func() string { return `{"` + CSRFHeader + `": "` + token + `"}` },
+		"csrfToken":           func() string { return token },
+		"impersonationBanner": func() htmltemplate.HTML { return impersonationBanner(ctx, token) },
+	}
+
+}
+
+/* A navigation to a page, or a browser that doesn't say what it's loading */
+func isPageLoad(req *http.Request) bool {
+
+	for _, prefix := range staticPrefixes {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return false
+		}
+	}
+
+	dest := strings.ToLower(req.Header.Get("Sec-Fetch-Dest"))
+	return req.Method == "GET" && (dest == "document" || dest == "")
+
+}
@@ -0,0 +1,219 @@
+package middleware_test
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+)
+
+// TestCSRF posts the login form with and without a matching CSRF token and
+// checks only the matching ones get through.
+func TestCSRF(t *testing.T) {
+	testData := []struct {
+		cookieToken    string
+		expectedStatus int
+		fieldToken     string
+		headerToken    string
+		testName       string
+	}{
+		{
+			cookieToken:    "matching-token",
+			expectedStatus: http.StatusOK,
+			headerToken:    "matching-token",
+			testName:       "Token in the header",
+		},
+		{
+			cookieToken:    "matching-token",
+			expectedStatus: http.StatusOK,
+			fieldToken:     "matching-token",
+			testName:       "Token in the form",
+		},
+		{
+			cookieToken:    "matching-token",
+			expectedStatus: http.StatusForbidden,
+			headerToken:    "some-other-token",
+			testName:       "Mismatched token",
+		},
+		{
+			cookieToken:    "matching-token",
+			expectedStatus: http.StatusForbidden,
+			testName:       "No token sent",
+		},
+		{
+			expectedStatus: http.StatusForbidden,
+			headerToken:    "made-up-token",
+			testName:       "No cookie",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			form := url.Values{"email": {"csrf-" + rand.Text() + "@localhost.com"}}
+			if data.fieldToken != "" {
+				form.Set(middleware.CSRFField, data.fieldToken)
+			}
+			req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+"/login", strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal("Error building the request", err)
+			}
+
+			if data.cookieToken != "" {
+				req.AddCookie(&http.Cookie{Name: middleware.CSRFCookie, Value: data.cookieToken})
+			}
+			if data.headerToken != "" {
+				req.Header.Set(middleware.CSRFHeader, data.headerToken)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("HX-Request", "true")
+			req.Header.Set("Sec-Fetch-Dest", "empty")
+			req.Header.Set("Sec-Fetch-Mode", "same-origin")
+			req.Header.Set("Sec-Fetch-Site", "same-origin")
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal("Error posting the login form", err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != data.expectedStatus {
+				t.Fatal("Expected a status of", data.expectedStatus, "but got", res.StatusCode)
+			}
+		})
+	}
+}
+
+// TestCSRFCookie checks page loads hand out a token, but the requests for the
+// page's styles and scripts don't.
+func TestCSRFCookie(t *testing.T) {
+	testData := []struct {
+		dest           string
+		expectedCookie bool
+		path           string
+		testName       string
+	}{
+		{
+			dest:           "document",
+			expectedCookie: true,
+			path:           "/login",
+			testName:       "Page load",
+		},
+		{
+			dest:           "",
+			expectedCookie: true,
+			path:           "/login",
+			testName:       "Page load without Fetch Metadata",
+		},
+		{
+			dest:           "style",
+			expectedCookie: false,
+			path:           "/css/styles.css",
+			testName:       "Stylesheet",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+data.path, nil)
+			if err != nil {
+				t.Fatal("Error building the request", err)
+			}
+			if data.dest != "" {
+				req.Header.Set("Sec-Fetch-Dest", data.dest)
+				req.Header.Set("Sec-Fetch-Mode", "same-origin")
+				req.Header.Set("Sec-Fetch-Site", "same-origin")
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal("Error loading", data.path, err)
+			}
+			_ = res.Body.Close()
+
+			issued := false
+			for _, cookie := range res.Cookies() {
+				issued = issued || (cookie.Name == middleware.CSRFCookie && cookie.Value != "")
+			}
+			if issued != data.expectedCookie {
+				t.Fatal("Expected a CSRF cookie", data.expectedCookie, "but got", issued)
+			}
+		})
+	}
+}
+
+// TestFetchMetadataFallback makes logged-in requests from a browser that
+// doesn't send Sec-Fetch-* headers, checking changes are only allowed from
+// the site's own pages.
+func TestFetchMetadataFallback(t *testing.T) {
+	testData := []struct {
+		expectedLogin bool
+		origin        string
+		testName      string
+	}{
+		{
+			expectedLogin: false,
+			origin:        "same",
+			testName:      "Same origin",
+		},
+		{
+			expectedLogin: false,
+			testName:      "No origin",
+		},
+		{
+			expectedLogin: true,
+			origin:        "https://evil.localhost",
+			testName:      "Another site",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := test.CreateSession(ctx, logger, db, test.UserData{
+				Email:     "no-fetch-metadata-" + rand.Text() + "@localhost.com",
+				FirstName: "Older",
+				LastName:  "Browser",
+			}, 5*time.Minute, test.DefaultUserAgent)
+			if err != nil {
+				t.Fatal("Error setting up test session", err)
+			}
+
+			req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+"/profile/devices/revoke-others", nil)
+			if err != nil {
+				t.Fatal("Error building the request", err)
+			}
+			req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: token})
+			req.Header.Set("User-Agent", test.DefaultUserAgent)
+			test.AddCSRFToken(req)
+			switch data.origin {
+			case "":
+			case "same":
+				req.Header.Set("Origin", testServer.URL)
+			default:
+				req.Header.Set("Origin", data.origin)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal("Error making the request", err)
+			}
+			_ = res.Body.Close()
+
+			/* Auth's redirect is relative, so it ends up under the request's path */
+			sentToLogin := strings.HasSuffix(res.Request.URL.Path, "/login")
+			if sentToLogin != data.expectedLogin {
+				t.Fatal("Expected to be sent to the login page", data.expectedLogin, "but ended up at", res.Request.URL.Path)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"html"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"gift-registry/internal/util"
+)
+
+const (
+	/* Where the banner's exit button posts to */
+	impersonationStopPath = "/admin/impersonation/stop"
+)
+
+// Impersonator returns the ID of the site admin viewing the app as someone
+// else, or 0 when the request isn't being made by an impersonating admin.
+// PersonID returns the person being impersonated, so handlers act as them
+// without knowing any different.
+func Impersonator(ctx context.Context) int64 {
+
+	adminID, _ := ctx.Value(impersonator).(int64)
+	return adminID
+
+}
+
+// NoImpersonation turns away requests made while impersonating, for actions an
+// admin shouldn't take on someone else's behalf (like changing their list or
+// claims). Like Admin, it has to be layered after Auth.
+func NoImpersonation(svr *util.ServerUtils, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		if adminID := Impersonator(ctx); adminID != 0 {
+			svr.Logger.WarnContext(ctx,
+				"Blocked a request made while impersonating",
+				slog.Int64("impersonatorID", adminID),
+				slog.Int64("personID", PersonID(res, req)),
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+			)
+			forbidden(res, req, "You can't do that while viewing the registry as someone else.", "")
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+/*
+Switches the request over to the person the admin is impersonating, keeping
+the admin's ID around for the audit log. Every request is logged, so there's a
+record of everything the admin looked at, not just what they changed.
+*/
+func impersonate(ctx context.Context, svr *util.ServerUtils, req *http.Request, sess session) context.Context {
+
+	svr.Logger.InfoContext(ctx,
+		"Request made while impersonating",
+		slog.Int64("impersonatorID", sess.personID),
+		slog.Int64("personID", sess.impersonatingID),
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+	)
+
+	ctx = context.WithValue(ctx, impersonator, sess.personID)
+	ctx = context.WithValue(ctx, impersonatedName, sess.impersonatingName)
+	return context.WithValue(ctx, loggedInUser, sess.impersonatingID)
+
+}
+
+/*
+The banner across the top of every page while impersonating. Exiting is a
+plain form post so it works on pages that don't load htmx.
+*/
+func impersonationBanner(ctx context.Context, token string) template.HTML {
+
+	name, ok := ctx.Value(impersonatedName).(string)
+	if !ok {
+		return ""
+	}
+
+	return template.HTML(`<div id="impersonation-banner" class="banner content flex-row shadowed" role="status">` +
+		`<strong>Viewing the registry as ` + html.EscapeString(name) + `.</strong>` +
+		`<form id="impersonation-stop" method="post" action="` + impersonationStopPath + `">` +
+		`<input type="hidden" name="` + CSRFField + `" value="` + html.EscapeString(token) + `" />` +
+		`<button id="impersonation-stop-submit" class="btn btn-contained primary" type="submit">Stop</button>` +
+		`</form></div>`)
+
+}
@@ -65,6 +65,7 @@ func TestMain(m *testing.M) {
 	)
 
 	env := map[string]string{
+		"APP_BASE_URL":     "https://gift-registry.localhost",
 		"DB_NAME":          dbName,
 		"MIGRATIONS_DIR":   filepath.Join("..", "..", "internal", "database", "migrations"),
 		"STATIC_FILES_DIR": filepath.Join("..", "..", "cmd", "web"),
@@ -0,0 +1,322 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gift-registry/internal/util"
+)
+
+// RatePolicy is a token bucket: it holds up to Burst requests, and gets one
+// back every Interval. A zero Burst means the policy isn't applied.
+type RatePolicy struct {
+	Burst    int
+	Interval time.Duration
+}
+
+// RoutePolicy is the set of buckets a request has to get a token from, one
+// per client IP, one per submitted email address, one per session and one per
+// personal access token.
+type RoutePolicy struct {
+	AccessToken RatePolicy
+	Email       RatePolicy
+	IP          RatePolicy
+	Session     RatePolicy
+}
+
+// RateLimitStore keeps the token buckets. MemoryStore is enough for a single
+// instance, anything running more than one would need a shared store.
+type RateLimitStore interface {
+	// Take uses up a token from the key's bucket, returning false (and how long
+	// until a token is free) if it's empty.
+	Take(ctx context.Context, key string, policy RatePolicy, now time.Time) (bool, time.Duration, error)
+}
+
+// MemoryStore keeps the token buckets in memory
+type MemoryStore struct {
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+/* One of the buckets a request draws from */
+type rateLimitKey struct {
+	bucket string
+	key    string
+	policy RatePolicy
+}
+
+type bucket struct {
+	/* When the bucket will be full again, which is all it needs to track */
+	full time.Time
+}
+
+const (
+	/* Full buckets are dropped from the memory store this often */
+	pruneInterval = time.Minute
+	/* Where the 429 goes on an htmx form, replacing its error message */
+	rateLimitTarget = "find .danger"
+)
+
+var (
+	/*
+		Logging in and verifying are strict, since they're what someone brute
+		forcing verification codes would hammer. The email bucket is what stops
+		them once they start rotating IP addresses. Guest claims are strict too,
+		since anyone with a share link can make the app email any address.
+	*/
+	strictPolicy = RoutePolicy{
+		Email:   RatePolicy{Burst: 5, Interval: time.Minute},
+		IP:      RatePolicy{Burst: 20, Interval: 30 * time.Second},
+		Session: RatePolicy{Burst: 20, Interval: 30 * time.Second},
+	}
+	/*
+		Scripts using personal access tokens get their own allowance, the same
+		on every route. It's enough for a bulk update without letting a runaway
+		script crowd out everyone else.
+	*/
+	accessTokenPolicy = RoutePolicy{
+		AccessToken: RatePolicy{Burst: 60, Interval: 500 * time.Millisecond},
+		IP:          RatePolicy{Burst: 120, Interval: 250 * time.Millisecond},
+	}
+	defaultPolicy = RoutePolicy{
+		IP:      RatePolicy{Burst: 300, Interval: 100 * time.Millisecond},
+		Session: RatePolicy{Burst: 120, Interval: 250 * time.Millisecond},
+	}
+	routePolicies = map[string]RoutePolicy{
+		"GET /login/oidc":                          strictPolicy,
+		"GET /login/oidc/callback":                 strictPolicy,
+		"POST /guest-claims/{externalID}/{action}": strictPolicy,
+		"POST /login":                              strictPolicy,
+		"POST /login/passkey":                      strictPolicy,
+		"POST /profile/account/delete":             strictPolicy,
+		"POST /profile/account/delete/confirm":     strictPolicy,
+		"POST /profile/email/confirm":              strictPolicy,
+		"POST /share/{token}/claim":                strictPolicy,
+		"POST /signin/revoke":                      strictPolicy,
+		"POST /verify":                             strictPolicy,
+		"POST /verify/link":                        strictPolicy,
+	}
+	/* Matches requests to routePolicies the way the router does, wildcards and all */
+	policyRoutes = func() *http.ServeMux {
+		mux := http.NewServeMux()
+		for pattern := range routePolicies {
+			mux.Handle(pattern, http.NotFoundHandler())
+		}
+		return mux
+	}()
+)
+
+// NewMemoryStore returns an empty in-memory token bucket store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Take uses up a token from the key's bucket
+func (store *MemoryStore) Take(ctx context.Context, key string, policy RatePolicy, now time.Time) (bool, time.Duration, error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if now.Sub(store.lastPrune) >= pruneInterval {
+		store.prune(now)
+	}
+
+	b, found := store.buckets[key]
+	if !found {
+		b = &bucket{full: now}
+		store.buckets[key] = b
+	}
+	if b.full.Before(now) {
+		b.full = now
+	}
+
+	/*
+		Taking a token pushes the "full" time back an interval. The bucket's empty
+		once that's more than a whole burst's worth of intervals away.
+	*/
+	full := b.full.Add(policy.Interval)
+	if limit := now.Add(time.Duration(policy.Burst) * policy.Interval); full.After(limit) {
+		return false, full.Sub(limit), nil
+	}
+
+	b.full = full
+	return true, 0, nil
+
+}
+
+/* Drops the buckets that are full again, they're the same as a new bucket */
+func (store *MemoryStore) prune(now time.Time) {
+
+	for key, b := range store.buckets {
+		if !b.full.After(now) {
+			delete(store.buckets, key)
+		}
+	}
+	store.lastPrune = now
+
+}
+
+// RateLimit turns away clients making too many requests with a 429. Each
+// route's policy decides which buckets (IP, email, session) a request draws
+// from, and how quickly they refill.
+func RateLimit(svr *util.ServerUtils, store RateLimitStore, next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		policy, route := defaultPolicy, "*"
+		if _, pattern := policyRoutes.Handler(req); pattern != "" {
+			policy, route = routePolicies[pattern], pattern
+		}
+		token := bearerToken(req)
+		if token != "" {
+			policy, route = accessTokenPolicy, "token"
+		}
+
+		/*
+			Checked in this order, with the email bucket last, so a request turned
+			away by another bucket doesn't use up the allowance for someone's email
+			address. Secrets are hashed before they're used as keys, so the store
+			never holds a working session or token.
+		*/
+		limits := []rateLimitKey{
+			{bucket: "ip", key: ClientIP(svr, req), policy: policy.IP},
+		}
+		if token != "" {
+			limits = append(limits, rateLimitKey{bucket: "token", key: util.HashSecret(svr, token), policy: policy.AccessToken})
+		}
+		if cookie, err := req.Cookie(SessionCookie); err == nil {
+			limits = append(limits, rateLimitKey{bucket: "session", key: util.HashSecret(svr, cookie.Value), policy: policy.Session})
+		}
+		if policy.Email.Burst > 0 {
+			if email := strings.ToLower(strings.TrimSpace(req.PostFormValue("email"))); email != "" {
+				limits = append(limits, rateLimitKey{bucket: "email", key: email, policy: policy.Email})
+			}
+		}
+
+		now := time.Now().UTC()
+		for _, limit := range limits {
+
+			if limit.policy.Burst == 0 {
+				continue
+			}
+
+			allowed, retryAfter, err := store.Take(ctx, limit.bucket+"|"+route+"|"+limit.key, limit.policy, now)
+			if err != nil {
+				/* Better to let people in than lock everyone out over the store */
+				svr.Logger.ErrorContext(ctx,
+					"Error checking the rate limit, allowing the request",
+					slog.String("errorMessage", err.Error()),
+				)
+				continue
+			} else if !allowed {
+				svr.Logger.WarnContext(ctx,
+					"Rate limited a request",
+					slog.String("route", route),
+					slog.String("bucket", limit.bucket),
+				)
+				tooManyRequests(res, req, retryAfter)
+				return
+			}
+
+		}
+
+		next.ServeHTTP(res, req)
+
+	})
+
+}
+
+// ClientIP returns the address the request came from. The X-Forwarded-For
+// header is only trusted when TRUST_PROXY_HEADERS is "true", and even then
+// only the entries our own proxies appended count. Anything to the left of
+// those came from the client, who can put whatever they want there. With more
+// than one proxy in front of the app, TRUSTED_PROXY_HOPS says how many.
+func ClientIP(svr *util.ServerUtils, req *http.Request) string {
+
+	if svr.Getenv("TRUST_PROXY_HEADERS") == "true" {
+
+		hops, err := strconv.Atoi(svr.Getenv("TRUSTED_PROXY_HOPS"))
+		if err != nil || hops < 1 {
+			hops = 1
+		}
+
+		forwarded := []string{}
+		for _, header := range req.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(header, ",")...)
+		}
+		if len(forwarded) >= hops {
+			if addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[len(forwarded)-hops])); err == nil {
+				return addr.String()
+			}
+		}
+
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+
+}
+
+// CoarseIP returns the network the request came from rather than the exact
+// address (the /24 for IPv4, the /48 for IPv6). It's enough for someone to
+// recognize where a sign-in came from without keeping where they are.
+func CoarseIP(svr *util.ServerUtils, req *http.Request) string {
+
+	addr, err := netip.ParseAddr(ClientIP(svr, req))
+	if err != nil {
+		return ""
+	}
+
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+
+}
+
+/*
+Writes the 429. htmx requests get the message swapped into the form's error
+message (the page's htmx config lets 429s swap), everything else gets plain
+text.
+*/
+func tooManyRequests(res http.ResponseWriter, req *http.Request, retryAfter time.Duration) {
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	message := fmt.Sprintf("Too many attempts, try again in %d seconds.", seconds)
+	res.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	if req.Header.Get("HX-Request") != "true" {
+		http.Error(res, message, http.StatusTooManyRequests)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("HX-Retarget", rateLimitTarget)
+	res.Header().Set("HX-Reswap", "outerHTML")
+	res.WriteHeader(http.StatusTooManyRequests)
+	res.Write([]byte(`<div class="danger flex-row" role="alert">` + message + `</div>`))
+
+}
@@ -0,0 +1,338 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+	"gift-registry/internal/util"
+)
+
+/* Keeps track of the buckets asked for, and turns away the ones in full */
+type recordingStore struct {
+	full  []string
+	taken []string
+}
+
+func (store *recordingStore) Take(ctx context.Context, key string, policy middleware.RatePolicy, now time.Time) (bool, time.Duration, error) {
+	store.taken = append(store.taken, key)
+	bucket, _, _ := strings.Cut(key, "|")
+	return !slices.Contains(store.full, bucket), time.Second, nil
+}
+
+// TestMemoryStore confirms a bucket lets through a burst of requests, turns
+// away the next one, and lets requests through again as it refills.
+func TestMemoryStore(t *testing.T) {
+	testData := []struct {
+		expectedAllowed bool
+		requests        int
+		testName        string
+		wait            time.Duration
+	}{
+		{
+			expectedAllowed: true,
+			requests:        3,
+			testName:        "Within the burst",
+		},
+		{
+			expectedAllowed: false,
+			requests:        4,
+			testName:        "Past the burst",
+		},
+		{
+			expectedAllowed: true,
+			requests:        4,
+			testName:        "Refilled",
+			wait:            time.Minute,
+		},
+	}
+
+	policy := middleware.RatePolicy{Burst: 3, Interval: time.Minute}
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			store := middleware.NewMemoryStore()
+			now := time.Now().UTC()
+			allowed := true
+			var retryAfter time.Duration
+			var err error
+			for request := 0; request < data.requests; request++ {
+				if request == data.requests-1 {
+					now = now.Add(data.wait)
+				}
+				allowed, retryAfter, err = store.Take(ctx, "test-key", policy, now)
+				if err != nil {
+					t.Fatal("Error taking a token", err)
+				}
+			}
+
+			if allowed != data.expectedAllowed {
+				t.Fatal("Expected the last request to be allowed", data.expectedAllowed, "but it was", allowed)
+			} else if !allowed && retryAfter != policy.Interval {
+				t.Fatal("Expected to retry after", policy.Interval, "but got", retryAfter)
+			}
+		})
+	}
+}
+
+// TestLoginRateLimit keeps logging in as the same email address until the
+// limiter steps in, and confirms htmx is told where to show the error.
+func TestLoginRateLimit(t *testing.T) {
+
+	form := url.Values{"email": {"ratelimited@localhost.com"}}
+	for attempt := 1; attempt <= 6; attempt++ {
+
+		req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+"/login", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal("Error building the login request", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		req.Header.Set("Sec-Fetch-Dest", "empty")
+		req.Header.Set("Sec-Fetch-Mode", "same-origin")
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		test.AddCSRFToken(req)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Error logging in", err)
+		}
+		_ = res.Body.Close()
+
+		if attempt < 6 && res.StatusCode == http.StatusTooManyRequests {
+			t.Fatal("Login attempt", attempt, "was rate limited too soon")
+		} else if attempt < 6 {
+			continue
+		}
+
+		if res.StatusCode != http.StatusTooManyRequests {
+			t.Fatal("Expected the last login attempt to be rate limited but got", res.StatusCode)
+		} else if res.Header.Get("Retry-After") == "" {
+			t.Fatal("The rate limited response is missing the Retry-After header")
+		} else if res.Header.Get("HX-Retarget") == "" {
+			t.Fatal("The rate limited response doesn't tell htmx where to show the error")
+		}
+
+	}
+
+}
+
+// TestAccessTokenRateLimit keeps calling the registry with the same access
+// token until the limiter steps in. Tokens draw from their own bucket, so the
+// token not being valid doesn't matter. The bucket refills while the requests
+// go out, so there's some slack past the burst.
+func TestAccessTokenRateLimit(t *testing.T) {
+
+	for attempt := 1; attempt <= 70; attempt++ {
+
+		req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+"/registry/items", nil)
+		if err != nil {
+			t.Fatal("Error building the registry request", err)
+		}
+		req.Header.Set("Authorization", "Bearer rate-limited-token")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Error calling the registry", err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != http.StatusTooManyRequests {
+			continue
+		} else if attempt <= 60 {
+			t.Fatal("Request", attempt, "was rate limited too soon")
+		}
+		return
+
+	}
+
+	t.Fatal("Expected the token to be rate limited")
+
+}
+
+// TestRateLimitBuckets checks the order the buckets are drawn from, so one
+// that's empty stops the request before it uses up the email bucket, and that
+// sessions and access tokens are only kept hashed.
+func TestRateLimitBuckets(t *testing.T) {
+	testData := []struct {
+		bearer          bool
+		expectedBuckets []string
+		expectedStatus  int
+		full            []string
+		method          string
+		path            string
+		testName        string
+	}{
+		{
+			expectedBuckets: []string{"ip", "session", "email"},
+			expectedStatus:  http.StatusOK,
+			method:          "POST",
+			path:            "/login",
+			testName:        "Every bucket",
+		},
+		{
+			expectedBuckets: []string{"ip"},
+			expectedStatus:  http.StatusTooManyRequests,
+			full:            []string{"ip"},
+			method:          "POST",
+			path:            "/login",
+			testName:        "IP bucket empty",
+		},
+		{
+			expectedBuckets: []string{"ip", "session"},
+			expectedStatus:  http.StatusTooManyRequests,
+			full:            []string{"session"},
+			method:          "POST",
+			path:            "/login",
+			testName:        "Session bucket empty",
+		},
+		{
+			expectedBuckets: []string{"ip", "session", "email"},
+			expectedStatus:  http.StatusOK,
+			method:          "POST",
+			path:            "/share/some-share-token/claim",
+			testName:        "Guest claim",
+		},
+		{
+			expectedBuckets: []string{"ip", "session"},
+			expectedStatus:  http.StatusOK,
+			method:          "POST",
+			path:            "/registry/items",
+			testName:        "Default policy",
+		},
+		{
+			bearer:          true,
+			expectedBuckets: []string{"ip", "token"},
+			expectedStatus:  http.StatusOK,
+			method:          "GET",
+			path:            "/registry/items",
+			testName:        "Access token",
+		},
+	}
+
+	svr := &util.ServerUtils{Getenv: func(string) string { return "" }, Logger: logger}
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			store := &recordingStore{full: data.full}
+			handler := middleware.RateLimit(svr, store, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(data.method, data.path, strings.NewReader(url.Values{"email": {"buckets@localhost.com"}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: "bucket-session"})
+			if data.bearer {
+				req.Header.Set("Authorization", "Bearer bucket-token")
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			if res.Code != data.expectedStatus {
+				t.Fatal("Expected a", data.expectedStatus, "but got", res.Code)
+			}
+
+			buckets := []string{}
+			for _, key := range store.taken {
+				bucket, _, _ := strings.Cut(key, "|")
+				buckets = append(buckets, bucket)
+				if strings.Contains(key, "bucket-token") || strings.Contains(key, "bucket-session") {
+					t.Fatal("Expected secrets to be hashed in the key", key)
+				}
+			}
+			if !slices.Equal(buckets, data.expectedBuckets) {
+				t.Fatal("Expected the buckets", data.expectedBuckets, "but took from", buckets)
+			}
+		})
+	}
+}
+
+// TestClientIP makes sure a client can't pick its own IP bucket by sending
+// X-Forwarded-For entries, only the ones our proxies added are used.
+func TestClientIP(t *testing.T) {
+	testData := []struct {
+		expectedCoarse string
+		expectedIP     string
+		forwarded      []string
+		hops           string
+		testName       string
+		trustProxy     bool
+	}{
+		{
+			expectedCoarse: "192.0.2.0/24",
+			expectedIP:     "192.0.2.1",
+			forwarded:      []string{"203.0.113.9"},
+			testName:       "Proxy headers not trusted",
+		},
+		{
+			expectedCoarse: "203.0.113.0/24",
+			expectedIP:     "203.0.113.9",
+			forwarded:      []string{"10.9.8.7, 203.0.113.9"},
+			testName:       "Spoofed entry ignored",
+			trustProxy:     true,
+		},
+		{
+			expectedCoarse: "203.0.113.0/24",
+			expectedIP:     "203.0.113.9",
+			forwarded:      []string{"10.9.8.7", "203.0.113.9"},
+			testName:       "Separate headers",
+			trustProxy:     true,
+		},
+		{
+			expectedCoarse: "198.51.100.0/24",
+			expectedIP:     "198.51.100.7",
+			forwarded:      []string{"10.9.8.7, 198.51.100.7, 172.16.0.2"},
+			hops:           "2",
+			testName:       "Two proxies",
+			trustProxy:     true,
+		},
+		{
+			expectedCoarse: "192.0.2.0/24",
+			expectedIP:     "192.0.2.1",
+			forwarded:      []string{"198.51.100.7"},
+			hops:           "2",
+			testName:       "Fewer entries than proxies",
+			trustProxy:     true,
+		},
+		{
+			expectedCoarse: "192.0.2.0/24",
+			expectedIP:     "192.0.2.1",
+			forwarded:      []string{"not-an-address"},
+			testName:       "Bad entry",
+			trustProxy:     true,
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			env := map[string]string{"TRUSTED_PROXY_HOPS": data.hops}
+			if data.trustProxy {
+				env["TRUST_PROXY_HEADERS"] = "true"
+			}
+			svr := &util.ServerUtils{Getenv: func(name string) string { return env[name] }, Logger: logger}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.0.2.1:51234"
+			for _, forwarded := range data.forwarded {
+				req.Header.Add("X-Forwarded-For", forwarded)
+			}
+
+			if ip := middleware.ClientIP(svr, req); ip != data.expectedIP {
+				t.Fatal("Expected the client IP", data.expectedIP, "but got", ip)
+			} else if coarse := middleware.CoarseIP(svr, req); coarse != data.expectedCoarse {
+				t.Fatal("Expected the network", data.expectedCoarse, "but got", coarse)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gift-registry/internal/util"
+)
+
+// SessionLifetimes are how long a login lasts. Idle is how long a session
+// survives without any requests, Absolute is how long activity can keep it
+// going, Remembered is how long a "remember this device" session lasts, and
+// Fresh is how recently someone has to have logged in for sensitive actions.
+type SessionLifetimes struct {
+	Absolute   time.Duration
+	Fresh      time.Duration
+	Idle       time.Duration
+	Remembered time.Duration
+}
+
+const (
+	defaultAbsoluteHours  = 12
+	defaultFreshMinutes   = 15
+	defaultIdleMinutes    = 5
+	defaultRememberedDays = 30
+	/* Where a 403 goes on an htmx form when no section is targeted */
+	forbiddenTarget = "find .danger"
+)
+
+// Lifetimes reads the session lifetimes from SESSION_IDLE_MINUTES,
+// SESSION_ABSOLUTE_HOURS, SESSION_REMEMBER_DAYS and SESSION_FRESH_MINUTES,
+// using the defaults for anything missing or invalid.
+func Lifetimes(svr *util.ServerUtils) SessionLifetimes {
+
+	return SessionLifetimes{
+		Absolute:   envDuration(svr, "SESSION_ABSOLUTE_HOURS", defaultAbsoluteHours, time.Hour),
+		Fresh:      envDuration(svr, "SESSION_FRESH_MINUTES", defaultFreshMinutes, time.Minute),
+		Idle:       envDuration(svr, "SESSION_IDLE_MINUTES", defaultIdleMinutes, time.Minute),
+		Remembered: envDuration(svr, "SESSION_REMEMBER_DAYS", defaultRememberedDays, 24*time.Hour),
+	}
+
+}
+
+// Fresh only lets people through to the next handler if they logged in
+// recently, so a remembered (or long-running) session on a borrowed or stolen
+// device can't be used to change how the account is signed into. Admins
+// viewing as someone else can't change how that person signs in at all. Like
+// Admin, it has to be layered after Auth.
+func Fresh(svr *util.ServerUtils, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		if Impersonator(ctx) != 0 {
+			NoImpersonation(svr, next).ServeHTTP(res, req)
+			return
+		}
+
+		started, ok := ctx.Value(sessionStarted).(time.Time)
+		if ok && time.Since(started) <= Lifetimes(svr).Fresh {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		svr.Logger.InfoContext(ctx,
+			"Session is too old for a sensitive action",
+			slog.String("path", req.URL.Path),
+		)
+		freshLoginRequired(res, req)
+	})
+}
+
+/* Reads a whole number of units from the environment */
+func envDuration(svr *util.ServerUtils, name string, fallback int, unit time.Duration) time.Duration {
+
+	value, err := strconv.Atoi(svr.Getenv(name))
+	if err != nil || value <= 0 {
+		value = fallback
+	}
+	return time.Duration(value) * unit
+
+}
+
+func freshLoginRequired(res http.ResponseWriter, req *http.Request) {
+	forbidden(res, req, "For your security, log in again to do that.", ` <a href="/logout">Log out</a>`)
+}
+
+/*
+Turns the request down. htmx requests get the message (and any extra HTML)
+swapped in over the error message in the section being updated, or in the
+form, when nothing's targeted.
+*/
+func forbidden(res http.ResponseWriter, req *http.Request, message string, extra string) {
+
+	if req.Header.Get("HX-Request") != "true" {
+		http.Error(res, message, http.StatusForbidden)
+		return
+	}
+
+	target := forbiddenTarget
+	if section := req.Header.Get("HX-Target"); section != "" {
+		target = "#" + section + " .danger"
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("HX-Retarget", target)
+	res.Header().Set("HX-Reswap", "outerHTML")
+	res.WriteHeader(http.StatusForbidden)
+	res.Write([]byte(`<div class="danger flex-row" role="alert">` + message + extra + `</div>`))
+
+}
@@ -0,0 +1,176 @@
+package middleware_test
+
+import (
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+)
+
+// TestSessionLifetime checks activity keeps a session going without pushing
+// it past its absolute expiration, and that remembered sessions don't slide.
+func TestSessionLifetime(t *testing.T) {
+	testData := []struct {
+		absolute   time.Duration
+		remembered bool
+		testName   string
+	}{
+		{
+			absolute: time.Hour,
+			testName: "Extended by the idle lifetime",
+		},
+		{
+			absolute: time.Minute,
+			testName: "Capped at the absolute lifetime",
+		},
+		{
+			absolute:   30 * 24 * time.Hour,
+			remembered: true,
+			testName:   "Remembered session",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := test.CreateSession(ctx, logger, db, test.UserData{
+				Email:     "lifetime-" + rand.Text() + "@localhost.com",
+				FirstName: "Session",
+				LastName:  "Lifetime",
+			}, time.Minute, test.DefaultUserAgent)
+			if err != nil {
+				t.Fatal("Error setting up test session", err)
+			}
+
+			absolute := time.Now().UTC().Add(data.absolute).Truncate(time.Second)
+			_, err = db.Execute(ctx,
+				"UPDATE session SET absolute_expiration = ?, remembered = ?, expiration = ? WHERE session_id = ?",
+				absolute, data.remembered, absolute, test.HashSecret(token),
+			)
+			if err != nil {
+				t.Fatal("Error setting the session lifetime", err)
+			}
+
+			res := request(t, "GET", "/registry", token, false)
+			_ = res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 but got", res.StatusCode)
+			}
+
+			var expiration time.Time
+			if err = db.QueryRow(ctx, "SELECT expiration FROM session WHERE session_id = ?", test.HashSecret(token)).Scan(&expiration); err != nil {
+				t.Fatal("Error looking up the session", err)
+			}
+
+			idleExpiration := time.Now().UTC().Add(5 * time.Minute)
+			switch {
+			case data.remembered || data.absolute < 5*time.Minute:
+				if !expiration.Equal(absolute) {
+					t.Fatal("Expected the session to expire at", absolute, "but it expires at", expiration)
+				}
+			case expiration.After(idleExpiration) || expiration.Before(idleExpiration.Add(-time.Minute)):
+				t.Fatal("Expected the session to expire around", idleExpiration, "but it expires at", expiration)
+			}
+		})
+	}
+}
+
+// TestFresh makes sure sensitive actions are only allowed when the person
+// logged in recently.
+func TestFresh(t *testing.T) {
+	testData := []struct {
+		expectedStatus int
+		htmx           bool
+		loggedInAgo    time.Duration
+		testName       string
+	}{
+		{
+			expectedStatus: http.StatusOK,
+			loggedInAgo:    time.Minute,
+			testName:       "Recent login",
+		},
+		{
+			expectedStatus: http.StatusForbidden,
+			loggedInAgo:    time.Hour,
+			testName:       "Old login",
+		},
+		{
+			expectedStatus: http.StatusForbidden,
+			htmx:           true,
+			loggedInAgo:    24 * time.Hour,
+			testName:       "Old login from htmx",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := test.CreateSession(ctx, logger, db, test.UserData{
+				Email:     "fresh-" + rand.Text() + "@localhost.com",
+				FirstName: "Fresh",
+				LastName:  "Session",
+			}, time.Hour, test.DefaultUserAgent)
+			if err != nil {
+				t.Fatal("Error setting up test session", err)
+			}
+
+			_, err = db.Execute(ctx,
+				"UPDATE session SET created_on = ? WHERE session_id = ?",
+				time.Now().UTC().Add(-data.loggedInAgo), test.HashSecret(token),
+			)
+			if err != nil {
+				t.Fatal("Error backdating the session", err)
+			}
+
+			res := request(t, "POST", "/profile/devices/revoke-others", token, data.htmx)
+			defer res.Body.Close()
+
+			if res.StatusCode != data.expectedStatus {
+				t.Fatal("Expected a status of", data.expectedStatus, "but got", res.StatusCode)
+			}
+
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal("Error reading the response", err)
+			}
+			if data.expectedStatus == http.StatusForbidden && !strings.Contains(string(body), "log in again") {
+				t.Fatal("Expected to be asked to log in again but got", string(body))
+			}
+			if data.htmx && res.Header.Get("HX-Retarget") == "" {
+				t.Fatal("Expected the message to be retargeted at the form's error message")
+			}
+		})
+	}
+}
+
+func request(t *testing.T, method string, path string, token string, htmx bool) *http.Response {
+
+	req, err := http.NewRequestWithContext(ctx, method, testServer.URL+path, nil)
+	if err != nil {
+		t.Fatal("Error building the request", err)
+	}
+
+	req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: token})
+	req.Header.Set("User-Agent", test.DefaultUserAgent)
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+	if htmx {
+		req.Header.Set("HX-Request", "true")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error making the request", err)
+	}
+	return res
+
+}
@@ -0,0 +1,352 @@
+// Package notification records the changes people make to their registry
+// lists so the rest of their household can be told about them, either right
+// away or batched into a daily or weekly digest depending on each person's
+// preference. Anyone who claimed a changed item is alerted separately.
+package notification
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gift-registry/internal/util"
+)
+
+type ChangeType string
+
+// Change describes a single change to an item on someone's list
+type Change struct {
+	ActorID        int64
+	Details        string
+	ItemExternalID string
+	ItemName       string
+	OwnerID        int64
+	Type           ChangeType
+}
+
+// ClaimAlert tells someone who claimed an item that the owner changed it or
+// took it off their list
+type ClaimAlert struct {
+	Details  string
+	Email    string
+	ItemName string
+	Owner    string
+	Type     ChangeType
+	alertID  int64
+}
+
+// ChangeSummary is how a change is shown in a digest
+type ChangeSummary struct {
+	ChangedOn string
+	Details   string
+	ItemName  string
+	Owner     string
+	Type      ChangeType
+}
+
+// Digest is the batch of pending changes for a single person
+type Digest struct {
+	Changes         []ChangeSummary
+	Email           string
+	PersonID        int64
+	notificationIDs []any
+}
+
+const (
+	Added     ChangeType = "ADDED"
+	Edited    ChangeType = "EDITED"
+	Removed   ChangeType = "REMOVED"
+	Withdrawn ChangeType = "WITHDRAWN"
+	Daily                = "DAILY"
+	Immediate            = "IMMEDIATE"
+	Off                  = "OFF"
+	Weekly               = "WEEKLY"
+	/*
+		Goes to every member and (confirmed) guest who claimed the item. The
+		owner never sees these, so they can't work out who the claimers are.
+	*/
+	alertClaimersStatement = `INSERT INTO claim_alert (person_id, guest_claim_id, owner_id, item_name, change_type, details)
+		SELECT c.person_id, NULL, ?, ?, ?, ?
+		FROM claim c
+		WHERE c.item_id = (SELECT item_id FROM item WHERE external_id = ?)
+		UNION ALL
+		SELECT NULL, g.guest_claim_id, ?, ?, ?, ?
+		FROM guest_claim g
+		WHERE g.item_id = (SELECT item_id FROM item WHERE external_id = ?)
+			AND g.status = 'ACTIVE'`
+	dateFmt = "January 2, 2006"
+	/*
+		Everyone else in the list owner's household gets a copy, except for
+		managed profiles (they don't have an email) and anyone who's opted out.
+	*/
+	fanOutStatement = `INSERT INTO notification (person_id, change_id)
+		SELECT hp.person_id, (SELECT change_id FROM item_change WHERE external_id = ?)
+		FROM household_person hp
+			INNER JOIN person p ON p.person_id = hp.person_id
+		WHERE hp.household_id = (SELECT household_id FROM household_person WHERE person_id = ?)
+			AND hp.person_id <> ?
+			AND hp.person_id <> ?
+			AND p.type <> 'MANAGED'
+			AND p.deleted_on IS NULL
+			AND p.notification_frequency <> 'OFF'`
+	insertChangeStatement = `INSERT INTO item_change 
+		(external_id, owner_id, actor_id, item_external_id, item_name, change_type, details) 
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	markAlertSentStatement = `UPDATE claim_alert SET sent_on = ? WHERE claim_alert_id = ?`
+	markNotifiedStatement  = `UPDATE person SET last_notified = ? WHERE person_id = ?`
+	pendingAlertsQuery     = `SELECT a.claim_alert_id,
+			COALESCE(p.email, g.email),
+			COALESCE(NULLIF(o.display_name, ''), o.first_name),
+			a.item_name,
+			a.change_type,
+			a.details
+		FROM claim_alert a
+			INNER JOIN person o ON o.person_id = a.owner_id
+			LEFT JOIN person p ON p.person_id = a.person_id
+			LEFT JOIN guest_claim g ON g.guest_claim_id = a.guest_claim_id
+		WHERE a.sent_on IS NULL
+			AND COALESCE(p.email, g.email, '') <> ''
+		ORDER BY a.claim_alert_id`
+	pendingQuery = `SELECT n.notification_id,
+			p.person_id,
+			p.email,
+			p.notification_frequency,
+			p.last_notified,
+			COALESCE(NULLIF(o.display_name, ''), o.first_name),
+			c.item_name,
+			c.change_type,
+			c.details,
+			c.changed_on
+		FROM notification n
+			INNER JOIN person p ON p.person_id = n.person_id
+			INNER JOIN item_change c ON c.change_id = n.change_id
+			INNER JOIN person o ON o.person_id = c.owner_id
+		WHERE n.sent_on IS NULL
+			AND p.notification_frequency <> 'OFF'
+			AND p.email <> ''
+		ORDER BY p.person_id, c.changed_on`
+	setSentStatement = `UPDATE notification SET sent_on = ? WHERE notification_id IN (%s)`
+)
+
+var (
+	// Frequencies lists the valid notification preferences, in the order
+	// they're offered on the profile page
+	Frequencies = []string{Immediate, Daily, Weekly, Off}
+)
+
+// Record saves the change and queues a notification for each household member
+// of the list's owner who wants to hear about it.
+func Record(ctx context.Context, svr *util.ServerUtils, change Change) error {
+
+	changeID := rand.Text()
+	statements := []string{insertChangeStatement, fanOutStatement}
+	params := [][]any{
+		{
+			changeID,
+			change.OwnerID,
+			change.ActorID,
+			change.ItemExternalID,
+			change.ItemName,
+			string(change.Type),
+			change.Details,
+		},
+		{changeID, change.OwnerID, change.OwnerID, change.ActorID},
+	}
+
+	_, errs := svr.DB.ExecuteBatch(ctx, statements, params)
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("error recording the %s change to %s: %v", change.Type, change.ItemExternalID, err)
+		}
+	}
+
+	svr.Logger.DebugContext(ctx,
+		"Recorded list change",
+		slog.String("changeType", string(change.Type)),
+		slog.String("itemID", change.ItemExternalID),
+		slog.Int64("ownerID", change.OwnerID),
+	)
+
+	return nil
+
+}
+
+// AlertClaimers queues an alert for everyone who claimed the changed item.
+// Unlike the household notifications these ignore the notification preference,
+// since the claimer may need to return or re-think the gift.
+func AlertClaimers(ctx context.Context, svr *util.ServerUtils, change Change) error {
+
+	alert := []any{change.OwnerID, change.ItemName, string(change.Type), change.Details, change.ItemExternalID}
+	result, err := svr.DB.Execute(ctx, alertClaimersStatement, append(alert, alert...)...)
+	if err != nil {
+		return fmt.Errorf("error alerting the claimers of %s: %v", change.ItemExternalID, err)
+	}
+
+	if alerted, err := result.RowsAffected(); err == nil && alerted > 0 {
+		svr.Logger.DebugContext(ctx,
+			"Queued claim alerts",
+			slog.String("changeType", string(change.Type)),
+			slog.String("itemID", change.ItemExternalID),
+			slog.Int64("alerted", alerted),
+		)
+	}
+
+	return nil
+
+}
+
+// PendingClaimAlerts returns the claim alerts that haven't been emailed yet.
+func PendingClaimAlerts(ctx context.Context, svr *util.ServerUtils) ([]ClaimAlert, error) {
+
+	rows, err := svr.DB.Query(ctx, pendingAlertsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error querying pending claim alerts: %v", err)
+	}
+	defer rows.Close()
+
+	alerts := []ClaimAlert{}
+	for rows.Next() {
+
+		var alert ClaimAlert
+		err = rows.Scan(&alert.alertID, &alert.Email, &alert.Owner, &alert.ItemName, &alert.Type, &alert.Details)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		alerts = append(alerts, alert)
+
+	}
+
+	return alerts, nil
+
+}
+
+// MarkAlertSent flags the claim alert as emailed (or un-flags it, with a zero
+// time, if the email failed to go out).
+func MarkAlertSent(ctx context.Context, svr *util.ServerUtils, alert ClaimAlert, sentOn time.Time) error {
+
+	var sent any = sentOn
+	if sentOn.IsZero() {
+		sent = nil
+	}
+
+	if _, err := svr.DB.Execute(ctx, markAlertSentStatement, sent, alert.alertID); err != nil {
+		return fmt.Errorf("error marking claim alert %d sent: %v", alert.alertID, err)
+	}
+
+	return nil
+
+}
+
+// DueDigests returns the pending changes for everyone whose notification
+// preference says they're due to hear about them as of now.
+func DueDigests(ctx context.Context, svr *util.ServerUtils, now time.Time) ([]Digest, error) {
+
+	rows, err := svr.DB.Query(ctx, pendingQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error querying pending notifications: %v", err)
+	}
+	defer rows.Close()
+
+	digests := []Digest{}
+	for rows.Next() {
+
+		var (
+			notificationID int64
+			personID       int64
+			email          string
+			frequency      string
+			lastNotified   sql.NullTime
+			summary        ChangeSummary
+			changedOn      time.Time
+		)
+
+		err = rows.Scan(
+			&notificationID,
+			&personID,
+			&email,
+			&frequency,
+			&lastNotified,
+			&summary.Owner,
+			&summary.ItemName,
+			&summary.Type,
+			&summary.Details,
+			&changedOn,
+		)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+
+		if !due(frequency, lastNotified, now) {
+			continue
+		}
+
+		summary.ChangedOn = changedOn.Format(dateFmt)
+		if len(digests) == 0 || digests[len(digests)-1].PersonID != personID {
+			digests = append(digests, Digest{
+				Changes:  []ChangeSummary{},
+				Email:    email,
+				PersonID: personID,
+			})
+		}
+		digest := &digests[len(digests)-1]
+		digest.Changes = append(digest.Changes, summary)
+		digest.notificationIDs = append(digest.notificationIDs, notificationID)
+
+	}
+
+	return digests, nil
+
+}
+
+// MarkSent flags the digest's notifications as sent (or un-sent, with a zero
+// time, if the email failed to go out) and records when the person was last
+// notified.
+func MarkSent(ctx context.Context, svr *util.ServerUtils, digest Digest, sentOn time.Time) error {
+
+	if len(digest.notificationIDs) == 0 {
+		return nil
+	}
+
+	var sent any = sentOn
+	if sentOn.IsZero() {
+		sent = nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(digest.notificationIDs)), ", ")
+	statements := []string{fmt.Sprintf(setSentStatement, placeholders), markNotifiedStatement}
+	params := [][]any{append([]any{sent}, digest.notificationIDs...), {sent, digest.PersonID}}
+
+	_, errs := svr.DB.ExecuteBatch(ctx, statements, params)
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("error marking notifications sent for %d: %v", digest.PersonID, err)
+		}
+	}
+
+	return nil
+
+}
+
+/* Works out if someone with the given preference is due for a digest */
+func due(frequency string, lastNotified sql.NullTime, now time.Time) bool {
+
+	switch frequency {
+
+	case Immediate:
+		return true
+	case Daily:
+		return !lastNotified.Valid || !now.Before(lastNotified.Time.Add(24*time.Hour))
+	case Weekly:
+		return !lastNotified.Valid || !now.Before(lastNotified.Time.Add(7*24*time.Hour))
+	default:
+		return false
+
+	}
+
+}
@@ -0,0 +1,314 @@
+// Package oidc signs people in through an OpenID Connect provider (like
+// Google), for the relatives who'd rather use a password they already
+// remember than wait on an emailed code. It only proves who the provider says
+// signed in, matching them up with a person and starting the session is up to
+// the caller.
+//
+// The flow is the authorization code flow with PKCE. The provider's endpoints
+// come from its discovery document, and ID tokens are checked against its
+// published keys, both cached so a login doesn't fetch them every time.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gift-registry/internal/util"
+)
+
+// Config is the provider people can sign in with, from OIDC_ISSUER,
+// OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_PROVIDER_NAME (what the login
+// button calls it). OIDC_REDIRECT_URL overrides the callback URL, which is
+// otherwise built from APP_BASE_URL.
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	Issuer       string
+	Name         string
+	RedirectURL  string
+}
+
+// Identity is who the provider says signed in
+type Identity struct {
+	Email         string
+	EmailVerified bool
+	Subject       string
+}
+
+type discovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	Issuer                string `json:"issuer"`
+	JWKSURI               string `json:"jwks_uri"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+type tokenResponse struct {
+	Error   string `json:"error"`
+	IDToken string `json:"id_token"`
+}
+
+type cachedDiscovery struct {
+	doc     discovery
+	expires time.Time
+}
+
+const (
+	// CallbackPath is where the provider sends people back to
+	CallbackPath = "/login/oidc/callback"
+
+	defaultName  = "your account provider"
+	discoveryTTL = time.Hour
+	loginTTL     = 5 * time.Minute
+	/* The provider has to answer within this long */
+	requestTimeout = 10 * time.Second
+	scopes         = "openid email profile"
+	wellKnownPath  = "/.well-known/openid-configuration"
+
+	deleteLoginStatement = `DELETE FROM oidc_login WHERE state = ?`
+	insertLoginStatement = `INSERT INTO oidc_login (state, nonce, code_verifier, expiration)
+		VALUES (?, ?, ?, ?)`
+	lookupLoginQuery = `SELECT nonce, code_verifier, expiration FROM oidc_login WHERE state = ?`
+)
+
+var (
+	client = &http.Client{Timeout: requestTimeout}
+
+	discoveryLock  sync.Mutex
+	discoveryCache = map[string]cachedDiscovery{}
+)
+
+// Settings reads the provider configuration from the environment
+func Settings(svr *util.ServerUtils) Config {
+
+	config := Config{
+		ClientID:     svr.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: svr.Getenv("OIDC_CLIENT_SECRET"),
+		Issuer:       strings.TrimSuffix(svr.Getenv("OIDC_ISSUER"), "/"),
+		Name:         svr.Getenv("OIDC_PROVIDER_NAME"),
+		RedirectURL:  svr.Getenv("OIDC_REDIRECT_URL"),
+	}
+	if config.Name == "" {
+		config.Name = defaultName
+	}
+	if config.RedirectURL == "" {
+		config.RedirectURL = util.AppURL(svr, CallbackPath)
+	}
+	return config
+
+}
+
+// Enabled reports whether a provider's been configured
+func (config Config) Enabled() bool {
+	return config.Issuer != "" && config.ClientID != ""
+}
+
+// Start begins a login, returning the provider URL to send the browser to and
+// the state to tie the callback back to this browser. The nonce and PKCE
+// verifier stay on the server, saved under the state's hash.
+func Start(ctx context.Context, svr *util.ServerUtils) (string, string, error) {
+
+	config := Settings(svr)
+	doc, err := lookupDiscovery(ctx, config.Issuer)
+	if err != nil {
+		return "", "", err
+	}
+
+	state := rand.Text()
+	nonce := rand.Text()
+	/* Two rand.Text() values make a verifier inside PKCE's 43-128 characters */
+	verifier := rand.Text() + rand.Text()
+
+	expires := time.Now().Add(loginTTL).UTC()
+	if _, err = svr.DB.Execute(ctx, insertLoginStatement, util.HashSecret(svr, state), nonce, verifier, expires); err != nil {
+		return "", "", fmt.Errorf("error saving the login state: %v", err)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"client_id":             {config.ClientID},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		"nonce":                 {nonce},
+		"redirect_uri":          {config.RedirectURL},
+		"response_type":         {"code"},
+		"scope":                 {scopes},
+		"state":                 {state},
+	}
+
+	separator := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return doc.AuthorizationEndpoint + separator + query.Encode(), state, nil
+
+}
+
+// Finish completes a login when the provider sends the browser back, trading
+// the code for an ID token and checking it. The state can only be used once.
+func Finish(ctx context.Context, svr *util.ServerUtils, state string, code string) (Identity, error) {
+
+	config := Settings(svr)
+	nonce, verifier, err := consumeLogin(ctx, svr, state)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	doc, err := lookupDiscovery(ctx, config.Issuer)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	idToken, err := exchangeCode(ctx, config, doc, config.RedirectURL, code, verifier)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	claims, err := verifyIDToken(ctx, doc, config.ClientID, idToken, time.Now())
+	if err != nil {
+		return Identity{}, err
+	}
+	if claims.Nonce != nonce {
+		return Identity{}, errors.New("ID token is for a different login")
+	}
+
+	return Identity{
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Subject:       claims.Subject,
+	}, nil
+
+}
+
+/*
+Uses up the saved login, returning its nonce and PKCE verifier. Like passkey
+challenges, whoever deletes the row first gets to use it.
+*/
+func consumeLogin(ctx context.Context, svr *util.ServerUtils, state string) (string, string, error) {
+
+	var (
+		nonce      string
+		verifier   string
+		expiration time.Time
+	)
+	stateHash := util.HashSecret(svr, state)
+	if err := svr.DB.QueryRow(ctx, lookupLoginQuery, stateHash).Scan(&nonce, &verifier, &expiration); err != nil {
+		return "", "", fmt.Errorf("unknown login state: %v", err)
+	}
+
+	res, err := svr.DB.Execute(ctx, deleteLoginStatement, stateHash)
+	if err != nil {
+		return "", "", fmt.Errorf("error deleting the login state: %v", err)
+	} else if deleted, err := res.RowsAffected(); err != nil || deleted != 1 {
+		return "", "", errors.New("login state was already used")
+	}
+
+	if expiration.Before(time.Now().UTC()) {
+		return "", "", errors.New("login took too long")
+	}
+
+	return nonce, verifier, nil
+
+}
+
+func exchangeCode(
+	ctx context.Context,
+	config Config,
+	doc discovery,
+	redirect string,
+	code string,
+	verifier string,
+) (string, error) {
+
+	form := url.Values{
+		"code":          {code},
+		"code_verifier": {verifier},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {redirect},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("error building the token request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+
+	var token tokenResponse
+	if err = fetchJSON(req, &token); err != nil {
+		return "", fmt.Errorf("error exchanging the code: %v", err)
+	} else if token.Error != "" {
+		return "", fmt.Errorf("provider refused the code: %s", token.Error)
+	} else if token.IDToken == "" {
+		return "", errors.New("provider didn't return an ID token")
+	}
+	return token.IDToken, nil
+
+}
+
+/* Decodes a JSON response, treating anything but a 200 as a failure */
+func fetchJSON(req *http.Request, target any) error {
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		/* Token errors come back as a 400 with an error code in the body */
+		if json.Unmarshal(body, target) == nil {
+			return nil
+		}
+		return fmt.Errorf("%s returned %d", req.URL.Host, res.StatusCode)
+	}
+	return json.Unmarshal(body, target)
+
+}
+
+/* Fetches the provider's discovery document, or uses the cached copy */
+func lookupDiscovery(ctx context.Context, issuer string) (discovery, error) {
+
+	discoveryLock.Lock()
+	cached, found := discoveryCache[issuer]
+	discoveryLock.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.doc, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", issuer+wellKnownPath, nil)
+	if err != nil {
+		return discovery{}, fmt.Errorf("error building the discovery request: %v", err)
+	}
+
+	var doc discovery
+	if err = fetchJSON(req, &doc); err != nil {
+		return discovery{}, fmt.Errorf("error reading the discovery document: %v", err)
+	}
+	/* The document has to be for the issuer it was fetched from */
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return discovery{}, fmt.Errorf("discovery document is for %s instead of %s", doc.Issuer, issuer)
+	} else if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return discovery{}, errors.New("discovery document is missing endpoints")
+	}
+
+	discoveryLock.Lock()
+	discoveryCache[issuer] = cachedDiscovery{doc: doc, expires: time.Now().Add(discoveryTTL)}
+	discoveryLock.Unlock()
+	return doc, nil
+
+}
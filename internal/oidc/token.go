@@ -0,0 +1,338 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The ID token checks the app needs, without pulling in a JWT library. Only the
+two algorithms providers actually use are accepted, so there's no way to talk
+the app into "none" or an HMAC keyed with a public key.
+*/
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type idClaims struct {
+	Audience      audience     `json:"aud"`
+	AuthorizedBy  string       `json:"azp"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Expires       int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Issuer        string       `json:"iss"`
+	Nonce         string       `json:"nonce"`
+	Subject       string       `json:"sub"`
+}
+
+/* "aud" is either a single client ID or a list of them */
+type audience []string
+
+/* Some providers send email_verified as the string "true" */
+type flexibleBool bool
+
+type jsonWebKey struct {
+	Curve     string `json:"crv"`
+	Exponent  string `json:"e"`
+	KeyID     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Modulus   string `json:"n"`
+	Use       string `json:"use"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	algorithm string
+	publicKey crypto.PublicKey
+}
+
+type cachedKeys struct {
+	expires time.Time
+	fetched time.Time
+	keys    []jsonWebKey
+}
+
+const (
+	algES256 = "ES256"
+	algRS256 = "RS256"
+	/* Allowance for the provider's clock being a little off from ours */
+	clockSkew = time.Minute
+	keysTTL   = time.Hour
+	/*
+		An unknown key ID usually means the provider rotated its keys, but don't
+		let a stream of made-up key IDs hammer the provider
+	*/
+	minKeyRefresh = time.Minute
+)
+
+var (
+	keysLock  sync.Mutex
+	keysCache = map[string]cachedKeys{}
+)
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*aud = list
+	return nil
+
+}
+
+func (flag *flexibleBool) UnmarshalJSON(data []byte) error {
+
+	var value bool
+	if err := json.Unmarshal(data, &value); err == nil {
+		*flag = flexibleBool(value)
+		return nil
+	}
+
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	*flag = flexibleBool(strings.EqualFold(text, "true"))
+	return nil
+
+}
+
+/*
+Checks the ID token's signature against the provider's published keys, and
+that it was issued by the provider, to this app, and hasn't expired. The nonce
+is left to the caller, it's the one that knows which login this is.
+*/
+func verifyIDToken(ctx context.Context, doc discovery, clientID string, token string, now time.Time) (idClaims, error) {
+
+	claims := idClaims{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("ID token isn't a JWT")
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, fmt.Errorf("error reading the ID token header: %v", err)
+	}
+	if header.Algorithm != algRS256 && header.Algorithm != algES256 {
+		return claims, fmt.Errorf("ID token is signed with an unsupported algorithm %q", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("error decoding the ID token signature: %v", err)
+	}
+
+	key, err := signingKey(ctx, doc.JWKSURI, header)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = verifySignature(key, header.Algorithm, digest[:], signature); err != nil {
+		return claims, err
+	}
+
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("error reading the ID token claims: %v", err)
+	}
+
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(doc.Issuer, "/"):
+		return claims, fmt.Errorf("ID token was issued by %s instead of %s", claims.Issuer, doc.Issuer)
+	case !slices.Contains(claims.Audience, clientID):
+		return claims, errors.New("ID token is for a different app")
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != clientID:
+		return claims, errors.New("ID token was issued to a different app")
+	case claims.Expires == 0 || now.After(time.Unix(claims.Expires, 0).Add(clockSkew)):
+		return claims, errors.New("ID token has expired")
+	case claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return claims, errors.New("ID token was issued in the future")
+	case claims.Subject == "":
+		return claims, errors.New("ID token doesn't say who signed in")
+	}
+
+	return claims, nil
+
+}
+
+func decodeSegment(segment string, target any) error {
+
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+
+}
+
+/* Fetches the provider's key set, or uses the cached copy */
+func lookupKeys(ctx context.Context, jwksURI string, refresh bool) ([]jsonWebKey, error) {
+
+	now := time.Now()
+	keysLock.Lock()
+	cached, found := keysCache[jwksURI]
+	keysLock.Unlock()
+	if found && now.Before(cached.expires) && (!refresh || now.Sub(cached.fetched) < minKeyRefresh) {
+		return cached.keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", jwksURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building the key set request: %v", err)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = fetchJSON(req, &set); err != nil {
+		return nil, fmt.Errorf("error reading the provider's keys: %v", err)
+	}
+
+	keys := []jsonWebKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if parseKey(&key) == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	keysLock.Lock()
+	keysCache[jwksURI] = cachedKeys{expires: now.Add(keysTTL), fetched: now, keys: keys}
+	keysLock.Unlock()
+	return keys, nil
+
+}
+
+/* Turns the JWK into a public key, skipping types that can't be verified */
+func parseKey(key *jsonWebKey) error {
+
+	switch key.KeyType {
+
+	case "RSA":
+		modulus, err := base64.RawURLEncoding.DecodeString(key.Modulus)
+		if err != nil {
+			return err
+		}
+		exponent, err := base64.RawURLEncoding.DecodeString(key.Exponent)
+		if err != nil {
+			return err
+		}
+		key.algorithm = algRS256
+		key.publicKey = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}
+		return nil
+
+	case "EC":
+		if key.Curve != "P-256" {
+			return fmt.Errorf("unsupported curve %s", key.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return err
+		}
+		key.algorithm = algES256
+		key.publicKey = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported key type %s", key.KeyType)
+
+	}
+
+}
+
+/*
+Finds the key the token was signed with. A key ID that isn't in the cached set
+gets one fresh look at the provider's keys, in case they've been rotated.
+*/
+func signingKey(ctx context.Context, jwksURI string, header tokenHeader) (crypto.PublicKey, error) {
+
+	for _, refresh := range []bool{false, true} {
+
+		keys, err := lookupKeys(ctx, jwksURI, refresh)
+		if err != nil {
+			return nil, err
+		}
+
+		matches := []jsonWebKey{}
+		for _, key := range keys {
+			if key.algorithm == header.Algorithm && (header.KeyID == "" || key.KeyID == header.KeyID) {
+				matches = append(matches, key)
+			}
+		}
+		/* Without a key ID, there has to be only the one key it could be */
+		if len(matches) == 1 || (header.KeyID != "" && len(matches) > 0) {
+			return matches[0].publicKey, nil
+		}
+
+	}
+
+	return nil, fmt.Errorf("no provider key matches key ID %q", header.KeyID)
+
+}
+
+func verifySignature(key crypto.PublicKey, algorithm string, digest []byte, signature []byte) error {
+
+	switch pub := key.(type) {
+
+	case *rsa.PublicKey:
+		if algorithm != algRS256 {
+			return errors.New("key doesn't match the token's algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature); err != nil {
+			return errors.New("ID token signature doesn't match")
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		/* JWS ECDSA signatures are r and s back to back, not ASN.1 */
+		if algorithm != algES256 || len(signature) != 64 {
+			return errors.New("ID token signature is malformed")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("ID token signature doesn't match")
+		}
+		return nil
+
+	default:
+		return errors.New("unsupported key type")
+
+	}
+
+}
@@ -0,0 +1,565 @@
+// Package passkey lets people sign in with a passkey (a WebAuthn credential
+// kept by their device or password manager) instead of waiting on an emailed
+// code. Passkeys are added, listed and revoked from the profile page.
+package passkey
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type passkeyList struct {
+	ErrorMessage string
+	Passkeys     []passkeyRow
+}
+
+type passkeyRow struct {
+	CreatedOn  string
+	ExternalID string
+	LastUsedOn string
+	Name       string
+}
+
+/*
+The options handed to navigator.credentials.create() and .get(). Binary
+values are base64url strings, the page's script decodes them.
+*/
+type creationOptions struct {
+	Attestation            string                 `json:"attestation"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Challenge              string                 `json:"challenge"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	RP                     relyingParty           `json:"rp"`
+	Timeout                int64                  `json:"timeout"`
+	User                   userEntity             `json:"user"`
+}
+
+type requestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	Timeout          int64  `json:"timeout"`
+	UserVerification string `json:"userVerification"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+type credentialDescriptor struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type credentialParameter struct {
+	Alg  int    `json:"alg"`
+	Type string `json:"type"`
+}
+
+type relyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	DisplayName string `json:"displayName"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+}
+
+const (
+	credentialLookupQuery = `SELECT pk.person_id, pk.public_key, pk.algorithm, pk.sign_count, p.email
+		FROM passkey pk
+			INNER JOIN person p ON p.person_id = pk.person_id
+		WHERE pk.credential_id = ?
+			AND p.deleted_on IS NULL
+			AND p.disabled_on IS NULL`
+	credentialsQuery       = `SELECT credential_id FROM passkey WHERE person_id = ?`
+	dateFmt                = "January 2, 2006"
+	deletePasskeyStatement = `DELETE FROM passkey WHERE external_id = ? AND person_id = ?`
+	insertPasskeyStatement = `INSERT INTO passkey (external_id, person_id, credential_id, public_key, algorithm, sign_count, name)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	maxNameLength = 255
+	passkeysQuery = `SELECT external_id, name, created_on, last_used_on
+		FROM passkey
+		WHERE person_id = ?
+		ORDER BY created_on, passkey_id`
+	publicKeyType          = "public-key"
+	registrantQuery        = `SELECT external_id, email, first_name, last_name FROM person WHERE person_id = ?`
+	rpName                 = "Family gift registry"
+	updateUsageStatement   = `UPDATE passkey SET sign_count = ?, last_used_on = ? WHERE credential_id = ?`
+	userVerificationPolicy = "required"
+)
+
+// ListHandler shows the logged-in person the passkeys they've added, with the
+// form for adding another.
+func ListHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("passkey_list")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		writePasskeys(ctx, svr, res, personID, "")
+
+	})
+
+}
+
+// RegisterOptionsHandler starts adding a passkey, returning the options for
+// the browser's navigator.credentials.create() call as JSON.
+func RegisterOptionsHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("passkey_register_options")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		var externalID, email, firstName, lastName string
+		err := svr.DB.QueryRow(ctx, registrantQuery, personID).Scan(&externalID, &email, &firstName, &lastName)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the person adding a passkey",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error starting to add a passkey"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		challenge, err := newChallenge(ctx, svr, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error creating a passkey challenge",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error starting to add a passkey"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		rpID, _ := RelyingParty(svr)
+		options := creationOptions{
+			Attestation: "none",
+			AuthenticatorSelection: authenticatorSelection{
+				ResidentKey:      "required",
+				UserVerification: userVerificationPolicy,
+			},
+			Challenge:          challenge,
+			ExcludeCredentials: []credentialDescriptor{},
+			PubKeyCredParams:   []credentialParameter{},
+			RP:                 relyingParty{ID: rpID, Name: rpName},
+			Timeout:            challengeLifetime.Milliseconds(),
+			User: userEntity{
+				DisplayName: firstName + " " + lastName,
+				ID:          encode([]byte(externalID)),
+				Name:        email,
+			},
+		}
+		for _, alg := range supportedAlgorithms {
+			options.PubKeyCredParams = append(options.PubKeyCredParams, credentialParameter{Alg: alg, Type: publicKeyType})
+		}
+
+		/* Stop the browser from registering the same authenticator twice */
+		rows, err := svr.DB.Query(ctx, credentialsQuery, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error looking up the existing passkeys", slog.String("errorMessage", err.Error()))
+		} else {
+
+			defer rows.Close()
+			for rows.Next() {
+
+				var credentialID string
+				if err := rows.Scan(&credentialID); err != nil {
+					svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+					continue
+				}
+				options.ExcludeCredentials = append(options.ExcludeCredentials, credentialDescriptor{ID: credentialID, Type: publicKeyType})
+
+			}
+
+		}
+
+		writeJSON(ctx, svr, res, options)
+
+	})
+
+}
+
+// RegisterHandler finishes adding a passkey, checking the browser's response
+// to the challenge and saving the credential's public key.
+func RegisterHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("passkey_register")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		name := strings.TrimSpace(req.PostFormValue("name"))
+		if name == "" || len(name) > maxNameLength {
+			span.SetAttributes(attribute.String("error_message", "invalid passkey name"))
+			writePasskeys(ctx, svr, res, personID, fmt.Sprintf("Give the passkey a name (up to %d characters) so you can tell it apart later.", maxNameLength))
+			return
+		}
+
+		credentialID, publicKey, algorithm, signCount, err := verifyRegistration(ctx, svr, req, personID)
+		if err != nil {
+			svr.Logger.WarnContext(
+				ctx,
+				"Passkey registration failed verification",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writePasskeys(ctx, svr, res, personID, "Could not add that passkey, please try again.")
+			return
+		}
+
+		externalID := rand.Text()
+		_, err = svr.DB.Execute(ctx, insertPasskeyStatement, externalID, personID, credentialID, encode(publicKey), algorithm, signCount, name)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error saving the passkey",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writePasskeys(ctx, svr, res, personID, "Could not save the passkey.")
+			return
+		}
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Create,
+			After:    map[string]string{"name": name},
+			Entity:   audit.Passkey,
+			EntityID: externalID,
+		})
+
+		writePasskeys(ctx, svr, res, personID, "")
+
+	})
+
+}
+
+// RevokeHandler deletes one of the logged-in person's passkeys, so it can't be
+// used to sign in anymore.
+func RevokeHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("passkey_revoke")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("passkey_external_id", externalID),
+		)
+
+		errorMessage := ""
+		if result, err := svr.DB.Execute(ctx, deletePasskeyStatement, externalID, personID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error deleting the passkey",
+				slog.String("errorMessage", err.Error()),
+			)
+			errorMessage = "Could not remove the passkey."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		} else if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+			audit.Record(ctx, svr, personID, audit.Event{
+				Action:   audit.Revoke,
+				Entity:   audit.Passkey,
+				EntityID: externalID,
+			})
+		}
+
+		writePasskeys(ctx, svr, res, personID, errorMessage)
+
+	})
+
+}
+
+// LoginOptionsHandler starts a passkey sign-in, returning the options for the
+// browser's navigator.credentials.get() call as JSON. No credentials are
+// listed, so the browser offers whichever passkeys it has for the site.
+func LoginOptionsHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("passkey_login_options")
+
+		challenge, err := newChallenge(ctx, svr, 0)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error creating a passkey challenge",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error starting passkey sign-in"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		rpID, _ := RelyingParty(svr)
+		writeJSON(ctx, svr, res, requestOptions{
+			Challenge:        challenge,
+			RPID:             rpID,
+			Timeout:          challengeLifetime.Milliseconds(),
+			UserVerification: userVerificationPolicy,
+		})
+
+	})
+
+}
+
+// Authenticate checks the browser's passkey sign-in response, returning the
+// person it belongs to (and their email address). Starting the session is left
+// to the caller, so passkey and emailed code sign-ins share the same path.
+func Authenticate(ctx context.Context, svr *util.ServerUtils, req *http.Request) (int64, string, error) {
+
+	credentialID := req.PostFormValue("credentialId")
+	clientDataJSON, err := decode(req.PostFormValue("clientDataJSON"))
+	if err != nil {
+		return 0, "", fmt.Errorf("error decoding the client data: %v", err)
+	}
+	authData, err := decode(req.PostFormValue("authenticatorData"))
+	if err != nil {
+		return 0, "", fmt.Errorf("error decoding the authenticator data: %v", err)
+	}
+	signature, err := decode(req.PostFormValue("signature"))
+	if err != nil {
+		return 0, "", fmt.Errorf("error decoding the signature: %v", err)
+	}
+
+	rpID, origin := RelyingParty(svr)
+	client, err := parseClientData(clientDataJSON, getCeremony, origin)
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err = consumeChallenge(ctx, svr, client.Challenge); err != nil {
+		return 0, "", err
+	}
+
+	authenticator, err := parseAuthenticatorData(authData, rpID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var (
+		personID  int64
+		encoded   string
+		algorithm int
+		signCount int64
+		email     string
+	)
+	err = svr.DB.QueryRow(ctx, credentialLookupQuery, credentialID).Scan(&personID, &encoded, &algorithm, &signCount, &email)
+	if err == sql.ErrNoRows {
+		return 0, "", errors.New("unknown passkey")
+	} else if err != nil {
+		return 0, "", fmt.Errorf("error looking up the passkey: %v", err)
+	}
+
+	publicKeyDER, err := decode(encoded)
+	if err != nil {
+		return 0, "", fmt.Errorf("error decoding the stored public key: %v", err)
+	}
+	publicKey, err := parsePublicKey(publicKeyDER, algorithm)
+	if err != nil {
+		return 0, "", err
+	}
+	if err = verifySignature(publicKey, authData, clientDataJSON, signature); err != nil {
+		return 0, "", err
+	}
+
+	/*
+		Authenticators that keep a signature counter never send the same value
+		twice, so one going backwards means the passkey may have been cloned.
+		Synced passkeys always send 0.
+	*/
+	if authenticator.signCount != 0 && int64(authenticator.signCount) <= signCount {
+		return 0, "", fmt.Errorf("signature counter went from %d to %d", signCount, authenticator.signCount)
+	}
+
+	if _, err = svr.DB.Execute(ctx, updateUsageStatement, authenticator.signCount, time.Now().UTC(), credentialID); err != nil {
+		/* Not failing the sign-in over this, the passkey itself checked out */
+		svr.Logger.ErrorContext(ctx, "Error recording the passkey use", slog.String("errorMessage", err.Error()))
+	}
+
+	return personID, email, nil
+
+}
+
+/*
+Checks the browser's response to a registration challenge, returning the
+credential ID, public key, algorithm and signature counter to save.
+*/
+func verifyRegistration(ctx context.Context, svr *util.ServerUtils, req *http.Request, personID int64) (string, []byte, int, uint32, error) {
+
+	credentialID := req.PostFormValue("credentialId")
+	rawCredentialID, err := decode(credentialID)
+	if err != nil || len(rawCredentialID) == 0 {
+		return "", nil, 0, 0, fmt.Errorf("invalid credential ID %q", credentialID)
+	}
+	clientDataJSON, err := decode(req.PostFormValue("clientDataJSON"))
+	if err != nil {
+		return "", nil, 0, 0, fmt.Errorf("error decoding the client data: %v", err)
+	}
+	authData, err := decode(req.PostFormValue("authenticatorData"))
+	if err != nil {
+		return "", nil, 0, 0, fmt.Errorf("error decoding the authenticator data: %v", err)
+	}
+	publicKey, err := decode(req.PostFormValue("publicKey"))
+	if err != nil {
+		return "", nil, 0, 0, fmt.Errorf("error decoding the public key: %v", err)
+	}
+	algorithm, err := strconv.Atoi(req.PostFormValue("publicKeyAlgorithm"))
+	if err != nil {
+		return "", nil, 0, 0, fmt.Errorf("invalid public key algorithm: %v", err)
+	}
+
+	rpID, origin := RelyingParty(svr)
+	client, err := parseClientData(clientDataJSON, createCeremony, origin)
+	if err != nil {
+		return "", nil, 0, 0, err
+	}
+
+	/* The challenge has to be one issued to this person */
+	owner, err := consumeChallenge(ctx, svr, client.Challenge)
+	if err != nil {
+		return "", nil, 0, 0, err
+	} else if owner != personID {
+		return "", nil, 0, 0, errors.New("challenge was issued to someone else")
+	}
+
+	authenticator, err := parseAuthenticatorData(authData, rpID)
+	if err != nil {
+		return "", nil, 0, 0, err
+	} else if authenticator.flags&flagAttestedData == 0 {
+		return "", nil, 0, 0, errors.New("registration is missing the attested credential")
+	} else if !bytes.Equal(authenticator.credentialID, rawCredentialID) {
+		return "", nil, 0, 0, errors.New("credential ID doesn't match the authenticator data")
+	}
+
+	if _, err = parsePublicKey(publicKey, algorithm); err != nil {
+		return "", nil, 0, 0, err
+	}
+
+	return credentialID, publicKey, algorithm, authenticator.signCount, nil
+
+}
+
+func writeJSON(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, body any) {
+
+	span := trace.SpanFromContext(ctx)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	if err := json.NewEncoder(res).Encode(body); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing the passkey options",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
+
+func writePasskeys(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, personID int64, errorMessage string) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/passkeys.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the passkeys template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your passkeys"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	list := passkeyList{
+		ErrorMessage: errorMessage,
+		Passkeys:     []passkeyRow{},
+	}
+
+	rows, err := svr.DB.Query(ctx, passkeysQuery, personID)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the passkeys", slog.String("errorMessage", err.Error()))
+		list.ErrorMessage = "Could not look up your passkeys."
+	} else {
+
+		defer rows.Close()
+		for rows.Next() {
+
+			var (
+				row        passkeyRow
+				createdOn  sql.NullTime
+				lastUsedOn sql.NullTime
+			)
+			if err := rows.Scan(&row.ExternalID, &row.Name, &createdOn, &lastUsedOn); err != nil {
+				svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+				continue
+			}
+			row.CreatedOn = createdOn.Time.Format(dateFmt)
+			if lastUsedOn.Valid {
+				row.LastUsedOn = lastUsedOn.Time.Format(dateFmt)
+			}
+			list.Passkeys = append(list.Passkeys, row)
+
+		}
+
+	}
+	span.SetAttributes(attribute.Int("passkey_count", len(list.Passkeys)))
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "passkeys", list); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
@@ -0,0 +1,340 @@
+package passkey_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+)
+
+/* Stands in for the browser and authenticator in a passkey ceremony */
+type authenticator struct {
+	credentialID []byte
+	key          *ecdsa.PrivateKey
+	signCount    uint32
+	unverified   bool
+}
+
+type options struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID string `json:"id"`
+	} `json:"rp"`
+	RPID string `json:"rpId"`
+}
+
+// TestRegister adds passkeys with good and bad browser responses and checks
+// only the good ones get saved.
+func TestRegister(t *testing.T) {
+	testData := []struct {
+		expectedSaved bool
+		name          string
+		origin        string
+		testName      string
+	}{
+		{
+			expectedSaved: true,
+			name:          "Work laptop",
+			testName:      "Valid registration",
+		},
+		{
+			expectedSaved: false,
+			name:          "Phishing site",
+			origin:        "https://evil.localhost",
+			testName:      "Wrong origin",
+		},
+		{
+			expectedSaved: false,
+			name:          " ",
+			testName:      "Missing name",
+		},
+	}
+
+	for index, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			externalID := "passkey-register-" + strconv.Itoa(index)
+			token, err := test.CreateSession(ctx, logger, db, test.UserData{
+				Email:      externalID + "@localhost.com",
+				ExternalID: externalID,
+				FirstName:  "Passkey",
+				LastName:   "Register",
+			}, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session", err)
+			}
+
+			origin := data.origin
+			if origin == "" {
+				origin = "https://gift-registry.localhost"
+			}
+			register(t, token, data.name, origin)
+
+			var saved int
+			err = db.QueryRow(ctx, "SELECT COUNT(*) FROM passkey pk INNER JOIN person p ON p.person_id = pk.person_id WHERE p.external_id = ?", externalID).Scan(&saved)
+			if err != nil {
+				t.Fatal("Error counting the saved passkeys", err)
+			} else if (saved == 1) != data.expectedSaved {
+				t.Fatal("Expected the passkey to be saved", data.expectedSaved, "but found", saved)
+			}
+		})
+	}
+}
+
+// TestPasskeyLogin signs in with a registered passkey and checks that only a
+// properly signed, fresh response for a passkey that still exists starts a
+// session.
+func TestPasskeyLogin(t *testing.T) {
+	testData := []struct {
+		expectedSession bool
+		replay          bool
+		revoke          bool
+		tamper          bool
+		testName        string
+		unverified      bool
+	}{
+		{
+			expectedSession: true,
+			testName:        "Valid passkey",
+		},
+		{
+			expectedSession: false,
+			replay:          true,
+			testName:        "Replayed response",
+		},
+		{
+			expectedSession: false,
+			tamper:          true,
+			testName:        "Bad signature",
+		},
+		{
+			expectedSession: false,
+			revoke:          true,
+			testName:        "Revoked passkey",
+		},
+		{
+			expectedSession: false,
+			testName:        "No user verification",
+			unverified:      true,
+		},
+	}
+
+	for index, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			externalID := "passkey-login-" + strconv.Itoa(index)
+			token, err := test.CreateSession(ctx, logger, db, test.UserData{
+				Email:      externalID + "@localhost.com",
+				ExternalID: externalID,
+				FirstName:  "Passkey",
+				LastName:   "Login",
+			}, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session", err)
+			}
+
+			auth := register(t, token, "Phone", "https://gift-registry.localhost")
+
+			if data.revoke {
+				var passkeyID string
+				err = db.QueryRow(ctx, "SELECT pk.external_id FROM passkey pk INNER JOIN person p ON p.person_id = pk.person_id WHERE p.external_id = ?", externalID).Scan(&passkeyID)
+				if err != nil {
+					t.Fatal("Error looking up the passkey to revoke", err)
+				}
+				res := post(t, token, "/profile/passkeys/"+passkeyID+"/revoke", nil)
+				_ = res.Body.Close()
+			}
+
+			loginOptions := options{}
+			res := post(t, "", "/login/passkey/options", nil)
+			if err = json.NewDecoder(res.Body).Decode(&loginOptions); err != nil {
+				t.Fatal("Error reading the sign-in options", err)
+			}
+			_ = res.Body.Close()
+
+			auth.signCount++
+			auth.unverified = data.unverified
+			clientData := clientDataJSON(t, "webauthn.get", loginOptions.Challenge, "https://gift-registry.localhost")
+			authData := auth.authenticatorData(loginOptions.RPID, false)
+			digest := sha256.Sum256(slices.Concat(authData, sha256Bytes(clientData)))
+			signature, err := ecdsa.SignASN1(rand.Reader, auth.key, digest[:])
+			if err != nil {
+				t.Fatal("Error signing the sign-in challenge", err)
+			}
+			if data.tamper {
+				signature[len(signature)-1] ^= 0xff
+			}
+
+			form := url.Values{
+				"authenticatorData": {encode(authData)},
+				"clientDataJSON":    {encode(clientData)},
+				"credentialId":      {encode(auth.credentialID)},
+				"signature":         {encode(signature)},
+			}
+			if data.replay {
+				res = post(t, "", "/login/passkey", form)
+				_ = res.Body.Close()
+			}
+			res = post(t, "", "/login/passkey", form)
+			defer res.Body.Close()
+
+			sessionStarted := false
+			for _, cookie := range res.Cookies() {
+				if cookie.Name == middleware.SessionCookie && cookie.Value != "" {
+					sessionStarted = true
+				}
+			}
+
+			if sessionStarted != data.expectedSession {
+				t.Fatal("Expected a session to be started", data.expectedSession, "but got", sessionStarted)
+			} else if sessionStarted && res.Header.Get("HX-Redirect") != "/registry" {
+				t.Fatal("Expected to be sent to the registry but got", res.Header.Get("HX-Redirect"))
+			}
+		})
+	}
+}
+
+/* Goes through adding a passkey for the logged-in person */
+func register(t *testing.T, token string, name string, origin string) authenticator {
+
+	auth := authenticator{credentialID: make([]byte, 16)}
+	if _, err := rand.Read(auth.credentialID); err != nil {
+		t.Fatal("Error generating a credential ID", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating a passkey", err)
+	}
+	auth.key = key
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal("Error encoding the public key", err)
+	}
+
+	createOptions := options{}
+	res := post(t, token, "/profile/passkeys/options", nil)
+	if err = json.NewDecoder(res.Body).Decode(&createOptions); err != nil {
+		t.Fatal("Error reading the registration options", err)
+	}
+	_ = res.Body.Close()
+
+	res = post(t, token, "/profile/passkeys", url.Values{
+		"authenticatorData":  {encode(auth.authenticatorData(createOptions.RP.ID, true))},
+		"clientDataJSON":     {encode(clientDataJSON(t, "webauthn.create", createOptions.Challenge, origin))},
+		"credentialId":       {encode(auth.credentialID)},
+		"name":               {name},
+		"publicKey":          {encode(publicKey)},
+		"publicKeyAlgorithm": {"-7"},
+	})
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		t.Fatal("Registration returned", res.StatusCode, string(body))
+	}
+
+	return auth
+
+}
+
+/*
+Builds the authenticator data, with the attested credential when registering.
+The COSE public key that would follow the credential ID isn't read by the
+server, so it's left off.
+*/
+func (auth authenticator) authenticatorData(rpID string, attested bool) []byte {
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(0x01 | 0x04)
+	if auth.unverified {
+		flags = 0x01
+	}
+	if attested {
+		flags |= 0x40
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, auth.signCount)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(auth.credentialID)))
+		data = append(data, auth.credentialID...)
+	}
+
+	return data
+
+}
+
+func clientDataJSON(t *testing.T, ceremony string, challenge string, origin string) []byte {
+
+	data, err := json.Marshal(map[string]string{
+		"challenge": challenge,
+		"origin":    origin,
+		"type":      ceremony,
+	})
+	if err != nil {
+		t.Fatal("Error building the client data", err)
+	}
+	return data
+
+}
+
+func encode(value []byte) string {
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+func sha256Bytes(value []byte) []byte {
+	hash := sha256.Sum256(value)
+	return hash[:]
+}
+
+/* Posts the form the way the page's script does, logged in if there's a token */
+func post(t *testing.T, token string, path string, form url.Values) *http.Response {
+
+	req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal("Error building the request", err)
+	}
+
+	if token != "" {
+		req.AddCookie(&http.Cookie{
+			HttpOnly: true,
+			Name:     middleware.SessionCookie,
+			SameSite: http.SameSiteStrictMode,
+			Secure:   true,
+			Value:    token,
+		})
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error posting to", path, err)
+	}
+	return res
+
+}
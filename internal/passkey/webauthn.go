@@ -0,0 +1,283 @@
+package passkey
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"gift-registry/internal/util"
+)
+
+/*
+The WebAuthn checks the app needs, without pulling in a library for them.
+Passkeys are registered with "none" attestation, so there's no attestation
+statement to verify, and the browser hands over the public key already in
+SPKI form (AuthenticatorAttestationResponse.getPublicKey()), so there's no
+CBOR to decode either.
+*/
+
+type clientData struct {
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+	Type      string `json:"type"`
+}
+
+type authenticatorData struct {
+	credentialID []byte
+	flags        byte
+	signCount    uint32
+}
+
+const (
+	/* COSE identifiers for the key types that can be verified */
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+
+	/* Authenticator data flags */
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+
+	/* rpIdHash (32 bytes), flags (1) and the signature counter (4) */
+	authDataMinLength = 37
+	/* Then, when there's attested data, the AAGUID (16) and credential ID length (2) */
+	credentialIDOffset = 55
+
+	challengeLifetime = 5 * time.Minute
+	createCeremony    = "webauthn.create"
+	getCeremony       = "webauthn.get"
+
+	deleteChallengeStatement = `DELETE FROM passkey_challenge WHERE challenge = ?`
+	insertChallengeStatement = `INSERT INTO passkey_challenge (challenge, person_id, expiration)
+		VALUES (?, ?, ?)`
+	lookupChallengeQuery = `SELECT person_id, expiration FROM passkey_challenge WHERE challenge = ?`
+)
+
+var (
+	/* The algorithms offered to the browser when registering, in preference order */
+	supportedAlgorithms = []int{algES256, algEdDSA, algRS256}
+)
+
+// RelyingParty returns the WebAuthn relying party ID (the host name from
+// APP_BASE_URL, unless WEBAUTHN_RP_ID says otherwise) and the origin browsers
+// will report for it. Neither comes from the request, since the client
+// controls its Host header.
+func RelyingParty(svr *util.ServerUtils) (string, string) {
+
+	base, err := url.Parse(svr.Getenv("APP_BASE_URL"))
+	if err != nil {
+		return svr.Getenv("WEBAUTHN_RP_ID"), ""
+	}
+
+	origin := base.Scheme + "://" + base.Host
+	if rpID := svr.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+		return rpID, origin
+	}
+	return base.Hostname(), origin
+
+}
+
+/*
+Saves a new single-use challenge. Registration challenges belong to the
+person adding the passkey, sign-in challenges (personID 0) don't belong to
+anyone yet.
+*/
+func newChallenge(ctx context.Context, svr *util.ServerUtils, personID int64) (string, error) {
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("error generating a challenge: %v", err)
+	}
+	challenge := encode(raw)
+
+	var person any
+	if personID != 0 {
+		person = personID
+	}
+
+	expires := time.Now().Add(challengeLifetime).UTC()
+	if _, err := svr.DB.Execute(ctx, insertChallengeStatement, challenge, person, expires); err != nil {
+		return "", fmt.Errorf("error saving the challenge: %v", err)
+	}
+
+	return challenge, nil
+
+}
+
+/*
+Uses up the challenge, returning who it was issued to. Whoever deletes the
+row first gets to use it, so a challenge can't be replayed even by two
+requests racing each other.
+*/
+func consumeChallenge(ctx context.Context, svr *util.ServerUtils, challenge string) (int64, error) {
+
+	var (
+		personID   sql.NullInt64
+		expiration time.Time
+	)
+	err := svr.DB.QueryRow(ctx, lookupChallengeQuery, challenge).Scan(&personID, &expiration)
+	if err == sql.ErrNoRows {
+		return 0, errors.New("unknown challenge")
+	} else if err != nil {
+		return 0, fmt.Errorf("error looking up the challenge: %v", err)
+	}
+
+	res, err := svr.DB.Execute(ctx, deleteChallengeStatement, challenge)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting the challenge: %v", err)
+	} else if deleted, err := res.RowsAffected(); err != nil {
+		return 0, fmt.Errorf("error checking the challenge was deleted: %v", err)
+	} else if deleted != 1 {
+		return 0, errors.New("challenge was already used")
+	}
+
+	if expiration.Before(time.Now().UTC()) {
+		return 0, errors.New("challenge expired")
+	}
+
+	return personID.Int64, nil
+
+}
+
+/* Checks the client data is for the expected ceremony on this site */
+func parseClientData(raw []byte, ceremony string, origin string) (clientData, error) {
+
+	data := clientData{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return data, fmt.Errorf("error reading the client data: %v", err)
+	}
+
+	if data.Type != ceremony {
+		return data, fmt.Errorf("expected a %s response but got %s", ceremony, data.Type)
+	} else if data.Origin != origin {
+		return data, fmt.Errorf("response came from %s instead of %s", data.Origin, origin)
+	} else if data.Challenge == "" {
+		return data, errors.New("response is missing the challenge")
+	}
+
+	return data, nil
+
+}
+
+/*
+Checks the authenticator data is for this site and the person was there to
+use the passkey and unlocked it (PIN, fingerprint, etc.), and reads out the signature counter (and credential ID, when
+registering).
+*/
+func parseAuthenticatorData(raw []byte, rpID string) (authenticatorData, error) {
+
+	data := authenticatorData{}
+	if len(raw) < authDataMinLength {
+		return data, errors.New("authenticator data is too short")
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return data, errors.New("passkey is for a different site")
+	}
+
+	data.flags = raw[32]
+	data.signCount = binary.BigEndian.Uint32(raw[33:authDataMinLength])
+	if data.flags&flagUserPresent == 0 {
+		return data, errors.New("user wasn't present")
+	}
+	if data.flags&flagUserVerified == 0 {
+		return data, errors.New("user wasn't verified")
+	}
+
+	if data.flags&flagAttestedData != 0 {
+
+		if len(raw) < credentialIDOffset {
+			return data, errors.New("attested credential data is too short")
+		}
+		length := int(binary.BigEndian.Uint16(raw[credentialIDOffset-2 : credentialIDOffset]))
+		if len(raw) < credentialIDOffset+length {
+			return data, errors.New("credential ID is cut off")
+		}
+		data.credentialID = raw[credentialIDOffset : credentialIDOffset+length]
+
+	}
+
+	return data, nil
+
+}
+
+/* Reads the SPKI public key, making sure it's the kind the algorithm expects */
+func parsePublicKey(der []byte, algorithm int) (crypto.PublicKey, error) {
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the public key: %v", err)
+	}
+
+	switch typed := key.(type) {
+	case *ecdsa.PublicKey:
+		if algorithm == algES256 && typed.Curve == elliptic.P256() {
+			return typed, nil
+		}
+	case ed25519.PublicKey:
+		if algorithm == algEdDSA {
+			return typed, nil
+		}
+	case *rsa.PublicKey:
+		if algorithm == algRS256 {
+			return typed, nil
+		}
+	}
+
+	return nil, fmt.Errorf("public key doesn't match algorithm %d", algorithm)
+
+}
+
+/*
+Checks the assertion signature, which covers the authenticator data followed
+by the SHA-256 hash of the client data.
+*/
+func verifySignature(key crypto.PublicKey, authData []byte, clientDataJSON []byte, signature []byte) error {
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(slices.Clone(authData), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	verified := false
+	switch typed := key.(type) {
+	case *ecdsa.PublicKey:
+		verified = ecdsa.VerifyASN1(typed, digest[:], signature)
+	case ed25519.PublicKey:
+		verified = ed25519.Verify(typed, signed, signature)
+	case *rsa.PublicKey:
+		verified = rsa.VerifyPKCS1v15(typed, crypto.SHA256, digest[:], signature) == nil
+	}
+
+	if !verified {
+		return errors.New("signature doesn't match")
+	}
+	return nil
+
+}
+
+/* WebAuthn binary values go back and forth as unpadded base64url */
+func decode(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(value)
+}
+
+func encode(value []byte) string {
+	return base64.RawURLEncoding.EncodeToString(value)
+}
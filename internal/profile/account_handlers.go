@@ -0,0 +1,668 @@
+package profile
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AccountEmailer sends the link confirming someone wants their account
+// deleted. The server's Emailer implements it.
+type AccountEmailer interface {
+	SendAccountDeletionEmail(ctx context.Context, to []string, deletion AccountDeletionEmail, getenv func(string) string) error
+}
+
+// AccountDeletionEmail holds the details for the email confirming an account
+// deletion
+type AccountDeletionEmail struct {
+	ConfirmURL string
+	Name       string
+}
+
+type accountSection struct {
+	ErrorMessage string
+	Message      string
+}
+
+type accountDeletePage struct {
+	Deleted      bool
+	ErrorMessage string
+	Token        string
+}
+
+/*
+Everything "Download my data" hands back. Claims on the person's own items are
+left out, the export shouldn't spoil anyone's surprise.
+*/
+type accountExport struct {
+	Claims     []exportClaim     `json:"claims"`
+	ExportedOn time.Time         `json:"exportedOn"`
+	Households []exportHousehold `json:"households"`
+	Items      []exportItem      `json:"items"`
+	Passkeys   []exportPasskey   `json:"passkeys"`
+	Profile    profileSnapshot   `json:"profile"`
+	Sessions   []exportSession   `json:"sessions"`
+}
+
+type exportClaim struct {
+	ClaimedOn time.Time `json:"claimedOn"`
+	ItemName  string    `json:"itemName"`
+	Owner     string    `json:"owner"`
+	Status    string    `json:"status"`
+}
+
+type exportHousehold struct {
+	Members []exportMember `json:"members"`
+	Name    string         `json:"name"`
+}
+
+type exportMember struct {
+	DisplayName string `json:"displayName"`
+	FirstName   string `json:"firstName"`
+	LastName    string `json:"lastName"`
+	Type        string `json:"type"`
+}
+
+type exportItem struct {
+	ArchivedOn *time.Time `json:"archivedOn,omitempty"`
+	DeletedOn  *time.Time `json:"deletedOn,omitempty"`
+	Event      string     `json:"event,omitempty"`
+	ExternalID string     `json:"externalID"`
+	Name       string     `json:"name"`
+	PriceCents int64      `json:"priceCents"`
+	Size       string     `json:"size"`
+	Store      string     `json:"store"`
+	URL        string     `json:"url"`
+}
+
+type exportPasskey struct {
+	CreatedOn  time.Time  `json:"createdOn"`
+	LastUsedOn *time.Time `json:"lastUsedOn,omitempty"`
+	Name       string     `json:"name"`
+}
+
+type exportSession struct {
+	CreatedOn  *time.Time `json:"createdOn,omitempty"`
+	Device     string     `json:"device"`
+	Expiration time.Time  `json:"expiration"`
+	IPAddress  string     `json:"ipAddress"`
+	LastSeenOn *time.Time `json:"lastSeenOn,omitempty"`
+	UserAgent  string     `json:"userAgent"`
+}
+
+const (
+	/* How long the emailed link to confirm deleting an account works for */
+	accountDeletionLifetime = time.Hour
+	accountDeletionQuery    = `SELECT token, expiration FROM account_deletion WHERE person_id = ?`
+	accountDeletionPath     = "/profile/account/delete/confirm"
+	accountOwnerQuery       = `SELECT p.external_id,
+			p.email,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name),
+			COALESCE(hp.household_id, 0)
+		FROM person p
+			LEFT JOIN household_person hp ON hp.person_id = p.person_id
+		WHERE p.person_id = ?`
+	exportClaimsQuery = `SELECT i.name,
+			COALESCE(NULLIF(o.display_name, ''), o.first_name),
+			c.status,
+			c.claimed_on
+		FROM claim c
+			INNER JOIN item i ON i.item_id = c.item_id
+			INNER JOIN person o ON o.person_id = i.person_id
+		WHERE c.person_id = ?
+		ORDER BY c.claimed_on`
+	exportHouseholdQuery = `SELECT h.name,
+			p.first_name,
+			p.last_name,
+			p.display_name,
+			p.type
+		FROM household h
+			INNER JOIN household_person hp ON hp.household_id = h.household_id
+			INNER JOIN person p ON p.person_id = hp.person_id
+		WHERE h.household_id = (SELECT household_id FROM household_person WHERE person_id = ?)
+			AND h.deleted_on IS NULL
+			AND p.deleted_on IS NULL
+		ORDER BY p.first_name, p.last_name`
+	exportItemsQuery = `SELECT i.external_id,
+			i.name,
+			i.size,
+			i.store,
+			i.url,
+			i.price_cents,
+			COALESCE(e.name, ''),
+			i.archived_on,
+			i.deleted_on
+		FROM item i
+			LEFT JOIN event e ON e.event_id = i.event_id
+		WHERE i.person_id = ?
+		ORDER BY i.name`
+	exportPasskeysQuery = `SELECT name, created_on, last_used_on FROM passkey WHERE person_id = ? ORDER BY created_on`
+	exportProfileQuery  = `SELECT email,
+			first_name,
+			last_name,
+			display_name,
+			notification_frequency,
+			birth_month,
+			birth_day,
+			birth_year
+		FROM person
+		WHERE person_id = ?`
+	exportSessionsQuery = `SELECT device_name,
+			COALESCE(user_agent, ''),
+			ip_address,
+			created_on,
+			last_seen_on,
+			expiration
+		FROM session
+		WHERE person_id = ?
+		ORDER BY created_on`
+	setAccountDeletionStatement = `INSERT INTO account_deletion (person_id, token, expiration)
+		VALUES (?, ?, ?)
+		ON CONFLICT (person_id) DO
+			UPDATE SET token = ?, expiration = ?`
+
+	/*
+		Deleting an account anonymizes the person instead of removing them. Their
+		claims on other people's lists (and the audit log) still point at the
+		person, so givers' histories hold together and nobody else's list looks
+		unclaimed. Everything that's only about the person goes, their own items
+		are deleted like any other (claimed ones end up archived by the purge),
+		and a household left without any regular members goes with them.
+	*/
+	anonymizePersonStatement = `UPDATE person
+		SET email = '',
+			external_id = ?,
+			first_name = 'Former',
+			last_name = 'family member',
+			display_name = 'Former family member',
+			birth_month = NULL,
+			birth_day = NULL,
+			birth_year = NULL,
+			notification_frequency = 'OFF',
+			site_admin = FALSE,
+			deleted_on = ?,
+			disabled_on = ?
+		WHERE person_id = ?`
+	deleteAccessTokensStatement    = `DELETE FROM access_token WHERE person_id = ?`
+	deleteAccountDeletionStatement = `DELETE FROM account_deletion WHERE person_id = ?`
+	deleteAlertsStatement          = `DELETE FROM claim_alert WHERE person_id = ?`
+	deleteCalendarTokenStatement   = `DELETE FROM calendar_token WHERE person_id = ?`
+	deleteChallengesStatement      = `DELETE FROM passkey_challenge WHERE person_id = ?`
+	deleteEmailChangeStatement     = `DELETE FROM email_change WHERE person_id = ?`
+	deleteEventPersonStatement     = `DELETE FROM event_person WHERE person_id = ?`
+	deleteHouseholdPersonStatement = `DELETE FROM household_person WHERE person_id = ?`
+	deleteItemsStatement           = `UPDATE item SET deleted_on = ? WHERE person_id = ? AND deleted_on IS NULL AND archived_on IS NULL`
+	deleteNotificationsStatement   = `DELETE FROM notification WHERE person_id = ?`
+	deletePasskeysStatement        = `DELETE FROM passkey WHERE person_id = ?`
+	deleteRemindersStatement       = `DELETE FROM reminder_sent WHERE person_id = ?`
+	deleteSessionsStatement        = `DELETE FROM session WHERE person_id = ?`
+	deleteShareLinksStatement      = `DELETE FROM share_link WHERE person_id = ?`
+	deleteVerificationStatement    = `DELETE FROM verification WHERE person_id = ?`
+	endImpersonationStatement      = `UPDATE session SET impersonating_id = NULL WHERE impersonating_id = ?`
+	forgetBirthdayStatement        = `UPDATE event SET birthday_person_id = NULL WHERE birthday_person_id = ?`
+	retireHouseholdStatement       = `UPDATE household SET deleted_on = ?
+		WHERE household_id = ?
+			AND deleted_on IS NULL
+			AND NOT EXISTS (SELECT 1
+				FROM household_person hp
+					INNER JOIN person p ON p.person_id = hp.person_id
+				WHERE hp.household_id = household.household_id
+					AND p.type <> 'MANAGED')`
+	retireManagedProfilesStatement = `UPDATE person SET deleted_on = ?
+		WHERE type = 'MANAGED'
+			AND deleted_on IS NULL
+			AND person_id IN (SELECT hp.person_id
+				FROM household_person hp
+					INNER JOIN household h ON h.household_id = hp.household_id
+				WHERE h.household_id = ?
+					AND h.deleted_on IS NOT NULL)`
+)
+
+// AccountHandler loads the profile page's account section, with the buttons
+// for downloading the person's data and deleting their account.
+func AccountHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("account")
+
+		writeAccountTemplate(ctx, res, svr, span, "account", accountSection{})
+
+	})
+
+}
+
+// AccountExportHandler sends the logged-in person everything the registry
+// keeps about them as a JSON download.
+func AccountExportHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("account_export")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		export, err := collectExport(ctx, svr, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error collecting the account data",
+				slog.Int64("personID", personID),
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Could not put your data together, please try again shortly"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		body, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error encoding the account data", slog.String("errorMessage", err.Error()))
+			res.WriteHeader(500)
+			res.Write([]byte("Could not put your data together, please try again shortly"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		svr.Logger.InfoContext(ctx, "Exported account data", slog.Int64("personID", personID))
+		res.Header().Set("Cache-Control", "no-store")
+		res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gift-registry-data-%s.json"`, export.ExportedOn.Format(time.DateOnly)))
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(200)
+		res.Write(body)
+
+	})
+
+}
+
+// AccountDeleteHandler starts deleting the logged-in person's account by
+// emailing them a link to confirm it. Nothing's deleted until they follow it.
+func AccountDeleteHandler(svr *util.ServerUtils, emailer AccountEmailer) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("account_delete")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		var (
+			externalID  string
+			email       string
+			name        string
+			householdID int64
+		)
+		if err := svr.DB.QueryRow(ctx, accountOwnerQuery, personID).Scan(&externalID, &email, &name, &householdID); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error looking up the account to delete", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeAccountTemplate(ctx, res, svr, span, "account", accountSection{ErrorMessage: "Could not start deleting your account, please try again shortly"})
+			return
+		}
+
+		/* Only the hash is saved, the token goes out in the email */
+		token := rand.Text()
+		tokenHash := util.HashSecret(svr, token)
+		expires := time.Now().Add(accountDeletionLifetime).UTC()
+		if _, err := svr.DB.Execute(ctx, setAccountDeletionStatement, personID, tokenHash, expires, tokenHash, expires); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error saving the account deletion token", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeAccountTemplate(ctx, res, svr, span, "account", accountSection{ErrorMessage: "Could not start deleting your account, please try again shortly"})
+			return
+		}
+
+		deletion := AccountDeletionEmail{
+			ConfirmURL: util.AppURL(svr, accountDeletionPath+"?token="+url.QueryEscape(token)),
+			Name:       name,
+		}
+		if err := emailer.SendAccountDeletionEmail(ctx, []string{email}, deletion, svr.Getenv); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error sending the account deletion email", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeAccountTemplate(ctx, res, svr, span, "account", accountSection{ErrorMessage: "Could not send the confirmation email, please try again shortly"})
+			return
+		}
+
+		svr.Logger.InfoContext(ctx, "Sent an account deletion confirmation", slog.String("externalID", externalID))
+		writeAccountTemplate(ctx, res, svr, span, "account", accountSection{
+			Message: fmt.Sprintf("We emailed a link to %s. Follow it within the hour to finish deleting your account.", email),
+		})
+
+	})
+
+}
+
+// AccountDeleteLinkHandler shows the confirmation page for the link in the
+// account deletion email. Like the login link, nothing happens until the
+// person presses the button, so email scanners can't delete anyone.
+func AccountDeleteLinkHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("account_delete_link")
+
+		personID := middleware.PersonID(res, req)
+		token := req.URL.Query().Get("token")
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		page := accountDeletePage{Token: token}
+		if err := checkDeletionToken(ctx, svr, personID, token); err != nil {
+			svr.Logger.InfoContext(ctx, "Account deletion link didn't check out", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			page = accountDeletePage{ErrorMessage: "This link isn't valid anymore. Head back to your profile to get a new one."}
+		}
+
+		res.Header().Set("Referrer-Policy", "no-referrer")
+		writeAccountTemplate(ctx, res, svr, span, "account-delete-page", page)
+
+	})
+
+}
+
+// AccountDeleteConfirmHandler deletes the logged-in person's account once
+// they've confirmed it from the emailed link, and signs them out everywhere.
+func AccountDeleteConfirmHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("account_delete_confirm")
+
+		personID := middleware.PersonID(res, req)
+		token := req.PostFormValue("token")
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		if err := checkDeletionToken(ctx, svr, personID, token); err != nil {
+			svr.Logger.InfoContext(ctx, "Account deletion confirmation didn't check out", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeAccountTemplate(ctx, res, svr, span, "account-delete-confirm", accountDeletePage{
+				ErrorMessage: "This link isn't valid anymore. Head back to your profile to get a new one.",
+			})
+			return
+		}
+
+		var (
+			externalID  string
+			email       string
+			name        string
+			householdID int64
+		)
+		if err := svr.DB.QueryRow(ctx, accountOwnerQuery, personID).Scan(&externalID, &email, &name, &householdID); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error looking up the account to delete", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeAccountTemplate(ctx, res, svr, span, "account-delete-confirm", accountDeletePage{
+				ErrorMessage: "Could not delete your account, please try again shortly",
+				Token:        token,
+			})
+			return
+		}
+
+		now := time.Now().UTC()
+		statements := []string{
+			anonymizePersonStatement,
+			deleteSessionsStatement,
+			endImpersonationStatement,
+			deleteVerificationStatement,
+			deleteEmailChangeStatement,
+			deleteAccountDeletionStatement,
+			deleteChallengesStatement,
+			deletePasskeysStatement,
+			deleteAccessTokensStatement,
+			deleteCalendarTokenStatement,
+			deleteShareLinksStatement,
+			deleteEventPersonStatement,
+			deleteRemindersStatement,
+			deleteNotificationsStatement,
+			deleteAlertsStatement,
+			deleteItemsStatement,
+			forgetBirthdayStatement,
+			deleteHouseholdPersonStatement,
+			retireHouseholdStatement,
+			retireManagedProfilesStatement,
+		}
+		params := [][]any{
+			/* A new external ID, so old links to the person stop working */
+			{rand.Text(), now, now, personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{personID},
+			{now, personID},
+			{personID},
+			{personID},
+			{now, householdID},
+			{now, householdID},
+		}
+		_, errs := svr.DB.ExecuteBatch(ctx, statements, params)
+		for _, err := range errs {
+			if err != nil {
+				svr.Logger.ErrorContext(ctx, "Error deleting the account", slog.String("errorMessage", err.Error()))
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				writeAccountTemplate(ctx, res, svr, span, "account-delete-confirm", accountDeletePage{
+					ErrorMessage: "Could not delete your account, please try again shortly",
+					Token:        token,
+				})
+				return
+			}
+		}
+
+		/* The audit log keeps that it happened, not who the person was */
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Delete,
+			Entity:   audit.Person,
+			EntityID: externalID,
+		})
+		svr.Logger.InfoContext(ctx, "Deleted an account", slog.String("externalID", externalID))
+
+		http.SetCookie(res, &http.Cookie{
+			Name:     middleware.SessionCookie,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		writeAccountTemplate(ctx, res, svr, span, "account-delete-confirm", accountDeletePage{Deleted: true})
+
+	})
+
+}
+
+/* Makes sure the token is the person's latest, unexpired deletion token */
+func checkDeletionToken(ctx context.Context, svr *util.ServerUtils, personID int64, token string) error {
+
+	var (
+		tokenHash  string
+		expiration time.Time
+	)
+	if token == "" {
+		return fmt.Errorf("no token")
+	}
+	if err := svr.DB.QueryRow(ctx, accountDeletionQuery, personID).Scan(&tokenHash, &expiration); err != nil {
+		return fmt.Errorf("no deletion pending: %v", err)
+	}
+	if !hmac.Equal([]byte(tokenHash), []byte(util.HashSecret(svr, token))) {
+		return fmt.Errorf("token doesn't match")
+	}
+	if time.Now().UTC().After(expiration) {
+		return fmt.Errorf("token expired")
+	}
+	return nil
+
+}
+
+/* Reads everything the export covers, failing rather than handing back half of it */
+func collectExport(ctx context.Context, svr *util.ServerUtils, personID int64) (accountExport, error) {
+
+	export := accountExport{
+		Claims:     []exportClaim{},
+		ExportedOn: time.Now().UTC(),
+		Households: []exportHousehold{},
+		Items:      []exportItem{},
+		Passkeys:   []exportPasskey{},
+		Sessions:   []exportSession{},
+	}
+
+	var (
+		user                  userData
+		month, day, birthYear sql.NullInt64
+	)
+	err := svr.DB.QueryRow(ctx, exportProfileQuery, personID).Scan(
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.DisplayName,
+		&user.NotificationFrequency,
+		&month,
+		&day,
+		&birthYear,
+	)
+	if err != nil {
+		return export, fmt.Errorf("error reading the profile: %v", err)
+	}
+	user.setBirthday(month, day, birthYear)
+	export.Profile = user.snapshot()
+
+	rows, err := svr.DB.Query(ctx, exportHouseholdQuery, personID)
+	if err != nil {
+		return export, fmt.Errorf("error reading the household: %v", err)
+	}
+	for rows.Next() {
+		var householdName string
+		var member exportMember
+		if err = rows.Scan(&householdName, &member.FirstName, &member.LastName, &member.DisplayName, &member.Type); err != nil {
+			rows.Close()
+			return export, fmt.Errorf("error scanning a household member: %v", err)
+		}
+		if len(export.Households) == 0 {
+			export.Households = append(export.Households, exportHousehold{Members: []exportMember{}, Name: householdName})
+		}
+		export.Households[0].Members = append(export.Households[0].Members, member)
+	}
+	rows.Close()
+
+	rows, err = svr.DB.Query(ctx, exportItemsQuery, personID)
+	if err != nil {
+		return export, fmt.Errorf("error reading the items: %v", err)
+	}
+	for rows.Next() {
+		var item exportItem
+		var archivedOn, deletedOn sql.NullTime
+		if err = rows.Scan(&item.ExternalID, &item.Name, &item.Size, &item.Store, &item.URL, &item.PriceCents, &item.Event, &archivedOn, &deletedOn); err != nil {
+			rows.Close()
+			return export, fmt.Errorf("error scanning an item: %v", err)
+		}
+		item.ArchivedOn, item.DeletedOn = optionalTime(archivedOn), optionalTime(deletedOn)
+		export.Items = append(export.Items, item)
+	}
+	rows.Close()
+
+	rows, err = svr.DB.Query(ctx, exportClaimsQuery, personID)
+	if err != nil {
+		return export, fmt.Errorf("error reading the claims: %v", err)
+	}
+	for rows.Next() {
+		var claim exportClaim
+		if err = rows.Scan(&claim.ItemName, &claim.Owner, &claim.Status, &claim.ClaimedOn); err != nil {
+			rows.Close()
+			return export, fmt.Errorf("error scanning a claim: %v", err)
+		}
+		export.Claims = append(export.Claims, claim)
+	}
+	rows.Close()
+
+	rows, err = svr.DB.Query(ctx, exportSessionsQuery, personID)
+	if err != nil {
+		return export, fmt.Errorf("error reading the sessions: %v", err)
+	}
+	for rows.Next() {
+		var sess exportSession
+		var createdOn, lastSeenOn sql.NullTime
+		if err = rows.Scan(&sess.Device, &sess.UserAgent, &sess.IPAddress, &createdOn, &lastSeenOn, &sess.Expiration); err != nil {
+			rows.Close()
+			return export, fmt.Errorf("error scanning a session: %v", err)
+		}
+		sess.CreatedOn, sess.LastSeenOn = optionalTime(createdOn), optionalTime(lastSeenOn)
+		export.Sessions = append(export.Sessions, sess)
+	}
+	rows.Close()
+
+	rows, err = svr.DB.Query(ctx, exportPasskeysQuery, personID)
+	if err != nil {
+		return export, fmt.Errorf("error reading the passkeys: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key exportPasskey
+		var lastUsedOn sql.NullTime
+		if err = rows.Scan(&key.Name, &key.CreatedOn, &lastUsedOn); err != nil {
+			return export, fmt.Errorf("error scanning a passkey: %v", err)
+		}
+		key.LastUsedOn = optionalTime(lastUsedOn)
+		export.Passkeys = append(export.Passkeys, key)
+	}
+
+	return export, nil
+
+}
+
+func optionalTime(value sql.NullTime) *time.Time {
+
+	if !value.Valid {
+		return nil
+	}
+	return &value.Time
+
+}
+
+func writeAccountTemplate(ctx context.Context, res http.ResponseWriter, svr *util.ServerUtils, span trace.Span, name string, data any) {
+
+	tmpl, err := template.New("account.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/account.html")
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error loading the account template", slog.String("errorMessage", err.Error()))
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading the account template!"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, name, data); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error writing template!", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
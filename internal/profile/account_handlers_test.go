@@ -0,0 +1,304 @@
+package profile_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+)
+
+/* The parts of the export the tests check */
+type exportedData struct {
+	Claims []struct {
+		ItemName string `json:"itemName"`
+		Owner    string `json:"owner"`
+	} `json:"claims"`
+	Households []struct {
+		Members []struct {
+			FirstName string `json:"firstName"`
+		} `json:"members"`
+		Name string `json:"name"`
+	} `json:"households"`
+	Items []struct {
+		Name string `json:"name"`
+	} `json:"items"`
+	Profile struct {
+		Email string `json:"email"`
+	} `json:"profile"`
+	Sessions []struct {
+		UserAgent string `json:"userAgent"`
+	} `json:"sessions"`
+}
+
+func TestAccountExport(t *testing.T) {
+	t.Parallel()
+
+	userData := test.UserData{
+		CreateHousehold: true,
+		Email:           "account-export@localhost.com",
+		ExternalID:      "account-export-owner",
+		FirstName:       "Export",
+		HouseholdName:   "account-export household",
+		LastName:        "Owner",
+	}
+	token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+	if err != nil {
+		t.Fatal("Could not create a test session", err)
+	}
+	personID := lookupPersonID(t, userData.ExternalID)
+
+	relativeData := test.UserData{
+		Email:         "account-export-relative@localhost.com",
+		ExternalID:    "account-export-relative",
+		FirstName:     "Relative",
+		HouseholdName: userData.HouseholdName,
+		LastName:      "Owner",
+	}
+	relativeID, err := test.CreateUser(ctx, logger, db, relativeData)
+	if err != nil {
+		t.Fatal("Could not create the relative", err)
+	}
+
+	ownItem, err := test.CreateItem(ctx, db, test.ItemData{ExternalID: "account-export-own-item", Name: "Secret surprise", PersonID: personID})
+	if err != nil {
+		t.Fatal("Could not create the person's item", err)
+	}
+	relativeItem, err := test.CreateItem(ctx, db, test.ItemData{ExternalID: "account-export-relative-item", Name: "Board game", PersonID: relativeID})
+	if err != nil {
+		t.Fatal("Could not create the relative's item", err)
+	}
+	if err = test.CreateClaim(ctx, db, relativeItem, personID, "CLAIMED"); err != nil {
+		t.Fatal("Could not claim the relative's item", err)
+	}
+	if err = test.CreateClaim(ctx, db, ownItem, relativeID, "PURCHASED"); err != nil {
+		t.Fatal("Could not claim the person's item", err)
+	}
+
+	res := accountRequest(t, token, "GET", "/profile/account/export", nil)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Expected a 200 from the export but got", res.StatusCode)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Disposition"), "attachment;") {
+		t.Fatal("Expected the export as a download but got", res.Header.Get("Content-Disposition"))
+	}
+
+	var export exportedData
+	if err = json.NewDecoder(res.Body).Decode(&export); err != nil {
+		t.Fatal("Error reading the export", err)
+	}
+
+	if export.Profile.Email != userData.Email {
+		t.Fatal("Expected the profile for", userData.Email, "but got", export.Profile.Email)
+	}
+	if len(export.Households) != 1 || export.Households[0].Name != userData.HouseholdName || len(export.Households[0].Members) != 2 {
+		t.Fatal("Expected the household with both members but got", export.Households)
+	}
+	if len(export.Items) != 1 || export.Items[0].Name != "Secret surprise" {
+		t.Fatal("Expected the person's own item but got", export.Items)
+	}
+	/* The relative's claim on the person's item would spoil the surprise */
+	if len(export.Claims) != 1 || export.Claims[0].ItemName != "Board game" || export.Claims[0].Owner != "Relative" {
+		t.Fatal("Expected only the person's claim on the relative's item but got", export.Claims)
+	}
+	if len(export.Sessions) != 1 || export.Sessions[0].UserAgent != userAgent {
+		t.Fatal("Expected the person's session but got", export.Sessions)
+	}
+}
+
+func TestAccountDelete(t *testing.T) {
+	testData := []struct {
+		deletedExpected bool
+		expired         bool
+		externalIDStart string
+		testName        string
+		wrongToken      bool
+	}{
+		{
+			deletedExpected: true,
+			externalIDStart: "account-delete",
+			testName:        "Confirmed from the email",
+		},
+		{
+			externalIDStart: "account-delete-wrong",
+			testName:        "Token from a different email",
+			wrongToken:      true,
+		},
+		{
+			expired:         true,
+			externalIDStart: "account-delete-expired",
+			testName:        "Link expired",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			userData := test.UserData{
+				CreateHousehold: true,
+				Email:           data.externalIDStart + "@localhost.com",
+				ExternalID:      data.externalIDStart + "-owner",
+				FirstName:       "Delete",
+				HouseholdName:   data.externalIDStart + " household",
+				LastName:        "Owner",
+			}
+			token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session", err)
+			}
+			personID := lookupPersonID(t, userData.ExternalID)
+
+			otherData := test.UserData{
+				CreateHousehold: true,
+				Email:           data.externalIDStart + "-other@localhost.com",
+				ExternalID:      data.externalIDStart + "-other",
+				FirstName:       "Other",
+				HouseholdName:   data.externalIDStart + " other household",
+				LastName:        "Owner",
+			}
+			otherID, err := test.CreateUser(ctx, logger, db, otherData)
+			if err != nil {
+				t.Fatal("Could not create the other person", err)
+			}
+			otherItem, err := test.CreateItem(ctx, db, test.ItemData{ExternalID: data.externalIDStart + "-item", Name: "Scarf", PersonID: otherID})
+			if err != nil {
+				t.Fatal("Could not create the other person's item", err)
+			}
+			if err = test.CreateClaim(ctx, db, otherItem, personID, "CLAIMED"); err != nil {
+				t.Fatal("Could not claim the other person's item", err)
+			}
+
+			res := accountRequest(t, token, "POST", "/profile/account/delete", url.Values{})
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 asking to delete the account but got", res.StatusCode)
+			}
+
+			sent := emailer.AccountDeletionsSent(userData.Email)
+			if len(sent) != 1 {
+				t.Fatal("Expected 1 confirmation email but got", len(sent))
+			}
+			link, err := url.Parse(sent[0].ConfirmURL)
+			if err != nil {
+				t.Fatal("Error reading the confirmation link", err)
+			} else if link.Host != "gift-registry.localhost" {
+				t.Fatal("Expected the confirmation link to use the configured address but got", link)
+			}
+			deleteToken := link.Query().Get("token")
+			if data.wrongToken {
+				deleteToken = "not-the-token"
+			}
+			if data.expired {
+				if _, err = db.Execute(ctx, "UPDATE account_deletion SET expiration = ? WHERE person_id = ?", time.Now().UTC().Add(-time.Minute), personID); err != nil {
+					t.Fatal("Could not expire the deletion token", err)
+				}
+			}
+
+			res = accountRequest(t, token, "POST", "/profile/account/delete/confirm", url.Values{"token": {deleteToken}})
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 confirming the deletion but got", res.StatusCode)
+			}
+
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+			if _, found := test.CheckElement(*doc, "account-deleted"); found != data.deletedExpected {
+				t.Fatal("Expected the account deleted message =", data.deletedExpected, "but it was", found)
+			}
+
+			var (
+				deleted  bool
+				email    string
+				name     string
+				sessions int
+				claims   int
+			)
+			err = db.QueryRow(ctx, "SELECT deleted_on IS NOT NULL, email, display_name FROM person WHERE person_id = ?", personID).Scan(&deleted, &email, &name)
+			if err != nil {
+				t.Fatal("Could not look up the person", err)
+			}
+			if deleted != data.deletedExpected {
+				t.Fatal("Expected the account to be deleted", data.deletedExpected, "but it was", deleted)
+			}
+			if data.deletedExpected && (email != "" || name != "Former family member") {
+				t.Fatal("Expected the person to be anonymized but found", email, name)
+			}
+
+			if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM session WHERE person_id = ?", personID).Scan(&sessions); err != nil {
+				t.Fatal("Could not count the sessions", err)
+			}
+			if (sessions == 0) != data.deletedExpected {
+				t.Fatal("Expected the sessions removed =", data.deletedExpected, "but found", sessions)
+			}
+
+			/* The other person's list still shows the gift as claimed */
+			if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM claim WHERE item_id = ? AND person_id = ?", otherItem, personID).Scan(&claims); err != nil {
+				t.Fatal("Could not count the claims", err)
+			}
+			if claims != 1 {
+				t.Fatal("Expected the claim on the other person's item to be kept but found", claims)
+			}
+
+			if data.deletedExpected {
+				var householdDeleted bool
+				err = db.QueryRow(ctx, "SELECT deleted_on IS NOT NULL FROM household WHERE name = ?", userData.HouseholdName).Scan(&householdDeleted)
+				if err != nil {
+					t.Fatal("Could not look up the household", err)
+				}
+				if !householdDeleted {
+					t.Fatal("Expected the emptied household to be deleted")
+				}
+			}
+		})
+	}
+}
+
+/* Sends the request as the session's user, with the form if there is one */
+func accountRequest(t *testing.T, token string, method string, path string, form url.Values) *http.Response {
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, testServer.URL+path, body)
+	if err != nil {
+		t.Fatal("Error building the account request", err)
+	}
+
+	req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: token})
+	req.Header.Set("User-Agent", userAgent)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error calling", path, err)
+	}
+	return res
+
+}
+
+func lookupPersonID(t *testing.T, externalID string) int64 {
+
+	var personID int64
+	if err := db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", externalID).Scan(&personID); err != nil {
+		t.Fatal("Could not look up the person", externalID, err)
+	}
+	return personID
+
+}
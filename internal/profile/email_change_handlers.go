@@ -0,0 +1,255 @@
+package profile
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EmailChangeEmailer sends the code confirming a new email address, and lets
+// the old address know about the change. The server's Emailer implements it.
+type EmailChangeEmailer interface {
+	SendEmailChangeCode(ctx context.Context, to []string, change EmailChangeEmail, getenv func(string) string) error
+	SendEmailChangeNotice(ctx context.Context, to []string, change EmailChangeEmail, getenv func(string) string) error
+}
+
+// EmailChangeEmail holds the details for the email change emails. The code is
+// only filled in for the email to the new address.
+type EmailChangeEmail struct {
+	Code     string
+	Name     string
+	NewEmail string
+}
+
+type emailChange struct {
+	attempts     int
+	newEmail     string
+	token        string
+	tokenExpires time.Time
+}
+
+const (
+	changeEmailStatement    = `UPDATE person SET email = ? WHERE person_id = ?`
+	emailChangeQuery        = `SELECT new_email, token, token_expiration, attempts FROM email_change WHERE person_id = ?`
+	emailInUseQuery         = `SELECT COUNT(*) FROM person WHERE email = ?`
+	pendingEmailQuery       = `SELECT new_email FROM email_change WHERE person_id = ?`
+	setEmailChangeStatement = `INSERT INTO email_change (new_email, token, token_expiration, attempts, person_id)
+		VALUES (?, ?, ?, 0, ?)
+		ON CONFLICT (person_id) DO
+			UPDATE SET new_email = ?, token = ?, token_expiration = ?, attempts = 0`
+	updateEmailAttemptsStatement = `UPDATE email_change SET attempts = ? WHERE person_id = ?`
+)
+
+// EmailConfirmHandler finishes changing the logged-in person's email address
+// once they enter the code sent to the new one. Login codes for the old
+// address stop working.
+func EmailConfirmHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("email_confirm")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/profile_form.html")
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error loading the profile form template", slog.String("errorMessage", err.Error()))
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the profile page template!"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		user, err := lookupOwnProfile(ctx, svr, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error looking up the profile for the email change", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			user.Errors.ErrorMessage = "Could not look up profile information."
+			writeProfileForm(ctx, res, svr, span, tmpl, user)
+			return
+		}
+
+		change := emailChange{}
+		err = svr.DB.QueryRow(ctx, emailChangeQuery, personID).Scan(&change.newEmail, &change.token, &change.tokenExpires, &change.attempts)
+		if err == sql.ErrNoRows {
+			user.Errors.Email = "There's no new email address waiting to be confirmed"
+			span.SetAttributes(attribute.String("error_message", "no pending email change"))
+			writeProfileForm(ctx, res, svr, span, tmpl, user)
+			return
+		} else if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error looking up the email change", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			user.Errors.Email = "Could not confirm your new email address, please try again shortly"
+			writeProfileForm(ctx, res, svr, span, tmpl, user)
+			return
+		}
+
+		codesMatch, attemptsRemaining, beforeExpiration := util.CheckCode(svr, change.token, change.tokenExpires, change.attempts, req.PostFormValue("emailCode"))
+		span.SetAttributes(
+			attribute.Bool("codes_match", codesMatch),
+			attribute.Bool("attempts_remaining", attemptsRemaining),
+			attribute.Bool("before_expiration", beforeExpiration),
+		)
+
+		switch {
+
+		case codesMatch && !beforeExpiration:
+			cancelEmailChange(ctx, svr, personID)
+			user.PendingEmail = ""
+			user.Errors.Email = "That code has expired. Save your new email address again to get a new one"
+			span.SetAttributes(attribute.String("error_message", "email change code expired"))
+			writeProfileForm(ctx, res, svr, span, tmpl, user)
+			return
+
+		case !codesMatch && attemptsRemaining:
+			if _, err = svr.DB.Execute(ctx, updateEmailAttemptsStatement, change.attempts+1, personID); err != nil {
+				svr.Logger.ErrorContext(ctx, "Error updating the email change attempt count", slog.String("errorMessage", err.Error()))
+			}
+			user.Errors.Email = "That code doesn't match, please check it and try again"
+			span.SetAttributes(attribute.String("error_message", "codes don't match"))
+			writeProfileForm(ctx, res, svr, span, tmpl, user)
+			return
+
+		case !codesMatch:
+			cancelEmailChange(ctx, svr, personID)
+			user.PendingEmail = ""
+			user.Errors.Email = "That code doesn't match. Save your new email address again to get a new one"
+			span.SetAttributes(attribute.String("error_message", "codes don't match and the person has no more attempts"))
+			writeProfileForm(ctx, res, svr, span, tmpl, user)
+			return
+
+		}
+
+		/* Login codes sent to the old address shouldn't outlive it */
+		_, errs := svr.DB.ExecuteBatch(
+			ctx,
+			[]string{changeEmailStatement, deleteEmailChangeStatement, deleteVerificationStatement},
+			[][]any{{change.newEmail, personID}, {personID}, {personID}},
+		)
+		for _, err := range errs {
+			if err != nil {
+				svr.Logger.ErrorContext(ctx, "Error changing the email address", slog.String("errorMessage", err.Error()))
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				user.Errors.Email = "Could not change your email address. It may already belong to someone else"
+				writeProfileForm(ctx, res, svr, span, tmpl, user)
+				return
+			}
+		}
+
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Update,
+			After:    map[string]string{"email": change.newEmail},
+			Before:   map[string]string{"email": user.Email},
+			Entity:   audit.Person,
+			EntityID: user.ExternalID,
+		})
+		svr.Logger.InfoContext(ctx, "Changed an email address", slog.String("externalID", user.ExternalID))
+
+		user.Email = change.newEmail
+		user.PendingEmail = ""
+		writeProfileForm(ctx, res, svr, span, tmpl, user)
+
+	})
+
+}
+
+/* Drops the email change, so the person has to ask for a new code */
+func cancelEmailChange(ctx context.Context, svr *util.ServerUtils, personID int64) {
+
+	if _, err := svr.DB.Execute(ctx, deleteEmailChangeStatement, personID); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error removing the email change", slog.String("errorMessage", err.Error()))
+	}
+
+}
+
+func lookupPendingEmail(ctx context.Context, svr *util.ServerUtils, personID int64) string {
+
+	pending := ""
+	if err := svr.DB.QueryRow(ctx, pendingEmailQuery, personID).Scan(&pending); err != nil && err != sql.ErrNoRows {
+		svr.Logger.ErrorContext(ctx, "Error looking up a pending email change", slog.String("errorMessage", err.Error()))
+	}
+	return pending
+
+}
+
+/*
+Starts changing the person's email address. The code to confirm it goes to the
+new address, and the old one gets a heads up in case it wasn't them. Problems
+are reported on the profile form's email field.
+*/
+func requestEmailChange(ctx context.Context, svr *util.ServerUtils, emailer EmailChangeEmailer, user *userData, newEmail string) {
+
+	newEmail = strings.TrimSpace(newEmail)
+	if address, err := mail.ParseAddress(newEmail); err != nil || address.Address != newEmail {
+		user.Errors.Email = "Invalid email address"
+		return
+	}
+
+	var inUse int
+	if err := svr.DB.QueryRow(ctx, emailInUseQuery, newEmail).Scan(&inUse); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error checking if the email address is in use", slog.String("errorMessage", err.Error()))
+		user.Errors.Email = "Could not change your email address, please try again shortly"
+		return
+	} else if inUse > 0 {
+		user.Errors.Email = "That email address already belongs to someone in the registry"
+		return
+	}
+
+	/* Only the hash is saved, the code goes out in the email */
+	code := rand.Text()
+	codeHash := util.HashCode(svr, code)
+	expires := time.Now().Add(util.CodeLifetime).UTC()
+	if _, err := svr.DB.Execute(ctx, setEmailChangeStatement, newEmail, codeHash, expires, user.personID, newEmail, codeHash, expires); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error saving the email change", slog.String("errorMessage", err.Error()))
+		user.Errors.Email = "Could not change your email address, please try again shortly"
+		return
+	}
+
+	change := EmailChangeEmail{
+		Code:     code,
+		Name:     user.DisplayName,
+		NewEmail: newEmail,
+	}
+	if err := emailer.SendEmailChangeCode(ctx, []string{newEmail}, change, svr.Getenv); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error sending the email change code", slog.String("errorMessage", err.Error()))
+		cancelEmailChange(ctx, svr, user.personID)
+		user.Errors.Email = "Could not send a code to that address, please check it and try again"
+		return
+	}
+
+	/* The notice is a courtesy, the change can go ahead without it */
+	change.Code = ""
+	if err := emailer.SendEmailChangeNotice(ctx, []string{user.Email}, change, svr.Getenv); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error sending the email change notice", slog.String("errorMessage", err.Error()))
+	}
+
+	svr.Logger.InfoContext(ctx, "Sent an email change code", slog.String("externalID", user.ExternalID))
+	user.PendingEmail = newEmail
+
+}
+
+func writeProfileForm(ctx context.Context, res http.ResponseWriter, svr *util.ServerUtils, span trace.Span, tmpl *template.Template, user userData) {
+
+	res.WriteHeader(200)
+	if err := tmpl.ExecuteTemplate(res, "profile-form", user); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error writing template!", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
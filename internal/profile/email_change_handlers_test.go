@@ -0,0 +1,197 @@
+package profile_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"gift-registry/internal/test"
+)
+
+// TestEmailChange saves a new email address from the profile form and checks it
+// only replaces the old one once the code sent to it is confirmed.
+func TestEmailChange(t *testing.T) {
+	testData := []struct {
+		changedExpected bool
+		emailTaken      bool
+		expired         bool
+		externalIDStart string
+		newEmail        string
+		pendingExpected bool
+		requestError    bool
+		testName        string
+		wrongCode       bool
+	}{
+		{
+			changedExpected: true,
+			externalIDStart: "email-change",
+			newEmail:        "email-change-new@localhost.com",
+			testName:        "Confirmed with the code",
+		},
+		{
+			externalIDStart: "email-change-wrong",
+			newEmail:        "email-change-wrong-new@localhost.com",
+			pendingExpected: true,
+			testName:        "Wrong code",
+			wrongCode:       true,
+		},
+		{
+			expired:         true,
+			externalIDStart: "email-change-expired",
+			newEmail:        "email-change-expired-new@localhost.com",
+			testName:        "Code expired",
+		},
+		{
+			emailTaken:      true,
+			externalIDStart: "email-change-taken",
+			newEmail:        "email-change-taken-other@localhost.com",
+			requestError:    true,
+			testName:        "Someone else has the address",
+		},
+		{
+			externalIDStart: "email-change-invalid",
+			newEmail:        "not an email address",
+			requestError:    true,
+			testName:        "Invalid address",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			userData := test.UserData{
+				CreateHousehold: true,
+				Email:           data.externalIDStart + "@localhost.com",
+				ExternalID:      data.externalIDStart + "-owner",
+				FirstName:       "Email",
+				HouseholdName:   data.externalIDStart + " household",
+				LastName:        "Change",
+			}
+			token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session", err)
+			}
+			personID := lookupPersonID(t, userData.ExternalID)
+
+			if data.emailTaken {
+				otherData := test.UserData{
+					CreateHousehold: true,
+					Email:           data.newEmail,
+					ExternalID:      data.externalIDStart + "-other",
+					FirstName:       "Other",
+					HouseholdName:   data.externalIDStart + " other household",
+					LastName:        "Change",
+				}
+				if _, err = test.CreateUser(ctx, logger, db, otherData); err != nil {
+					t.Fatal("Could not create the other person", err)
+				}
+			}
+
+			form := url.Values{
+				"displayName":   {"Email"},
+				"email":         {data.newEmail},
+				"firstName":     {userData.FirstName},
+				"householdName": {userData.HouseholdName},
+				"lastName":      {userData.LastName},
+			}
+			res := accountRequest(t, token, "POST", "/profile/"+userData.ExternalID, form)
+			doc, err := html.Parse(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+
+			/* The address on file doesn't change until the code's confirmed */
+			if email := lookupEmail(t, personID); email != userData.Email {
+				t.Fatal("Expected the email address to stay", userData.Email, "but it's", email)
+			}
+
+			if data.requestError {
+				if errorElem, found := test.CheckElement(*doc, "email-error-"+userData.ExternalID); !found || !test.ElementVisible(errorElem) {
+					t.Fatal("Expected an error on the email address")
+				}
+				if len(emailer.EmailChangeCodesSent(data.newEmail)) != 0 {
+					t.Fatal("Expected no code to be sent")
+				}
+				return
+			}
+
+			if _, found := test.CheckElement(*doc, "email-pending-"+userData.ExternalID); !found {
+				t.Fatal("Expected the form to ask for the code")
+			}
+			codes := emailer.EmailChangeCodesSent(data.newEmail)
+			if len(codes) != 1 {
+				t.Fatal("Expected 1 code sent to the new address but got", len(codes))
+			}
+			notices := emailer.EmailChangeNoticesSent(userData.Email)
+			if len(notices) != 1 || notices[0].Code != "" || notices[0].NewEmail != data.newEmail {
+				t.Fatal("Expected a notice without the code sent to the old address but got", notices)
+			}
+
+			code := codes[0].Code
+			if data.wrongCode {
+				code = "NOTTHECODE"
+			}
+			if data.expired {
+				if _, err = db.Execute(ctx, "UPDATE email_change SET token_expiration = ? WHERE person_id = ?", time.Now().UTC().Add(-time.Minute), personID); err != nil {
+					t.Fatal("Could not expire the code", err)
+				}
+			}
+
+			/* A login code sent to the old address, which confirming should clear */
+			if _, err = db.Execute(ctx, "INSERT INTO verification (person_id, token, token_expiration, attempts) VALUES (?, ?, ?, 0)", personID, "old-address-code", time.Now().UTC().Add(time.Minute)); err != nil {
+				t.Fatal("Could not add a login code", err)
+			}
+
+			/* Codes aren't case sensitive */
+			res = accountRequest(t, token, "POST", "/profile/email/confirm", url.Values{"emailCode": {strings.ToLower(code)}})
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 confirming the code but got", res.StatusCode)
+			}
+			doc, err = html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+
+			expectedEmail := userData.Email
+			if data.changedExpected {
+				expectedEmail = data.newEmail
+			}
+			if email := lookupEmail(t, personID); email != expectedEmail {
+				t.Fatal("Expected the email address to be", expectedEmail, "but it's", email)
+			}
+
+			var pending, loginCodes int
+			if err = db.QueryRow(ctx, "SELECT (SELECT COUNT(*) FROM email_change WHERE person_id = ?), (SELECT COUNT(*) FROM verification WHERE person_id = ?)", personID, personID).Scan(&pending, &loginCodes); err != nil {
+				t.Fatal("Could not count the pending changes and login codes", err)
+			}
+			if data.changedExpected && (pending != 0 || loginCodes != 0) {
+				t.Fatal("Expected the change and old login codes to be cleared but found", pending, "changes and", loginCodes, "codes")
+			}
+
+			if _, found := test.CheckElement(*doc, "email-pending-"+userData.ExternalID); found != data.pendingExpected {
+				t.Fatal("Expected the change to still be waiting on a code =", data.pendingExpected, "but it was", found)
+			}
+			errorElem, found := test.CheckElement(*doc, "email-error-"+userData.ExternalID)
+			if !found || test.ElementVisible(errorElem) == data.changedExpected {
+				t.Fatal("Expected an error on the email address =", !data.changedExpected)
+			}
+		})
+	}
+}
+
+func lookupEmail(t *testing.T, personID int64) string {
+
+	var email string
+	if err := db.QueryRow(ctx, "SELECT email FROM person WHERE person_id = ?", personID).Scan(&email); err != nil {
+		t.Fatal("Could not look up the email address", err)
+	}
+	return email
+
+}
@@ -4,12 +4,20 @@
 package profile
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"gift-registry/internal/audit"
 	"gift-registry/internal/middleware"
+	"gift-registry/internal/notification"
 	"gift-registry/internal/util"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -17,25 +25,58 @@ import (
 )
 
 type profileErrors struct {
-	Email        string
-	ErrorMessage string
-	FirstName    string
-	Household    string
-	LastName     string
+	Birthday              string
+	Email                 string
+	ErrorMessage          string
+	FirstName             string
+	Household             string
+	LastName              string
+	NotificationFrequency string
 }
 
 type userData struct {
-	DisplayName   string
-	Errors        profileErrors
-	Email         string
-	ExternalID    string
-	FirstName     string
-	HouseholdName string
-	LastName      string
-	Type          string
-	householdID   int64
-	personID      int64
-	valid         bool
+	BirthDay              string
+	BirthMonth            string
+	BirthYear             string
+	DisplayName           string
+	Errors                profileErrors
+	Email                 string
+	ExternalID            string
+	FirstName             string
+	Frequencies           []string
+	HouseholdName         string
+	LastName              string
+	Months                []monthOption
+	NotificationFrequency string
+	PendingEmail          string
+	Type                  string
+	householdID           int64
+	personID              int64
+	valid                 bool
+}
+
+/* What the audit log keeps of a profile */
+type profileSnapshot struct {
+	BirthDay              string `json:"birthDay"`
+	BirthMonth            string `json:"birthMonth"`
+	BirthYear             string `json:"birthYear"`
+	DisplayName           string `json:"displayName"`
+	Email                 string `json:"email"`
+	FirstName             string `json:"firstName"`
+	LastName              string `json:"lastName"`
+	NotificationFrequency string `json:"notificationFrequency"`
+}
+
+type monthOption struct {
+	Name  string
+	Value string
+}
+
+/* Takes the place of a deleted profile's card for a few seconds */
+type undoToast struct {
+	ID      string
+	Message string
+	UndoURL string
 }
 
 type pageData struct {
@@ -45,17 +86,36 @@ type pageData struct {
 }
 
 const (
+	/* The before picture of a profile update, for the audit log */
+	auditSnapshotQuery = `SELECT p.email,
+			p.first_name,
+			p.last_name,
+			p.display_name,
+			p.notification_frequency,
+			p.birth_month,
+			p.birth_day,
+			p.birth_year
+		FROM person p
+		WHERE p.person_id = ?`
+	/* Soft-deleted, the database purge removes the profile for good later on */
+	deleteProfileStatement = `UPDATE person SET deleted_on = ? WHERE person_id = ? AND type = 'MANAGED'`
 	/*
 		The second part of the WHERE clause here ensures that the external ID either
 		belongs to the logged in user or an account that user manages.
 	*/
 	externalIDLookupQuery = `SELECT p.person_id, 
 			p.external_id,
-			p.type
+			p.type,
+			p.email
 		FROM person p
 			INNER JOIN household_person hp on hp.person_id = p.person_id
 		WHERE p.external_id = ?
+			AND p.deleted_on IS NULL
 			AND (hp.person_id = ? OR (p.type = 'MANAGED' AND hp.household_id = (SELECT household_id FROM household_person WHERE person_id = ?)))`
+	householdNameQuery = `SELECT h.external_id, h.name
+		FROM household h
+			INNER JOIN household_person hp ON hp.household_id = h.household_id
+		WHERE hp.person_id = ?`
 	lookupManagedProfilesQuery = `SELECT p.person_id, 
 			h.household_id,
 			p.external_id,
@@ -63,12 +123,17 @@ const (
 			p.last_name, 
 			p.display_name, 
 			p.type,
+			p.birth_month,
+			p.birth_day,
+			p.birth_year,
 			h.name
 		FROM person p
 			INNER JOIN household_person hp ON p.person_id = hp.person_id
 			INNER JOIN household h ON hp.household_id = h.household_id
 		WHERE h.household_id = ?
-			AND p.type = 'MANAGED'`
+			AND p.type = 'MANAGED'
+			AND p.deleted_on IS NULL
+			AND h.deleted_on IS NULL`
 	lookupPersonQuery = `SELECT p.person_id, 
 			h.household_id,
 			p.external_id,
@@ -77,12 +142,51 @@ const (
 			p.last_name, 
 			p.display_name, 
 			p.type,
-			h.name
+			p.notification_frequency,
+			p.birth_month,
+			p.birth_day,
+			p.birth_year,
+			h.name,
+			COALESCE(ec.new_email, '')
 		FROM person p
 			INNER JOIN household_person hp ON p.person_id = hp.person_id
 			INNER JOIN household h ON hp.household_id = h.household_id
+			LEFT JOIN email_change ec ON ec.person_id = p.person_id
 		WHERE p.person_id = ?`
-	updatePersonQuery = `UPDATE person SET email = ?, first_name = ?, last_name = ?, display_name = ? 
+	/*
+		A managed profile in the editor's household, deleted or not, for the
+		delete and restore (undo) handlers.
+	*/
+	managedProfileLookupQuery = `SELECT p.person_id,
+			h.household_id,
+			p.external_id,
+			p.first_name,
+			p.last_name,
+			p.display_name,
+			p.type,
+			p.birth_month,
+			p.birth_day,
+			p.birth_year,
+			h.name,
+			p.deleted_on IS NOT NULL
+		FROM person p
+			INNER JOIN household_person hp ON p.person_id = hp.person_id
+			INNER JOIN household h ON hp.household_id = h.household_id
+		WHERE p.external_id = ?
+			AND p.type = 'MANAGED'
+			AND h.deleted_on IS NULL
+			AND hp.household_id = (SELECT household_id FROM household_person WHERE person_id = ?)`
+	restoreProfileStatement = `UPDATE person SET deleted_on = NULL WHERE person_id = ?`
+	/* Email addresses change through requestEmailChange, once they're confirmed */
+	updatePersonQuery = `UPDATE person SET first_name = ?, last_name = ?, display_name = ?, 
+			birth_month = ?, birth_day = ?, birth_year = ?
+		WHERE external_id = ?`
+	/*
+		Managed profiles don't get emails, so only regular accounts set this. A
+		blank value leaves the current preference alone.
+	*/
+	updateNotificationFrequencyQuery = `UPDATE person 
+		SET notification_frequency = COALESCE(NULLIF(?, ''), notification_frequency)
 		WHERE external_id = ?`
 	updateHouseholdQuery = `UPDATE household 
 		SET name = ? 
@@ -92,6 +196,17 @@ const (
 	varcharMaxLength = 255
 )
 
+var (
+	/* Options for the birth month drop-down, with a blank for "not set" */
+	months = func() []monthOption {
+		options := []monthOption{{Name: "", Value: ""}}
+		for month := time.January; month <= time.December; month++ {
+			options = append(options, monthOption{Name: month.String(), Value: strconv.Itoa(int(month))})
+		}
+		return options
+	}()
+)
+
 // ProfileHandler looks up the person information and returns it, along with
 // any other managed profiles in the household.
 func ProfileHandler(svr *util.ServerUtils) http.HandlerFunc {
@@ -103,7 +218,7 @@ func ProfileHandler(svr *util.ServerUtils) http.HandlerFunc {
 		span.SetName("profile_handler")
 
 		templatesDir := svr.Getenv("TEMPLATES_DIR")
-		tmpl, err := template.ParseFiles(templatesDir+"/profile_page.html", templatesDir+"/profile_form.html")
+		tmpl, err := template.New("profile_page.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(templatesDir+"/profile_page.html", templatesDir+"/profile_form.html")
 		if err != nil {
 			svr.Logger.ErrorContext(
 				ctx,
@@ -120,22 +235,11 @@ func ProfileHandler(svr *util.ServerUtils) http.HandlerFunc {
 			Profiles: []userData{},
 		}
 
-		var person userData
+		var birthMonth, birthDay, birthYear sql.NullInt64
 		personID := middleware.PersonID(res, req)
 		profileIDs := []int64{personID}
 		span.SetAttributes(attribute.Int64("person_id", personID))
-		err = svr.DB.QueryRow(ctx, lookupPersonQuery, personID).
-			Scan(
-				&person.personID,
-				&person.householdID,
-				&person.ExternalID,
-				&person.Email,
-				&person.FirstName,
-				&person.LastName,
-				&person.DisplayName,
-				&person.Type,
-				&person.HouseholdName,
-			)
+		person, err := lookupOwnProfile(ctx, svr, personID)
 		if err != nil {
 			person = userData{
 				Errors: profileErrors{
@@ -203,12 +307,16 @@ func ProfileHandler(svr *util.ServerUtils) http.HandlerFunc {
 				&person.LastName,
 				&person.DisplayName,
 				&person.Type,
+				&birthMonth,
+				&birthDay,
+				&birthYear,
 				&person.HouseholdName,
 			)
 			if err != nil {
 				svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
 				continue
 			}
+			person.setBirthday(birthMonth, birthDay, birthYear)
 
 			profile.Profiles = append(profile.Profiles, person)
 			profileIDs = append(profileIDs, person.personID)
@@ -236,7 +344,9 @@ func ProfileHandler(svr *util.ServerUtils) http.HandlerFunc {
 }
 
 // Updates the person's information with the values provided from form input.
-func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
+// A new email address isn't saved right away, the person gets a code at the
+// new address to confirm it with EmailConfirmHandler.
+func ProfileUpdateHandler(svr *util.ServerUtils, emailer EmailChangeEmailer) http.Handler {
 
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
@@ -261,12 +371,18 @@ func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
 		}
 
 		user := userData{
-			DisplayName:   req.FormValue("displayName"),
-			Email:         req.FormValue("email"),
-			ExternalID:    req.FormValue("externalID"),
-			FirstName:     req.FormValue("firstName"),
-			HouseholdName: req.FormValue("householdName"),
-			LastName:      req.FormValue("lastName"),
+			BirthDay:              req.FormValue("birthDay"),
+			BirthMonth:            req.FormValue("birthMonth"),
+			BirthYear:             req.FormValue("birthYear"),
+			DisplayName:           req.FormValue("displayName"),
+			Email:                 req.FormValue("email"),
+			ExternalID:            req.FormValue("externalID"),
+			FirstName:             req.FormValue("firstName"),
+			Frequencies:           notification.Frequencies,
+			HouseholdName:         req.FormValue("householdName"),
+			LastName:              req.FormValue("lastName"),
+			Months:                months,
+			NotificationFrequency: req.FormValue("notificationFrequency"),
 		}
 
 		/*
@@ -281,6 +397,7 @@ func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
 			attribute.String("updated_first_name", user.FirstName),
 			attribute.String("updated_household_name", user.HouseholdName),
 			attribute.String("updated_last_name", user.LastName),
+			attribute.String("updated_notification_frequency", user.NotificationFrequency),
 		)
 
 		tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/profile_form.html")
@@ -296,11 +413,13 @@ func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
 			return
 		}
 
+		currentEmail := ""
 		err = svr.DB.QueryRow(ctx, externalIDLookupQuery, externalID, personID, personID).
 			Scan(
 				&user.personID,
 				&user.ExternalID,
 				&user.Type,
+				&currentEmail,
 			)
 
 		/* We can't validate the profile details, so we can't do an update */
@@ -357,8 +476,21 @@ func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
 			return
 		}
 
+		/*
+			Login is by emailed code, so a typo in a new address would lock the
+			person out. The current address stays until the new one is confirmed.
+		*/
+		newEmail := ""
+		if user.Type != "MANAGED" && strings.TrimSpace(user.Email) != currentEmail {
+			newEmail = user.Email
+			user.Email = currentEmail
+		}
+
+		before, householdExtID, householdBefore := auditSnapshot(ctx, svr, user.personID, personID)
+
 		sqlStatements := []string{updatePersonQuery}
-		sqlParams := [][]any{{user.Email, user.FirstName, user.LastName, user.DisplayName, externalID}}
+		month, day, year := user.birthdayParams()
+		sqlParams := [][]any{{user.FirstName, user.LastName, user.DisplayName, month, day, year, externalID}}
 
 		/*
 			TODO:
@@ -372,8 +504,8 @@ func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
 		*/
 		if user.Type != "MANAGED" {
 
-			sqlStatements = append(sqlStatements, updateHouseholdQuery)
-			sqlParams = append(sqlParams, []any{user.HouseholdName, personID})
+			sqlStatements = append(sqlStatements, updateHouseholdQuery, updateNotificationFrequencyQuery)
+			sqlParams = append(sqlParams, []any{user.HouseholdName, personID}, []any{user.NotificationFrequency, externalID})
 
 		}
 
@@ -384,8 +516,10 @@ func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
 			slog.Any("params", sqlParams),
 		)
 		_, errs := svr.DB.ExecuteBatch(ctx, sqlStatements, sqlParams)
+		saved := true
 		for _, err := range errs {
 			if err != nil {
+				saved = false
 				svr.Logger.ErrorContext(
 					ctx,
 					"Error updating the profile information",
@@ -408,6 +542,16 @@ func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
 			}
 		}
 
+		if saved {
+			recordProfileChanges(ctx, svr, personID, user, before, householdExtID, householdBefore)
+		}
+
+		if saved && newEmail != "" {
+			requestEmailChange(ctx, svr, emailer, &user, newEmail)
+		} else if user.Type != "MANAGED" {
+			user.PendingEmail = lookupPendingEmail(ctx, svr, user.personID)
+		}
+
 		err = tmpl.ExecuteTemplate(res, "profile-form", user)
 		if err != nil {
 			svr.Logger.ErrorContext(
@@ -425,6 +569,350 @@ func ProfileUpdateHandler(svr *util.ServerUtils) http.Handler {
 
 }
 
+// ProfileDeleteHandler deletes a managed profile in the logged-in person's
+// household. The profile is only soft-deleted, so ProfileRestoreHandler can
+// bring it back until the database purges it.
+func ProfileDeleteHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("profile_delete")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("deleted_external_id", externalID),
+		)
+
+		templatesDir := svr.Getenv("TEMPLATES_DIR")
+		tmpl, err := template.ParseFiles(templatesDir+"/profile_form.html", templatesDir+"/undo_toast.html")
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the profile templates",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the profile templates!"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		user, deleted, err := lookupManagedProfile(ctx, svr, externalID, personID)
+		if err == nil && deleted {
+			err = fmt.Errorf("profile %s is already deleted", externalID)
+		}
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error looking up the profile to delete",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(404)
+			res.Write([]byte("Could not find the profile to delete"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		if _, err = svr.DB.Execute(ctx, deleteProfileStatement, time.Now().UTC(), user.personID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error deleting the profile",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Could not delete the profile"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Delete,
+			Before:   user.snapshot(),
+			Entity:   audit.Person,
+			EntityID: user.ExternalID,
+		})
+
+		/* htmx swaps the profile's card out for the "Undo" toast */
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "undo-toast", undoToast{
+			ID:      "profile-" + user.ExternalID,
+			Message: fmt.Sprintf("Deleted %s's profile.", user.DisplayName),
+			UndoURL: "/profile/" + user.ExternalID + "/restore",
+		})
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+
+	})
+
+}
+
+// ProfileRestoreHandler brings back a deleted managed profile (the "Undo"
+// after a delete), along with everything on its list.
+func ProfileRestoreHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("profile_restore")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("restored_external_id", externalID),
+		)
+
+		tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/profile_form.html")
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the profile page template",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the profile page template!"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		user, deleted, err := lookupManagedProfile(ctx, svr, externalID, personID)
+		if err == nil && !deleted {
+			err = fmt.Errorf("profile %s isn't deleted", externalID)
+		}
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error looking up the profile to restore",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(404)
+			res.Write([]byte("Could not find the profile to restore"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		if _, err = svr.DB.Execute(ctx, restoreProfileStatement, user.personID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error restoring the profile",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Could not restore the profile"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Restore,
+			After:    user.snapshot(),
+			Entity:   audit.Person,
+			EntityID: user.ExternalID,
+		})
+
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "profile-card", user)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+
+	})
+
+}
+
+/*
+Reads the profile (and the editor's household name) as they are before an
+update, so the audit log can show what changed. A failure just leaves the
+"before" side empty.
+*/
+func auditSnapshot(ctx context.Context, svr *util.ServerUtils, profileID int64, editorID int64) (*profileSnapshot, string, string) {
+
+	var (
+		snapshot      profileSnapshot
+		month         sql.NullInt64
+		day           sql.NullInt64
+		year          sql.NullInt64
+		householdID   string
+		householdName string
+	)
+
+	err := svr.DB.QueryRow(ctx, auditSnapshotQuery, profileID).Scan(
+		&snapshot.Email,
+		&snapshot.FirstName,
+		&snapshot.LastName,
+		&snapshot.DisplayName,
+		&snapshot.NotificationFrequency,
+		&month,
+		&day,
+		&year,
+	)
+	if err != nil {
+		svr.Logger.WarnContext(ctx, "Could not read the profile before updating it", slog.String("errorMessage", err.Error()))
+		return nil, "", ""
+	}
+
+	before := userData{}
+	before.setBirthday(month, day, year)
+	snapshot.BirthDay, snapshot.BirthMonth, snapshot.BirthYear = before.BirthDay, before.BirthMonth, before.BirthYear
+
+	if err = svr.DB.QueryRow(ctx, householdNameQuery, editorID).Scan(&householdID, &householdName); err != nil {
+		svr.Logger.WarnContext(ctx, "Could not read the household before updating it", slog.String("errorMessage", err.Error()))
+	}
+
+	return &snapshot, householdID, householdName
+
+}
+
+/* The logged-in person's own profile, with any email change waiting on a code */
+func lookupOwnProfile(ctx context.Context, svr *util.ServerUtils, personID int64) (userData, error) {
+
+	var (
+		user       userData
+		birthMonth sql.NullInt64
+		birthDay   sql.NullInt64
+		birthYear  sql.NullInt64
+	)
+
+	err := svr.DB.QueryRow(ctx, lookupPersonQuery, personID).Scan(
+		&user.personID,
+		&user.householdID,
+		&user.ExternalID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.DisplayName,
+		&user.Type,
+		&user.NotificationFrequency,
+		&birthMonth,
+		&birthDay,
+		&birthYear,
+		&user.HouseholdName,
+		&user.PendingEmail,
+	)
+	user.Frequencies = notification.Frequencies
+	user.setBirthday(birthMonth, birthDay, birthYear)
+	if err != nil {
+		return user, fmt.Errorf("error looking up person %d's profile: %v", personID, err)
+	}
+
+	if user.DisplayName == "" {
+		user.DisplayName = user.FirstName
+	}
+
+	return user, nil
+
+}
+
+/*
+Looks up a managed profile in the editor's household, and whether it's been
+deleted.
+*/
+func lookupManagedProfile(ctx context.Context, svr *util.ServerUtils, externalID string, editorID int64) (userData, bool, error) {
+
+	var (
+		user       userData
+		birthMonth sql.NullInt64
+		birthDay   sql.NullInt64
+		birthYear  sql.NullInt64
+		deleted    bool
+	)
+
+	err := svr.DB.QueryRow(ctx, managedProfileLookupQuery, externalID, editorID).Scan(
+		&user.personID,
+		&user.householdID,
+		&user.ExternalID,
+		&user.FirstName,
+		&user.LastName,
+		&user.DisplayName,
+		&user.Type,
+		&birthMonth,
+		&birthDay,
+		&birthYear,
+		&user.HouseholdName,
+		&deleted,
+	)
+	if err == sql.ErrNoRows {
+		return user, false, fmt.Errorf("no managed profile %s in person %d's household", externalID, editorID)
+	} else if err != nil {
+		return user, false, fmt.Errorf("error looking up managed profile %s: %v", externalID, err)
+	}
+
+	user.setBirthday(birthMonth, birthDay, birthYear)
+	if user.DisplayName == "" {
+		user.DisplayName = user.FirstName
+	}
+
+	return user, deleted, nil
+
+}
+
+/* Records the profile update, and the household rename if there was one */
+func recordProfileChanges(
+	ctx context.Context,
+	svr *util.ServerUtils,
+	editorID int64,
+	user userData,
+	before *profileSnapshot,
+	householdExtID string,
+	householdBefore string,
+) {
+
+	after := user.snapshot()
+	/* A blank (or managed profile) frequency leaves the old one in place */
+	if before != nil && (after.NotificationFrequency == "" || user.Type == "MANAGED") {
+		after.NotificationFrequency = before.NotificationFrequency
+	}
+
+	event := audit.Event{
+		Action:   audit.Update,
+		After:    after,
+		Entity:   audit.Person,
+		EntityID: user.ExternalID,
+	}
+	if before != nil {
+		event.Before = before
+	}
+	audit.Record(ctx, svr, editorID, event)
+
+	if user.Type != "MANAGED" && householdExtID != "" && householdBefore != user.HouseholdName {
+		audit.Record(ctx, svr, editorID, audit.Event{
+			Action:   audit.Update,
+			After:    map[string]string{"name": user.HouseholdName},
+			Before:   map[string]string{"name": householdBefore},
+			Entity:   audit.Household,
+			EntityID: householdExtID,
+		})
+	}
+
+}
+
+func (user userData) snapshot() profileSnapshot {
+	return profileSnapshot{
+		BirthDay:              user.BirthDay,
+		BirthMonth:            user.BirthMonth,
+		BirthYear:             user.BirthYear,
+		DisplayName:           user.DisplayName,
+		Email:                 user.Email,
+		FirstName:             user.FirstName,
+		LastName:              user.LastName,
+		NotificationFrequency: user.NotificationFrequency,
+	}
+}
+
 func (user *userData) validate() {
 	user.valid = true
 
@@ -483,6 +971,91 @@ func (user *userData) validate() {
 		user.valid = false
 
 	}
+
+	if user.BirthMonth != "" || user.BirthDay != "" || user.BirthYear != "" {
+		user.validateBirthday()
+	}
+
+	if user.NotificationFrequency != "" && !slices.Contains(notification.Frequencies, user.NotificationFrequency) {
+
+		user.Errors.NotificationFrequency = "Choose how often you want to hear about list changes"
+		user.valid = false
+
+	}
+}
+
+/*
+Birthdays need both a month and a day, the year is optional. February 29th is
+allowed since it's a real birthday even if it isn't every year's.
+*/
+func (user *userData) validateBirthday() {
+
+	month, monthErr := strconv.Atoi(user.BirthMonth)
+	day, dayErr := strconv.Atoi(user.BirthDay)
+	if monthErr != nil || dayErr != nil || month < 1 || month > 12 {
+
+		user.Errors.Birthday = "Birthday needs both a month and a day"
+		user.valid = false
+		return
+
+	}
+
+	/* 2024 was a leap year, so this gives the most days each month can have */
+	if day < 1 || day > time.Date(2024, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day() {
+
+		user.Errors.Birthday = fmt.Sprintf("%s doesn't have a day %d", time.Month(month), day)
+		user.valid = false
+		return
+
+	}
+
+	if user.BirthYear == "" {
+		return
+	}
+
+	year, err := strconv.Atoi(user.BirthYear)
+	if err != nil || year < 1900 || year > time.Now().Year() {
+
+		user.Errors.Birthday = "Birth year must be a 4 digit year, or left blank"
+		user.valid = false
+
+	}
+
+}
+
+// Returns the birthday for saving, with nils for anything left blank
+func (user userData) birthdayParams() (any, any, any) {
+
+	var month, day, year any
+	if parsed, err := strconv.Atoi(user.BirthMonth); err == nil {
+		month = parsed
+	}
+	if parsed, err := strconv.Atoi(user.BirthDay); err == nil {
+		day = parsed
+	}
+	if parsed, err := strconv.Atoi(user.BirthYear); err == nil {
+		year = parsed
+	}
+
+	return month, day, year
+
+}
+
+// Fills in the form values for the birthday read from the database
+func (user *userData) setBirthday(month sql.NullInt64, day sql.NullInt64, year sql.NullInt64) {
+
+	user.BirthDay, user.BirthMonth, user.BirthYear = "", "", ""
+	user.Months = months
+	if month.Valid {
+		user.BirthMonth = strconv.FormatInt(month.Int64, 10)
+	}
+	if day.Valid {
+		user.BirthDay = strconv.FormatInt(day.Int64, 10)
+	}
+	if year.Valid {
+		user.BirthYear = strconv.FormatInt(year.Int64, 10)
+	}
+
 }
 
 func (user userData) String() string {
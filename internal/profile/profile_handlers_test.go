@@ -53,6 +53,7 @@ const (
 var (
 	ctx        context.Context
 	db         database.Database
+	emailer    *test.EmailMock
 	getenv     func(string) string
 	logger     *slog.Logger
 	testServer *httptest.Server
@@ -87,6 +88,7 @@ func TestMain(m *testing.M) {
 	)
 
 	env := map[string]string{
+		"APP_BASE_URL":     "https://gift-registry.localhost",
 		"DB_NAME":          dbPath,
 		"MIGRATIONS_DIR":   filepath.Join("..", "..", "internal", "database", "migrations"),
 		"STATIC_FILES_DIR": filepath.Join("..", "..", "cmd", "web"),
@@ -99,7 +101,8 @@ func TestMain(m *testing.M) {
 		log.Fatal("database connection failure! ", err)
 	}
 
-	appHandler, err := server.NewServer(getenv, db, logger, nil)
+	emailer = &test.EmailMock{}
+	appHandler, err := server.NewServer(getenv, db, logger, emailer)
 	if err != nil {
 		log.Fatal("Error setting up the test handler", err)
 	}
@@ -387,6 +390,7 @@ func TestProfilePage(t *testing.T) {
 
 func TestProfileEndpointsBadTemplates(t *testing.T) {
 	env := map[string]string{
+		"APP_BASE_URL":     "https://gift-registry.localhost",
 		"STATIC_FILES_DIR": filepath.Join("..", "..", "cmd", "web"),
 		"TEMPLATES_DIR":    "templates",
 	}
@@ -478,6 +482,7 @@ func TestProfileEndpointsBadTemplates(t *testing.T) {
 			req.Header.Set("Sec-Fetch-Dest", "document")
 			req.Header.Set("Sec-Fetch-Mode", "same-origin")
 			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			test.AddCSRFToken(req)
 			res, err := http.DefaultClient.Do(req)
 			defer func() {
 				if res != nil && res.Body != nil {
@@ -528,9 +533,10 @@ func TestProfileUpdates(t *testing.T) {
 					Visible: true,
 				},
 				"email-success-update": {
-					Value:   "completedupdate@localhost.com",
+					Value:   "successfulupdate@localhost.com",
 					Visible: true,
 				},
+				"email-pending-success-update": {Visible: true},
 				"household-name-success-update": {
 					Value:   "New House Success",
 					Visible: true,
@@ -888,6 +894,7 @@ func TestProfileUpdates(t *testing.T) {
 			req.Header.Set("Sec-Fetch-Dest", "document")
 			req.Header.Set("Sec-Fetch-Mode", "same-origin")
 			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			test.AddCSRFToken(req)
 			res, err := http.DefaultClient.Do(req)
 			defer func() {
 				if res != nil && res.Body != nil {
@@ -944,8 +951,9 @@ func TestProfileUpdates(t *testing.T) {
 				}
 
 				/* The following fields only get changed for non-managed profiles */
-				if data.updatedUserData.Type != "MANAGED" && updatedRecord.email != data.updatedUserData.Email {
-					t.Fatal("Updated email address doesn't match the expected value! DB", updatedRecord.email, " expected", data.updatedUserData.Email)
+				/* A new email address waits on its confirmation code */
+				if data.updatedUserData.Type != "MANAGED" && updatedRecord.email != data.userData.Email {
+					t.Fatal("Email address shouldn't change before it's confirmed! DB", updatedRecord.email, " expected", data.userData.Email)
 				}
 				if data.updatedUserData.Type != "MANAGED" && updatedRecord.householdName != data.updatedUserData.HouseholdName {
 					t.Fatal("Updated household doesn't match the expected value! DB", updatedRecord.householdName, " expected", data.updatedUserData.HouseholdName)
@@ -954,3 +962,151 @@ func TestProfileUpdates(t *testing.T) {
 		})
 	}
 }
+
+// TestProfileDelete deletes managed profiles, and un-does the delete, the way
+// the "Undo" toast would.
+func TestProfileDelete(t *testing.T) {
+	testData := []struct {
+		deleteStatus    int
+		deletedExpected bool
+		externalIDStart string
+		otherHousehold  bool
+		ownProfile      bool
+		restore         bool
+		testName        string
+	}{
+		{
+			deleteStatus:    http.StatusOK,
+			deletedExpected: true,
+			externalIDStart: "delete-managed",
+			testName:        "Delete a managed profile",
+		},
+		{
+			deleteStatus:    http.StatusOK,
+			deletedExpected: false,
+			externalIDStart: "restore-managed",
+			restore:         true,
+			testName:        "Undo the delete",
+		},
+		{
+			deleteStatus:    http.StatusNotFound,
+			deletedExpected: false,
+			externalIDStart: "delete-self",
+			ownProfile:      true,
+			testName:        "Can't delete your own profile",
+		},
+		{
+			deleteStatus:    http.StatusNotFound,
+			deletedExpected: false,
+			externalIDStart: "delete-other-house",
+			otherHousehold:  true,
+			testName:        "Can't delete another household's profile",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			userData := test.UserData{
+				CreateHousehold: true,
+				Email:           data.externalIDStart + "@localhost.com",
+				ExternalID:      data.externalIDStart + "-manager",
+				FirstName:       "Profile",
+				HouseholdName:   data.externalIDStart + " household",
+				LastName:        "Manager",
+			}
+			token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session for ", data.testName, err)
+			}
+
+			managedData := test.UserData{
+				DisplayName:   "Kiddo",
+				ExternalID:    data.externalIDStart + "-managed",
+				FirstName:     "Kid",
+				HouseholdName: userData.HouseholdName,
+				LastName:      "Manager",
+				Type:          "MANAGED",
+			}
+			if data.otherHousehold {
+				managedData.CreateHousehold = true
+				managedData.HouseholdName = data.externalIDStart + " other household"
+			}
+			if _, err = test.CreateUser(ctx, logger, db, managedData); err != nil {
+				t.Fatal("Could not create the managed profile", err)
+			}
+
+			externalID := managedData.ExternalID
+			if data.ownProfile {
+				externalID = userData.ExternalID
+			}
+
+			res := postProfile(t, token, "/profile/"+externalID+"/delete")
+			_ = res.Body.Close()
+			if res.StatusCode != data.deleteStatus {
+				t.Fatal("Expected status", data.deleteStatus, "deleting the profile but got", res.StatusCode)
+			}
+
+			if data.restore {
+				res = postProfile(t, token, "/profile/"+externalID+"/restore")
+				defer res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatal("Expected status 200 restoring the profile but got", res.StatusCode)
+				}
+
+				doc, err := html.Parse(res.Body)
+				if err != nil {
+					t.Fatal("Error parsing response body!", err)
+				}
+				err = test.ValidatePage(doc, map[string]test.ElementValidation{
+					"profile-" + externalID: {Visible: true},
+				})
+				if err != nil {
+					t.Fatal("The restored profile card wasn't returned", err)
+				}
+			}
+
+			var deleted bool
+			err = db.QueryRow(ctx, "SELECT deleted_on IS NOT NULL FROM person WHERE external_id = ?", externalID).Scan(&deleted)
+			if err != nil {
+				t.Fatal("Could not look up the profile", err)
+			} else if deleted != data.deletedExpected {
+				t.Fatal("Expected the profile to be deleted", data.deletedExpected, "but it was", deleted)
+			}
+		})
+	}
+}
+
+/* Posts an empty form as the session's user */
+func postProfile(t *testing.T, token string, path string) *http.Response {
+
+	sessCookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   time.Now().UTC().Add(time.Minute * 1).Second(),
+		Name:     middleware.SessionCookie,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+		Value:    token,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+path, strings.NewReader(""))
+	if err != nil {
+		t.Fatal("Error building the profile request", err)
+	}
+
+	req.AddCookie(&sessCookie)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error posting to", path, err)
+	}
+
+	return res
+
+}
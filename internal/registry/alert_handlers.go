@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type claimAlert struct {
+	Details  string
+	ItemName string
+	Owner    string
+	Type     string
+}
+
+type claimAlerts struct {
+	Alerts       []claimAlert
+	ErrorMessage string
+}
+
+const (
+	claimAlertsQuery = `SELECT COALESCE(NULLIF(o.display_name, ''), o.first_name),
+			a.item_name,
+			a.change_type,
+			a.details
+		FROM claim_alert a
+			INNER JOIN person o ON o.person_id = a.owner_id
+		WHERE a.person_id = ?
+			AND a.dismissed_on IS NULL
+		ORDER BY a.created_on, a.claim_alert_id`
+	dismissAlertsStatement = `UPDATE claim_alert SET dismissed_on = ?
+		WHERE person_id = ?
+			AND dismissed_on IS NULL`
+)
+
+// ClaimAlertsHandler shows the logged-in person a banner for any items they
+// claimed that have since been changed or taken off a list.
+func ClaimAlertsHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("claim_alerts")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		writeClaimAlerts(ctx, svr, res, lookupClaimAlerts(ctx, svr, personID))
+
+	})
+
+}
+
+// ClaimAlertsDismissHandler clears the logged-in person's claim alert banner.
+func ClaimAlertsDismissHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("claim_alerts_dismiss")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		if _, err := svr.DB.Execute(ctx, dismissAlertsStatement, time.Now().UTC(), personID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error dismissing the claim alerts",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			alerts := lookupClaimAlerts(ctx, svr, personID)
+			alerts.ErrorMessage = "Could not dismiss the alerts."
+			writeClaimAlerts(ctx, svr, res, alerts)
+			return
+		}
+
+		writeClaimAlerts(ctx, svr, res, claimAlerts{Alerts: []claimAlert{}})
+
+	})
+
+}
+
+func lookupClaimAlerts(ctx context.Context, svr *util.ServerUtils, personID int64) claimAlerts {
+
+	alerts := claimAlerts{
+		Alerts: []claimAlert{},
+	}
+
+	rows, err := svr.DB.Query(ctx, claimAlertsQuery, personID)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the claim alerts", slog.String("errorMessage", err.Error()))
+		alerts.ErrorMessage = "Could not look up changes to your claimed gifts."
+		return alerts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var alert claimAlert
+		if err := rows.Scan(&alert.Owner, &alert.ItemName, &alert.Type, &alert.Details); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		alerts.Alerts = append(alerts.Alerts, alert)
+
+	}
+
+	return alerts
+
+}
+
+func writeClaimAlerts(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, alerts claimAlerts) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/claim_alerts.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the claim alerts template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your alerts"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "claim-alerts", alerts); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
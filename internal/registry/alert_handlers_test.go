@@ -0,0 +1,220 @@
+package registry_test
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestClaimAlerts changes claimed items as the owner, then confirms the
+// claimers (and only the claimers) are alerted and see the banner until they
+// dismiss it.
+func TestClaimAlerts(t *testing.T) {
+	testData := []struct {
+		alertsExpected  int
+		changeType      string
+		claimed         bool
+		externalIDStart string
+		formData        url.Values
+		guestClaim      bool
+		pathSuffix      string
+		testName        string
+	}{
+		{
+			alertsExpected:  1,
+			changeType:      "EDITED",
+			claimed:         true,
+			externalIDStart: "alert-price",
+			formData:        url.Values{"name": {"Headphones"}, "price": {"101.00"}},
+			testName:        "Small price change",
+		},
+		{
+			alertsExpected:  1,
+			changeType:      "EDITED",
+			claimed:         true,
+			externalIDStart: "alert-size",
+			formData:        url.Values{"name": {"Headphones"}, "price": {"100.00"}, "size": {"Large"}},
+			testName:        "Size change",
+		},
+		{
+			alertsExpected:  1,
+			changeType:      "WITHDRAWN",
+			claimed:         true,
+			externalIDStart: "alert-withdrawn",
+			pathSuffix:      "/withdraw",
+			testName:        "No longer wanted",
+		},
+		{
+			alertsExpected:  1,
+			changeType:      "REMOVED",
+			claimed:         true,
+			externalIDStart: "alert-deleted",
+			pathSuffix:      "/delete",
+			testName:        "Deleted item",
+		},
+		{
+			alertsExpected:  1,
+			changeType:      "EDITED",
+			externalIDStart: "alert-guest",
+			formData:        url.Values{"name": {"Headphones"}, "price": {"120.00"}},
+			guestClaim:      true,
+			testName:        "Guest claimer",
+		},
+		{
+			alertsExpected:  0,
+			externalIDStart: "alert-unclaimed",
+			formData:        url.Values{"name": {"Headphones"}, "price": {"120.00"}},
+			testName:        "Unclaimed item",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			ownerData := test.UserData{
+				Email:      data.externalIDStart + "-owner@localhost.com",
+				ExternalID: data.externalIDStart + "-owner",
+				FirstName:  "List",
+				LastName:   "Owner",
+			}
+			ownerToken, err := test.CreateSession(ctx, logger, db, ownerData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create the owner's session", err)
+			}
+
+			claimerData := test.UserData{
+				Email:      data.externalIDStart + "-claimer@localhost.com",
+				ExternalID: data.externalIDStart + "-claimer",
+				FirstName:  "Secret",
+				LastName:   "Claimer",
+			}
+			claimerToken, err := test.CreateSession(ctx, logger, db, claimerData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create the claimer's session", err)
+			}
+
+			ids := map[string]int64{}
+			for _, extID := range []string{ownerData.ExternalID, claimerData.ExternalID} {
+				var id int64
+				err = db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", extID).Scan(&id)
+				if err != nil {
+					t.Fatal("Could not look up", extID, err)
+				}
+				ids[extID] = id
+			}
+
+			itemExtID := data.externalIDStart + "-item"
+			itemID, err := test.CreateItem(ctx, db, test.ItemData{
+				ExternalID: itemExtID,
+				Name:       "Headphones",
+				PersonID:   ids[ownerData.ExternalID],
+				PriceCents: 10000,
+			})
+			if err != nil {
+				t.Fatal("Could not create the item", err)
+			}
+
+			if data.claimed {
+				if err = test.CreateClaim(ctx, db, itemID, ids[claimerData.ExternalID], "CLAIMED"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if data.guestClaim {
+				_, err = db.Execute(ctx, `INSERT INTO guest_claim (external_id, item_id, name, email, status)
+					VALUES (?, ?, 'Guest', ?, 'ACTIVE')`, data.externalIDStart+"-guest", itemID, data.externalIDStart+"-guest@localhost.com")
+				if err != nil {
+					t.Fatal("Could not create the guest claim", err)
+				}
+			}
+
+			res := postForm(t, ownerToken, "/registry/items/"+itemExtID+data.pathSuffix, data.formData)
+			body, err := io.ReadAll(res.Body)
+			_ = res.Body.Close()
+			if err != nil {
+				t.Fatal("Error reading the owner's response", err)
+			} else if strings.Contains(string(body), claimerData.FirstName) {
+				t.Fatal("The owner's response gave away who claimed the item")
+			}
+
+			var alerts int
+			var changeType string
+			err = db.QueryRow(ctx, `SELECT COUNT(*), COALESCE(MAX(a.change_type), '')
+				FROM claim_alert a
+					LEFT JOIN guest_claim g ON g.guest_claim_id = a.guest_claim_id
+				WHERE a.person_id = ? OR g.item_id = ?`, ids[claimerData.ExternalID], itemID).Scan(&alerts, &changeType)
+			if err != nil {
+				t.Fatal("Could not count the claim alerts", err)
+			} else if alerts != data.alertsExpected {
+				t.Fatal("Expected", data.alertsExpected, "claim alerts but found", alerts)
+			} else if changeType != data.changeType {
+				t.Fatal("Expected a", data.changeType, "alert but got", changeType)
+			}
+
+			if !data.claimed {
+				return
+			}
+
+			doc := getPage(t, claimerToken, "/registry/alerts")
+			if err = test.ValidatePage(doc, map[string]test.ElementValidation{"claim-alert-0": {Visible: true}}); err != nil {
+				t.Fatal("Claim alert banner validation failed!", err)
+			}
+
+			res = postForm(t, claimerToken, "/registry/alerts/dismiss", url.Values{})
+			_ = res.Body.Close()
+
+			doc = getPage(t, claimerToken, "/registry/alerts")
+			if _, found := test.CheckElement(*doc, "claim-alert-0"); found {
+				t.Fatal("The claim alert banner is still showing after being dismissed")
+			}
+		})
+	}
+}
+
+/* Gets the page as the session's user and fails the test on a non-200 */
+func getPage(t *testing.T, token string, path string) *html.Node {
+
+	sessCookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   time.Now().UTC().Add(time.Minute * 1).Second(),
+		Name:     middleware.SessionCookie,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+		Value:    token,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+path, nil)
+	if err != nil {
+		t.Fatal("Error building the page request", err)
+	}
+
+	req.AddCookie(&sessCookie)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error getting the page!", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Got an error status from the server!", res.StatusCode)
+	}
+
+	doc, err := html.Parse(res.Body)
+	if err != nil {
+		t.Fatal("Error parsing response body!", err)
+	}
+
+	return doc
+
+}
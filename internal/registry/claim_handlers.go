@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	/*
+		People can claim items on the lists of their own household, and of anyone
+		they're giving to for an event (if the item's for that event, or any
+		event). Nobody can claim their own items, and like guest claims, an item
+		only gets one claimer. Doing the checks in the INSERT keeps 2 claims from
+		racing.
+	*/
+	claimItemStatement = `INSERT INTO claim (item_id, person_id, status, claimed_on)
+		SELECT i.item_id, ?, 'CLAIMED', ?
+		FROM item i
+			INNER JOIN person o ON o.person_id = i.person_id
+		WHERE i.external_id = ?
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NULL
+			AND o.deleted_on IS NULL
+			AND i.person_id <> ?
+			AND (i.person_id IN (
+					SELECT hp.person_id
+					FROM household_person hp
+					WHERE hp.household_id IN (SELECT household_id FROM household_person WHERE person_id = ?))
+				OR EXISTS (
+					SELECT 1
+					FROM event_person r
+						INNER JOIN event_person g ON g.event_id = r.event_id
+					WHERE r.person_id = i.person_id
+						AND r.role = 'RECIPIENT'
+						AND g.person_id = ?
+						AND g.role = 'GIVER'
+						AND (i.event_id IS NULL OR i.event_id = r.event_id)))
+			AND NOT EXISTS (SELECT 1 FROM claim c WHERE c.item_id = i.item_id)
+			AND NOT EXISTS (SELECT 1 FROM guest_claim g WHERE g.item_id = i.item_id AND g.status = 'ACTIVE')`
+	purchaseClaimStatement = `UPDATE claim SET status = 'PURCHASED'
+		WHERE person_id = ?
+			AND item_id = (SELECT item_id FROM item WHERE external_id = ?)`
+	unclaimItemStatement = `DELETE FROM claim
+		WHERE person_id = ?
+			AND item_id = (SELECT item_id FROM item WHERE external_id = ?)`
+)
+
+// ClaimHandler claims an item on someone else's list for the logged-in person,
+// so nobody else buys it too. The response is their updated shopping list.
+func ClaimHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("item_claim")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("item_external_id", externalID),
+		)
+
+		result, err := svr.DB.Execute(ctx, claimItemStatement, personID, time.Now().UTC(), externalID, personID, personID, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error claiming the item",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Could not claim the item"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		if added, err := result.RowsAffected(); err != nil || added == 0 {
+			svr.Logger.InfoContext(ctx, "Item isn't available to claim", slog.String("itemID", externalID))
+			res.WriteHeader(409)
+			res.Write([]byte("That item isn't available to claim"))
+			span.SetAttributes(attribute.String("error_message", "item not available to claim"))
+			return
+		}
+
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Create,
+			After:    map[string]string{"status": "CLAIMED"},
+			Entity:   audit.Claim,
+			EntityID: externalID,
+		})
+		writeShoppingList(ctx, svr, res, personID)
+
+	})
+
+}
+
+// PurchaseHandler marks one of the logged-in person's claims as bought. The
+// response is their updated shopping list.
+func PurchaseHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("item_purchase")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("item_external_id", externalID),
+		)
+
+		if !changeClaim(ctx, svr, res, purchaseClaimStatement, personID, externalID) {
+			return
+		}
+
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Update,
+			After:    map[string]string{"status": "PURCHASED"},
+			Entity:   audit.Claim,
+			EntityID: externalID,
+		})
+		writeShoppingList(ctx, svr, res, personID)
+
+	})
+
+}
+
+// UnclaimHandler gives up one of the logged-in person's claims, so the item
+// is free for someone else to get. The response is their updated shopping
+// list.
+func UnclaimHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("item_unclaim")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("item_external_id", externalID),
+		)
+
+		if !changeClaim(ctx, svr, res, unclaimItemStatement, personID, externalID) {
+			return
+		}
+
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Release,
+			Entity:   audit.Claim,
+			EntityID: externalID,
+		})
+		writeShoppingList(ctx, svr, res, personID)
+
+	})
+
+}
+
+/*
+Runs the update or delete on the person's claim of the item, writing the error
+response and returning false if it fails or they haven't claimed it.
+*/
+func changeClaim(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, statement string, personID int64, externalID string) bool {
+
+	span := trace.SpanFromContext(ctx)
+	result, err := svr.DB.Execute(ctx, statement, personID, externalID)
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error updating the claim",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Could not update the claim"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return false
+	}
+
+	if changed, err := result.RowsAffected(); err != nil || changed == 0 {
+		res.WriteHeader(404)
+		res.Write([]byte("You haven't claimed that item"))
+		span.SetAttributes(attribute.String("error_message", "no claim on the item"))
+		return false
+	}
+
+	return true
+
+}
+
+/* Sends back the person's shopping list, for the page to swap in */
+func writeShoppingList(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, personID int64) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.New("shopping_list.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/shopping_list.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the shopping list template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error rendering the shopping list"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	list, err := lookupShoppingList(ctx, svr, personID)
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error looking up the shopping list",
+			slog.Int64("personID", personID),
+			slog.String("errorMessage", err.Error()),
+		)
+		list.ErrorMessage = "Could not look up your shopping list."
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "shopping-list", list); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
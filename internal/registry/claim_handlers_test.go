@@ -0,0 +1,235 @@
+package registry_test
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestClaims claims items from the lists people can see, then marks them
+// bought and gives them up again, checking the shopping list follows along.
+func TestClaims(t *testing.T) {
+	testData := []struct {
+		claimedBefore   bool
+		expectedStatus  int
+		externalIDStart string
+		household       bool
+		ownItem         bool
+		testName        string
+		viaEvent        bool
+	}{
+		{
+			expectedStatus:  http.StatusOK,
+			externalIDStart: "claim-household",
+			household:       true,
+			testName:        "Household member's item",
+		},
+		{
+			expectedStatus:  http.StatusOK,
+			externalIDStart: "claim-event",
+			testName:        "Giving to them for an event",
+			viaEvent:        true,
+		},
+		{
+			expectedStatus:  http.StatusConflict,
+			externalIDStart: "claim-stranger",
+			testName:        "List they can't see",
+		},
+		{
+			expectedStatus:  http.StatusConflict,
+			externalIDStart: "claim-own",
+			household:       true,
+			ownItem:         true,
+			testName:        "Their own item",
+		},
+		{
+			claimedBefore:   true,
+			expectedStatus:  http.StatusConflict,
+			externalIDStart: "claim-taken",
+			household:       true,
+			testName:        "Someone else got there first",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			giverData := test.UserData{
+				CreateHousehold: true,
+				Email:           data.externalIDStart + "-giver@localhost.com",
+				ExternalID:      data.externalIDStart + "-giver",
+				FirstName:       "Claim",
+				HouseholdName:   data.externalIDStart + " household",
+				LastName:        "Giver",
+			}
+			token, err := test.CreateSession(ctx, logger, db, giverData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session for ", data.testName, err)
+			}
+			var giverID int64
+			if err = db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", giverData.ExternalID).Scan(&giverID); err != nil {
+				t.Fatal("Could not look up the giver", err)
+			}
+
+			recipientData := test.UserData{
+				Email:      data.externalIDStart + "-recipient@localhost.com",
+				ExternalID: data.externalIDStart + "-recipient",
+				FirstName:  "Claim",
+				LastName:   "Recipient",
+			}
+			if data.household {
+				recipientData.HouseholdName = giverData.HouseholdName
+			}
+			recipientID, err := test.CreateUser(ctx, logger, db, recipientData)
+			if err != nil {
+				t.Fatal("Could not create the recipient", err)
+			}
+
+			if data.viaEvent {
+				eventID, err := test.CreateEvent(ctx, db, test.EventData{
+					Date:       time.Now().UTC().AddDate(0, 1, 0),
+					ExternalID: data.externalIDStart + "-event",
+					Name:       "Claim party",
+				})
+				if err != nil {
+					t.Fatal("Could not create the event", err)
+				}
+				if err = test.AddEventPerson(ctx, db, eventID, recipientID, "RECIPIENT"); err != nil {
+					t.Fatal(err)
+				}
+				if err = test.AddEventPerson(ctx, db, eventID, giverID, "GIVER"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ownerID := recipientID
+			if data.ownItem {
+				ownerID = giverID
+			}
+			itemExtID := data.externalIDStart + "-item"
+			itemID, err := test.CreateItem(ctx, db, test.ItemData{
+				ExternalID: itemExtID,
+				Name:       "Claimable gift",
+				PersonID:   ownerID,
+				PriceCents: 2500,
+			})
+			if err != nil {
+				t.Fatal("Could not create the item", err)
+			}
+
+			if data.claimedBefore {
+				otherID, err := test.CreateUser(ctx, logger, db, test.UserData{
+					Email:         data.externalIDStart + "-other@localhost.com",
+					ExternalID:    data.externalIDStart + "-other",
+					FirstName:     "Other",
+					HouseholdName: giverData.HouseholdName,
+					LastName:      "Giver",
+				})
+				if err != nil {
+					t.Fatal("Could not create the other giver", err)
+				}
+				if err = test.CreateClaim(ctx, db, itemID, otherID, "CLAIMED"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			res, doc := postClaim(t, token, "/registry/items/"+itemExtID+"/claim")
+			if res.StatusCode != data.expectedStatus {
+				t.Fatal("Expected a", data.expectedStatus, "claiming the item but got", res.StatusCode)
+			}
+			if status := claimStatus(t, itemID, giverID); (status != "") != (data.expectedStatus == http.StatusOK) {
+				t.Fatal("Expected the claim to be saved =", data.expectedStatus == http.StatusOK, "but found", status)
+			}
+			if data.expectedStatus != http.StatusOK {
+				return
+			}
+
+			err = test.ValidatePage(doc, map[string]test.ElementValidation{
+				"shopping-item-" + itemExtID: {Visible: true},
+				"shopping-item-status-" + itemExtID: {
+					Value:   "CLAIMED",
+					Visible: true,
+				},
+				"shopping-total": {
+					Value:   "$25.00",
+					Visible: true,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, doc = postClaim(t, token, "/registry/items/"+itemExtID+"/purchase")
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 marking the item bought but got", res.StatusCode)
+			} else if status := claimStatus(t, itemID, giverID); status != "PURCHASED" {
+				t.Fatal("Expected the claim to be PURCHASED but it was", status)
+			}
+			if _, found := test.CheckElement(*doc, "shopping-item-purchase-"+itemExtID); found {
+				t.Fatal("Expected no bought button on an item already bought")
+			}
+
+			res, _ = postClaim(t, token, "/registry/items/"+itemExtID+"/unclaim")
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 giving up the claim but got", res.StatusCode)
+			} else if status := claimStatus(t, itemID, giverID); status != "" {
+				t.Fatal("Expected the claim to be gone but it was", status)
+			}
+
+			/* There's nothing left to give up */
+			res, _ = postClaim(t, token, "/registry/items/"+itemExtID+"/unclaim")
+			if res.StatusCode != http.StatusNotFound {
+				t.Fatal("Expected a 404 giving up a claim twice but got", res.StatusCode)
+			}
+		})
+	}
+}
+
+/* The person's claim on the item, or "" if they don't have one */
+func claimStatus(t *testing.T, itemID int64, personID int64) string {
+
+	var status string
+	err := db.QueryRow(ctx, "SELECT status FROM claim WHERE item_id = ? AND person_id = ?", itemID, personID).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatal("Could not look up the claim", err)
+	}
+	return status
+
+}
+
+/* Posts to a claim route as the session's user, the way the page's buttons do */
+func postClaim(t *testing.T, token string, path string) (*http.Response, *html.Node) {
+
+	req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+path, strings.NewReader(""))
+	if err != nil {
+		t.Fatal("Error building the claim request", err)
+	}
+
+	req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: token})
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error calling", path, err)
+	}
+	defer res.Body.Close()
+
+	doc, err := html.Parse(res.Body)
+	if err != nil {
+		t.Fatal("Error parsing response body!", err)
+	}
+
+	return res, doc
+
+}
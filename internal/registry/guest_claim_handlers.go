@@ -0,0 +1,412 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ClaimEmailer sends guests the links for confirming and releasing their
+// claims. The server's Emailer implements it.
+type ClaimEmailer interface {
+	SendGuestClaimEmail(ctx context.Context, to []string, claim GuestClaimEmail, getenv func(string) string) error
+}
+
+// GuestClaimEmail holds the details for the email sent to a guest after they
+// claim an item from a share link
+type GuestClaimEmail struct {
+	ConfirmURL string
+	ItemName   string
+	ListTitle  string
+	Name       string
+	ReleaseURL string
+}
+
+type guestClaimPage struct {
+	ActionLabel  string
+	ErrorMessage string
+	ItemName     string
+	Message      string
+	PostURL      string
+	Signature    string
+}
+
+const (
+	confirmAction = "confirm"
+	/*
+		The claim only goes active if the item is still on the list and nobody
+		(member or guest) got to it first. Doing the check in the UPDATE keeps 2
+		confirmations from racing.
+	*/
+	confirmGuestClaimStatement = `UPDATE guest_claim SET status = 'ACTIVE', confirmed_on = ?
+		WHERE external_id = ?
+			AND status = 'PENDING'
+			AND EXISTS (SELECT 1 FROM item i WHERE i.item_id = guest_claim.item_id AND i.archived_on IS NULL AND i.deleted_on IS NULL)
+			AND NOT EXISTS (SELECT 1 FROM claim c WHERE c.item_id = guest_claim.item_id)
+			AND NOT EXISTS (SELECT 1 FROM guest_claim g WHERE g.item_id = guest_claim.item_id AND g.status = 'ACTIVE')`
+	deleteGuestClaimStatement = `DELETE FROM guest_claim WHERE external_id = ? AND status = 'PENDING'`
+	guestClaimLookupQuery     = `SELECT i.name, g.status
+		FROM guest_claim g
+			INNER JOIN item i ON i.item_id = g.item_id
+		WHERE g.external_id = ?`
+	insertGuestClaimStatement = `INSERT INTO guest_claim (external_id, item_id, name, email)
+		VALUES (?, ?, ?, ?)`
+	releaseAction              = "release"
+	releaseGuestClaimStatement = `UPDATE guest_claim SET status = 'RELEASED', released_on = ?
+		WHERE external_id = ?
+			AND status IN ('PENDING', 'ACTIVE')`
+	/*
+		Makes sure the item is actually on the shared list, using the same rules
+		as the shared list queries.
+	*/
+	sharedItemLookupQuery = `SELECT i.item_id,
+			i.name,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name),
+			COALESCE(e.name, '')
+		FROM share_link s
+			INNER JOIN person p ON p.person_id = s.person_id
+			LEFT JOIN event e ON e.event_id = s.event_id
+			INNER JOIN item i ON i.external_id = ?
+		WHERE s.token = ?
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NULL
+			AND ((s.event_id IS NULL AND i.person_id = s.person_id)
+				OR (s.event_id IS NOT NULL
+					AND (i.event_id = s.event_id OR i.event_id IS NULL)
+					AND i.person_id IN (SELECT ep.person_id FROM event_person ep WHERE ep.event_id = s.event_id AND ep.role = 'RECIPIENT')))`
+)
+
+// GuestClaimHandler takes a claim from someone without an account, from a
+// share link. The claim stays pending until the guest confirms it with the
+// link emailed to them.
+func GuestClaimHandler(svr *util.ServerUtils, emailer ClaimEmailer) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("guest_claim")
+
+		itemExtID := req.FormValue("item")
+		name := strings.TrimSpace(req.FormValue("name"))
+		email := strings.TrimSpace(req.FormValue("email"))
+		span.SetAttributes(attribute.String("item_external_id", itemExtID))
+
+		var (
+			itemID    int64
+			page      guestClaimPage
+			owner     string
+			eventName string
+		)
+		err := svr.DB.QueryRow(ctx, sharedItemLookupQuery, itemExtID, req.PathValue("token")).
+			Scan(&itemID, &page.ItemName, &owner, &eventName)
+		if err == sql.ErrNoRows {
+			res.WriteHeader(404)
+			res.Write([]byte("That item isn't on this list"))
+			return
+		} else if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the shared item",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error claiming the item"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		if name == "" || len(name) > varcharMaxLength {
+			page.ErrorMessage = fmt.Sprintf("Your name is required, and can't be more than %d characters", varcharMaxLength)
+		} else if _, err := mail.ParseAddress(email); err != nil || len(email) > varcharMaxLength {
+			page.ErrorMessage = "A valid email address is required to confirm the claim"
+		}
+		if page.ErrorMessage != "" {
+			writeGuestClaimPage(ctx, svr, res, page)
+			return
+		}
+
+		externalID := rand.Text()
+		if _, err = svr.DB.Execute(ctx, insertGuestClaimStatement, externalID, itemID, name, email); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error saving the guest claim",
+				slog.String("errorMessage", err.Error()),
+			)
+			page.ErrorMessage = "Could not save your claim."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeGuestClaimPage(ctx, svr, res, page)
+			return
+		}
+		span.SetAttributes(attribute.String("guest_claim_external_id", externalID))
+		audit.Record(ctx, svr, 0, audit.Event{
+			Action:   audit.Create,
+			After:    map[string]string{"email": email, "item": itemExtID, "name": name},
+			Entity:   audit.GuestClaim,
+			EntityID: externalID,
+		})
+
+		listTitle := owner + "'s wishlist"
+		if eventName != "" {
+			listTitle = eventName
+		}
+		claimEmail := GuestClaimEmail{
+			ConfirmURL: guestClaimURL(svr, externalID, confirmAction),
+			ItemName:   page.ItemName,
+			ListTitle:  listTitle,
+			Name:       name,
+			ReleaseURL: guestClaimURL(svr, externalID, releaseAction),
+		}
+		if err = emailer.SendGuestClaimEmail(ctx, []string{email}, claimEmail, svr.Getenv); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error sending the guest claim email",
+				slog.String("errorMessage", err.Error()),
+			)
+			if _, err := svr.DB.Execute(ctx, deleteGuestClaimStatement, externalID); err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error clearing the unconfirmable guest claim",
+					slog.String("errorMessage", err.Error()),
+				)
+			}
+			page.ErrorMessage = "Could not send the confirmation email, please try again."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeGuestClaimPage(ctx, svr, res, page)
+			return
+		}
+
+		page.Message = fmt.Sprintf(
+			"We emailed a confirmation link to %s. Your claim on %s isn't active until you confirm it.",
+			email,
+			page.ItemName,
+		)
+		writeGuestClaimPage(ctx, svr, res, page)
+
+	})
+
+}
+
+// GuestClaimLinkHandler is where the links in the guest claim email land. It
+// only shows a button to confirm (or release) the claim, so email scanners
+// following the link don't act on it.
+func GuestClaimLinkHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("guest_claim_link")
+
+		externalID := req.PathValue("externalID")
+		action := req.PathValue("action")
+		signature := req.URL.Query().Get("sig")
+		span.SetAttributes(
+			attribute.String("guest_claim_external_id", externalID),
+			attribute.String("action", action),
+		)
+
+		page, status, ok := lookupGuestClaim(ctx, svr, res, externalID, action, signature)
+		if !ok {
+			return
+		}
+
+		switch {
+		case action == confirmAction && status == "PENDING":
+			page.ActionLabel = "Confirm my claim"
+		case action == releaseAction && status != "RELEASED":
+			page.ActionLabel = "Release my claim"
+		default:
+			page.Message = guestClaimStatusMessage(page.ItemName, status)
+		}
+		if page.ActionLabel != "" {
+			page.PostURL = req.URL.Path
+			page.Signature = signature
+		}
+
+		writeGuestClaimPage(ctx, svr, res, page)
+
+	})
+
+}
+
+// GuestClaimActionHandler confirms or releases a guest claim, if the link's
+// signature checks out.
+func GuestClaimActionHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("guest_claim_action")
+
+		externalID := req.PathValue("externalID")
+		action := req.PathValue("action")
+		span.SetAttributes(
+			attribute.String("guest_claim_external_id", externalID),
+			attribute.String("action", action),
+		)
+
+		page, _, ok := lookupGuestClaim(ctx, svr, res, externalID, action, req.FormValue("sig"))
+		if !ok {
+			return
+		}
+
+		statement := confirmGuestClaimStatement
+		if action == releaseAction {
+			statement = releaseGuestClaimStatement
+		}
+
+		result, err := svr.DB.Execute(ctx, statement, time.Now().UTC(), externalID)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error updating the guest claim",
+				slog.String("errorMessage", err.Error()),
+			)
+			page.ErrorMessage = "Could not update your claim, please try again."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeGuestClaimPage(ctx, svr, res, page)
+			return
+		}
+
+		if updated, err := result.RowsAffected(); err == nil && updated > 0 {
+
+			status, auditAction := "ACTIVE", audit.Confirm
+			if action == releaseAction {
+				status, auditAction = "RELEASED", audit.Release
+			}
+			page.Message = guestClaimStatusMessage(page.ItemName, status)
+			audit.Record(ctx, svr, 0, audit.Event{
+				Action:   auditAction,
+				After:    map[string]string{"status": status},
+				Entity:   audit.GuestClaim,
+				EntityID: externalID,
+			})
+
+		} else {
+
+			/* Nothing changed, so report whatever state the claim is in now */
+			var status string
+			if err := svr.DB.QueryRow(ctx, guestClaimLookupQuery, externalID).Scan(&page.ItemName, &status); err != nil {
+				page.ErrorMessage = "Could not update your claim, please try again."
+			} else if action == confirmAction && status == "PENDING" {
+				page.Message = fmt.Sprintf("Sorry, %s isn't available anymore.", page.ItemName)
+			} else {
+				page.Message = guestClaimStatusMessage(page.ItemName, status)
+			}
+
+		}
+
+		writeGuestClaimPage(ctx, svr, res, page)
+
+	})
+
+}
+
+func guestClaimStatusMessage(itemName string, status string) string {
+
+	switch status {
+	case "ACTIVE":
+		return fmt.Sprintf("Your claim on %s is confirmed. If plans change, use the release link in the email.", itemName)
+	case "RELEASED":
+		return fmt.Sprintf("Your claim on %s has been released.", itemName)
+	default:
+		return fmt.Sprintf("Your claim on %s hasn't been confirmed yet.", itemName)
+	}
+
+}
+
+func guestClaimURL(svr *util.ServerUtils, externalID string, action string) string {
+	return util.AppURL(svr, fmt.Sprintf(
+		"/guest-claims/%s/%s?sig=%s",
+		url.PathEscape(externalID),
+		action,
+		url.QueryEscape(util.SignLink(svr, action, externalID)),
+	))
+}
+
+/*
+Checks the link's signature and looks up the claim it's for. Writes the error
+response and returns false if either fails.
+*/
+func lookupGuestClaim(
+	ctx context.Context,
+	svr *util.ServerUtils,
+	res http.ResponseWriter,
+	externalID string,
+	action string,
+	signature string,
+) (guestClaimPage, string, bool) {
+
+	var page guestClaimPage
+	if (action != confirmAction && action != releaseAction) || !util.ValidSignature(svr, action, externalID, signature) {
+		svr.Logger.InfoContext(ctx, "Guest claim link with a bad signature", slog.String("externalID", externalID))
+		res.WriteHeader(404)
+		res.Write([]byte("This link isn't valid"))
+		return page, "", false
+	}
+
+	var status string
+	err := svr.DB.QueryRow(ctx, guestClaimLookupQuery, externalID).Scan(&page.ItemName, &status)
+	if err == sql.ErrNoRows {
+		res.WriteHeader(404)
+		res.Write([]byte("This claim doesn't exist anymore"))
+		return page, "", false
+	} else if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error looking up the guest claim",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your claim"))
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("error_message", err.Error()))
+		return page, "", false
+	}
+
+	return page, status, true
+
+}
+
+func writeGuestClaimPage(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, page guestClaimPage) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/guest_claim.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the guest claim template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your claim"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "guest-claim-page", page); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
@@ -0,0 +1,185 @@
+package registry_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestGuestClaim claims an item from a share link without an account, then
+// follows the links from the email the way the guest would.
+func TestGuestClaim(t *testing.T) {
+	testData := []struct {
+		confirmStatus   int
+		expectedStatus  string
+		externalIDStart string
+		memberClaim     bool
+		message         string
+		release         bool
+		tamper          bool
+		testName        string
+	}{
+		{
+			confirmStatus:   http.StatusOK,
+			expectedStatus:  "ACTIVE",
+			externalIDStart: "guest-confirm",
+			message:         "Your claim on Board game is confirmed. If plans change, use the release link in the email.",
+			testName:        "Confirm the claim",
+		},
+		{
+			confirmStatus:   http.StatusNotFound,
+			expectedStatus:  "PENDING",
+			externalIDStart: "guest-tamper",
+			tamper:          true,
+			testName:        "Bad signature",
+		},
+		{
+			confirmStatus:   http.StatusOK,
+			expectedStatus:  "PENDING",
+			externalIDStart: "guest-taken",
+			memberClaim:     true,
+			message:         "Sorry, Board game isn't available anymore.",
+			testName:        "Already claimed",
+		},
+		{
+			confirmStatus:   http.StatusOK,
+			expectedStatus:  "RELEASED",
+			externalIDStart: "guest-release",
+			message:         "Your claim on Board game has been released.",
+			release:         true,
+			testName:        "Release the claim",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			ownerID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:      data.externalIDStart + "-owner@localhost.com",
+				ExternalID: data.externalIDStart + "-owner",
+				FirstName:  "Sharer",
+				LastName:   "Owner",
+			})
+			if err != nil {
+				t.Fatal("Could not create the list owner", err)
+			}
+
+			itemID, err := test.CreateItem(ctx, db, test.ItemData{
+				ExternalID: data.externalIDStart + "-item",
+				Name:       "Board game",
+				PersonID:   ownerID,
+			})
+			if err != nil {
+				t.Fatal("Could not create the item", err)
+			}
+
+			if err = test.CreateShareLink(ctx, db, data.externalIDStart+"-token", ownerID, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			guestEmail := data.externalIDStart + "-guest@localhost.com"
+			res, err := http.PostForm(testServer.URL+"/share/"+data.externalIDStart+"-token/claim", url.Values{
+				"email": {guestEmail},
+				"item":  {data.externalIDStart + "-item"},
+				"name":  {"Guest"},
+			})
+			if err != nil {
+				t.Fatal("Error claiming the item!", err)
+			}
+			_ = res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected status 200 claiming the item but got", res.StatusCode)
+			}
+
+			sent := emailer.GuestClaimsSent(guestEmail)
+			if len(sent) != 1 {
+				t.Fatal("Expected 1 guest claim email but got", len(sent))
+			}
+
+			if data.memberClaim {
+				memberID, err := test.CreateUser(ctx, logger, db, test.UserData{
+					Email:      data.externalIDStart + "-member@localhost.com",
+					ExternalID: data.externalIDStart + "-member",
+					FirstName:  "Member",
+					LastName:   "Giver",
+				})
+				if err != nil {
+					t.Fatal("Could not create the member", err)
+				}
+				if err = test.CreateClaim(ctx, db, itemID, memberID, "CLAIMED"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if data.release {
+				followClaimLink(t, sent[0].ConfirmURL, false, http.StatusOK)
+			}
+
+			link := sent[0].ConfirmURL
+			if data.release {
+				link = sent[0].ReleaseURL
+			}
+			doc := followClaimLink(t, link, data.tamper, data.confirmStatus)
+
+			if doc != nil && data.message != "" {
+				err = test.ValidatePage(doc, map[string]test.ElementValidation{
+					"guest-claim-message": {Value: data.message, Visible: true},
+				})
+				if err != nil {
+					t.Fatal("Claim page validation failed!", err)
+				}
+			}
+
+			var status string
+			err = db.QueryRow(ctx, "SELECT status FROM guest_claim WHERE item_id = ?", itemID).Scan(&status)
+			if err != nil {
+				t.Fatal("Could not look up the guest claim", err)
+			} else if status != data.expectedStatus {
+				t.Fatal("Expected the guest claim to be", data.expectedStatus, "but it was", status)
+			}
+		})
+	}
+}
+
+/*
+Posts the signed link from the guest claim email, the same as the button on
+the page it lands on.
+*/
+func followClaimLink(t *testing.T, link string, tamper bool, expectedStatus int) *html.Node {
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal("Could not parse the claim link", link, err)
+	} else if parsed.Host != "gift-registry.localhost" {
+		t.Fatal("Expected the claim link to use the configured address but got", link)
+	}
+
+	sig := parsed.Query().Get("sig")
+	if tamper {
+		sig = "not-" + sig
+	}
+
+	res, err := http.PostForm(testServer.URL+parsed.Path, url.Values{"sig": {sig}})
+	if err != nil {
+		t.Fatal("Error following the claim link!", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != expectedStatus {
+		t.Fatal("Expected status", expectedStatus, "from", parsed.Path, "but got", res.StatusCode)
+	} else if expectedStatus != http.StatusOK {
+		return nil
+	}
+
+	doc, err := html.Parse(res.Body)
+	if err != nil {
+		t.Fatal("Error parsing response body!", err)
+	}
+
+	return doc
+
+}
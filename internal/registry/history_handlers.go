@@ -0,0 +1,274 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type historyItem struct {
+	EventName string
+	Giver     string
+	Name      string
+	Price     string
+}
+
+type historyYear struct {
+	Count int
+	Items []historyItem
+	Total string
+	Year  int
+	total int64
+}
+
+type historyPerson struct {
+	ExternalID string
+	Name       string
+	Total      string
+	Years      []historyYear
+	total      int64
+}
+
+type giftHistory struct {
+	ErrorMessage string
+	People       []historyPerson
+	Received     bool
+}
+
+const (
+	/*
+		Only events that have already happened are included, so nothing here
+		gives away a claim before the recipient has opened it. Archived and
+		deleted items still count, the gift was given either way. Items that
+		aren't tied to an event count toward the recipient's first event after
+		the claim was made.
+	*/
+	givenHistoryQuery = `SELECT p.external_id,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name),
+			e.event_date,
+			e.name,
+			i.name,
+			i.price_cents,
+			''
+		FROM claim c
+			INNER JOIN item i ON i.item_id = c.item_id
+			INNER JOIN person p ON p.person_id = i.person_id
+			INNER JOIN event e ON e.event_id = COALESCE(i.event_id, (
+				SELECT ne.event_id
+				FROM event ne
+					INNER JOIN event_person ep ON ep.event_id = ne.event_id
+				WHERE ep.person_id = i.person_id
+					AND ep.role = 'RECIPIENT'
+					AND ne.event_date >= c.claimed_on
+				ORDER BY ne.event_date
+				LIMIT 1))
+		WHERE c.person_id = ?
+			AND e.event_date < ?
+		ORDER BY COALESCE(NULLIF(p.display_name, ''), p.first_name), p.external_id, e.event_date DESC, i.name`
+	receivedView = "received"
+	/*
+		Everything the person and the rest of their households received, from
+		members and confirmed guests, again only for events that are over.
+	*/
+	receivedHistoryQuery = `SELECT p.external_id AS recipient_id,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name) AS recipient_name,
+			e.event_date AS event_date,
+			e.name,
+			i.name AS item_name,
+			i.price_cents,
+			COALESCE(NULLIF(g.display_name, ''), g.first_name)
+		FROM claim c
+			INNER JOIN item i ON i.item_id = c.item_id
+			INNER JOIN person p ON p.person_id = i.person_id
+			INNER JOIN person g ON g.person_id = c.person_id
+			INNER JOIN event e ON e.event_id = COALESCE(i.event_id, (
+				SELECT ne.event_id
+				FROM event ne
+					INNER JOIN event_person ep ON ep.event_id = ne.event_id
+				WHERE ep.person_id = i.person_id
+					AND ep.role = 'RECIPIENT'
+					AND ne.event_date >= c.claimed_on
+				ORDER BY ne.event_date
+				LIMIT 1))
+		WHERE (i.person_id = ? OR i.person_id IN (
+				SELECT hp.person_id
+				FROM household_person hp
+				WHERE hp.household_id IN (SELECT household_id FROM household_person WHERE person_id = ?)))
+			AND e.event_date < ?
+		UNION ALL
+		SELECT p.external_id,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name),
+			e.event_date,
+			e.name,
+			i.name,
+			i.price_cents,
+			gc.name
+		FROM guest_claim gc
+			INNER JOIN item i ON i.item_id = gc.item_id
+			INNER JOIN person p ON p.person_id = i.person_id
+			INNER JOIN event e ON e.event_id = COALESCE(i.event_id, (
+				SELECT ne.event_id
+				FROM event ne
+					INNER JOIN event_person ep ON ep.event_id = ne.event_id
+				WHERE ep.person_id = i.person_id
+					AND ep.role = 'RECIPIENT'
+					AND ne.event_date >= gc.confirmed_on
+				ORDER BY ne.event_date
+				LIMIT 1))
+		WHERE gc.status = 'ACTIVE'
+			AND (i.person_id = ? OR i.person_id IN (
+				SELECT hp.person_id
+				FROM household_person hp
+				WHERE hp.household_id IN (SELECT household_id FROM household_person WHERE person_id = ?)))
+			AND e.event_date < ?
+		ORDER BY recipient_name, recipient_id, event_date DESC, item_name`
+)
+
+// GiftHistoryHandler shows what the logged-in person has given each recipient
+// in past events, totalled by year. A "view=received" query parameter shows
+// what the people in their households received instead.
+func GiftHistoryHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("gift_history_handler")
+
+		tmpl, err := template.New("gift_history.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/gift_history.html")
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the gift history template",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error rendering the gift history"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		personID := middleware.PersonID(res, req)
+		received := req.URL.Query().Get("view") == receivedView
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.Bool("received", received),
+		)
+
+		now := time.Now().UTC()
+		query, params := givenHistoryQuery, []any{personID, now}
+		if received {
+			query, params = receivedHistoryQuery, []any{personID, personID, now, personID, personID, now}
+		}
+
+		history, err := lookupHistory(ctx, svr, query, params)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the gift history",
+				slog.Int64("personID", personID),
+				slog.String("errorMessage", err.Error()),
+			)
+			history.ErrorMessage = "Could not look up the gift history."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+		history.Received = received
+		span.SetAttributes(attribute.Int("recipient_count", len(history.People)))
+
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "gift-history-page", history)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the gift history"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+	})
+
+}
+
+/*
+Folds the (already sorted) rows into recipient -> year -> gift groupings,
+counting and totalling each year and recipient as it goes.
+*/
+func lookupHistory(ctx context.Context, svr *util.ServerUtils, query string, params []any) (giftHistory, error) {
+
+	history := giftHistory{
+		People: []historyPerson{},
+	}
+
+	rows, err := svr.DB.Query(ctx, query, params...)
+	if err != nil {
+		return history, fmt.Errorf("error querying the gift history: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item       historyItem
+			externalID string
+			name       string
+			eventDate  time.Time
+			cents      int64
+		)
+
+		err = rows.Scan(&externalID, &name, &eventDate, &item.EventName, &item.Name, &cents, &item.Giver)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		item.Price = formatPrice(cents)
+
+		if len(history.People) == 0 || history.People[len(history.People)-1].ExternalID != externalID {
+			history.People = append(history.People, historyPerson{
+				ExternalID: externalID,
+				Name:       name,
+				Years:      []historyYear{},
+			})
+		}
+		person := &history.People[len(history.People)-1]
+
+		if len(person.Years) == 0 || person.Years[len(person.Years)-1].Year != eventDate.Year() {
+			person.Years = append(person.Years, historyYear{
+				Items: []historyItem{},
+				Year:  eventDate.Year(),
+			})
+		}
+		year := &person.Years[len(person.Years)-1]
+
+		year.Items = append(year.Items, item)
+		year.Count++
+		year.total += cents
+		person.total += cents
+
+	}
+
+	for personIdx := range history.People {
+
+		person := &history.People[personIdx]
+		person.Total = formatPrice(person.total)
+		for yearIdx := range person.Years {
+			person.Years[yearIdx].Total = formatPrice(person.Years[yearIdx].total)
+		}
+
+	}
+
+	return history, nil
+
+}
@@ -0,0 +1,233 @@
+package registry_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestGiftHistory checks both history views only include past events, that
+// archived items and items without an event still count, and that confirmed
+// guest claims show up as received.
+func TestGiftHistory(t *testing.T) {
+	pastDate := time.Now().UTC().AddDate(0, -1, 0)
+	testData := []struct {
+		expectedCount   string
+		expectedTotal   string
+		externalIDStart string
+		path            string
+		sessionUser     string
+		testName        string
+	}{
+		{
+			expectedCount:   "3",
+			expectedTotal:   "$25.00",
+			externalIDStart: "history-given",
+			path:            "/registry/history",
+			sessionUser:     "giver",
+			testName:        "Gifts given",
+		},
+		{
+			expectedCount:   "4",
+			expectedTotal:   "$30.00",
+			externalIDStart: "history-received",
+			path:            "/registry/history?view=received",
+			sessionUser:     "recipient",
+			testName:        "Gifts received",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			people := map[string]test.UserData{}
+			ids := map[string]int64{}
+			for _, role := range []string{"giver", "recipient"} {
+
+				people[role] = test.UserData{
+					Email:      data.externalIDStart + "-" + role + "@localhost.com",
+					ExternalID: data.externalIDStart + "-" + role,
+					FirstName:  "History",
+					LastName:   role,
+				}
+
+			}
+
+			token, err := test.CreateSession(ctx, logger, db, people[data.sessionUser], time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session for ", data.testName, err)
+			}
+
+			for role, userData := range people {
+
+				var id int64
+				if role == data.sessionUser {
+					err = db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", userData.ExternalID).Scan(&id)
+				} else {
+					id, err = test.CreateUser(ctx, logger, db, userData)
+				}
+				if err != nil {
+					t.Fatal("Could not set up the", role, err)
+				}
+				ids[role] = id
+
+			}
+
+			events := map[string]time.Time{
+				"past":   pastDate,
+				"future": time.Now().UTC().AddDate(0, 1, 0),
+			}
+			for when, date := range events {
+
+				eventID, err := test.CreateEvent(ctx, db, test.EventData{
+					Date:       date,
+					ExternalID: data.externalIDStart + "-" + when,
+					Name:       "History " + when,
+				})
+				if err != nil {
+					t.Fatal("Could not create the event", err)
+				}
+				if err = test.AddEventPerson(ctx, db, eventID, ids["recipient"], "RECIPIENT"); err != nil {
+					t.Fatal(err)
+				}
+
+				for idx := range 2 {
+
+					itemID, err := test.CreateItem(ctx, db, test.ItemData{
+						EventID:    eventID,
+						ExternalID: fmt.Sprintf("%s-%s-item-%d", data.externalIDStart, when, idx),
+						Name:       fmt.Sprintf("Gift %d", idx),
+						PersonID:   ids["recipient"],
+						PriceCents: 1000,
+					})
+					if err != nil {
+						t.Fatal("Could not create the item", err)
+					}
+					if err = test.CreateClaim(ctx, db, itemID, ids["giver"], "PURCHASED"); err != nil {
+						t.Fatal(err)
+					}
+
+				}
+
+			}
+
+			/*
+				Items without an event belong to the recipient's first event after
+				the claim, so only the one claimed before the past event counts
+			*/
+			for when, claimedOn := range map[string]time.Time{
+				"early": pastDate.AddDate(0, -1, 0),
+				"late":  time.Now().UTC(),
+			} {
+
+				itemID, err := test.CreateItem(ctx, db, test.ItemData{
+					ExternalID: data.externalIDStart + "-" + when + "-unlinked",
+					Name:       "Unlinked gift " + when,
+					PersonID:   ids["recipient"],
+					PriceCents: 500,
+				})
+				if err != nil {
+					t.Fatal("Could not create the item", err)
+				}
+				if err = test.CreateClaim(ctx, db, itemID, ids["giver"], "CLAIMED"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = db.Execute(ctx, "UPDATE claim SET claimed_on = ? WHERE item_id = ?", claimedOn, itemID); err != nil {
+					t.Fatal("Could not date the claim", err)
+				}
+
+			}
+
+			/* A confirmed guest claim was received too, a released one wasn't */
+			for _, status := range []string{"ACTIVE", "RELEASED"} {
+
+				itemID, err := test.CreateItem(ctx, db, test.ItemData{
+					ExternalID: data.externalIDStart + "-guest-" + status,
+					Name:       "Guest gift " + status,
+					PersonID:   ids["recipient"],
+					PriceCents: 500,
+				})
+				if err != nil {
+					t.Fatal("Could not create the item", err)
+				}
+				_, err = db.Execute(ctx,
+					"INSERT INTO guest_claim (external_id, item_id, name, email, status, confirmed_on) VALUES (?, ?, ?, ?, ?, ?)",
+					data.externalIDStart+"-guest-claim-"+status, itemID, "Guest Aunt", data.externalIDStart+"-guest@localhost.com", status, pastDate.AddDate(0, -1, 0),
+				)
+				if err != nil {
+					t.Fatal("Could not create the guest claim", err)
+				}
+
+			}
+
+			/* An item removed after the fact still belongs in the history */
+			_, err = db.Execute(ctx, "UPDATE item SET archived_on = ? WHERE external_id = ?",
+				time.Now().UTC(), data.externalIDStart+"-past-item-1")
+			if err != nil {
+				t.Fatal("Could not archive the item", err)
+			}
+
+			sessCookie := http.Cookie{
+				HttpOnly: true,
+				MaxAge:   time.Now().UTC().Add(time.Minute * 1).Second(),
+				Name:     middleware.SessionCookie,
+				SameSite: http.SameSiteStrictMode,
+				Secure:   true,
+				Value:    token,
+			}
+
+			req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+data.path, nil)
+			if err != nil {
+				t.Fatal("Error building gift history request", err)
+			}
+
+			req.AddCookie(&sessCookie)
+			req.Header.Set("User-Agent", userAgent)
+			req.Header.Set("Sec-Fetch-Dest", "document")
+			req.Header.Set("Sec-Fetch-Mode", "same-origin")
+			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			res, err := http.DefaultClient.Do(req)
+			defer func() {
+				if res != nil && res.Body != nil {
+					_ = res.Body.Close()
+				}
+			}()
+			if err != nil {
+				t.Fatal("Error getting the gift history!", err)
+			} else if res.StatusCode != http.StatusOK {
+				t.Fatal("Got an error status from the server!", res.StatusCode)
+			}
+
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+
+			recipientExtID := people["recipient"].ExternalID
+			year := pastDate.Year()
+			err = test.ValidatePage(doc, map[string]test.ElementValidation{
+				"history-empty":                    {Visible: false},
+				"history-error":                    {Visible: false},
+				"history-person-" + recipientExtID: {Visible: true},
+				fmt.Sprintf("history-count-%s-%d", recipientExtID, year): {
+					Value:   data.expectedCount,
+					Visible: true,
+				},
+				"history-total-" + recipientExtID: {
+					Value:   data.expectedTotal,
+					Visible: true,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
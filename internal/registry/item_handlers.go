@@ -0,0 +1,932 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/notification"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type itemErrors struct {
+	ErrorMessage string
+	Name         string
+	Price        string
+	Size         string
+	Store        string
+	URL          string
+}
+
+type itemData struct {
+	Errors     itemErrors
+	ExternalID string
+	Name       string
+	Price      string
+	Size       string
+	Store      string
+	URL        string
+	itemID     int64
+	ownerID    int64
+	priceCents int64
+	valid      bool
+}
+
+/* What the audit log keeps of an item */
+type itemSnapshot struct {
+	Name       string `json:"name"`
+	PriceCents int64  `json:"priceCents"`
+	Size       string `json:"size"`
+	Store      string `json:"store"`
+	URL        string `json:"url"`
+}
+
+/* Takes the place of a deleted item's card for a few seconds */
+type undoToast struct {
+	ID      string
+	Message string
+	UndoURL string
+}
+
+type itemsPage struct {
+	Errors  itemErrors
+	Items   []itemData
+	NewItem itemData
+}
+
+const (
+	/*
+		Deleted items stay around (and can be restored) until the database purge
+		catches them. Claimed ones are archived then, instead of purged, so they
+		still show up in the gift history.
+	*/
+	deleteItemStatement = `UPDATE item SET deleted_on = ? WHERE item_id = ?`
+	/* Same as itemLookupQuery, for an item that was deleted but not purged yet */
+	deletedItemLookupQuery = `SELECT i.item_id,
+			i.external_id,
+			i.person_id,
+			i.name,
+			i.size,
+			i.store,
+			i.url,
+			i.price_cents
+		FROM item i
+		WHERE i.external_id = ?
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NOT NULL
+			AND (i.person_id = ? OR i.person_id IN (
+				SELECT p.person_id
+				FROM person p
+					INNER JOIN household_person hp ON hp.person_id = p.person_id
+				WHERE p.type = 'MANAGED'
+					AND p.deleted_on IS NULL
+					AND hp.household_id = (SELECT household_id FROM household_person WHERE person_id = ?)))`
+	insertItemStatement = `INSERT INTO item (external_id, person_id, name, size, store, url, price_cents)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	/*
+		Like the profile lookups, the second part of the WHERE clause makes sure the
+		item either belongs to the logged in user or a managed profile in their
+		household.
+	*/
+	itemLookupQuery = `SELECT i.item_id,
+			i.external_id,
+			i.person_id,
+			i.name,
+			i.size,
+			i.store,
+			i.url,
+			i.price_cents
+		FROM item i
+		WHERE i.external_id = ?
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NULL
+			AND (i.person_id = ? OR i.person_id IN (
+				SELECT p.person_id
+				FROM person p
+					INNER JOIN household_person hp ON hp.person_id = p.person_id
+				WHERE p.type = 'MANAGED'
+					AND p.deleted_on IS NULL
+					AND hp.household_id = (SELECT household_id FROM household_person WHERE person_id = ?)))`
+	itemsQuery = `SELECT item_id, external_id, person_id, name, size, store, url, price_cents
+		FROM item
+		WHERE person_id = ?
+			AND archived_on IS NULL
+			AND deleted_on IS NULL
+		ORDER BY name`
+	/* A million dollars is more than anyone's asking for on a gift list */
+	maxPriceCents        = 100000000
+	maxPriceDigits       = 9
+	restoreItemStatement = `UPDATE item SET deleted_on = NULL WHERE item_id = ?`
+	/* Price changes smaller than this percentage aren't worth notifying about */
+	significantPriceChange = 10
+	updateItemStatement    = `UPDATE item SET name = ?, size = ?, store = ?, url = ?, price_cents = ?
+		WHERE item_id = ?`
+	urlMaxLength     = 2048
+	varcharMaxLength = 255
+	/* Unlike a delete, this archives the item right away, claimed or not */
+	withdrawItemStatement = `UPDATE item SET archived_on = ? WHERE item_id = ?`
+)
+
+// ItemsHandler shows the logged-in person's own list, with a form for adding
+// new items and editing the existing ones.
+func ItemsHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("items_handler")
+
+		tmpl, err := parseItemTemplates(ctx, svr)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the item templates",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error rendering your list"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		page := loadItemsPage(ctx, svr, personID)
+		span.SetAttributes(attribute.Int("item_count", len(page.Items)))
+
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "items-page", page)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading your list"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+	})
+
+}
+
+// ItemCreateHandler adds a new item to the logged-in person's list and lets
+// the rest of their household know about it.
+func ItemCreateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("item_create")
+
+		tmpl, err := parseItemTemplates(ctx, svr)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the item templates",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the item templates!"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		item, err := parseItemForm(req)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error parsing the new item form",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(400)
+			res.Write([]byte("Could not read the item data"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		item.validate()
+		span.SetAttributes(attribute.Bool("data_valid", item.valid))
+
+		if item.valid {
+
+			item.ExternalID = rand.Text()
+			item.ownerID = personID
+			_, err = svr.DB.Execute(ctx, insertItemStatement, item.ExternalID, personID, item.Name, item.Size, item.Store, item.URL, item.priceCents)
+			if err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error adding the item",
+					slog.String("errorMessage", err.Error()),
+				)
+				item.Errors.ErrorMessage = "Could not add the item"
+				item.valid = false
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+			} else {
+				span.SetAttributes(attribute.String("item_external_id", item.ExternalID))
+				recordChange(ctx, svr, personID, item, notification.Added, "")
+				audit.Record(ctx, svr, personID, audit.Event{
+					Action:   audit.Create,
+					After:    item.snapshot(),
+					Entity:   audit.Item,
+					EntityID: item.ExternalID,
+				})
+			}
+
+		}
+
+		page := loadItemsPage(ctx, svr, personID)
+		if !item.valid {
+			page.NewItem = item
+		}
+
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "items-content", page)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading your list"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+	})
+
+}
+
+// ItemUpdateHandler saves changes to an item on the logged-in person's list (or
+// the list of a managed profile in their household). Significant changes are
+// passed along to the rest of the household.
+func ItemUpdateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("item_update")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("item_external_id", externalID),
+		)
+
+		tmpl, err := parseItemTemplates(ctx, svr)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the item templates",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the item templates!"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		item, err := parseItemForm(req)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error parsing the item update form",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(400)
+			res.Write([]byte("Could not read the item data"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+		item.ExternalID = externalID
+
+		existing, err := lookupItem(ctx, svr, itemLookupQuery, externalID, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error looking up item to update",
+				slog.String("errorMessage", err.Error()),
+			)
+			item.Errors.ErrorMessage = "Could not update the item"
+			writeItemForm(ctx, res, svr, span, tmpl, item)
+			return
+		}
+		item.itemID = existing.itemID
+		item.ownerID = existing.ownerID
+
+		item.validate()
+		span.SetAttributes(attribute.Bool("data_valid", item.valid))
+		if !item.valid {
+			writeItemForm(ctx, res, svr, span, tmpl, item)
+			return
+		}
+
+		_, err = svr.DB.Execute(ctx, updateItemStatement, item.Name, item.Size, item.Store, item.URL, item.priceCents, item.itemID)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error updating the item",
+				slog.String("errorMessage", err.Error()),
+			)
+			item.Errors.ErrorMessage = "Could not save the item update"
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeItemForm(ctx, res, svr, span, tmpl, item)
+			return
+		}
+
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Update,
+			After:    item.snapshot(),
+			Before:   existing.snapshot(),
+			Entity:   audit.Item,
+			EntityID: item.ExternalID,
+		})
+
+		if changes := significantChanges(existing, item); len(changes) > 0 {
+			recordChange(ctx, svr, personID, item, notification.Edited, strings.Join(changes, "; "))
+		}
+		if changes := claimerChanges(existing, item); len(changes) > 0 {
+			alertClaimers(ctx, svr, personID, item, notification.Edited, strings.Join(changes, "; "))
+		}
+
+		writeItemForm(ctx, res, svr, span, tmpl, item)
+
+	})
+
+}
+
+// ItemDeleteHandler removes an item from the logged-in person's list, or the
+// list of a managed profile in their household. The item is only soft-deleted,
+// so it can be put back with ItemRestoreHandler until the database purges it.
+func ItemDeleteHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("item_delete")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("item_external_id", externalID),
+		)
+
+		tmpl, err := parseItemTemplates(ctx, svr)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the item templates",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the item templates!"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		existing, err := lookupItem(ctx, svr, itemLookupQuery, externalID, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error looking up item to delete",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(404)
+			res.Write([]byte("Could not find the item to delete"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		if _, err = svr.DB.Execute(ctx, deleteItemStatement, time.Now().UTC(), existing.itemID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error deleting the item",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Could not delete the item"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		recordChange(ctx, svr, personID, existing, notification.Removed, "")
+		alertClaimers(ctx, svr, personID, existing, notification.Removed, "")
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Delete,
+			Before:   existing.snapshot(),
+			Entity:   audit.Item,
+			EntityID: existing.ExternalID,
+		})
+
+		/* htmx swaps the item's card out for the "Undo" toast */
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "undo-toast", undoToast{
+			ID:      "item-" + existing.ExternalID,
+			Message: fmt.Sprintf("Removed %s from the list.", existing.Name),
+			UndoURL: "/registry/items/" + existing.ExternalID + "/restore",
+		})
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+
+	})
+
+}
+
+// ItemRestoreHandler puts a deleted item back on the list it came from (the
+// "Undo" after a delete). Anyone who was told it was removed hears that it's
+// back.
+func ItemRestoreHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("item_restore")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("item_external_id", externalID),
+		)
+
+		tmpl, err := parseItemTemplates(ctx, svr)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the item templates",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the item templates!"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		existing, err := lookupItem(ctx, svr, deletedItemLookupQuery, externalID, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error looking up item to restore",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(404)
+			res.Write([]byte("Could not find the item to restore"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		if _, err = svr.DB.Execute(ctx, restoreItemStatement, existing.itemID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error restoring the item",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Could not restore the item"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		recordChange(ctx, svr, personID, existing, notification.Added, "back on the list")
+		alertClaimers(ctx, svr, personID, existing, notification.Edited, "back on the list")
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Restore,
+			After:    existing.snapshot(),
+			Entity:   audit.Item,
+			EntityID: existing.ExternalID,
+		})
+
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "item-card", existing)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+
+	})
+
+}
+
+// ItemWithdrawHandler marks an item on the logged-in person's list (or a
+// managed profile's list) as no longer wanted. It comes off the list like a
+// delete, but anyone who claimed it is told it isn't wanted anymore.
+func ItemWithdrawHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("item_withdraw")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("item_external_id", externalID),
+		)
+
+		existing, err := lookupItem(ctx, svr, itemLookupQuery, externalID, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error looking up item to withdraw",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(404)
+			res.Write([]byte("Could not find the item"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		if _, err = svr.DB.Execute(ctx, withdrawItemStatement, time.Now().UTC(), existing.itemID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error withdrawing the item",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Could not update the item"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		recordChange(ctx, svr, personID, existing, notification.Removed, "no longer wanted")
+		alertClaimers(ctx, svr, personID, existing, notification.Withdrawn, "")
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Withdraw,
+			Before:   existing.snapshot(),
+			Entity:   audit.Item,
+			EntityID: existing.ExternalID,
+		})
+
+		/* htmx swaps the item's card out for this (empty) response */
+		res.WriteHeader(200)
+
+	})
+
+}
+
+func loadItemsPage(ctx context.Context, svr *util.ServerUtils, personID int64) itemsPage {
+
+	page := itemsPage{
+		Items: []itemData{},
+	}
+
+	rows, err := svr.DB.Query(ctx, itemsQuery, personID)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the list items", slog.String("errorMessage", err.Error()))
+		page.Errors.ErrorMessage = "Could not look up your list."
+		return page
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var item itemData
+		err = rows.Scan(&item.itemID, &item.ExternalID, &item.ownerID, &item.Name, &item.Size, &item.Store, &item.URL, &item.priceCents)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		item.Price = priceInput(item.priceCents)
+		page.Items = append(page.Items, item)
+
+	}
+
+	return page
+
+}
+
+/* Looks up the item with either itemLookupQuery or deletedItemLookupQuery */
+func lookupItem(ctx context.Context, svr *util.ServerUtils, query string, externalID string, personID int64) (itemData, error) {
+
+	var item itemData
+	err := svr.DB.QueryRow(ctx, query, externalID, personID, personID).
+		Scan(&item.itemID, &item.ExternalID, &item.ownerID, &item.Name, &item.Size, &item.Store, &item.URL, &item.priceCents)
+	if err == sql.ErrNoRows {
+		return item, fmt.Errorf("no item %s on a list person %d manages", externalID, personID)
+	} else if err != nil {
+		return item, fmt.Errorf("error looking up item %s: %v", externalID, err)
+	}
+
+	item.Price = priceInput(item.priceCents)
+	return item, nil
+
+}
+
+func parseItemForm(req *http.Request) (itemData, error) {
+
+	if err := req.ParseForm(); err != nil {
+		return itemData{}, err
+	}
+
+	return itemData{
+		Name:  strings.TrimSpace(req.FormValue("name")),
+		Price: strings.TrimSpace(req.FormValue("price")),
+		Size:  strings.TrimSpace(req.FormValue("size")),
+		Store: strings.TrimSpace(req.FormValue("store")),
+		URL:   strings.TrimSpace(req.FormValue("url")),
+	}, nil
+
+}
+
+func parseItemTemplates(ctx context.Context, svr *util.ServerUtils) (*template.Template, error) {
+	templatesDir := svr.Getenv("TEMPLATES_DIR")
+	return template.New("items_page.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(templatesDir+"/items_page.html", templatesDir+"/item_form.html", templatesDir+"/undo_toast.html")
+}
+
+/*
+Reads a dollar amount (like "$19.99", "20" or "4.5") as cents. The digits are
+read as a string, not a float, so there's no rounding, and things ParseFloat
+would take like "NaN", "Inf" or "1e30" aren't prices.
+*/
+func parsePrice(price string) (int64, error) {
+
+	dollars, fraction, _ := strings.Cut(strings.TrimPrefix(price, "$"), ".")
+	if (dollars == "" && fraction == "") || len(fraction) > 2 || len(dollars) > maxPriceDigits {
+		return 0, fmt.Errorf("%q isn't a dollar amount", price)
+	}
+	for _, digit := range dollars + fraction {
+		if digit < '0' || digit > '9' {
+			return 0, fmt.Errorf("%q isn't a dollar amount", price)
+		}
+	}
+
+	cents := int64(0)
+	if dollars != "" {
+		whole, err := strconv.ParseInt(dollars, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q isn't a dollar amount: %v", price, err)
+		}
+		cents = whole * 100
+	}
+	if fraction != "" {
+		part, err := strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q isn't a dollar amount: %v", price, err)
+		}
+		if len(fraction) == 1 {
+			part *= 10
+		}
+		cents += part
+	}
+
+	return cents, nil
+
+}
+
+/* Formats a price in cents the way it's typed into the item form */
+func priceInput(cents int64) string {
+	if cents == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+/*
+Queues alerts for anyone who claimed the item. Like recordChange, a failure is
+logged rather than failing the request. The response is the same whether or
+not anyone claimed it, so the owner can't tell.
+*/
+func alertClaimers(
+	ctx context.Context,
+	svr *util.ServerUtils,
+	actorID int64,
+	item itemData,
+	changeType notification.ChangeType,
+	details string,
+) {
+	err := notification.AlertClaimers(ctx, svr, notification.Change{
+		ActorID:        actorID,
+		Details:        details,
+		ItemExternalID: item.ExternalID,
+		ItemName:       item.Name,
+		OwnerID:        item.ownerID,
+		Type:           changeType,
+	})
+	if err != nil {
+		svr.Logger.ErrorContext(ctx,
+			"Error alerting the item's claimers",
+			slog.String("itemID", item.ExternalID),
+			slog.String("errorMessage", err.Error()),
+		)
+	}
+}
+
+/*
+Describes the changes a claimer needs to know about. This is stricter than the
+household notifications, since any price or size change can matter to someone
+who already bought the gift.
+*/
+func claimerChanges(before itemData, after itemData) []string {
+
+	changes := []string{}
+	if before.Name != after.Name {
+		changes = append(changes, fmt.Sprintf("renamed from %s", before.Name))
+	}
+
+	if before.Size != after.Size {
+		changes = append(changes, fmt.Sprintf("size changed from %s to %s", sizeLabel(before.Size), sizeLabel(after.Size)))
+	}
+
+	if before.URL != after.URL {
+		changes = append(changes, "link changed")
+	}
+
+	if before.priceCents != after.priceCents {
+		changes = append(changes, fmt.Sprintf("price changed from %s to %s", formatPrice(before.priceCents), formatPrice(after.priceCents)))
+	}
+
+	return changes
+
+}
+
+/*
+Records the change for the household notifications. A failure here shouldn't
+fail the request, since the change itself was saved.
+*/
+func recordChange(
+	ctx context.Context,
+	svr *util.ServerUtils,
+	actorID int64,
+	item itemData,
+	changeType notification.ChangeType,
+	details string,
+) {
+	err := notification.Record(ctx, svr, notification.Change{
+		ActorID:        actorID,
+		Details:        details,
+		ItemExternalID: item.ExternalID,
+		ItemName:       item.Name,
+		OwnerID:        item.ownerID,
+		Type:           changeType,
+	})
+	if err != nil {
+		svr.Logger.ErrorContext(ctx,
+			"Error recording the list change for notifications",
+			slog.String("itemID", item.ExternalID),
+			slog.String("errorMessage", err.Error()),
+		)
+	}
+}
+
+/*
+Describes the changes between the old and new versions of an item that the
+household would care about. Store changes and small price tweaks don't count.
+*/
+func significantChanges(before itemData, after itemData) []string {
+
+	changes := []string{}
+	if before.Name != after.Name {
+		changes = append(changes, fmt.Sprintf("renamed from %s", before.Name))
+	}
+
+	if before.Size != after.Size {
+		changes = append(changes, "size changed")
+	}
+
+	if before.URL != after.URL {
+		changes = append(changes, "link changed")
+	}
+
+	diff := after.priceCents - before.priceCents
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > 0 && (before.priceCents == 0 || diff*100/before.priceCents >= significantPriceChange) {
+		changes = append(changes, fmt.Sprintf("price changed from %s to %s", formatPrice(before.priceCents), formatPrice(after.priceCents)))
+	}
+
+	return changes
+
+}
+
+func (item itemData) snapshot() itemSnapshot {
+	return itemSnapshot{
+		Name:       item.Name,
+		PriceCents: item.priceCents,
+		Size:       item.Size,
+		Store:      item.Store,
+		URL:        item.URL,
+	}
+}
+
+/* Blank sizes read better as "none" in the change details */
+func sizeLabel(size string) string {
+	if size == "" {
+		return "none"
+	}
+	return size
+}
+
+func writeItemForm(
+	ctx context.Context,
+	res http.ResponseWriter,
+	svr *util.ServerUtils,
+	span trace.Span,
+	tmpl *template.Template,
+	item itemData,
+) {
+	res.WriteHeader(200)
+	err := tmpl.ExecuteTemplate(res, "item-form", item)
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing the item form",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+}
+
+func (item *itemData) validate() {
+	item.valid = true
+
+	if item.Name == "" {
+
+		item.Errors.Name = "Item name is required"
+		item.valid = false
+
+	} else if len(item.Name) > varcharMaxLength {
+
+		item.Errors.Name = fmt.Sprintf("Item name can't be more than %d characters", varcharMaxLength)
+		item.valid = false
+
+	}
+
+	if len(item.Size) > varcharMaxLength {
+
+		item.Errors.Size = fmt.Sprintf("Size can't be more than %d characters", varcharMaxLength)
+		item.valid = false
+
+	}
+
+	if len(item.Store) > varcharMaxLength {
+
+		item.Errors.Store = fmt.Sprintf("Store can't be more than %d characters", varcharMaxLength)
+		item.valid = false
+
+	}
+
+	if item.URL != "" {
+
+		parsed, err := url.Parse(item.URL)
+		if len(item.URL) > urlMaxLength {
+			item.Errors.URL = fmt.Sprintf("Link can't be more than %d characters", urlMaxLength)
+			item.valid = false
+		} else if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			item.Errors.URL = "Link must be a full http:// or https:// address"
+			item.valid = false
+		}
+
+	}
+
+	item.priceCents = 0
+	if item.Price != "" {
+
+		cents, err := parsePrice(item.Price)
+		if err != nil {
+			item.Errors.Price = "Price must be a dollar amount, like 19.99"
+			item.valid = false
+		} else if cents > maxPriceCents {
+			item.Errors.Price = fmt.Sprintf("Price can't be more than %s", formatPrice(maxPriceCents))
+			item.valid = false
+		} else {
+			item.priceCents = cents
+		}
+
+	}
+}
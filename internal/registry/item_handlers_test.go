@@ -0,0 +1,411 @@
+package registry_test
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestItemCreate adds items from the list page, checking valid ones are saved
+// and the household hears about them.
+func TestItemCreate(t *testing.T) {
+	testData := []struct {
+		elements      map[string]test.ElementValidation
+		formData      url.Values
+		itemsExpected int
+		testName      string
+		userData      test.UserData
+	}{
+		{
+			elements: map[string]test.ElementValidation{
+				"items-content":       {Visible: true},
+				"item-name-error-new": {Visible: false},
+			},
+			formData: url.Values{
+				"name":  {"Board game"},
+				"price": {"24.99"},
+				"store": {"Game shop"},
+			},
+			itemsExpected: 1,
+			testName:      "Valid item",
+			userData: test.UserData{
+				CreateHousehold: true,
+				Email:           "itemadd@localhost.com",
+				ExternalID:      "item-add-valid",
+				FirstName:       "Item",
+				HouseholdName:   "Item add household",
+				LastName:        "Adder",
+			},
+		},
+		{
+			elements: map[string]test.ElementValidation{
+				"items-content": {Visible: true},
+				"item-name-error-new": {
+					Value:   "Item name is required",
+					Visible: true,
+				},
+				"item-price-error-new": {
+					Value:   "Price must be a dollar amount, like 19.99",
+					Visible: true,
+				},
+			},
+			formData: url.Values{
+				"price": {"cheap"},
+			},
+			itemsExpected: 0,
+			testName:      "Invalid item",
+			userData: test.UserData{
+				CreateHousehold: true,
+				Email:           "itemaddinvalid@localhost.com",
+				ExternalID:      "item-add-invalid",
+				FirstName:       "Item",
+				HouseholdName:   "Invalid item household",
+				LastName:        "Adder",
+			},
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := test.CreateSession(ctx, logger, db, data.userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session for ", data.testName, err)
+			}
+
+			/* Someone else in the household should hear about the new item */
+			memberID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:         data.userData.ExternalID + "-member@localhost.com",
+				ExternalID:    data.userData.ExternalID + "-member",
+				FirstName:     "Household",
+				HouseholdName: data.userData.HouseholdName,
+				LastName:      "Member",
+			})
+			if err != nil {
+				t.Fatal("Could not create the household member", err)
+			}
+
+			res := postForm(t, token, "/registry/items", data.formData)
+			defer func() {
+				if res != nil && res.Body != nil {
+					_ = res.Body.Close()
+				}
+			}()
+
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+
+			err = test.ValidatePage(doc, data.elements)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var items int
+			err = db.QueryRow(ctx, `SELECT COUNT(*) FROM item i INNER JOIN person p ON p.person_id = i.person_id 
+				WHERE p.external_id = ?`, data.userData.ExternalID).Scan(&items)
+			if err != nil {
+				t.Fatal("Could not count the saved items", err)
+			} else if items != data.itemsExpected {
+				t.Fatal("Expected", data.itemsExpected, "items but found", items)
+			}
+
+			var notifications int
+			err = db.QueryRow(ctx, "SELECT COUNT(*) FROM notification WHERE person_id = ?", memberID).Scan(&notifications)
+			if err != nil {
+				t.Fatal("Could not count the member's notifications", err)
+			} else if notifications != data.itemsExpected {
+				t.Fatal("Expected", data.itemsExpected, "notifications for the household member but found", notifications)
+			}
+		})
+	}
+}
+
+func TestItemUpdate(t *testing.T) {
+	testData := []struct {
+		auditExpected  int
+		delete         bool
+		formData       url.Values
+		notifyExpected int
+		restore        bool
+		testName       string
+		userData       test.UserData
+	}{
+		{
+			auditExpected: 1,
+			formData: url.Values{
+				"name":  {"Fancy headphones"},
+				"price": {"100.00"},
+			},
+			notifyExpected: 1,
+			testName:       "Renamed item",
+			userData: test.UserData{
+				CreateHousehold: true,
+				Email:           "itemrename@localhost.com",
+				ExternalID:      "item-update-rename",
+				FirstName:       "Item",
+				HouseholdName:   "Item rename household",
+				LastName:        "Renamer",
+			},
+		},
+		{
+			auditExpected: 1,
+			formData: url.Values{
+				"name":  {"Headphones"},
+				"price": {"101.00"},
+			},
+			notifyExpected: 0,
+			testName:       "Small price change",
+			userData: test.UserData{
+				CreateHousehold: true,
+				Email:           "itemprice@localhost.com",
+				ExternalID:      "item-update-price",
+				FirstName:       "Item",
+				HouseholdName:   "Item price household",
+				LastName:        "Pricer",
+			},
+		},
+		{
+			auditExpected:  1,
+			delete:         true,
+			notifyExpected: 1,
+			testName:       "Deleted item",
+			userData: test.UserData{
+				CreateHousehold: true,
+				Email:           "itemdelete@localhost.com",
+				ExternalID:      "item-delete",
+				FirstName:       "Item",
+				HouseholdName:   "Item delete household",
+				LastName:        "Deleter",
+			},
+		},
+		{
+			auditExpected:  2,
+			delete:         true,
+			notifyExpected: 2,
+			restore:        true,
+			testName:       "Undone delete",
+			userData: test.UserData{
+				CreateHousehold: true,
+				Email:           "itemrestore@localhost.com",
+				ExternalID:      "item-restore",
+				FirstName:       "Item",
+				HouseholdName:   "Item restore household",
+				LastName:        "Restorer",
+			},
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := test.CreateSession(ctx, logger, db, data.userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session for ", data.testName, err)
+			}
+
+			var ownerID int64
+			err = db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", data.userData.ExternalID).Scan(&ownerID)
+			if err != nil {
+				t.Fatal("Could not look up the item owner", err)
+			}
+
+			memberID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:         data.userData.ExternalID + "-member@localhost.com",
+				ExternalID:    data.userData.ExternalID + "-member",
+				FirstName:     "Household",
+				HouseholdName: data.userData.HouseholdName,
+				LastName:      "Member",
+			})
+			if err != nil {
+				t.Fatal("Could not create the household member", err)
+			}
+
+			itemExtID := data.userData.ExternalID + "-item"
+			_, err = test.CreateItem(ctx, db, test.ItemData{
+				ExternalID: itemExtID,
+				Name:       "Headphones",
+				PersonID:   ownerID,
+				PriceCents: 10000,
+			})
+			if err != nil {
+				t.Fatal("Could not create the item", err)
+			}
+
+			path := "/registry/items/" + itemExtID
+			if data.delete {
+				path += "/delete"
+			}
+
+			res := postForm(t, token, path, data.formData)
+			if data.delete {
+				doc, err := html.Parse(res.Body)
+				if err != nil {
+					t.Fatal("Error parsing the delete response", err)
+				} else if _, found := test.CheckElement(*doc, "item-"+itemExtID+"-undo"); !found {
+					t.Fatal("The delete response didn't offer an undo")
+				}
+			}
+			if res != nil && res.Body != nil {
+				_ = res.Body.Close()
+			}
+
+			if data.restore {
+				res = postForm(t, token, "/registry/items/"+itemExtID+"/restore", url.Values{})
+				_ = res.Body.Close()
+			}
+
+			var items int
+			err = db.QueryRow(ctx, "SELECT COUNT(*) FROM item WHERE external_id = ? AND deleted_on IS NULL", itemExtID).Scan(&items)
+			if err != nil {
+				t.Fatal("Could not look up the item", err)
+			} else if data.delete && !data.restore && items != 0 {
+				t.Fatal("The item wasn't deleted")
+			} else if (!data.delete || data.restore) && items != 1 {
+				t.Fatal("The item is missing from the list")
+			}
+
+			var audited int
+			err = db.QueryRow(ctx, "SELECT COUNT(*) FROM audit_event WHERE entity = 'item' AND entity_id = ? AND actor_id = ?", itemExtID, ownerID).
+				Scan(&audited)
+			if err != nil {
+				t.Fatal("Could not count the audit events", err)
+			} else if audited != data.auditExpected {
+				t.Fatal("Expected", data.auditExpected, "audit events for the item but found", audited)
+			}
+
+			var notifications int
+			err = db.QueryRow(ctx, "SELECT COUNT(*) FROM notification WHERE person_id = ?", memberID).Scan(&notifications)
+			if err != nil {
+				t.Fatal("Could not count the member's notifications", err)
+			} else if notifications != data.notifyExpected {
+				t.Fatal("Expected", data.notifyExpected, "notifications for the household member but found", notifications)
+			}
+		})
+	}
+}
+
+// TestItemPrice checks the prices the item form takes, and that anything that
+// isn't a sensible dollar amount is turned away.
+func TestItemPrice(t *testing.T) {
+	testData := []struct {
+		expectedCents int64
+		expectedError string
+		price         string
+		testName      string
+	}{
+		{expectedCents: 1999, price: "19.99", testName: "Dollars and cents"},
+		{expectedCents: 2000, price: "$20", testName: "Dollar sign"},
+		{expectedCents: 450, price: "4.5", testName: "One decimal place"},
+		{expectedCents: 50, price: ".50", testName: "Just cents"},
+		{expectedCents: 100000000, price: "1000000.00", testName: "Largest price"},
+		{expectedError: "Price can't be more than $1000000.00", price: "1000000.01", testName: "Too expensive"},
+		{expectedError: "Price must be a dollar amount, like 19.99", price: "1e30", testName: "Exponent"},
+		{expectedError: "Price must be a dollar amount, like 19.99", price: "99999999999999999999", testName: "Overflow"},
+		{expectedError: "Price must be a dollar amount, like 19.99", price: "NaN", testName: "Not a number"},
+		{expectedError: "Price must be a dollar amount, like 19.99", price: "Inf", testName: "Infinity"},
+		{expectedError: "Price must be a dollar amount, like 19.99", price: "-5", testName: "Negative"},
+		{expectedError: "Price must be a dollar amount, like 19.99", price: "1.999", testName: "Fractions of a cent"},
+		{expectedError: "Price must be a dollar amount, like 19.99", price: "$", testName: "No digits"},
+		{expectedError: "Price must be a dollar amount, like 19.99", price: "1,000", testName: "Thousands separator"},
+	}
+
+	for idx, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			userData := test.UserData{
+				Email:      fmt.Sprintf("itemprice%d@localhost.com", idx),
+				ExternalID: fmt.Sprintf("item-price-%d", idx),
+				FirstName:  "Item",
+				LastName:   "Pricer",
+			}
+			token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session for ", data.testName, err)
+			}
+
+			res := postForm(t, token, "/registry/items", url.Values{
+				"name":  {"Priced item"},
+				"price": {data.price},
+			})
+			doc, err := html.Parse(res.Body)
+			_ = res.Body.Close()
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+
+			err = test.ValidatePage(doc, map[string]test.ElementValidation{
+				"item-price-error-new": {
+					Value:   data.expectedError,
+					Visible: data.expectedError != "",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var cents int64
+			err = db.QueryRow(ctx, `SELECT i.price_cents FROM item i INNER JOIN person p ON p.person_id = i.person_id
+				WHERE p.external_id = ?`, userData.ExternalID).Scan(&cents)
+			if data.expectedError != "" {
+				if err != sql.ErrNoRows {
+					t.Fatal("Expected the item not to be saved but got", cents, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Could not look up the saved item", err)
+			} else if cents != data.expectedCents {
+				t.Fatal("Expected", data.expectedCents, "cents but saved", cents)
+			}
+		})
+	}
+}
+
+/* Posts the form as the session's user and fails the test on a non-200 */
+func postForm(t *testing.T, token string, path string, form url.Values) *http.Response {
+
+	sessCookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   time.Now().UTC().Add(time.Minute * 1).Second(),
+		Name:     middleware.SessionCookie,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+		Value:    token,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal("Error building the item request", err)
+	}
+
+	req.AddCookie(&sessCookie)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error posting the item form!", err)
+	} else if res.StatusCode != http.StatusOK {
+		t.Fatal("Got an error status from the server!", res.StatusCode)
+	}
+
+	return res
+
+}
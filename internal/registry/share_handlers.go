@@ -0,0 +1,433 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type shareEvent struct {
+	ExternalID string
+	Name       string
+}
+
+type shareLink struct {
+	EventName  string
+	ExternalID string
+	URL        string
+}
+
+type shareLinks struct {
+	ErrorMessage string
+	Events       []shareEvent
+	Links        []shareLink
+}
+
+type sharedItem struct {
+	ExternalID string
+	Name       string
+	Price      string
+	Recipient  string
+	Store      string
+	URL        string
+}
+
+type sharedList struct {
+	Date  string
+	Items []sharedItem
+	Title string
+	Token string
+}
+
+const (
+	deleteShareStatement = `DELETE FROM share_link WHERE external_id = ? AND person_id = ?`
+	insertShareStatement = `INSERT INTO share_link (external_id, token, person_id, event_id)
+		VALUES (?, ?, ?, ?)`
+	/* Only events the person is a recipient of can be shared */
+	shareEventLookupQuery = `SELECT e.event_id
+		FROM event e
+			INNER JOIN event_person ep ON ep.event_id = e.event_id
+		WHERE e.external_id = ?
+			AND ep.person_id = ?
+			AND ep.role = 'RECIPIENT'`
+	shareEventsQuery = `SELECT e.external_id, e.name
+		FROM event e
+			INNER JOIN event_person ep ON ep.event_id = e.event_id
+		WHERE ep.person_id = ?
+			AND ep.role = 'RECIPIENT'
+			AND e.event_date >= ?
+		ORDER BY e.event_date, e.name`
+	shareLinksQuery = `SELECT s.external_id, s.token, COALESCE(e.name, '')
+		FROM share_link s
+			LEFT JOIN event e ON e.event_id = s.event_id
+		WHERE s.person_id = ?
+		ORDER BY s.created_on, s.share_id`
+	shareLookupQuery = `SELECT s.person_id,
+			s.event_id,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name),
+			COALESCE(e.name, ''),
+			e.event_date
+		FROM share_link s
+			INNER JOIN person p ON p.person_id = s.person_id
+			LEFT JOIN event e ON e.event_id = s.event_id
+		WHERE s.token = ?`
+	/* Same rule as the reminders, undated items count for every event */
+	sharedEventItemsQuery = `SELECT i.external_id,
+			i.name,
+			i.store,
+			i.url,
+			i.price_cents,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name)
+		FROM event_person ep
+			INNER JOIN person p ON p.person_id = ep.person_id
+			INNER JOIN item i ON i.person_id = ep.person_id
+		WHERE ep.event_id = ?
+			AND ep.role = 'RECIPIENT'
+			AND (i.event_id = ep.event_id OR i.event_id IS NULL)
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NULL
+			AND p.deleted_on IS NULL
+		ORDER BY COALESCE(NULLIF(p.display_name, ''), p.first_name), i.name`
+	sharedPersonItemsQuery = `SELECT i.external_id,
+			i.name,
+			i.store,
+			i.url,
+			i.price_cents,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name)
+		FROM item i
+			INNER JOIN person p ON p.person_id = i.person_id
+		WHERE i.person_id = ?
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NULL
+			AND p.deleted_on IS NULL
+		ORDER BY i.name`
+)
+
+// SharedListHandler renders the read-only list behind a share link. The route
+// is public, so the token in the URL is the only thing granting access.
+func SharedListHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("shared_list_handler")
+
+		tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/shared_list.html")
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the shared list template",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error rendering the list"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		list, err := lookupSharedList(ctx, svr, req.PathValue("token"))
+		if err == sql.ErrNoRows {
+			svr.Logger.InfoContext(ctx, "Shared list requested with an unknown token")
+			res.WriteHeader(404)
+			res.Write([]byte("This list isn't shared anymore"))
+			return
+		} else if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the shared list",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the list"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+		span.SetAttributes(attribute.Int("item_count", len(list.Items)))
+
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, "shared-list-page", list)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading the list"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+	})
+
+}
+
+// ShareLinksHandler lists the logged-in person's share links, with the form for
+// creating new ones.
+func ShareLinksHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("share_links_handler")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		writeShareLinks(ctx, svr, res, personID, "")
+
+	})
+
+}
+
+// ShareCreateHandler creates a new share link for the logged-in person's list,
+// or for an event they're a recipient of.
+func ShareCreateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("share_create")
+
+		personID := middleware.PersonID(res, req)
+		eventExtID := req.FormValue("event")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("event_external_id", eventExtID),
+		)
+
+		var eventID any
+		if eventExtID != "" {
+
+			var id int64
+			err := svr.DB.QueryRow(ctx, shareEventLookupQuery, eventExtID, personID).Scan(&id)
+			if err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error looking up the event to share",
+					slog.String("errorMessage", err.Error()),
+				)
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				writeShareLinks(ctx, svr, res, personID, "Could not find that event.")
+				return
+			}
+			eventID = id
+
+		}
+
+		externalID := rand.Text()
+		_, err := svr.DB.Execute(ctx, insertShareStatement, externalID, rand.Text(), personID, eventID)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error saving the share link",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeShareLinks(ctx, svr, res, personID, "Could not create the share link.")
+			return
+		}
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Create,
+			After:    map[string]string{"event": eventExtID},
+			Entity:   audit.ShareLink,
+			EntityID: externalID,
+		})
+
+		writeShareLinks(ctx, svr, res, personID, "")
+
+	})
+
+}
+
+// ShareRevokeHandler deletes one of the logged-in person's share links, so it
+// stops working for anyone who has it.
+func ShareRevokeHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("share_revoke")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("share_external_id", externalID),
+		)
+
+		errorMessage := ""
+		if result, err := svr.DB.Execute(ctx, deleteShareStatement, externalID, personID); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error deleting the share link",
+				slog.String("errorMessage", err.Error()),
+			)
+			errorMessage = "Could not turn off the share link."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		} else if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+			audit.Record(ctx, svr, personID, audit.Event{
+				Action:   audit.Revoke,
+				Entity:   audit.ShareLink,
+				EntityID: externalID,
+			})
+		}
+
+		writeShareLinks(ctx, svr, res, personID, errorMessage)
+
+	})
+
+}
+
+/*
+Looks up the list behind the token. Returns sql.ErrNoRows if the token
+doesn't exist (or was revoked).
+*/
+func lookupSharedList(ctx context.Context, svr *util.ServerUtils, token string) (sharedList, error) {
+
+	list := sharedList{
+		Items: []sharedItem{},
+		Token: token,
+	}
+
+	var (
+		personID  int64
+		eventID   sql.NullInt64
+		owner     string
+		eventName string
+		eventDate sql.NullTime
+	)
+	err := svr.DB.QueryRow(ctx, shareLookupQuery, token).Scan(&personID, &eventID, &owner, &eventName, &eventDate)
+	if err != nil {
+		return list, err
+	}
+
+	query, param := sharedPersonItemsQuery, personID
+	list.Title = owner + "'s wishlist"
+	if eventID.Valid {
+		query, param = sharedEventItemsQuery, eventID.Int64
+		list.Title = eventName
+		list.Date = eventDate.Time.Format(dateFmt)
+	}
+
+	rows, err := svr.DB.Query(ctx, query, param)
+	if err != nil {
+		return list, fmt.Errorf("error querying the shared items: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var item sharedItem
+		var cents int64
+		if err := rows.Scan(&item.ExternalID, &item.Name, &item.Store, &item.URL, &cents, &item.Recipient); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		if cents > 0 {
+			item.Price = formatPrice(cents)
+		}
+		list.Items = append(list.Items, item)
+
+	}
+
+	return list, nil
+
+}
+
+func writeShareLinks(
+	ctx context.Context,
+	svr *util.ServerUtils,
+	res http.ResponseWriter,
+	personID int64,
+	errorMessage string,
+) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/share_links.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the share links template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your share links"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	links := shareLinks{
+		ErrorMessage: errorMessage,
+		Events:       []shareEvent{},
+		Links:        []shareLink{},
+	}
+
+	rows, err := svr.DB.Query(ctx, shareLinksQuery, personID)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the share links", slog.String("errorMessage", err.Error()))
+		links.ErrorMessage = "Could not look up your share links."
+	} else {
+
+		defer rows.Close()
+		for rows.Next() {
+
+			var link shareLink
+			var token string
+			if err := rows.Scan(&link.ExternalID, &token, &link.EventName); err != nil {
+				svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+				continue
+			}
+			link.URL = util.AppURL(svr, "/share/"+token)
+			links.Links = append(links.Links, link)
+
+		}
+
+	}
+
+	eventRows, err := svr.DB.Query(ctx, shareEventsQuery, personID, time.Now().UTC())
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the shareable events", slog.String("errorMessage", err.Error()))
+	} else {
+
+		defer eventRows.Close()
+		for eventRows.Next() {
+
+			var event shareEvent
+			if err := eventRows.Scan(&event.ExternalID, &event.Name); err != nil {
+				svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+				continue
+			}
+			links.Events = append(links.Events, event)
+
+		}
+
+	}
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "share-links", links); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
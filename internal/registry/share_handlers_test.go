@@ -0,0 +1,218 @@
+package registry_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestSharedList loads share links the way someone without an account would,
+// with no session and no Sec-Fetch headers.
+func TestSharedList(t *testing.T) {
+	testData := []struct {
+		elements        map[string]test.ElementValidation
+		eventLink       bool
+		expectedStatus  int
+		externalIDStart string
+		missing         []string
+		path            string
+		testName        string
+	}{
+		{
+			elements: map[string]test.ElementValidation{
+				"shared-title": {
+					Value:   "Sharer's wishlist",
+					Visible: true,
+				},
+				"shared-empty":                  {Visible: false},
+				"shared-item-share-person-item": {Visible: true},
+			},
+			expectedStatus:  http.StatusOK,
+			externalIDStart: "share-person",
+			missing:         []string{"shared-item-share-person-gone", "shared-item-share-person-nearby"},
+			path:            "/share/share-person-token",
+			testName:        "Person's list",
+		},
+		{
+			elements: map[string]test.ElementValidation{
+				"shared-title": {
+					Value:   "Wedding",
+					Visible: true,
+				},
+				"shared-item-share-event-item":   {Visible: true},
+				"shared-item-share-event-nearby": {Visible: true},
+			},
+			eventLink:       true,
+			expectedStatus:  http.StatusOK,
+			externalIDStart: "share-event",
+			path:            "/share/share-event-token",
+			testName:        "Event's list",
+		},
+		{
+			expectedStatus:  http.StatusNotFound,
+			externalIDStart: "share-unknown",
+			path:            "/share/not-a-real-token",
+			testName:        "Unknown token",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			ownerID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:      data.externalIDStart + "-owner@localhost.com",
+				ExternalID: data.externalIDStart + "-owner",
+				FirstName:  "Sharer",
+				LastName:   "Owner",
+			})
+			if err != nil {
+				t.Fatal("Could not create the list owner", err)
+			}
+
+			partnerID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:      data.externalIDStart + "-partner@localhost.com",
+				ExternalID: data.externalIDStart + "-partner",
+				FirstName:  "Partner",
+				LastName:   "Owner",
+			})
+			if err != nil {
+				t.Fatal("Could not create the partner", err)
+			}
+
+			eventID, err := test.CreateEvent(ctx, db, test.EventData{
+				Date:       time.Now().UTC().AddDate(0, 2, 0),
+				ExternalID: data.externalIDStart + "-event",
+				Name:       "Wedding",
+			})
+			if err != nil {
+				t.Fatal("Could not create the event", err)
+			}
+			for _, recipientID := range []int64{ownerID, partnerID} {
+				if err = test.AddEventPerson(ctx, db, eventID, recipientID, "RECIPIENT"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			items := []test.ItemData{
+				{ExternalID: data.externalIDStart + "-item", Name: "Toaster", PersonID: ownerID, PriceCents: 3000},
+				{ExternalID: data.externalIDStart + "-gone", Name: "Blender", PersonID: ownerID},
+				{ExternalID: data.externalIDStart + "-nearby", Name: "Kettle", PersonID: partnerID},
+			}
+			for _, item := range items {
+				if _, err = test.CreateItem(ctx, db, item); err != nil {
+					t.Fatal("Could not create the item", err)
+				}
+			}
+			_, err = db.Execute(ctx, "UPDATE item SET archived_on = ? WHERE external_id = ?", time.Now().UTC(), data.externalIDStart+"-gone")
+			if err != nil {
+				t.Fatal("Could not archive the item", err)
+			}
+
+			linkEvent := int64(0)
+			if data.eventLink {
+				linkEvent = eventID
+			}
+			if err = test.CreateShareLink(ctx, db, data.externalIDStart+"-token", ownerID, linkEvent); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := http.Get(testServer.URL + data.path)
+			defer func() {
+				if res != nil && res.Body != nil {
+					_ = res.Body.Close()
+				}
+			}()
+			if err != nil {
+				t.Fatal("Error getting the shared list!", err)
+			} else if res.StatusCode != data.expectedStatus {
+				t.Fatal("Expected status", data.expectedStatus, "but got", res.StatusCode)
+			}
+
+			if data.expectedStatus != http.StatusOK {
+				return
+			}
+
+			if res.Header.Get("Cache-Control") != "no-store" {
+				t.Fatal("Shared list should not be cached, got", res.Header.Get("Cache-Control"))
+			}
+
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+
+			err = test.ValidatePage(doc, data.elements)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, id := range data.missing {
+				if _, found := test.CheckElement(*doc, id); found {
+					t.Fatal("Element", id, "shouldn't be on the shared list")
+				}
+			}
+		})
+	}
+}
+
+// TestShareRevoke creates a share link through the app, then turns it off and
+// makes sure it stops working.
+func TestShareRevoke(t *testing.T) {
+
+	userData := test.UserData{
+		Email:      "sharerevoke@localhost.com",
+		ExternalID: "share-revoke",
+		FirstName:  "Share",
+		LastName:   "Revoke",
+	}
+	token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+	if err != nil {
+		t.Fatal("Could not create a test session", err)
+	}
+
+	res := postForm(t, token, "/registry/shares", nil)
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatal("Error reading the share links", err)
+	}
+
+	var shareExtID, shareToken string
+	err = db.QueryRow(ctx, `SELECT s.external_id, s.token FROM share_link s 
+		INNER JOIN person p ON p.person_id = s.person_id 
+		WHERE p.external_id = ?`, userData.ExternalID).Scan(&shareExtID, &shareToken)
+	if err != nil {
+		t.Fatal("Share link wasn't created", err)
+	} else if !strings.Contains(string(body), "https://gift-registry.localhost/share/"+shareToken) {
+		t.Fatal("Expected the share link to use the configured address\n", string(body))
+	}
+
+	res, err = http.Get(testServer.URL + "/share/" + shareToken)
+	if err != nil {
+		t.Fatal("Error getting the shared list!", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("New share link doesn't work, got status", res.StatusCode)
+	}
+
+	res = postForm(t, token, "/registry/shares/"+shareExtID+"/revoke", nil)
+	_ = res.Body.Close()
+
+	res, err = http.Get(testServer.URL + "/share/" + shareToken)
+	if err != nil {
+		t.Fatal("Error getting the shared list!", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatal("Revoked share link still works, got status", res.StatusCode)
+	}
+
+}
@@ -0,0 +1,252 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type shoppingItem struct {
+	ExternalID string
+	Name       string
+	Price      string
+	Recipient  string
+	Status     string
+	URL        string
+}
+
+type shoppingStore struct {
+	Items    []shoppingItem
+	Name     string
+	Subtotal string
+	subtotal int64
+}
+
+type shoppingEvent struct {
+	Date       string
+	ExternalID string
+	Name       string
+	Stores     []shoppingStore
+	Subtotal   string
+	subtotal   int64
+}
+
+type shoppingList struct {
+	ErrorMessage string
+	Events       []shoppingEvent
+	ItemCount    int
+	Printable    bool
+	Total        string
+}
+
+const (
+	anyStore  = "Any store"
+	noEvent   = "No event"
+	dateFmt   = "January 2, 2006"
+	printView = "print"
+	/*
+		Sorting on the event first (with undated items last, and the ID keeping
+		events with the same date and name apart), then the store, so the rows
+		come back already in the order the page groups them.
+	*/
+	shoppingListQuery = `SELECT i.external_id,
+			i.name,
+			i.store,
+			i.url,
+			i.price_cents,
+			c.status,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name),
+			COALESCE(e.external_id, ''),
+			COALESCE(e.name, ''),
+			e.event_date
+		FROM claim c
+			INNER JOIN item i ON i.item_id = c.item_id
+			INNER JOIN person p ON p.person_id = i.person_id
+			LEFT JOIN event e ON e.event_id = i.event_id
+		WHERE c.person_id = ?
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NULL
+			AND p.deleted_on IS NULL
+		ORDER BY e.event_date IS NULL, e.event_date, e.name, e.event_id, i.store, i.name`
+)
+
+// ShoppingListHandler returns every item the logged-in person has claimed,
+// across all recipients and events, grouped by event and then by store. A
+// "view=print" query parameter renders the same list without the page chrome
+// so it can be printed.
+func ShoppingListHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("shopping_list_handler")
+
+		templateDef := "shopping-page"
+		if req.URL.Query().Get("view") == printView {
+			templateDef = "shopping-print-page"
+		}
+
+		tmpl, err := template.New("shopping_list.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/shopping_list.html")
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error loading the shopping list template",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error rendering the shopping list"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.Bool("printable", templateDef == "shopping-print-page"),
+		)
+
+		list, err := lookupShoppingList(ctx, svr, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error looking up the shopping list",
+				slog.Int64("personID", personID),
+				slog.String("errorMessage", err.Error()),
+			)
+			list.ErrorMessage = "Could not look up your shopping list."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+		list.Printable = templateDef == "shopping-print-page"
+		span.SetAttributes(attribute.Int("item_count", list.ItemCount))
+
+		res.WriteHeader(200)
+		err = tmpl.ExecuteTemplate(res, templateDef, list)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error writing template!",
+				slog.String("errorMessage", err.Error()),
+			)
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading your shopping list"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+	})
+
+}
+
+// Formats a price stored in cents as dollars for display
+func formatPrice(cents int64) string {
+	return fmt.Sprintf("$%d.%02d", cents/100, cents%100)
+}
+
+/*
+Reads the person's claims and folds the (already sorted) rows into the
+event -> store -> item groupings the page displays, totalling as it goes.
+*/
+func lookupShoppingList(ctx context.Context, svr *util.ServerUtils, personID int64) (shoppingList, error) {
+
+	list := shoppingList{
+		Events: []shoppingEvent{},
+		Total:  formatPrice(0),
+	}
+
+	rows, err := svr.DB.Query(ctx, shoppingListQuery, personID)
+	if err != nil {
+		return list, fmt.Errorf("error querying claimed items: %v", err)
+	}
+	defer rows.Close()
+
+	var total int64
+	for rows.Next() {
+
+		var (
+			item       shoppingItem
+			store      string
+			cents      int64
+			eventID    string
+			eventName  string
+			eventDate  sql.NullTime
+			eventLabel string
+		)
+
+		err = rows.Scan(
+			&item.ExternalID,
+			&item.Name,
+			&store,
+			&item.URL,
+			&cents,
+			&item.Status,
+			&item.Recipient,
+			&eventID,
+			&eventName,
+			&eventDate,
+		)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+
+		item.Price = formatPrice(cents)
+		if store == "" {
+			store = anyStore
+		}
+		if eventName == "" {
+			eventName = noEvent
+		}
+		if eventDate.Valid {
+			eventLabel = eventDate.Time.Format(dateFmt)
+		}
+
+		if len(list.Events) == 0 || list.Events[len(list.Events)-1].ExternalID != eventID {
+			list.Events = append(list.Events, shoppingEvent{
+				Date:       eventLabel,
+				ExternalID: eventID,
+				Name:       eventName,
+				Stores:     []shoppingStore{},
+			})
+		}
+		event := &list.Events[len(list.Events)-1]
+
+		if len(event.Stores) == 0 || event.Stores[len(event.Stores)-1].Name != store {
+			event.Stores = append(event.Stores, shoppingStore{
+				Items: []shoppingItem{},
+				Name:  store,
+			})
+		}
+		storeGroup := &event.Stores[len(event.Stores)-1]
+
+		storeGroup.Items = append(storeGroup.Items, item)
+		storeGroup.subtotal += cents
+		event.subtotal += cents
+		total += cents
+		list.ItemCount++
+
+	}
+
+	for eventIdx := range list.Events {
+
+		event := &list.Events[eventIdx]
+		event.Subtotal = formatPrice(event.subtotal)
+		for storeIdx := range event.Stores {
+			event.Stores[storeIdx].Subtotal = formatPrice(event.Stores[storeIdx].subtotal)
+		}
+
+	}
+	list.Total = formatPrice(total)
+
+	return list, nil
+
+}
@@ -0,0 +1,276 @@
+package registry_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+
+	"golang.org/x/net/html"
+)
+
+// TestShoppingList checks the claimed items are listed and totalled, in both
+// the regular and printable views.
+func TestShoppingList(t *testing.T) {
+	testData := []struct {
+		claimData []test.ItemData
+		elements  map[string]test.ElementValidation
+		path      string
+		testName  string
+		userData  test.UserData
+	}{
+		{
+			elements: map[string]test.ElementValidation{
+				"shopping-list":  {Visible: true},
+				"shopping-empty": {Visible: true},
+				"shopping-error": {Visible: false},
+				"shopping-total": {
+					Value:   "$0.00",
+					Visible: true,
+				},
+			},
+			path:     "/registry/shopping",
+			testName: "No claims",
+			userData: test.UserData{
+				Email:      "noclaims@localhost.com",
+				ExternalID: "shopping-no-claims",
+				FirstName:  "No",
+				LastName:   "Claims",
+			},
+		},
+		{
+			claimData: []test.ItemData{
+				{
+					ExternalID: "shopping-item-1",
+					Name:       "Train set",
+					PriceCents: 4999,
+					Store:      "Toy store",
+				},
+				{
+					ExternalID: "shopping-item-2",
+					Name:       "Socks",
+					PriceCents: 1001,
+				},
+			},
+			elements: map[string]test.ElementValidation{
+				"shopping-list":                 {Visible: true},
+				"shopping-empty":                {Visible: false},
+				"shopping-event-none":           {Visible: true},
+				"shopping-item-shopping-item-1": {Visible: true},
+				"shopping-item-shopping-item-2": {Visible: true},
+				"shopping-item-price-shopping-item-1": {
+					Value:   "$49.99",
+					Visible: true,
+				},
+				"shopping-item-status-shopping-item-2": {
+					Value:   "CLAIMED",
+					Visible: true,
+				},
+				"shopping-total": {
+					Value:   "$60.00",
+					Visible: true,
+				},
+			},
+			path:     "/registry/shopping",
+			testName: "Claims totalled",
+			userData: test.UserData{
+				Email:      "withclaims@localhost.com",
+				ExternalID: "shopping-with-claims",
+				FirstName:  "With",
+				LastName:   "Claims",
+			},
+		},
+		{
+			elements: map[string]test.ElementValidation{
+				"shopping-list":  {Visible: true},
+				"shopping-empty": {Visible: true},
+			},
+			path:     "/registry/shopping?view=print",
+			testName: "Printable view",
+			userData: test.UserData{
+				Email:      "printable@localhost.com",
+				ExternalID: "shopping-printable",
+				FirstName:  "Print",
+				LastName:   "Able",
+			},
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := test.CreateSession(ctx, logger, db, data.userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session for ", data.testName, err)
+			}
+
+			if len(data.claimData) > 0 {
+
+				var giverID int64
+				err = db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", data.userData.ExternalID).Scan(&giverID)
+				if err != nil {
+					t.Fatal("Could not look up the giver", err)
+				}
+
+				recipientID, err := test.CreateUser(ctx, logger, db, test.UserData{
+					Email:      data.userData.ExternalID + "-recipient@localhost.com",
+					ExternalID: data.userData.ExternalID + "-recipient",
+					FirstName:  "Recipient",
+					LastName:   "Person",
+				})
+				if err != nil {
+					t.Fatal("Could not create the gift recipient", err)
+				}
+
+				for _, itemData := range data.claimData {
+
+					itemData.PersonID = recipientID
+					itemID, err := test.CreateItem(ctx, db, itemData)
+					if err != nil {
+						t.Fatal("Could not create item", err)
+					}
+
+					if err = test.CreateClaim(ctx, db, itemID, giverID, "CLAIMED"); err != nil {
+						t.Fatal("Could not claim item", err)
+					}
+
+				}
+
+			}
+
+			sessCookie := http.Cookie{
+				HttpOnly: true,
+				MaxAge:   time.Now().UTC().Add(time.Minute * 1).Second(),
+				Name:     middleware.SessionCookie,
+				SameSite: http.SameSiteStrictMode,
+				Secure:   true,
+				Value:    token,
+			}
+
+			req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+data.path, nil)
+			if err != nil {
+				t.Fatal("Error building shopping list request", err)
+			}
+
+			req.AddCookie(&sessCookie)
+			req.Header.Set("User-Agent", userAgent)
+			req.Header.Set("Sec-Fetch-Dest", "document")
+			req.Header.Set("Sec-Fetch-Mode", "same-origin")
+			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			res, err := http.DefaultClient.Do(req)
+			defer func() {
+				if res != nil && res.Body != nil {
+					_ = res.Body.Close()
+				}
+			}()
+			if err != nil {
+				t.Fatal("Error getting the shopping list!", err)
+			} else if res.StatusCode != http.StatusOK {
+				t.Fatal("Got an error status from the server!", res.StatusCode)
+			}
+
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing response body!", err)
+			}
+
+			err = test.ValidatePage(doc, data.elements)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestShoppingListSameEvents claims items for 2 events with the same name and
+// date, checking each event's items stay grouped together across stores.
+func TestShoppingListSameEvents(t *testing.T) {
+	t.Parallel()
+
+	giverData := test.UserData{
+		Email:      "shopping-same-events@localhost.com",
+		ExternalID: "shopping-same-events",
+		FirstName:  "Same",
+		LastName:   "Events",
+	}
+	token, err := test.CreateSession(ctx, logger, db, giverData, time.Minute*5, userAgent)
+	if err != nil {
+		t.Fatal("Could not create a test session", err)
+	}
+	var giverID int64
+	if err = db.QueryRow(ctx, "SELECT person_id FROM person WHERE external_id = ?", giverData.ExternalID).Scan(&giverID); err != nil {
+		t.Fatal("Could not look up the giver", err)
+	}
+
+	date := time.Now().UTC().AddDate(0, 1, 0)
+	for _, cousin := range []string{"a", "b"} {
+
+		recipientID, err := test.CreateUser(ctx, logger, db, test.UserData{
+			Email:      "shopping-same-events-" + cousin + "@localhost.com",
+			ExternalID: "shopping-same-events-" + cousin,
+			FirstName:  "Cousin",
+			LastName:   cousin,
+		})
+		if err != nil {
+			t.Fatal("Could not create the recipient", err)
+		}
+		eventID, err := test.CreateEvent(ctx, db, test.EventData{
+			Date:       date,
+			ExternalID: "shopping-same-event-" + cousin,
+			Name:       "Birthday",
+		})
+		if err != nil {
+			t.Fatal("Could not create the event", err)
+		}
+
+		for _, store := range []string{"Book store", "Toy store"} {
+
+			itemID, err := test.CreateItem(ctx, db, test.ItemData{
+				EventID:    eventID,
+				ExternalID: "shopping-same-events-" + cousin + "-" + strings.Fields(store)[0],
+				Name:       "Gift from the " + store,
+				PersonID:   recipientID,
+				PriceCents: 1000,
+				Store:      store,
+			})
+			if err != nil {
+				t.Fatal("Could not create the item", err)
+			}
+			if err = test.CreateClaim(ctx, db, itemID, giverID, "CLAIMED"); err != nil {
+				t.Fatal(err)
+			}
+
+		}
+
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+"/registry/shopping", nil)
+	if err != nil {
+		t.Fatal("Error building shopping list request", err)
+	}
+	req.AddCookie(&http.Cookie{Name: middleware.SessionCookie, Value: token})
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error getting the shopping list!", err)
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatal("Error reading the shopping list", err)
+	}
+
+	for _, cousin := range []string{"a", "b"} {
+		if groups := strings.Count(string(body), `id="shopping-event-shopping-same-event-`+cousin+`"`); groups != 1 {
+			t.Fatal("Expected event", cousin, "to be listed once but found it", groups, "times")
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"gift-registry/internal/middleware"
 	"gift-registry/internal/util"
 	"html/template"
 	"log/slog"
@@ -19,7 +20,7 @@ func IndexHandler(svr *util.ServerUtils) http.Handler {
 		span.SetName("index_handler")
 
 		dir := svr.Getenv("TEMPLATES_DIR")
-		tmpl, tmplErr := template.ParseFiles(dir + "/index.html")
+		tmpl, tmplErr := template.New("index.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(dir + "/index.html")
 
 		if tmplErr != nil {
 			svr.Logger.ErrorContext(ctx, "Error loading the index template", slog.String("errorMessage", tmplErr.Error()))
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"gift-registry/internal/database"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type birthday struct {
+	day      int
+	month    time.Month
+	name     string
+	personID int64
+	year     int
+}
+
+const (
+	birthdaysQuery = `SELECT person_id,
+			COALESCE(NULLIF(display_name, ''), first_name),
+			birth_month,
+			birth_day,
+			COALESCE(birth_year, 0)
+		FROM person
+		WHERE birth_month IS NOT NULL
+			AND birth_day IS NOT NULL
+			AND deleted_on IS NULL`
+	/* Birthdays only need checking once a day */
+	defaultBirthdayInterval  = 86400000
+	defaultBirthdayLookahead = 4
+	/*
+		The unique index on the birthday person and year makes this a no-op if the
+		event was already created. The event_person inserts select the event by
+		its new external ID, so they don't add anyone when that happens either.
+	*/
+	insertBirthdayEventStatement = `INSERT INTO event (external_id, name, event_date, birthday_person_id, birthday_year)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`
+	insertBirthdayGiversStatement = `INSERT INTO event_person (event_id, person_id, role)
+		SELECT DISTINCT e.event_id, hp.person_id, 'GIVER'
+		FROM event e, household_person hp
+		WHERE e.external_id = ?
+			AND hp.household_id IN (SELECT household_id FROM household_person WHERE person_id = ?)
+			AND hp.person_id <> ?
+			AND hp.person_id NOT IN (SELECT person_id FROM person WHERE deleted_on IS NOT NULL)
+		ON CONFLICT DO NOTHING`
+	insertBirthdayRecipientStatement = `INSERT INTO event_person (event_id, person_id, role)
+		SELECT event_id, ?, 'RECIPIENT'
+		FROM event
+		WHERE external_id = ?`
+)
+
+// StartBirthdays launches the scheduler that creates a birthday event for
+// everyone whose birthday is coming up, with the rest of their households
+// invited to give. It runs until the given context is cancelled.
+func StartBirthdays(
+	ctx context.Context,
+	getenv func(string) string,
+	db database.Database,
+	logger *slog.Logger,
+) *Scheduler {
+
+	return startScheduler(
+		ctx,
+		getenv,
+		db,
+		logger,
+		nil,
+		"birthdays",
+		"BIRTHDAY_INTERVAL",
+		defaultBirthdayInterval,
+		(*Scheduler).createBirthdayEvents,
+	)
+
+}
+
+/*
+Creates the events for every birthday falling within the next
+BIRTHDAY_LOOKAHEAD_WEEKS weeks (4 by default) that doesn't have one yet.
+*/
+func (sch *Scheduler) createBirthdayEvents(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "createBirthdayEvents")
+	defer span.End()
+
+	weeks := defaultBirthdayLookahead
+	if parsed, err := strconv.Atoi(sch.svr.Getenv("BIRTHDAY_LOOKAHEAD_WEEKS")); err == nil {
+		weeks = parsed
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	cutoff := today.AddDate(0, 0, weeks*7)
+
+	birthdays, err := sch.birthdays(ctx)
+	if err != nil {
+		sch.svr.Logger.ErrorContext(ctx, "Error looking up birthdays", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	created := 0
+	for _, bday := range birthdays {
+
+		date := bday.next(today)
+		if date.After(cutoff) {
+			continue
+		}
+
+		if sch.createBirthdayEvent(ctx, bday, date) {
+			created++
+		}
+
+	}
+
+	span.SetAttributes(
+		attribute.Int("birthdays", len(birthdays)),
+		attribute.Int("events_created", created),
+	)
+
+}
+
+func (sch *Scheduler) birthdays(ctx context.Context) ([]birthday, error) {
+	rows, err := sch.svr.DB.Query(ctx, birthdaysQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error querying birthdays: %v", err)
+	}
+	defer rows.Close()
+
+	birthdays := []birthday{}
+	for rows.Next() {
+
+		var bday birthday
+		if err := rows.Scan(&bday.personID, &bday.name, &bday.month, &bday.day, &bday.year); err != nil {
+			sch.svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		birthdays = append(birthdays, bday)
+
+	}
+
+	return birthdays, nil
+}
+
+/*
+Adds the birthday event with the person as the recipient and their
+households as the givers. Returns true if a new event was created.
+*/
+func (sch *Scheduler) createBirthdayEvent(ctx context.Context, bday birthday, date time.Time) bool {
+
+	externalID := rand.Text()
+	statements := []string{
+		insertBirthdayEventStatement,
+		insertBirthdayRecipientStatement,
+		insertBirthdayGiversStatement,
+	}
+	params := [][]any{
+		{externalID, bday.eventName(date), date, bday.personID, date.Year()},
+		{bday.personID, externalID},
+		{externalID, bday.personID, bday.personID},
+	}
+
+	results, errs := sch.svr.DB.ExecuteBatch(ctx, statements, params)
+	for _, err := range errs {
+		if err != nil {
+			sch.svr.Logger.ErrorContext(ctx,
+				"Error creating the birthday event",
+				slog.Int64("personID", bday.personID),
+				slog.String("errorMessage", err.Error()),
+			)
+			return false
+		}
+	}
+
+	if len(results) == 0 {
+		return false
+	} else if added, err := results[0].RowsAffected(); err != nil || added == 0 {
+		return false
+	}
+
+	sch.svr.Logger.InfoContext(ctx,
+		"Created birthday event",
+		slog.Int64("personID", bday.personID),
+		slog.Time("eventDate", date),
+	)
+	return true
+
+}
+
+/* Names the event, including the age if we know the birth year */
+func (bday birthday) eventName(date time.Time) string {
+
+	if bday.year == 0 || date.Year() <= bday.year {
+		return bday.name + "'s birthday"
+	}
+
+	return fmt.Sprintf("%s's %s birthday", bday.name, ordinal(date.Year()-bday.year))
+
+}
+
+/*
+Returns the next time the birthday comes around, on or after today. February
+29th birthdays are celebrated on the 28th in non-leap years.
+*/
+func (bday birthday) next(today time.Time) time.Time {
+
+	on := func(year int) time.Time {
+		date := time.Date(year, bday.month, bday.day, 0, 0, 0, 0, time.UTC)
+		if date.Month() != bday.month {
+			date = time.Date(year, bday.month+1, 0, 0, 0, 0, 0, time.UTC)
+		}
+		return date
+	}
+
+	date := on(today.Year())
+	if date.Before(today) {
+		date = on(today.Year() + 1)
+	}
+
+	return date
+
+}
+
+func ordinal(number int) string {
+
+	suffix := "th"
+	switch {
+	case number%100 >= 11 && number%100 <= 13:
+	case number%10 == 1:
+		suffix = "st"
+	case number%10 == 2:
+		suffix = "nd"
+	case number%10 == 3:
+		suffix = "rd"
+	}
+
+	return strconv.Itoa(number) + suffix
+
+}
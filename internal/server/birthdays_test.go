@@ -0,0 +1,119 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gift-registry/internal/server"
+	"gift-registry/internal/test"
+)
+
+// TestBirthdays runs the scheduler on a short interval and confirms upcoming
+// birthdays get exactly 1 event with the household invited, and birthdays
+// further out are left for later.
+func TestBirthdays(t *testing.T) {
+	testData := []struct {
+		birthday        time.Time
+		birthYear       any
+		expectedEvents  int
+		expectedName    string
+		externalIDStart string
+		testName        string
+	}{
+		{
+			birthday:        time.Now().UTC().AddDate(0, 0, 10),
+			birthYear:       time.Now().UTC().AddDate(-8, 0, 10).Year(),
+			expectedEvents:  1,
+			expectedName:    "Nephew's 8th birthday",
+			externalIDStart: "birthday-soon",
+			testName:        "Birthday coming up",
+		},
+		{
+			birthday:        time.Now().UTC().AddDate(0, 3, 0),
+			expectedEvents:  0,
+			externalIDStart: "birthday-later",
+			testName:        "Birthday too far away",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			householdName := data.externalIDStart + " household"
+			personID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				CreateHousehold: true,
+				ExternalID:      data.externalIDStart + "-nephew",
+				FirstName:       "Nephew",
+				HouseholdName:   householdName,
+				LastName:        "Birthday",
+				Type:            "MANAGED",
+			})
+			if err != nil {
+				t.Fatal("Could not create the birthday person", err)
+			}
+
+			_, err = db.Execute(ctx, "UPDATE person SET birth_month = ?, birth_day = ?, birth_year = ? WHERE person_id = ?",
+				int(data.birthday.Month()), data.birthday.Day(), data.birthYear, personID)
+			if err != nil {
+				t.Fatal("Could not set the birthday", err)
+			}
+
+			_, err = test.CreateUser(ctx, logger, db, test.UserData{
+				Email:         data.externalIDStart + "-aunt@localhost.com",
+				ExternalID:    data.externalIDStart + "-aunt",
+				FirstName:     "Aunt",
+				HouseholdName: householdName,
+				LastName:      "Birthday",
+			})
+			if err != nil {
+				t.Fatal("Could not create the household member", err)
+			}
+
+			env := map[string]string{"BIRTHDAY_INTERVAL": "20"}
+			schedulerCtx, cancel := context.WithCancel(ctx)
+			birthdays := server.StartBirthdays(schedulerCtx, func(name string) string { return env[name] }, db, logger)
+
+			/* Let the scheduler tick several times to prove it doesn't duplicate events */
+			time.Sleep(500 * time.Millisecond)
+			cancel()
+
+			select {
+			case <-birthdays.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Birthday scheduler didn't shut down")
+			}
+
+			var events int
+			var name string
+			err = db.QueryRow(ctx, "SELECT COUNT(*), COALESCE(MAX(name), '') FROM event WHERE birthday_person_id = ?", personID).
+				Scan(&events, &name)
+			if err != nil {
+				t.Fatal("Could not count the birthday events", err)
+			} else if events != data.expectedEvents {
+				t.Fatal("Expected", data.expectedEvents, "birthday events but found", events)
+			}
+
+			if data.expectedEvents == 0 {
+				return
+			}
+
+			if name != data.expectedName {
+				t.Fatal("Expected the event to be called", data.expectedName, "but got", name)
+			}
+
+			var recipients, givers int
+			err = db.QueryRow(ctx, `SELECT SUM(CASE WHEN ep.role = 'RECIPIENT' THEN 1 ELSE 0 END),
+					SUM(CASE WHEN ep.role = 'GIVER' THEN 1 ELSE 0 END)
+				FROM event_person ep
+					INNER JOIN event e ON e.event_id = ep.event_id
+				WHERE e.birthday_person_id = ?`, personID).Scan(&recipients, &givers)
+			if err != nil {
+				t.Fatal("Could not count the event's people", err)
+			} else if recipients != 1 || givers != 1 {
+				t.Fatal("Expected 1 recipient and 1 giver, got", recipients, "and", givers)
+			}
+		})
+	}
+}
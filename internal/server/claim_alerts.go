@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"gift-registry/internal/database"
+	"gift-registry/internal/notification"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	/*
+		Claimers are told right away, so this runs more often than the digest
+		check
+	*/
+	defaultClaimAlertInterval = 15000
+)
+
+// StartClaimAlerts launches the scheduler that emails people when an item
+// they claimed is changed or taken off its owner's list. It runs until the
+// given context is cancelled.
+func StartClaimAlerts(
+	ctx context.Context,
+	getenv func(string) string,
+	db database.Database,
+	logger *slog.Logger,
+	emailProvider Emailer,
+) *Scheduler {
+
+	return startScheduler(
+		ctx,
+		getenv,
+		db,
+		logger,
+		emailProvider,
+		"claim alerts",
+		"CLAIM_ALERT_INTERVAL",
+		defaultClaimAlertInterval,
+		(*Scheduler).sendClaimAlerts,
+	)
+
+}
+
+/*
+Emails the pending claim alerts. Like the digests, each alert is flagged as
+sent before the email goes out and un-flagged if the email fails.
+*/
+func (sch *Scheduler) sendClaimAlerts(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "sendClaimAlerts")
+	defer span.End()
+
+	alerts, err := notification.PendingClaimAlerts(ctx, sch.svr)
+	if err != nil {
+		sch.svr.Logger.ErrorContext(ctx, "Error looking up pending claim alerts", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+	span.SetAttributes(attribute.Int("alerts_due", len(alerts)))
+
+	now := time.Now().UTC()
+	for _, alert := range alerts {
+
+		if err := notification.MarkAlertSent(ctx, sch.svr, alert, now); err != nil {
+			sch.svr.Logger.ErrorContext(ctx,
+				"Error marking the claim alert as sent, skipping",
+				slog.String("errorMessage", err.Error()),
+			)
+			continue
+		}
+
+		if err := sch.emailer.SendClaimAlertEmail(ctx, []string{alert.Email}, alert, sch.svr.Getenv); err != nil {
+			sch.svr.Logger.ErrorContext(ctx,
+				"Error sending the claim alert, will retry",
+				slog.String("errorMessage", err.Error()),
+			)
+			if err := notification.MarkAlertSent(ctx, sch.svr, alert, time.Time{}); err != nil {
+				sch.svr.Logger.ErrorContext(ctx,
+					"Error resetting the failed claim alert",
+					slog.String("errorMessage", err.Error()),
+				)
+			}
+			continue
+		}
+
+	}
+}
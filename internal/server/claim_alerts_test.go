@@ -0,0 +1,120 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gift-registry/internal/server"
+	"gift-registry/internal/test"
+)
+
+// TestClaimAlerts runs the claim alert scheduler on a short interval and
+// confirms each pending alert is emailed exactly once, to members and guests.
+func TestClaimAlerts(t *testing.T) {
+	testData := []struct {
+		externalIDStart string
+		guest           bool
+		testName        string
+	}{
+		{
+			externalIDStart: "claim-alert-member",
+			testName:        "Member claimer",
+		},
+		{
+			externalIDStart: "claim-alert-guest",
+			guest:           true,
+			testName:        "Guest claimer",
+		},
+	}
+
+	for _, data := range testData {
+		/*
+			Not parallel, every scheduler picks up all the pending alerts so the
+			cases would steal each other's emails
+		*/
+		t.Run(data.testName, func(t *testing.T) {
+
+			ownerID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:      data.externalIDStart + "-owner@localhost.com",
+				ExternalID: data.externalIDStart + "-owner",
+				FirstName:  "List",
+				LastName:   "Owner",
+			})
+			if err != nil {
+				t.Fatal("Could not create the list owner", err)
+			}
+
+			claimerEmail := data.externalIDStart + "-claimer@localhost.com"
+			if data.guest {
+
+				itemID, err := test.CreateItem(ctx, db, test.ItemData{
+					ExternalID: data.externalIDStart + "-item",
+					Name:       "Scarf",
+					PersonID:   ownerID,
+				})
+				if err != nil {
+					t.Fatal("Could not create the item", err)
+				}
+
+				_, errs := db.ExecuteBatch(ctx,
+					[]string{
+						`INSERT INTO guest_claim (external_id, item_id, name, email, status) VALUES (?, ?, 'Guest', ?, 'ACTIVE')`,
+						`INSERT INTO claim_alert (guest_claim_id, owner_id, item_name, change_type)
+							SELECT guest_claim_id, ?, 'Scarf', 'WITHDRAWN' FROM guest_claim WHERE external_id = ?`,
+					},
+					[][]any{
+						{data.externalIDStart + "-guest", itemID, claimerEmail},
+						{ownerID, data.externalIDStart + "-guest"},
+					},
+				)
+				for _, err := range errs {
+					if err != nil {
+						t.Fatal("Could not queue the guest's alert", err)
+					}
+				}
+
+			} else {
+
+				claimerID, err := test.CreateUser(ctx, logger, db, test.UserData{
+					Email:      claimerEmail,
+					ExternalID: data.externalIDStart + "-claimer",
+					FirstName:  "Gift",
+					LastName:   "Claimer",
+				})
+				if err != nil {
+					t.Fatal("Could not create the claimer", err)
+				}
+
+				_, err = db.Execute(ctx, `INSERT INTO claim_alert (person_id, owner_id, item_name, change_type, details)
+					VALUES (?, ?, 'Scarf', 'EDITED', 'size changed from none to Large')`, claimerID, ownerID)
+				if err != nil {
+					t.Fatal("Could not queue the member's alert", err)
+				}
+
+			}
+
+			mock := &test.EmailMock{}
+			env := map[string]string{"CLAIM_ALERT_INTERVAL": "20"}
+			schedulerCtx, cancel := context.WithCancel(ctx)
+			claimAlerts := server.StartClaimAlerts(schedulerCtx, func(name string) string { return env[name] }, db, logger, mock)
+
+			/* Let the scheduler tick several times to prove it doesn't double-send */
+			time.Sleep(500 * time.Millisecond)
+			cancel()
+
+			select {
+			case <-claimAlerts.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Claim alert scheduler didn't shut down")
+			}
+
+			sent := mock.ClaimAlertsSent(claimerEmail)
+			if len(sent) != 1 {
+				t.Fatal("Expected 1 claim alert email but got", len(sent))
+			} else if sent[0].ItemName != "Scarf" || sent[0].Owner != "List" {
+				t.Fatal("Claim alert has the wrong details", sent[0])
+			}
+		})
+	}
+}
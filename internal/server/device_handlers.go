@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type device struct {
+	Current    bool
+	CreatedOn  string
+	ExternalID string
+	IPAddress  string
+	LastSeenOn string
+	Name       string
+}
+
+type deviceList struct {
+	Devices      []device
+	ErrorMessage string
+}
+
+const (
+	deleteDeviceStatement = `DELETE FROM session
+		WHERE external_id = ?
+			AND person_id = ?
+			AND session_id <> ?`
+	deleteOtherDevicesStatement = `DELETE FROM session
+		WHERE person_id = ?
+			AND session_id <> ?`
+	deviceTimeFmt = "January 2, 2006 3:04 PM"
+	devicesQuery  = `SELECT session_id, external_id, device_name, ip_address, created_on, last_seen_on
+		FROM session
+		WHERE person_id = ?
+			AND expiration > ?
+		ORDER BY last_seen_on DESC`
+	unknownDevice = "Unknown device"
+)
+
+/*
+Browsers and operating systems to look for in the user agent, in the order to
+check them. Most browsers claim to be several others (Edge says it's Chrome
+and Safari), so the more specific ones come first.
+*/
+var (
+	browserNames = [][2]string{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	}
+	platformNames = [][2]string{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "Mac"},
+		{"Linux", "Linux"},
+	}
+)
+
+// Lists the devices the logged-in person is signed in on, so they can spot
+// (and revoke) any they don't recognize.
+func DevicesHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("devices_handler")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		writeDevices(ctx, svr, res, req, personID, "")
+
+	})
+
+}
+
+// Signs one of the logged-in person's other devices out. The device making
+// the request can't revoke itself this way, that's what logging out is for.
+func DeviceRevokeHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("device_revoke")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("session_external_id", externalID),
+		)
+
+		errorMessage := ""
+		if result, err := svr.DB.Execute(ctx, deleteDeviceStatement, externalID, personID, currentSessionID(svr, req)); err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error revoking the session",
+				slog.String("errorMessage", err.Error()),
+			)
+			errorMessage = "Could not sign that device out."
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		} else if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+			audit.Record(ctx, svr, personID, audit.Event{
+				Action:   audit.Revoke,
+				Entity:   audit.Session,
+				EntityID: externalID,
+			})
+		}
+
+		writeDevices(ctx, svr, res, req, personID, errorMessage)
+
+	})
+
+}
+
+// Signs the logged-in person out everywhere except the device making the
+// request, and revokes their personal access tokens, since a script holding
+// one is as good as signed in.
+func DeviceRevokeOthersHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("device_revoke_others")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		errorMessage := ""
+		results, errs := svr.DB.ExecuteBatch(
+			ctx,
+			[]string{deleteOtherDevicesStatement, deleteAccessTokensStatement},
+			[][]any{{personID, currentSessionID(svr, req)}, {personID}},
+		)
+		for _, err := range errs {
+			if err != nil {
+				svr.Logger.ErrorContext(
+					ctx,
+					"Error revoking the other sessions",
+					slog.String("errorMessage", err.Error()),
+				)
+				errorMessage = "Could not sign your other devices out."
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+			}
+		}
+
+		if errorMessage == "" {
+			deleted, _ := results[0].RowsAffected()
+			tokensDeleted, _ := results[1].RowsAffected()
+			if deleted > 0 || tokensDeleted > 0 {
+				span.SetAttributes(attribute.Int64("revoked_count", deleted), attribute.Int64("tokens_revoked_count", tokensDeleted))
+				audit.Record(ctx, svr, personID, audit.Event{
+					Action: audit.Revoke,
+					After:  map[string]int64{"revoked": deleted, "tokens_revoked": tokensDeleted},
+					Entity: audit.Session,
+				})
+			}
+		}
+
+		writeDevices(ctx, svr, res, req, personID, errorMessage)
+
+	})
+
+}
+
+/*
+The stored (hashed) ID of the session the request came in on. Auth already
+checked it's valid.
+*/
+func currentSessionID(svr *util.ServerUtils, req *http.Request) string {
+
+	cookie, err := req.Cookie(middleware.SessionCookie)
+	if err != nil {
+		return ""
+	}
+	return util.HashSecret(svr, cookie.Value)
+
+}
+
+/*
+Names the device from its user agent, like "Firefox on Windows". It only has
+to be good enough for someone to recognize their own devices in a list.
+*/
+func deviceName(userAgent string) string {
+
+	browser := ""
+	for _, name := range browserNames {
+		if strings.Contains(userAgent, name[0]) {
+			browser = name[1]
+			break
+		}
+	}
+
+	platform := ""
+	for _, name := range platformNames {
+		if strings.Contains(userAgent, name[0]) {
+			platform = name[1]
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	default:
+		return unknownDevice
+	}
+
+}
+
+func writeDevices(
+	ctx context.Context,
+	svr *util.ServerUtils,
+	res http.ResponseWriter,
+	req *http.Request,
+	personID int64,
+	errorMessage string,
+) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/devices.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the devices template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your devices"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	list := deviceList{
+		Devices:      []device{},
+		ErrorMessage: errorMessage,
+	}
+
+	current := currentSessionID(svr, req)
+	rows, err := svr.DB.Query(ctx, devicesQuery, personID, time.Now().UTC())
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the devices", slog.String("errorMessage", err.Error()))
+		list.ErrorMessage = "Could not look up your devices."
+	} else {
+
+		defer rows.Close()
+		for rows.Next() {
+
+			var (
+				dev        device
+				sessionID  string
+				externalID sql.NullString
+				createdOn  sql.NullTime
+				lastSeenOn sql.NullTime
+			)
+			if err := rows.Scan(&sessionID, &externalID, &dev.Name, &dev.IPAddress, &createdOn, &lastSeenOn); err != nil {
+				svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+				continue
+			}
+			dev.Current = sessionID == current
+			dev.ExternalID = externalID.String
+			if createdOn.Valid {
+				dev.CreatedOn = createdOn.Time.Format(deviceTimeFmt)
+			}
+			if lastSeenOn.Valid {
+				dev.LastSeenOn = lastSeenOn.Time.Format(deviceTimeFmt)
+			}
+			if dev.Name == "" {
+				dev.Name = unknownDevice
+			}
+			list.Devices = append(list.Devices, dev)
+
+		}
+
+	}
+	span.SetAttributes(attribute.Int("device_count", len(list.Devices)))
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "devices", list); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
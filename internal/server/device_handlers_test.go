@@ -0,0 +1,260 @@
+package server_test
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+)
+
+// TestDevices signs the same person in on a few devices and checks they can
+// sign the others out one at a time or all at once, but never the device
+// they're using or someone else's.
+func TestDevices(t *testing.T) {
+	testData := []struct {
+		expectedRemaining []string
+		path              func(devices map[string]string) string
+		testName          string
+		tokensRevoked     bool
+	}{
+		{
+			expectedRemaining: []string{"current", "laptop", "tablet"},
+			path:              func(devices map[string]string) string { return "/profile/devices" },
+			testName:          "List devices",
+		},
+		{
+			expectedRemaining: []string{"current", "tablet"},
+			path: func(devices map[string]string) string {
+				return "/profile/devices/" + devices["laptop"] + "/revoke"
+			},
+			testName: "Revoke one device",
+		},
+		{
+			expectedRemaining: []string{"current", "laptop", "tablet"},
+			path: func(devices map[string]string) string {
+				return "/profile/devices/" + devices["current"] + "/revoke"
+			},
+			testName: "Revoke current device",
+		},
+		{
+			expectedRemaining: []string{"current", "laptop", "tablet", "stranger"},
+			path: func(devices map[string]string) string {
+				return "/profile/devices/" + devices["stranger"] + "/revoke"
+			},
+			testName: "Revoke someone else's device",
+		},
+		{
+			expectedRemaining: []string{"current"},
+			path:              func(devices map[string]string) string { return "/profile/devices/revoke-others" },
+			testName:          "Revoke other devices",
+			tokensRevoked:     true,
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			userData := test.UserData{
+				Email:     "devices-" + rand.Text() + "@localhost.com",
+				FirstName: "Many",
+				LastName:  "Devices",
+			}
+			token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session", err)
+			}
+
+			devices := map[string]string{}
+			var personID int64
+			var currentID string
+			err = db.QueryRow(ctx, "SELECT person_id, external_id FROM session WHERE session_id = ?", test.HashSecret(token)).Scan(&personID, &currentID)
+			if err != nil {
+				t.Fatal("Could not look up the test session", err)
+			}
+			devices["current"] = currentID
+			if err = test.CreateAccessToken(ctx, db, personID, "devices-"+rand.Text()); err != nil {
+				t.Fatal(err)
+			}
+
+			strangerToken, err := test.CreateSession(ctx, logger, db, test.UserData{
+				Email:     "stranger-" + rand.Text() + "@localhost.com",
+				FirstName: "Someone",
+				LastName:  "Else",
+			}, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create the stranger's session", err)
+			}
+			var strangerID string
+			if err = db.QueryRow(ctx, "SELECT external_id FROM session WHERE session_id = ?", test.HashSecret(strangerToken)).Scan(&strangerID); err != nil {
+				t.Fatal("Could not look up the stranger's session", err)
+			}
+			devices["stranger"] = strangerID
+
+			now := time.Now().UTC()
+			for _, name := range []string{"laptop", "tablet"} {
+				devices[name] = rand.Text()
+				_, err = db.Execute(ctx,
+					"INSERT INTO session (session_id, external_id, person_id, expiration, user_agent, device_name, ip_address, created_on, last_seen_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+					rand.Text(), devices[name], personID, now.Add(time.Hour), "Mozilla/5.0", name, "192.0.2.0/24", now, now,
+				)
+				if err != nil {
+					t.Fatal("Could not add the", name, "session", err)
+				}
+			}
+
+			sessCookie := &http.Cookie{Name: middleware.SessionCookie, Value: token}
+			var res *http.Response
+			if path := data.path(devices); path == "/profile/devices" {
+
+				req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+path, nil)
+				if err != nil {
+					t.Fatal("Error building the devices request", err)
+				}
+				req.AddCookie(sessCookie)
+				req.Header.Set("User-Agent", userAgent)
+				req.Header.Set("Sec-Fetch-Dest", "empty")
+				req.Header.Set("Sec-Fetch-Mode", "same-origin")
+				req.Header.Set("Sec-Fetch-Site", "same-origin")
+				if res, err = http.DefaultClient.Do(req); err != nil {
+					t.Fatal("Error loading the devices", err)
+				}
+
+			} else {
+				res = submitForm(t, path, nil, []*http.Cookie{sessCookie}, userAgent)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 but got", res.StatusCode)
+			}
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing the devices section", err)
+			}
+
+			var tokens int
+			if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM access_token WHERE person_id = ?", personID).Scan(&tokens); err != nil {
+				t.Fatal("Error counting access tokens", err)
+			} else if (tokens == 0) != data.tokensRevoked {
+				t.Fatal("Expected the access tokens to be revoked", data.tokensRevoked, "but found", tokens)
+			}
+
+			for name, externalID := range devices {
+
+				var count int
+				if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM session WHERE external_id = ?", externalID).Scan(&count); err != nil {
+					t.Fatal("Error counting sessions", err)
+				}
+
+				expected := false
+				for _, remaining := range data.expectedRemaining {
+					expected = expected || remaining == name
+				}
+				if (count == 1) != expected {
+					t.Fatal("Expected the", name, "session to remain", expected, "but found", count)
+				}
+
+				_, listed := test.CheckElement(*doc, "device-"+externalID)
+				if name != "stranger" && listed != expected {
+					t.Fatal("Expected the", name, "device to be listed", expected, "but it was", listed)
+				} else if name == "stranger" && listed {
+					t.Fatal("Someone else's device is on the list")
+				}
+
+			}
+		})
+	}
+}
+
+// TestDeviceName logs in again on a device that already has a session,
+// checking the new session gets a name people will recognize and the old one
+// is left alone.
+func TestDeviceName(t *testing.T) {
+	testData := []struct {
+		expectedName string
+		testName     string
+		userAgent    string
+	}{
+		{
+			expectedName: "Edge on Windows",
+			testName:     "Edge",
+			userAgent:    "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36 Edg/130.0.0.0",
+		},
+		{
+			expectedName: "Safari on iPhone",
+			testName:     "iPhone",
+			userAgent:    "Mozilla/5.0 (iPhone; CPU iPhone OS 18_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Mobile/15E148 Safari/604.1",
+		},
+		{
+			expectedName: "Firefox on Linux",
+			testName:     "Firefox",
+			userAgent:    "Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0",
+		},
+		{
+			expectedName: "Unknown device",
+			testName:     "Unrecognized",
+			userAgent:    userAgent,
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			token, err := test.CreateSession(ctx, logger, db, test.UserData{
+				Email:     "device-name-" + rand.Text() + "@localhost.com",
+				FirstName: "Device",
+				LastName:  "Name",
+			}, time.Minute*5, data.userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session", err)
+			}
+
+			/* Log in again on the same device to get a session named by the server */
+			var email string
+			if err = db.QueryRow(ctx, "SELECT p.email FROM person p INNER JOIN session s ON s.person_id = p.person_id WHERE s.session_id = ?", test.HashSecret(token)).Scan(&email); err != nil {
+				t.Fatal("Could not look up the test person", err)
+			}
+			if err = createVerification(email, "device-name-code"); err != nil {
+				t.Fatal(err)
+			}
+			res := submitForm(t, "/verify", map[string][]string{"code": {"device-name-code"}, "email": {email}}, nil, data.userAgent)
+			_ = res.Body.Close()
+
+			var name string
+			err = db.QueryRow(ctx, "SELECT s.device_name FROM session s INNER JOIN person p ON p.person_id = s.person_id WHERE p.email = ? AND s.session_id <> ?", email, test.HashSecret(token)).Scan(&name)
+			if err != nil {
+				t.Fatal("Could not find the new session", err)
+			} else if name != data.expectedName {
+				t.Fatal("Expected the device to be called", data.expectedName, "but it was", name)
+			}
+
+			var sessions int
+			if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM session s INNER JOIN person p ON p.person_id = s.person_id WHERE p.email = ?", email).Scan(&sessions); err != nil {
+				t.Fatal("Error counting the sessions", err)
+			} else if sessions != 2 {
+				t.Fatal("Expected the earlier session to still be there, but found", sessions, "sessions")
+			}
+		})
+	}
+}
+
+/* Gives the person a verification code to log in with */
+func createVerification(email string, code string) error {
+	_, err := db.Execute(ctx,
+		"INSERT INTO verification (person_id, token, token_expiration, attempts) SELECT person_id, ?, ?, 0 FROM person WHERE email = ?",
+		test.HashSecret(strings.ToUpper(code)), time.Now().Add(5*time.Minute).UTC(), email,
+	)
+	if err != nil {
+		return fmt.Errorf("error creating the verification code: %v", err)
+	}
+	return nil
+}
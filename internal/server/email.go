@@ -4,15 +4,31 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"html/template"
+	"mime"
 	"net/smtp"
-	"text/template"
+	"strings"
+	"unicode"
+
+	"gift-registry/internal/notification"
+	"gift-registry/internal/profile"
+	"gift-registry/internal/registry"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Emailer interface {
-	SendVerificationEmail(ctx context.Context, to []string, code string, getenv func(string) string) error
+	SendAccountDeletionEmail(ctx context.Context, to []string, deletion profile.AccountDeletionEmail, getenv func(string) string) error
+	SendClaimAlertEmail(ctx context.Context, to []string, alert notification.ClaimAlert, getenv func(string) string) error
+	SendDigestEmail(ctx context.Context, to []string, digest notification.Digest, getenv func(string) string) error
+	SendEmailChangeCode(ctx context.Context, to []string, change profile.EmailChangeEmail, getenv func(string) string) error
+	SendEmailChangeNotice(ctx context.Context, to []string, change profile.EmailChangeEmail, getenv func(string) string) error
+	SendGuestClaimEmail(ctx context.Context, to []string, claim registry.GuestClaimEmail, getenv func(string) string) error
+	SendReminderEmail(ctx context.Context, to []string, reminder ReminderEmail, getenv func(string) string) error
+	SendSignInEmail(ctx context.Context, to []string, signIn SignInEmail, getenv func(string) string) error
+	SendVerificationEmail(ctx context.Context, to []string, code string, link string, device string, getenv func(string) string) error
 }
 
 type emailSender struct {
@@ -22,10 +38,34 @@ type emailSender struct {
 	port        string
 }
 
+// ReminderEmail holds the details for an upcoming event reminder sent to a
+// giver
+type ReminderEmail struct {
+	Claims     []ReminderClaim
+	EventDate  string
+	EventName  string
+	Recipients []ReminderRecipient
+}
+
+// ReminderClaim is an item the giver has claimed but not marked purchased
+type ReminderClaim struct {
+	ItemName  string
+	Recipient string
+	Status    string
+}
+
+// ReminderRecipient lists a recipient's items nobody has claimed yet
+type ReminderRecipient struct {
+	Name           string
+	UnclaimedItems []string
+}
+
 type loginEmail struct {
-	Code string
-	From string
-	To   []string
+	Code   string
+	Device string
+	From   string
+	Link   string
+	To     []string
 }
 
 const (
@@ -60,32 +100,162 @@ func (es emailSender) String() string {
 
 // Send the login email to the given address used for registering an account
 // to confirm the poerson who tried to log in is the person who owns the
-// address.
-func (es *emailSender) SendVerificationEmail(ctx context.Context, to []string, code string, getenv func(string) string) error {
-	_, span := tracer.Start(ctx, "sendVerificationEmail")
+// address. The email names the device that asked for the code, so the person
+// can tell if it wasn't them.
+func (es *emailSender) SendVerificationEmail(ctx context.Context, to []string, code string, link string, device string, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendVerificationEmail")
 	defer span.End()
 
 	span.SetAttributes(attribute.StringSlice("to", to))
-	const subject = "Subject: Your login code for the gift registry"
-	const mime = "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";"
 
 	/* Build the data for the email body */
 	fields := loginEmail{
-		Code: code,
+		Code:   code,
+		Device: device,
+		Link:   link,
+	}
+
+	return es.send(ctx, to, "Your login code for the gift registry", "/login_email.html", "login-email", fields, getenv)
+}
+
+// Send the link that finishes deleting someone's account, so a borrowed
+// session can't delete it on its own.
+func (es *emailSender) SendAccountDeletionEmail(ctx context.Context, to []string, deletion profile.AccountDeletionEmail, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendAccountDeletionEmail")
+	defer span.End()
+
+	span.SetAttributes(attribute.StringSlice("to", to))
+
+	return es.send(ctx, to, "Confirm deleting your gift registry account", "/account_deletion_email.html", "account-deletion-email", deletion, getenv)
+}
+
+// Tell someone that an item they claimed was changed or taken off the list.
+func (es *emailSender) SendClaimAlertEmail(ctx context.Context, to []string, alert notification.ClaimAlert, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendClaimAlertEmail")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.StringSlice("to", to),
+		attribute.String("change_type", string(alert.Type)),
+	)
+
+	subject := fmt.Sprintf("A gift you claimed for %s has changed", alert.Owner)
+	if alert.Type != notification.Edited {
+		subject = fmt.Sprintf("A gift you claimed for %s is no longer on their list", alert.Owner)
 	}
+	return es.send(ctx, to, subject, "/claim_alert_email.html", "claim-alert-email", alert, getenv)
+}
+
+// Send a household member the changes made to other people's lists since they
+// were last notified.
+func (es *emailSender) SendDigestEmail(ctx context.Context, to []string, digest notification.Digest, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendDigestEmail")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.StringSlice("to", to),
+		attribute.Int("changes", len(digest.Changes)),
+	)
+
+	subject := "Updates to your family's gift lists"
+	if len(digest.Changes) == 1 {
+		subject = fmt.Sprintf("%s updated their gift list", digest.Changes[0].Owner)
+	}
+	return es.send(ctx, to, subject, "/digest_email.html", "digest-email", digest, getenv)
+}
+
+// Send the code that confirms a new email address to that address, so a typo
+// doesn't lock the person out.
+func (es *emailSender) SendEmailChangeCode(ctx context.Context, to []string, change profile.EmailChangeEmail, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendEmailChangeCode")
+	defer span.End()
+
+	span.SetAttributes(attribute.StringSlice("to", to))
+
+	return es.send(ctx, to, "Confirm your new email address for the gift registry", "/email_change_email.html", "email-change-code-email", change, getenv)
+}
+
+// Let the current email address know it's being replaced, in case someone
+// else is making the change.
+func (es *emailSender) SendEmailChangeNotice(ctx context.Context, to []string, change profile.EmailChangeEmail, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendEmailChangeNotice")
+	defer span.End()
+
+	span.SetAttributes(attribute.StringSlice("to", to))
+
+	return es.send(ctx, to, "Your gift registry email address is being changed", "/email_change_email.html", "email-change-notice-email", change, getenv)
+}
+
+// Send a guest the links for confirming (and later releasing) the claim they
+// made from a share link.
+func (es *emailSender) SendGuestClaimEmail(ctx context.Context, to []string, claim registry.GuestClaimEmail, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendGuestClaimEmail")
+	defer span.End()
+
+	span.SetAttributes(attribute.StringSlice("to", to))
+
+	subject := fmt.Sprintf("Confirm your claim on %s", claim.ItemName)
+	return es.send(ctx, to, subject, "/guest_claim_email.html", "guest-claim-email", claim, getenv)
+}
+
+// Send a reminder to a giver ahead of an upcoming event, listing what's still
+// unclaimed and what they've claimed but not yet bought.
+func (es *emailSender) SendReminderEmail(ctx context.Context, to []string, reminder ReminderEmail, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendReminderEmail")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.StringSlice("to", to),
+		attribute.String("event", reminder.EventName),
+	)
+
+	subject := fmt.Sprintf("Reminder: %s is coming up on %s", reminder.EventName, reminder.EventDate)
+	return es.send(ctx, to, subject, "/reminder_email.html", "reminder-email", reminder, getenv)
+}
+
+// Tell someone their account was just signed into, with a link to sign out
+// everywhere if it wasn't them.
+func (es *emailSender) SendSignInEmail(ctx context.Context, to []string, signIn SignInEmail, getenv func(string) string) error {
+	ctx, span := tracer.Start(ctx, "sendSignInEmail")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.StringSlice("to", to),
+		attribute.String("device", signIn.Device),
+	)
+
+	return es.send(ctx, to, "New sign-in to your gift registry account", "/signin_email.html", "signin-email", signIn, getenv)
+}
+
+/*
+Renders the given template definition as an HTML email body and sends it.
+Every email the app sends goes through here so the SMTP and MIME handling
+only lives in 1 place.
+*/
+func (es *emailSender) send(
+	ctx context.Context,
+	to []string,
+	subject string,
+	templateFile string,
+	templateDef string,
+	fields any,
+	getenv func(string) string,
+) error {
+	span := trace.SpanFromContext(ctx)
+	const mimeHeaders = "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";"
 
 	templates := getenv("TEMPLATES_DIR")
-	tmpl, err := template.ParseFiles(templates + "/login_email.html")
+	tmpl, err := template.ParseFiles(templates + templateFile)
 	if err != nil {
 		return fmt.Errorf("could not load email template: %v", err)
 	}
 
 	msg := new(bytes.Buffer)
-	if _, err = fmt.Fprintf(msg, "%s\n%s\n\n", subject, mime); err != nil {
+	if _, err = fmt.Fprintf(msg, "Subject: %s\n%s\n\n", subjectHeader(subject), mimeHeaders); err != nil {
 		return fmt.Errorf("error writing the message subject and mime type to buffer: %v", err)
 	}
 
-	if err = tmpl.ExecuteTemplate(msg, "login-email", fields); err != nil {
+	if err = tmpl.ExecuteTemplate(msg, templateDef, fields); err != nil {
 		return fmt.Errorf("error loading email template: %v", err)
 	}
 
@@ -98,3 +268,18 @@ func (es *emailSender) SendVerificationEmail(ctx context.Context, to []string, c
 
 	return err
 }
+
+/*
+Subjects include names people typed in (items, events, owners), so line breaks
+and other control characters come out before it's written as a header. It's
+encoded too, so non-ASCII names make it through intact.
+*/
+func subjectHeader(subject string) string {
+	subject = strings.Map(func(char rune) rune {
+		if unicode.IsControl(char) {
+			return ' '
+		}
+		return char
+	}, subject)
+	return mime.QEncoding.Encode("utf-8", subject)
+}
@@ -2,17 +2,24 @@ package server
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/mail"
+	"net/url"
+	"path"
 	"strings"
 	"text/template"
 	"time"
 
+	"gift-registry/internal/audit"
 	"gift-registry/internal/middleware"
+	"gift-registry/internal/oidc"
+	"gift-registry/internal/passkey"
 	"gift-registry/internal/util"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -37,11 +44,18 @@ type loginFormErrors struct {
 	ErrorMessage string
 }
 
+/* The full login page, which offers the OIDC provider when one's set up */
+type loginPage struct {
+	Form     loginForm
+	Provider string
+}
+
 type verificationForm struct {
-	Code    string
-	Email   string
-	Errors  verificationFormErrors
-	success bool
+	Code     string
+	Email    string
+	Errors   verificationFormErrors
+	Remember bool
+	success  bool
 }
 
 type verificationFormErrors struct {
@@ -49,8 +63,17 @@ type verificationFormErrors struct {
 	ErrorMessage string
 }
 
+type verificationLink struct {
+	Email        string
+	ErrorMessage string
+	Signature    string
+	Token        string
+	success      bool
+}
+
 type verificationRecord struct {
 	attempts     int
+	browserToken string
 	personID     int64
 	token        string
 	tokenExpires time.Time
@@ -66,24 +89,34 @@ const (
 	DeleteVerificationTokenStatement = `DELETE 
 		FROM verification 
 		WHERE person_id = ?`
-	GetVerificationQuery = `SELECT v.person_id, v.token, v.token_expiration, v.attempts 
+	GetVerificationQuery = `SELECT v.person_id, v.token, v.token_expiration, v.attempts, COALESCE(v.browser_token, '') 
 		FROM verification v 
 			INNER JOIN person p ON p.person_id = v.person_id 
 		WHERE p.email = ?`
-	InsertSessionStatement = `INSERT INTO session(session_id, person_id, expiration, user_agent) 
-		VALUES (?, ?, ?, ?)`
+	InsertSessionStatement = `INSERT INTO session(session_id, external_id, person_id, expiration, absolute_expiration, remembered, user_agent, device_name, ip_address, created_on, last_seen_on) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	/*
+		Set on the browser that asked for a code. The emailed link only works
+		there, so an email scanner pre-fetching (or even submitting) the link
+		can't use it to log in.
+	*/
+	LoginBrowserCookie     = "gift-registry-login"
 	LoginFailed            = "Login process failed. Please try again"
-	MaxAttempts            = 3
+	LoginLinkAction        = "login"
+	MaxAttempts            = util.MaxCodeAttempts
+	PasskeyLoginFailed     = "Could not sign in with that passkey. Please try again or log in with your email address"
 	SelectUserByEmailQuery = `SELECT person_id, email 
 		FROM person 
-		WHERE email = ?`
-	SetVerificationTokenStatement = `INSERT INTO verification (token, token_expiration, person_id) 
-		VALUES (?, ?, ?) 
+		WHERE email = ?
+			AND disabled_on IS NULL`
+	SetVerificationTokenStatement = `INSERT INTO verification (token, token_expiration, browser_token, person_id) 
+		VALUES (?, ?, ?, ?) 
 		ON CONFLICT (person_id) DO 
-			UPDATE SET token = ?, token_expiration = ?`
+			UPDATE SET token = ?, token_expiration = ?, browser_token = ?`
 	UpdateAttemptCountStatement = `UPDATE verification 
 		SET attempts = ? 
 		WHERE person_id = ?`
+	verificationLifetime = util.CodeLifetime
 )
 
 // Starts the login process by checking the provided email address against the
@@ -127,6 +160,21 @@ func LoginHandler(svr *util.ServerUtils) http.Handler {
 
 		}
 
+		/*
+			The cookie goes out whether or not the email matches anyone, so it
+			doesn't give away which addresses have accounts
+		*/
+		browserToken := rand.Text()
+		http.SetCookie(res, &http.Cookie{
+			Name:     LoginBrowserCookie,
+			Value:    browserToken,
+			Path:     "/verify",
+			MaxAge:   int(verificationLifetime.Seconds()),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+
 		email := ""
 		var personID int64 = 0
 		if err := svr.DB.QueryRow(ctx, SelectUserByEmailQuery, userData.Email).Scan(&personID, &email); err != nil && err != sql.ErrNoRows {
@@ -138,7 +186,7 @@ func LoginHandler(svr *util.ServerUtils) http.Handler {
 
 		if email != "" {
 
-			modified, token, err = setVerificationCode(ctx, svr, personID, &userData)
+			modified, token, err = setVerificationCode(ctx, svr, personID, browserToken, &userData)
 			if err != nil {
 				span.SetAttributes(attribute.String("error_message", err.Error()))
 				writeResponse(ctx, res, svr, span, userData, "/login_form.html", "login-form")
@@ -151,7 +199,8 @@ func LoginHandler(svr *util.ServerUtils) http.Handler {
 		if modified == 1 {
 
 			svr.Logger.DebugContext(ctx, "Sending user email with the login token", slog.String("userEmail", userData.Email), slog.Any("emailer", emailer))
-			emailErr = emailer.SendVerificationEmail(ctx, []string{userData.Email}, token, svr.Getenv)
+			link := util.AppURL(svr, loginLink(svr, userData.Email, token))
+			emailErr = emailer.SendVerificationEmail(ctx, []string{userData.Email}, token, link, deviceName(req.UserAgent()), svr.Getenv)
 
 		}
 
@@ -198,28 +247,7 @@ func LoginFormHandler(svr *util.ServerUtils) http.Handler {
 		span := trace.SpanFromContext(ctx)
 		span.SetName("login_form_handler")
 
-		templates := svr.Getenv("TEMPLATES_DIR")
-		tmpl, tmplErr := template.ParseFiles(templates+"/login_page.html", templates+"/login_form.html")
-
-		if tmplErr != nil {
-			svr.Logger.ErrorContext(ctx, "Error loading the login form template", slog.String("errorMessage", tmplErr.Error()))
-			res.WriteHeader(500)
-			res.Write([]byte("Error loading gift registry login"))
-			span.SetAttributes(attribute.String("error_message", tmplErr.Error()))
-			return
-		}
-
-		res.WriteHeader(200)
-
-		err := tmpl.ExecuteTemplate(res, "login-page", loginForm{})
-		if err != nil {
-			svr.Logger.ErrorContext(ctx, "Error writing template!",
-				slog.String("errorMessage", err.Error()))
-			res.WriteHeader(500)
-			res.Write([]byte("Error loading gift registry login form"))
-			span.SetAttributes(attribute.String("error_message", err.Error()))
-			return
-		}
+		writeLoginPage(ctx, res, svr, span, "login-page", loginForm{})
 	})
 }
 
@@ -244,7 +272,7 @@ func LogoutHandler(svr *util.ServerUtils) http.Handler {
 		cookie.Expires = time.Unix(0, 0)
 		cookie.MaxAge = 0
 
-		if _, err := svr.DB.Execute(ctx, DeleteSessionStatement, cookie.Value); err != nil {
+		if _, err := svr.DB.Execute(ctx, DeleteSessionStatement, util.HashSecret(svr, cookie.Value)); err != nil {
 			svr.Logger.ErrorContext(
 				ctx,
 				"Error cleaning up the session table",
@@ -253,6 +281,7 @@ func LogoutHandler(svr *util.ServerUtils) http.Handler {
 			res.WriteHeader(500)
 			return
 		}
+		audit.Record(ctx, svr, middleware.PersonID(res, req), audit.Event{Action: audit.Logout, Entity: audit.Session})
 
 		http.Redirect(res, req, "/login", http.StatusSeeOther)
 	})
@@ -284,6 +313,7 @@ func VerificationHandler(svr *util.ServerUtils) http.Handler {
 
 		submission.Code = req.FormValue("code")
 		submission.Email = req.FormValue("email")
+		submission.Remember = req.FormValue("remember") == "true"
 		submission.validate(ctx, svr)
 		if !submission.success {
 			writeResponse(ctx, res, svr, span, submission, "/verify_login.html", "verify-login-form")
@@ -292,7 +322,7 @@ func VerificationHandler(svr *util.ServerUtils) http.Handler {
 		/* Look up the verification record */
 		recData := verificationRecord{}
 		err = svr.DB.QueryRow(ctx, GetVerificationQuery, submission.Email).
-			Scan(&recData.personID, &recData.token, &recData.tokenExpires, &recData.attempts)
+			Scan(&recData.personID, &recData.token, &recData.tokenExpires, &recData.attempts, &recData.browserToken)
 
 		/*
 			Handle errors looking up verification details (other than not finding the
@@ -333,7 +363,7 @@ func VerificationHandler(svr *util.ServerUtils) http.Handler {
 			svr.Logger.DebugContext(ctx, "Read in record data", slog.String("userEmail", submission.Email))
 		}
 
-		codesMatch, attemptsRemaining, beforeExpiration := compareValidation(recData, submission)
+		codesMatch, attemptsRemaining, beforeExpiration := compareValidation(svr, recData, submission)
 		span.SetAttributes(
 			attribute.Bool("codes_match", codesMatch),
 			attribute.Bool("attempts_remaining", attemptsRemaining),
@@ -409,7 +439,7 @@ func VerificationHandler(svr *util.ServerUtils) http.Handler {
 				writeResponse(ctx, res, svr, span, submission, "/verify_login.html", "verify-login-form")
 			}
 
-			sessionID, sessionExpires, err := createSession(ctx, svr, req, recData.personID, submission.Email)
+			sessionID, sessionExpires, err := createSession(ctx, svr, req, recData.personID, submission.Email, submission.Remember)
 			if err != nil {
 				svr.Logger.ErrorContext(ctx,
 					"Error writing a session record!",
@@ -423,18 +453,193 @@ func VerificationHandler(svr *util.ServerUtils) http.Handler {
 			}
 
 			submission.success = true
+			startSession(res, sessionID, sessionExpires)
+			span.SetAttributes(attribute.Bool("submission_success", submission.success))
+
+		}
+	})
+}
+
+// Signs the person in with a passkey instead of an emailed code. The browser
+// posts its response to the challenge from /login/passkey/options, and once
+// that checks out the session is started the same way as a verified code.
+func PasskeyLoginHandler(svr *util.ServerUtils) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("passkey_login_handler")
+
+		personID, email, err := passkey.Authenticate(ctx, svr, req)
+		if err != nil {
+			svr.Logger.InfoContext(ctx, "Passkey sign-in failed", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeResponse(ctx, res, svr, span, loginWithError(PasskeyLoginFailed), "/login_form.html", "login-form")
+			return
+		}
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		sessionID, sessionExpires, err := createSession(ctx, svr, req, personID, email, false)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error writing a session record!",
+				slog.String("userEmail", email),
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeResponse(ctx, res, svr, span, loginWithError(LoginFailed), "/login_form.html", "login-form")
+			return
+		}
+
+		startSession(res, sessionID, sessionExpires)
+	})
+}
+
+// Shows the confirmation page for the login link in the verification email.
+// Nothing is used up here, so email scanners that pre-fetch links don't burn
+// the code. Logging in takes the confirmation POST.
+func VerificationLinkHandler(svr *util.ServerUtils) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("verification_link_handler")
+
+		link := verificationLink{
+			Signature: req.URL.Query().Get("sig"),
+			Token:     req.URL.Query().Get("token"),
+			success:   true,
+		}
+
+		email, _, valid := parseLoginLink(svr, link.Token, link.Signature)
+		if !valid {
+			svr.Logger.InfoContext(ctx, "Login link with a bad token or signature")
+			link = verificationLink{ErrorMessage: "This login link isn't valid. Head back to the login page to get a new one."}
+			span.SetAttributes(attribute.String("error_message", "invalid login link"))
+		}
+		link.Email = email
+
+		tmpl, err := template.New("verify_link.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/verify_link.html")
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error loading the login link template", slog.String("errorMessage", err.Error()))
+			res.WriteHeader(500)
+			res.Write([]byte("Error loading gift registry login"))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			return
+		}
+
+		res.Header().Set("Referrer-Policy", "no-referrer")
+		res.WriteHeader(200)
+		if err = tmpl.ExecuteTemplate(res, "verify-link-page", link); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error writing template!", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+	})
+}
+
+// Finishes logging in from the emailed link. The code in the link goes through
+// the same expiration and attempt checks as a typed-in code, but only from the
+// browser that asked for it.
+func VerificationLinkConfirmHandler(svr *util.ServerUtils) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("verification_link_confirm_handler")
+
+		link := verificationLink{
+			Signature: req.PostFormValue("sig"),
+			Token:     req.PostFormValue("token"),
+		}
+
+		email, code, valid := parseLoginLink(svr, link.Token, link.Signature)
+		if !valid {
+			svr.Logger.InfoContext(ctx, "Login link with a bad token or signature")
+			span.SetAttributes(attribute.String("error_message", "invalid login link"))
+			writeResponse(ctx, res, svr, span, linkWithError(email, "This login link isn't valid. Head back to the login page to get a new one."), "/verify_link.html", "verify-link")
+			return
+		}
+		link.Email = email
+
+		recData := verificationRecord{}
+		err := svr.DB.QueryRow(ctx, GetVerificationQuery, email).
+			Scan(&recData.personID, &recData.token, &recData.tokenExpires, &recData.attempts, &recData.browserToken)
+		if err == sql.ErrNoRows {
+			svr.Logger.InfoContext(ctx, "Could not find verification record", slog.String("userEmail", email))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeResponse(ctx, res, svr, span, linkWithError(email, LoginFailed), "/verify_link.html", "verify-link")
+			return
+		} else if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error looking up verification details from the database",
+				slog.String("userEmail", email),
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeResponse(ctx, res, svr, span, linkWithError(email, "Error completing login, please try again shortly"), "/verify_link.html", "verify-link")
+			return
+		}
 
-			cookie := http.Cookie{
-				Name:     middleware.SessionCookie,
-				Value:    sessionID,
-				MaxAge:   int(time.Until(sessionExpires).Seconds()),
-				HttpOnly: true,
-				Secure:   true,
-				SameSite: http.SameSiteStrictMode,
+		/*
+			A different browser (or a scanner) doesn't count as a failed attempt, the
+			link is fine, it's just being opened in the wrong place
+		*/
+		cookie, err := req.Cookie(LoginBrowserCookie)
+		if err != nil || recData.browserToken == "" || !hmac.Equal([]byte(util.HashSecret(svr, cookie.Value)), []byte(recData.browserToken)) {
+			svr.Logger.InfoContext(ctx, "Login link opened in a different browser", slog.String("userEmail", email))
+			span.SetAttributes(attribute.String("error_message", "login link opened in a different browser"))
+			writeResponse(ctx, res, svr, span, linkWithError(email, "This link only works in the browser you asked for it from. Open it there, or enter the code from the email instead."), "/verify_link.html", "verify-link")
+			return
+		}
+
+		codesMatch, attemptsRemaining, beforeExpiration := compareValidation(svr, recData, verificationForm{Code: code, Email: email})
+		span.SetAttributes(
+			attribute.Bool("codes_match", codesMatch),
+			attribute.Bool("attempts_remaining", attemptsRemaining),
+			attribute.Bool("before_expiration", beforeExpiration),
+		)
+		switch {
+
+		case codesMatch && !beforeExpiration:
+			if err = deleteVerification(ctx, svr, recData.personID); err != nil {
+				span.SetAttributes(attribute.String("error_message", err.Error()))
 			}
-			http.SetCookie(res, &cookie)
-			res.Header().Add("HX-Redirect", "/registry")
-			span.SetAttributes(attribute.Bool("submission_success", submission.success))
+			span.SetAttributes(attribute.String("error_message", "verification code expired"))
+			writeResponse(ctx, res, svr, span, linkWithError(email, "This login link has expired. Head back to the login page to get a new one."), "/verify_link.html", "verify-link")
+
+		/* The person asked for another code after this one was sent */
+		case !codesMatch && attemptsRemaining:
+			updateAttemptCount(ctx, svr, email, recData.personID, recData.attempts)
+			span.SetAttributes(attribute.String("error_message", "codes don't match"))
+			writeResponse(ctx, res, svr, span, linkWithError(email, "This login link was replaced by a newer one. Use the link or code from the latest email."), "/verify_link.html", "verify-link")
+
+		case !codesMatch:
+			if err = deleteVerification(ctx, svr, recData.personID); err != nil {
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+			}
+			span.SetAttributes(attribute.String("error_message", "codes don't match and the user has no more attempts"))
+			writeResponse(ctx, res, svr, span, linkWithError(email, LoginFailed), "/verify_link.html", "verify-link")
+
+		default:
+			if err = deleteVerification(ctx, svr, recData.personID); err != nil {
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				writeResponse(ctx, res, svr, span, linkWithError(email, "Error completing login, please try again shortly"), "/verify_link.html", "verify-link")
+				return
+			}
+
+			sessionID, sessionExpires, err := createSession(ctx, svr, req, recData.personID, email, req.FormValue("remember") == "true")
+			if err != nil {
+				svr.Logger.ErrorContext(ctx,
+					"Error writing a session record!",
+					slog.String("userEmail", email),
+					slog.String("errorMessage", err.Error()),
+				)
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				writeResponse(ctx, res, svr, span, linkWithError(email, "Error completing login, please try again shortly"), "/verify_link.html", "verify-link")
+				return
+			}
+
+			/* The browser cookie's done its job */
+			http.SetCookie(res, &http.Cookie{Name: LoginBrowserCookie, Path: "/verify", MaxAge: -1, HttpOnly: true, Secure: true})
+			startSession(res, sessionID, sessionExpires)
+			span.SetAttributes(attribute.Bool("submission_success", true))
 
 		}
 	})
@@ -446,28 +651,48 @@ func createSession(
 	req *http.Request,
 	personID int64,
 	email string,
+	remember bool,
 ) (string, time.Time, error) {
 	svr.Logger.InfoContext(ctx,
 		"Starting a new authenticated session",
 		slog.String("userEmail", email),
 	)
 
-	expires := time.Now().Add(5 * time.Minute).UTC()
-	sessionID := rand.Text()
-	userAgent := req.UserAgent()
-
 	/*
-		I'm not going to return this error, since it's not a requirement to being
-		able to create a new session, but I do want to capture it just in case.
+		People can be logged in on more than one device at a time, their other
+		sessions are left alone (they can revoke them from their profile).
+		Remembered sessions skip the idle timeout and last the whole remembered
+		lifetime.
 	*/
-	if _, err := svr.DB.Execute(ctx, DeleteSessionForPersonStatement, personID); err != nil {
-		svr.Logger.ErrorContext(ctx,
-			"Error cleaning up old sessions",
-			slog.String("errorMessage", err.Error()),
-		)
+	now := time.Now().UTC()
+	lifetimes := middleware.Lifetimes(svr)
+	absolute := now.Add(lifetimes.Absolute)
+	expires := now.Add(lifetimes.Idle)
+	if remember {
+		absolute = now.Add(lifetimes.Remembered)
+		expires = absolute
 	}
+	/* The browser gets the session ID, the database only gets its hash */
+	sessionID := rand.Text()
+	externalID := rand.Text()
+	userAgent := req.UserAgent()
+	device := deviceName(userAgent)
+	ipAddress := middleware.CoarseIP(svr, req)
 
-	res, err := svr.DB.Execute(ctx, InsertSessionStatement, sessionID, personID, expires, userAgent)
+	res, err := svr.DB.Execute(ctx,
+		InsertSessionStatement,
+		util.HashSecret(svr, sessionID),
+		externalID,
+		personID,
+		expires,
+		absolute,
+		remember,
+		userAgent,
+		device,
+		ipAddress,
+		now,
+		now,
+	)
 	if err != nil {
 		svr.Logger.ErrorContext(ctx,
 			"Error inserting session record",
@@ -510,9 +735,37 @@ func createSession(
 		)
 	}
 
+	audit.Record(ctx, svr, personID, audit.Event{
+		Action:   audit.Login,
+		After:    map[string]any{"device": device, "remembered": remember, "userAgent": userAgent},
+		Entity:   audit.Session,
+		EntityID: externalID,
+	})
+
+	sendSignInEmail(ctx, svr, personID, email, externalID, SignInEmail{
+		Device:    device,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+	}, now)
+
 	return sessionID, expires, nil
 }
 
+/* Hands the browser its session cookie and sends it on to the registry */
+func startSession(res http.ResponseWriter, sessionID string, sessionExpires time.Time) {
+	cookie := http.Cookie{
+		Name:     middleware.SessionCookie,
+		Value:    sessionID,
+		Path:     "/",
+		MaxAge:   int(time.Until(sessionExpires).Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(res, &cookie)
+	res.Header().Add("HX-Redirect", "/registry")
+}
+
 func deleteVerification(ctx context.Context, svr *util.ServerUtils, personID int64) error {
 	/* Make sure we have a transaction so we can roll back if this doesn't work */
 	res, err := svr.DB.Execute(ctx, DeleteVerificationTokenStatement, personID)
@@ -560,6 +813,42 @@ func updateAttemptCount(ctx context.Context, svr *util.ServerUtils, email string
 	return nil
 }
 
+/*
+Builds the path for the login link in the verification email. The token is
+the email address and code, signed so the address can't be swapped out.
+*/
+func loginLink(svr *util.ServerUtils, email string, code string) string {
+	token := base64.RawURLEncoding.EncodeToString([]byte(email + ":" + code))
+	return fmt.Sprintf("/verify/link?token=%s&sig=%s",
+		url.QueryEscape(token),
+		url.QueryEscape(util.SignLink(svr, LoginLinkAction, email+":"+code)),
+	)
+}
+
+/* Reads the email address and code back out of a login link */
+func parseLoginLink(svr *util.ServerUtils, token string, signature string) (string, string, bool) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", false
+	}
+
+	/* Codes never have a colon, email addresses might */
+	separator := strings.LastIndex(string(decoded), ":")
+	if separator < 0 || !util.ValidSignature(svr, LoginLinkAction, string(decoded), signature) {
+		return "", "", false
+	}
+
+	return string(decoded[:separator]), string(decoded[separator+1:]), true
+}
+
+func linkWithError(email string, errorMessage string) verificationLink {
+	return verificationLink{
+		Email:        email,
+		ErrorMessage: errorMessage,
+		success:      false,
+	}
+}
+
 func loginWithError(errorMessage string) loginForm {
 	return loginForm{
 		Errors: loginFormErrors{
@@ -573,20 +862,26 @@ func setVerificationCode(
 	ctx context.Context,
 	svr *util.ServerUtils,
 	personID int64,
+	browserToken string,
 	userData *loginForm,
 ) (int64, string, error) {
 	token := rand.Text()
-	expires := time.Now().Add(5 * time.Minute).UTC()
+	expires := time.Now().Add(verificationLifetime).UTC()
 	svr.Logger.DebugContext(ctx, "Created a login token", slog.String("userEmail", userData.Email))
 
+	/* Only the hashes are saved, the code goes out in the email and the browser token in the cookie */
+	tokenHash := util.HashCode(svr, token)
+	browserHash := util.HashSecret(svr, browserToken)
 	rows, err := svr.DB.Execute(
 		ctx,
 		SetVerificationTokenStatement,
-		token,
+		tokenHash,
 		expires,
+		browserHash,
 		personID,
-		token,
+		tokenHash,
 		expires,
+		browserHash,
 	)
 	if err != nil {
 		switch {
@@ -631,19 +926,40 @@ func setVerificationCode(
 	return modified, token, nil
 }
 
-func compareValidation(record verificationRecord, submission verificationForm) (tokensMatch bool, attemptsRemaining bool, beforeExpiration bool) {
-	now := time.Now().UTC()
+func compareValidation(svr *util.ServerUtils, record verificationRecord, submission verificationForm) (tokensMatch bool, attemptsRemaining bool, beforeExpiration bool) {
+	return util.CheckCode(svr, record.token, record.tokenExpires, record.attempts, submission.Code)
+}
 
-	tokensMatch = strings.EqualFold(record.token, submission.Code)
-	beforeExpiration = now.Before(record.tokenExpires)
+/*
+Writes one of the full-page login templates, with the OIDC provider's name
+for the "sign in with" button.
+*/
+func writeLoginPage(ctx context.Context, res http.ResponseWriter, svr *util.ServerUtils, span trace.Span, templateDef string, form loginForm) {
+	templates := svr.Getenv("TEMPLATES_DIR")
+	tmpl, tmplErr := template.New("login_page.html").Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(templates+"/login_page.html", templates+"/login_form.html")
+	if tmplErr != nil {
+		svr.Logger.ErrorContext(ctx, "Error loading the login form template", slog.String("errorMessage", tmplErr.Error()))
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading gift registry login"))
+		span.SetAttributes(attribute.String("error_message", tmplErr.Error()))
+		return
+	}
 
-	/*
-		Adding 1 to the attempts count stored in the database
-		to account for the attempt we're making right now
-	*/
-	attemptsRemaining = MaxAttempts-(record.attempts+1) > 0
+	page := loginPage{Form: form}
+	if config := oidc.Settings(svr); config.Enabled() {
+		page.Provider = config.Name
+	}
 
-	return
+	res.WriteHeader(200)
+	err := tmpl.ExecuteTemplate(res, templateDef, page)
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error writing template!",
+			slog.String("errorMessage", err.Error()))
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading gift registry login form"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
 }
 
 func writeResponse(ctx context.Context,
@@ -661,7 +977,7 @@ func writeResponse(ctx context.Context,
 
 	tmplPath := fmt.Sprintf("%s/%s", svr.Getenv("TEMPLATES_DIR"), templateFile)
 
-	tmpl, tmplErr := template.ParseFiles(tmplPath)
+	tmpl, tmplErr := template.New(path.Base(tmplPath)).Funcs(middleware.TemplateFuncs(ctx)).ParseFiles(tmplPath)
 	if tmplErr != nil {
 		svr.Logger.ErrorContext(
 			ctx,
@@ -736,3 +1052,19 @@ func (vf verificationForm) succeeded() bool {
 func (vf verificationForm) Error() string {
 	return fmt.Sprintf("formErrors=%s, codeErrors=%s", vf.Errors.ErrorMessage, vf.Errors.Code)
 }
+
+func (vl verificationLink) emailAddress() string {
+	return vl.Email
+}
+
+func (vl verificationLink) String() string {
+	return fmt.Sprintf("email=%s, validated=%v, error=%s", vl.Email, vl.success, vl.ErrorMessage)
+}
+
+func (vl verificationLink) succeeded() bool {
+	return vl.success
+}
+
+func (vl verificationLink) Error() string {
+	return fmt.Sprintf("formErrors=%s", vl.ErrorMessage)
+}
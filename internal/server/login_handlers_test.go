@@ -2,6 +2,7 @@ package server_test
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"log/slog"
@@ -111,6 +112,7 @@ func TestLoginEmailValidationForm(t *testing.T) {
 			req.Header.Set("Sec-Fetch-Dest", "document")
 			req.Header.Set("Sec-Fetch-Mode", "same-origin")
 			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			test.AddCSRFToken(req)
 			res, err := http.DefaultClient.Do(req)
 			defer func() {
 				if res != nil && res.Body != nil {
@@ -388,6 +390,7 @@ func TestVerification(t *testing.T) {
 			req.Header.Set("Sec-Fetch-Dest", "document")
 			req.Header.Set("Sec-Fetch-Mode", "same-origin")
 			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			test.AddCSRFToken(req)
 			res, err := http.DefaultClient.Do(req)
 			defer func() {
 				if res.Body != nil {
@@ -424,6 +427,280 @@ func TestVerification(t *testing.T) {
 	}
 }
 
+// TestVerificationLink logs in through the emailed link, checking the link
+// only works once, only with its signature intact, and only in the browser
+// that asked for the code.
+func TestVerificationLink(t *testing.T) {
+	testData := []struct {
+		expectedSession bool
+		replay          bool
+		sameBrowser     bool
+		tamper          bool
+		testName        string
+		userData        test.UserData
+	}{
+		{
+			expectedSession: true,
+			sameBrowser:     true,
+			testName:        "Same browser",
+			userData: test.UserData{
+				Email:     "linkSameBrowser@localhost.com",
+				FirstName: "Same",
+				LastName:  "Browser",
+			},
+		},
+		{
+			expectedSession: false,
+			sameBrowser:     false,
+			testName:        "Different browser",
+			userData: test.UserData{
+				Email:     "linkOtherBrowser@localhost.com",
+				FirstName: "Other",
+				LastName:  "Browser",
+			},
+		},
+		{
+			expectedSession: false,
+			sameBrowser:     true,
+			tamper:          true,
+			testName:        "Tampered signature",
+			userData: test.UserData{
+				Email:     "linkTampered@localhost.com",
+				FirstName: "Tampered",
+				LastName:  "Link",
+			},
+		},
+		{
+			expectedSession: false,
+			replay:          true,
+			sameBrowser:     true,
+			testName:        "Replayed link",
+			userData: test.UserData{
+				Email:     "linkReplayed@localhost.com",
+				FirstName: "Replayed",
+				LastName:  "Link",
+			},
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := test.CreateUser(ctx, logger, db, data.userData); err != nil {
+				t.Fatal("Error creating the test user", err)
+			}
+
+			/* Ask for a code, keeping the cookie the login form hands back */
+			res := submitForm(t, "/login", url.Values{"email": {data.userData.Email}}, nil, userAgent)
+			_ = res.Body.Close()
+			var browserCookie *http.Cookie
+			for _, cookie := range res.Cookies() {
+				if cookie.Name == server.LoginBrowserCookie {
+					browserCookie = cookie
+				}
+			}
+			if browserCookie == nil {
+				t.Fatal("The login response didn't set the browser cookie")
+			}
+
+			link, err := url.Parse(emailer.(*test.EmailMock).LoginLinkSent(data.userData.Email))
+			if err != nil || link.Query().Get("token") == "" {
+				t.Fatal("The verification email is missing the login link", link, err)
+			}
+			if link.Scheme != "https" || link.Host != "gift-registry.localhost" {
+				t.Fatal("Expected the login link to use the configured address but got", link)
+			}
+
+			/* Opening the link (like a scanner would) shouldn't log anyone in */
+			req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+link.RequestURI(), nil)
+			if err != nil {
+				t.Fatal("Error building the link request", err)
+			}
+			req.Header.Set("Sec-Fetch-Dest", "document")
+			req.Header.Set("Sec-Fetch-Mode", "navigate")
+			req.Header.Set("Sec-Fetch-Site", "none")
+			res, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal("Error opening the login link", err)
+			}
+			doc, err := html.Parse(res.Body)
+			_ = res.Body.Close()
+			if err != nil {
+				t.Fatal("Error parsing the confirmation page", err)
+			} else if _, found := test.CheckElement(*doc, "verify-link-submit"); !found {
+				t.Fatal("The confirmation page is missing its log in button")
+			}
+
+			form := url.Values{
+				"sig":   {link.Query().Get("sig")},
+				"token": {link.Query().Get("token")},
+			}
+			if data.tamper {
+				form.Set("sig", "tampered"+form.Get("sig"))
+			}
+			cookies := []*http.Cookie{}
+			if data.sameBrowser {
+				cookies = append(cookies, browserCookie)
+			}
+
+			if data.replay {
+				res = submitForm(t, "/verify/link", form, cookies, userAgent)
+				_ = res.Body.Close()
+			}
+			res = submitForm(t, "/verify/link", form, cookies, userAgent)
+			defer res.Body.Close()
+
+			sessionStarted := false
+			for _, cookie := range res.Cookies() {
+				if cookie.Name == middleware.SessionCookie && cookie.Value != "" {
+					sessionStarted = true
+				}
+			}
+			if sessionStarted != data.expectedSession {
+				t.Fatal("Expected a session to be started", data.expectedSession, "but got", sessionStarted)
+			} else if sessionStarted && res.Header.Get("HX-Redirect") != "/registry" {
+				t.Fatal("Expected to be sent to the registry but got", res.Header.Get("HX-Redirect"))
+			}
+		})
+	}
+}
+
+// TestRememberDevice logs in with and without "remember this device" checked
+// and checks only the remembered login gets a long-lived session.
+func TestRememberDevice(t *testing.T) {
+	testData := []struct {
+		email    string
+		remember bool
+		testName string
+	}{
+		{
+			email:    "rememberDevice@localhost.com",
+			remember: true,
+			testName: "Remember this device",
+		},
+		{
+			email:    "forgetDevice@localhost.com",
+			remember: false,
+			testName: "Don't remember this device",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:     data.email,
+				FirstName: "Remember",
+				LastName:  "Device",
+			}); err != nil {
+				t.Fatal("Could not create the test user", err)
+			}
+			if err := createVerification(data.email, "remember-code"); err != nil {
+				t.Fatal(err)
+			}
+
+			form := url.Values{"code": {"remember-code"}, "email": {data.email}}
+			if data.remember {
+				form.Set("remember", "true")
+			}
+			res := submitForm(t, "/verify", form, nil, userAgent)
+			_ = res.Body.Close()
+
+			var cookie *http.Cookie
+			for _, c := range res.Cookies() {
+				if c.Name == middleware.SessionCookie {
+					cookie = c
+				}
+			}
+			if cookie == nil {
+				t.Fatal("Expected a session cookie but didn't get one")
+			}
+
+			var remembered bool
+			var expiration time.Time
+			err := db.QueryRow(ctx, "SELECT remembered, expiration FROM session WHERE session_id = ?", test.HashSecret(cookie.Value)).Scan(&remembered, &expiration)
+			if err != nil {
+				t.Fatal("Could not find the new session", err)
+			}
+
+			longLived := time.Until(expiration) > 24*time.Hour && cookie.MaxAge > 24*60*60
+			if remembered != data.remember || longLived != data.remember {
+				t.Fatal("Expected the session to be remembered", data.remember, "but it was", remembered, "and expires", expiration)
+			}
+		})
+	}
+}
+
+// TestSecretsHashedAtRest logs in and checks the database only ever holds
+// hashes of the code, browser cookie and session ID handed out.
+func TestSecretsHashedAtRest(t *testing.T) {
+	email := "hashedSecrets@localhost.com"
+	if _, err := test.CreateUser(ctx, logger, db, test.UserData{
+		Email:     email,
+		FirstName: "Hashed",
+		LastName:  "Secrets",
+	}); err != nil {
+		t.Fatal("Error creating the test user", err)
+	}
+
+	res := submitForm(t, "/login", url.Values{"email": {email}}, nil, userAgent)
+	_ = res.Body.Close()
+	var browserCookie *http.Cookie
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == server.LoginBrowserCookie {
+			browserCookie = cookie
+		}
+	}
+	if browserCookie == nil {
+		t.Fatal("The login response didn't set the browser cookie")
+	}
+
+	link, err := url.Parse(emailer.(*test.EmailMock).LoginLinkSent(email))
+	if err != nil {
+		t.Fatal("The verification email is missing the login link", err)
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(link.Query().Get("token"))
+	if err != nil {
+		t.Fatal("Could not read the login link", err)
+	}
+	code := string(decoded[strings.LastIndex(string(decoded), ":")+1:])
+
+	var storedCode, storedBrowser string
+	err = db.QueryRow(ctx, "SELECT v.token, v.browser_token FROM verification v INNER JOIN person p ON p.person_id = v.person_id WHERE p.email = ?", email).
+		Scan(&storedCode, &storedBrowser)
+	if err != nil {
+		t.Fatal("Could not find the verification record", err)
+	} else if storedCode != test.HashSecret(code) || storedBrowser != test.HashSecret(browserCookie.Value) {
+		t.Fatal("Expected the code and browser token to be stored hashed")
+	}
+
+	/* Codes are case-insensitive, the hash shouldn't change that */
+	res = submitForm(t, "/verify", url.Values{"code": {strings.ToLower(code)}, "email": {email}}, nil, userAgent)
+	_ = res.Body.Close()
+	var sessionID string
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == middleware.SessionCookie {
+			sessionID = cookie.Value
+		}
+	}
+	if sessionID == "" {
+		t.Fatal("Expected a session cookie but didn't get one")
+	}
+
+	var plain, hashed int
+	if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM session WHERE session_id = ?", sessionID).Scan(&plain); err != nil {
+		t.Fatal("Error counting the sessions", err)
+	}
+	if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM session WHERE session_id = ?", test.HashSecret(sessionID)).Scan(&hashed); err != nil {
+		t.Fatal("Error counting the sessions", err)
+	}
+	if plain != 0 || hashed != 1 {
+		t.Fatal("Expected only the hashed session ID to be stored but found", plain, "plain and", hashed, "hashed")
+	}
+}
+
 func TestLogout(t *testing.T) {
 	testData := []struct {
 		createSession    bool
@@ -532,7 +809,7 @@ func TestLogout(t *testing.T) {
 
 			var foundSessionID string
 			var foundPersonID int64
-			err = db.QueryRow(ctx, "SELECT session_id, person_id FROM session WHERE session_id = ?", token).
+			err = db.QueryRow(ctx, "SELECT session_id, person_id FROM session WHERE session_id = ?", test.HashSecret(token)).
 				Scan(&foundSessionID, foundPersonID)
 			if err == nil || err != sql.ErrNoRows {
 				t.Fatal("Error confirming logout")
@@ -570,7 +847,7 @@ func createToken(
 		fails, so I'm not going to worry about Rollback() calls erroring, the
 		database is going to be deleted anyhow
 	*/
-	if res, err := dbConn.Execute(ctx, "INSERT INTO verification (person_id, token, token_expiration, attempts) VALUES (?, ?, ?, ?)", personID, token, expires, attempts); err != nil {
+	if res, err := dbConn.Execute(ctx, "INSERT INTO verification (person_id, token, token_expiration, attempts) VALUES (?, ?, ?, ?)", personID, test.HashSecret(strings.ToUpper(token)), expires, attempts); err != nil {
 		log.Println("Error adding a new test verification record to the database.")
 		return fmt.Errorf("error executing insert operation: %v", err)
 	} else if added, err := res.RowsAffected(); err != nil {
@@ -585,3 +862,28 @@ func createToken(
 
 	return nil
 }
+
+/* Posts the form the way htmx does from the login pages */
+func submitForm(t *testing.T, path string, form url.Values, cookies []*http.Cookie, agent string) *http.Response {
+	req, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal("Error building the request", err)
+	}
+
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set("User-Agent", agent)
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "same-origin")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	test.AddCSRFToken(req)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error posting to", path, err)
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"gift-registry/internal/database"
+	"gift-registry/internal/notification"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	/*
+		Checked every minute by default so "immediate" notifications don't sit
+		around for long
+	*/
+	defaultNotificationInterval = 60000
+)
+
+// StartNotifications launches the scheduler that emails household members
+// about changes to each other's lists, batched according to each person's
+// notification preference. It runs until the given context is cancelled.
+func StartNotifications(
+	ctx context.Context,
+	getenv func(string) string,
+	db database.Database,
+	logger *slog.Logger,
+	emailProvider Emailer,
+) *Scheduler {
+
+	return startScheduler(
+		ctx,
+		getenv,
+		db,
+		logger,
+		emailProvider,
+		"notifications",
+		"NOTIFICATION_INTERVAL",
+		defaultNotificationInterval,
+		(*Scheduler).sendDigests,
+	)
+
+}
+
+/*
+Sends everyone who's due their batch of pending change notifications. The
+notifications are flagged as sent before the email goes out so a restart
+can't send them twice, and un-flagged if the email fails.
+*/
+func (sch *Scheduler) sendDigests(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "sendDigests")
+	defer span.End()
+
+	now := time.Now().UTC()
+	digests, err := notification.DueDigests(ctx, sch.svr, now)
+	if err != nil {
+		sch.svr.Logger.ErrorContext(ctx, "Error looking up pending notifications", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+	span.SetAttributes(attribute.Int("digests_due", len(digests)))
+
+	for _, digest := range digests {
+
+		if err := notification.MarkSent(ctx, sch.svr, digest, now); err != nil {
+			sch.svr.Logger.ErrorContext(ctx,
+				"Error marking notifications as sent, skipping",
+				slog.Int64("personID", digest.PersonID),
+				slog.String("errorMessage", err.Error()),
+			)
+			continue
+		}
+
+		if err := sch.emailer.SendDigestEmail(ctx, []string{digest.Email}, digest, sch.svr.Getenv); err != nil {
+			sch.svr.Logger.ErrorContext(ctx,
+				"Error sending the notification digest, will retry",
+				slog.Int64("personID", digest.PersonID),
+				slog.String("errorMessage", err.Error()),
+			)
+			if err := notification.MarkSent(ctx, sch.svr, digest, time.Time{}); err != nil {
+				sch.svr.Logger.ErrorContext(ctx,
+					"Error resetting the failed notifications",
+					slog.Int64("personID", digest.PersonID),
+					slog.String("errorMessage", err.Error()),
+				)
+			}
+			continue
+		}
+
+		sch.svr.Logger.InfoContext(ctx,
+			"Sent notification digest",
+			slog.Int64("personID", digest.PersonID),
+			slog.Int("changes", len(digest.Changes)),
+		)
+
+	}
+}
@@ -0,0 +1,127 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gift-registry/internal/server"
+	"gift-registry/internal/test"
+)
+
+// TestNotifications runs the digest scheduler on a short interval and confirms
+// pending changes go out once to the people who are due for them, and people
+// who heard recently wait for their next digest.
+func TestNotifications(t *testing.T) {
+	testData := []struct {
+		expectedChanges int
+		expectedSent    int
+		externalIDStart string
+		frequency       string
+		lastNotified    any
+		testName        string
+	}{
+		{
+			expectedChanges: 2,
+			expectedSent:    1,
+			externalIDStart: "notify-immediate",
+			frequency:       "IMMEDIATE",
+			testName:        "Immediate notification",
+		},
+		{
+			expectedChanges: 2,
+			expectedSent:    1,
+			externalIDStart: "notify-weekly-due",
+			frequency:       "WEEKLY",
+			lastNotified:    time.Now().UTC().AddDate(0, 0, -8),
+			testName:        "Weekly digest due",
+		},
+		{
+			expectedSent:    0,
+			externalIDStart: "notify-daily-waiting",
+			frequency:       "DAILY",
+			lastNotified:    time.Now().UTC().Add(-time.Hour),
+			testName:        "Daily digest not due yet",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			ownerID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:      data.externalIDStart + "-owner@localhost.com",
+				ExternalID: data.externalIDStart + "-owner",
+				FirstName:  "List",
+				LastName:   "Owner",
+			})
+			if err != nil {
+				t.Fatal("Could not create the list owner", err)
+			}
+
+			memberEmail := data.externalIDStart + "-member@localhost.com"
+			memberID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:      memberEmail,
+				ExternalID: data.externalIDStart + "-member",
+				FirstName:  "Household",
+				LastName:   "Member",
+			})
+			if err != nil {
+				t.Fatal("Could not create the household member", err)
+			}
+
+			_, err = db.Execute(ctx, "UPDATE person SET notification_frequency = ?, last_notified = ? WHERE person_id = ?",
+				data.frequency, data.lastNotified, memberID)
+			if err != nil {
+				t.Fatal("Could not set the notification preference", err)
+			}
+
+			for _, change := range []string{"added", "removed"} {
+
+				changeID := data.externalIDStart + "-" + change
+				_, errs := db.ExecuteBatch(ctx,
+					[]string{
+						`INSERT INTO item_change (external_id, owner_id, actor_id, item_external_id, item_name, change_type, details) 
+							VALUES (?, ?, ?, ?, ?, 'ADDED', '')`,
+						`INSERT INTO notification (person_id, change_id) 
+							SELECT ?, change_id FROM item_change WHERE external_id = ?`,
+					},
+					[][]any{
+						{changeID, ownerID, ownerID, changeID + "-item", "Gift " + change},
+						{memberID, changeID},
+					},
+				)
+				for _, err := range errs {
+					if err != nil {
+						t.Fatal("Could not queue the change", err)
+					}
+				}
+
+			}
+
+			mock := &test.EmailMock{}
+			env := map[string]string{"NOTIFICATION_INTERVAL": "20"}
+			schedulerCtx, cancel := context.WithCancel(ctx)
+			notifications := server.StartNotifications(schedulerCtx, func(name string) string { return env[name] }, db, logger, mock)
+
+			/* Let the scheduler tick several times to prove it doesn't double-send */
+			time.Sleep(500 * time.Millisecond)
+			cancel()
+
+			select {
+			case <-notifications.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Notification scheduler didn't shut down")
+			}
+
+			sent := mock.DigestsSent(memberEmail)
+			if len(sent) != data.expectedSent {
+				t.Fatal("Expected", data.expectedSent, "digests but got", len(sent))
+			}
+
+			if data.expectedSent > 0 && len(sent[0].Changes) != data.expectedChanges {
+				t.Fatal("Expected", data.expectedChanges, "changes in the digest, got", sent[0].Changes)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gift-registry/internal/oidc"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	/*
+		Ties the provider's callback to the browser that started the login. Lax so
+		it comes back on the provider's redirect, which is a cross-site navigation.
+	*/
+	OIDCStateCookie = "gift-registry-oidc"
+	OIDCLoginFailed = "Could not sign in with %s. Please try again or log in with your email address"
+	OIDCNoAccount   = "There's no one in the registry with the email address from %s. Log in with your email address instead"
+	OIDCUnverified  = "%s hasn't verified that email address. Please log in with your email address instead"
+	oidcStatePath   = "/login/oidc"
+	oidcStateTTL    = 5 * time.Minute
+)
+
+// Sends the browser off to the OIDC provider to sign in. There's no page here
+// when a provider isn't configured.
+func OIDCLoginHandler(svr *util.ServerUtils) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("oidc_login_handler")
+
+		config := oidc.Settings(svr)
+		if !config.Enabled() {
+			http.NotFound(res, req)
+			return
+		}
+
+		authURL, state, err := oidc.Start(ctx, svr)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error starting the OIDC login", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeLoginPage(ctx, res, svr, span, "login-page", loginWithError(fmt.Sprintf(OIDCLoginFailed, config.Name)))
+			return
+		}
+
+		http.SetCookie(res, &http.Cookie{
+			Name:     OIDCStateCookie,
+			Value:    state,
+			Path:     oidcStatePath,
+			MaxAge:   int(oidcStateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(res, req, authURL, http.StatusSeeOther)
+	})
+}
+
+// Finishes signing in when the OIDC provider sends the browser back. The
+// provider's verified email address has to match someone in the registry, and
+// then the session starts the same way as a verified code.
+func OIDCCallbackHandler(svr *util.ServerUtils) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("oidc_callback_handler")
+
+		config := oidc.Settings(svr)
+		if !config.Enabled() {
+			http.NotFound(res, req)
+			return
+		}
+
+		/* The state is single use, so the cookie's done with either way */
+		http.SetCookie(res, &http.Cookie{
+			Name:     OIDCStateCookie,
+			Path:     oidcStatePath,
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		query := req.URL.Query()
+		failed := loginWithError(fmt.Sprintf(OIDCLoginFailed, config.Name))
+		if providerErr := query.Get("error"); providerErr != "" {
+			svr.Logger.InfoContext(ctx, "OIDC provider didn't sign the person in", slog.String("providerError", providerErr))
+			span.SetAttributes(attribute.String("error_message", providerErr))
+			writeLoginPage(ctx, res, svr, span, "login-page", failed)
+			return
+		}
+
+		state := query.Get("state")
+		cookie, err := req.Cookie(OIDCStateCookie)
+		if err != nil || state == "" || !hmac.Equal([]byte(cookie.Value), []byte(state)) {
+			svr.Logger.WarnContext(ctx, "OIDC callback state doesn't match this browser")
+			span.SetAttributes(attribute.String("error_message", "state mismatch"))
+			writeLoginPage(ctx, res, svr, span, "login-page", failed)
+			return
+		}
+
+		identity, err := oidc.Finish(ctx, svr, state, query.Get("code"))
+		if err != nil {
+			svr.Logger.WarnContext(ctx, "Error finishing the OIDC login", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeLoginPage(ctx, res, svr, span, "login-page", failed)
+			return
+		}
+
+		/* An unverified address could belong to anyone, so it can't pick the account */
+		if !identity.EmailVerified || identity.Email == "" {
+			svr.Logger.InfoContext(ctx, "OIDC login with an unverified email address", slog.String("subject", identity.Subject))
+			span.SetAttributes(attribute.String("error_message", "email not verified"))
+			writeLoginPage(ctx, res, svr, span, "login-page", loginWithError(fmt.Sprintf(OIDCUnverified, config.Name)))
+			return
+		}
+
+		var personID int64
+		email := ""
+		if err = svr.DB.QueryRow(ctx, SelectUserByEmailQuery, identity.Email).Scan(&personID, &email); err == sql.ErrNoRows {
+			svr.Logger.InfoContext(ctx, "OIDC login for someone who isn't in the registry", slog.String("userEmail", identity.Email))
+			span.SetAttributes(attribute.String("error_message", "unknown email"))
+			writeLoginPage(ctx, res, svr, span, "login-page", loginWithError(fmt.Sprintf(OIDCNoAccount, config.Name)))
+			return
+		} else if err != nil {
+			svr.Logger.ErrorContext(ctx, "Could not read person from the database", slog.String("errorMessage", err.Error()), slog.String("userEmail", identity.Email))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeLoginPage(ctx, res, svr, span, "login-page", failed)
+			return
+		}
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		sessionID, sessionExpires, err := createSession(ctx, svr, req, personID, email, false)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx,
+				"Error writing a session record!",
+				slog.String("userEmail", email),
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeLoginPage(ctx, res, svr, span, "login-page", loginWithError(LoginFailed))
+			return
+		}
+
+		/*
+			The session cookie is SameSite=Strict, and browsers hold it back on a
+			redirect chain that started on the provider's site. Landing on a page of
+			our own first means the trip to the registry carries it.
+		*/
+		startSession(res, sessionID, sessionExpires)
+		writeLoginPage(ctx, res, svr, span, "login-redirect", loginForm{success: true})
+	})
+}
@@ -0,0 +1,335 @@
+package server_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/server"
+	"gift-registry/internal/test"
+)
+
+type oidcLogin struct {
+	challenge string
+	cookies   []*http.Cookie
+	nonce     string
+	state     string
+}
+
+func TestOIDCLogin(t *testing.T) {
+	testData := []struct {
+		badChallenge    bool
+		badState        bool
+		claims          map[string]any
+		createUser      bool
+		expectedSession bool
+		providerError   string
+		testName        string
+		userData        test.UserData
+		wrongKey        bool
+	}{
+		{
+			createUser:      true,
+			expectedSession: true,
+			testName:        "Verified email",
+			userData: test.UserData{
+				Email:      "oidcsuccess@localhost.com",
+				ExternalID: "oidc-success-test",
+				FirstName:  "Oidc",
+				LastName:   "Success",
+			},
+		},
+		{
+			claims:          map[string]any{"email_verified": "true"},
+			createUser:      true,
+			expectedSession: true,
+			testName:        "Email verified as a string",
+			userData: test.UserData{
+				Email:      "oidcstringverified@localhost.com",
+				ExternalID: "oidc-string-verified-test",
+				FirstName:  "Oidc",
+				LastName:   "Stringverified",
+			},
+		},
+		{
+			testName: "Nobody with that email",
+			userData: test.UserData{Email: "oidcunknown@localhost.com"},
+		},
+		{
+			claims:     map[string]any{"email_verified": false},
+			createUser: true,
+			testName:   "Unverified email",
+			userData: test.UserData{
+				Email:      "oidcunverified@localhost.com",
+				ExternalID: "oidc-unverified-test",
+				FirstName:  "Oidc",
+				LastName:   "Unverified",
+			},
+		},
+		{
+			claims:     map[string]any{"nonce": "some-other-login"},
+			createUser: true,
+			testName:   "Wrong nonce",
+			userData: test.UserData{
+				Email:      "oidcnonce@localhost.com",
+				ExternalID: "oidc-nonce-test",
+				FirstName:  "Oidc",
+				LastName:   "Nonce",
+			},
+		},
+		{
+			claims:     map[string]any{"aud": "some-other-app"},
+			createUser: true,
+			testName:   "Wrong audience",
+			userData: test.UserData{
+				Email:      "oidcaudience@localhost.com",
+				ExternalID: "oidc-audience-test",
+				FirstName:  "Oidc",
+				LastName:   "Audience",
+			},
+		},
+		{
+			claims:     map[string]any{"iss": "https://someone-else.example.com"},
+			createUser: true,
+			testName:   "Wrong issuer",
+			userData: test.UserData{
+				Email:      "oidcissuer@localhost.com",
+				ExternalID: "oidc-issuer-test",
+				FirstName:  "Oidc",
+				LastName:   "Issuer",
+			},
+		},
+		{
+			claims:     map[string]any{"exp": time.Now().Add(-time.Hour).Unix()},
+			createUser: true,
+			testName:   "Expired ID token",
+			userData: test.UserData{
+				Email:      "oidcexpired@localhost.com",
+				ExternalID: "oidc-expired-test",
+				FirstName:  "Oidc",
+				LastName:   "Expired",
+			},
+		},
+		{
+			createUser: true,
+			testName:   "Signed with the wrong key",
+			userData: test.UserData{
+				Email:      "oidcwrongkey@localhost.com",
+				ExternalID: "oidc-wrong-key-test",
+				FirstName:  "Oidc",
+				LastName:   "Wrongkey",
+			},
+			wrongKey: true,
+		},
+		{
+			badChallenge: true,
+			createUser:   true,
+			testName:     "PKCE verifier doesn't match",
+			userData: test.UserData{
+				Email:      "oidcpkce@localhost.com",
+				ExternalID: "oidc-pkce-test",
+				FirstName:  "Oidc",
+				LastName:   "Pkce",
+			},
+		},
+		{
+			badState:   true,
+			createUser: true,
+			testName:   "State from another browser",
+			userData: test.UserData{
+				Email:      "oidcstate@localhost.com",
+				ExternalID: "oidc-state-test",
+				FirstName:  "Oidc",
+				LastName:   "State",
+			},
+		},
+		{
+			createUser:    true,
+			providerError: "access_denied",
+			testName:      "Provider turned the login down",
+			userData: test.UserData{
+				Email:      "oidcdenied@localhost.com",
+				ExternalID: "oidc-denied-test",
+				FirstName:  "Oidc",
+				LastName:   "Denied",
+			},
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			if data.createUser {
+				if _, err := test.CreateUser(ctx, logger, db, data.userData); err != nil {
+					t.Fatal("Error creating the test user", err)
+				}
+			}
+
+			login := startOIDCLogin(t)
+			claims := map[string]any{
+				"email":          data.userData.Email,
+				"email_verified": true,
+				"nonce":          login.nonce,
+			}
+			for name, value := range data.claims {
+				claims[name] = value
+			}
+			grant := test.OIDCGrant{Challenge: login.challenge, Claims: claims, WrongKey: data.wrongKey}
+			if data.badChallenge {
+				grant.Challenge = "not-the-challenge"
+			}
+			provider.Grant(data.userData.ExternalID+"-code", grant)
+
+			query := url.Values{"code": {data.userData.ExternalID + "-code"}, "state": {login.state}}
+			if data.badState {
+				query.Set("state", "someone-elses-state")
+			}
+			if data.providerError != "" {
+				query = url.Values{"error": {data.providerError}, "state": {login.state}}
+			}
+
+			res := oidcCallback(t, query, login.cookies)
+			defer res.Body.Close()
+			if res.StatusCode != 200 {
+				t.Fatal("Expected a 200 from the callback but got", res.StatusCode)
+			}
+
+			sessionSet := false
+			for _, cookie := range res.Cookies() {
+				if cookie.Name == middleware.SessionCookie && cookie.Value != "" {
+					sessionSet = true
+					/* Otherwise the browser only sends it back under /login/oidc */
+					if cookie.Path != "/" {
+						t.Fatal("Expected the session cookie for the whole site but it's scoped to", cookie.Path)
+					}
+				}
+			}
+			if sessionSet != data.expectedSession {
+				t.Fatal("Expected a session cookie to be set =", data.expectedSession, "but it was", sessionSet)
+			}
+
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing the callback response", err)
+			}
+
+			if data.expectedSession {
+				if _, found := test.CheckElement(*doc, "login-redirect"); !found {
+					t.Fatal("Expected the page sending the browser on to the registry")
+				}
+			} else if errorElem, found := test.CheckElement(*doc, "login-error"); !found || !test.ElementVisible(errorElem) {
+				t.Fatal("Expected the login page with an error showing")
+			}
+		})
+	}
+}
+
+func TestOIDCStateUsedOnce(t *testing.T) {
+	t.Parallel()
+
+	userData := test.UserData{
+		Email:      "oidcreplay@localhost.com",
+		ExternalID: "oidc-replay-test",
+		FirstName:  "Oidc",
+		LastName:   "Replay",
+	}
+	if _, err := test.CreateUser(ctx, logger, db, userData); err != nil {
+		t.Fatal("Error creating the test user", err)
+	}
+
+	login := startOIDCLogin(t)
+	for attempt, code := range []string{"oidc-replay-first", "oidc-replay-second"} {
+		provider.Grant(code, test.OIDCGrant{
+			Challenge: login.challenge,
+			Claims:    map[string]any{"email": userData.Email, "email_verified": true, "nonce": login.nonce},
+		})
+
+		res := oidcCallback(t, url.Values{"code": {code}, "state": {login.state}}, login.cookies)
+		res.Body.Close()
+
+		sessionSet := false
+		for _, cookie := range res.Cookies() {
+			if cookie.Name == middleware.SessionCookie && cookie.Value != "" {
+				sessionSet = true
+			}
+		}
+		if sessionSet != (attempt == 0) {
+			t.Fatal("Expected only the first callback to sign in, but attempt", attempt+1, "set a session =", sessionSet)
+		}
+	}
+}
+
+/* Calls the app's callback the way the browser does coming back from the provider */
+func oidcCallback(t *testing.T, query url.Values, cookies []*http.Cookie) *http.Response {
+	req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+"/login/oidc/callback?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal("Error building the callback request", err)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error calling the OIDC callback", err)
+	}
+	return res
+}
+
+/* Starts a login and pulls what the provider would see out of the redirect */
+func startOIDCLogin(t *testing.T) oidcLogin {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", testServer.URL+"/login/oidc", nil)
+	if err != nil {
+		t.Fatal("Error building the OIDC login request", err)
+	}
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal("Error starting the OIDC login", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatal("Expected a redirect to the provider but got", res.StatusCode)
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal("Error reading the provider redirect", err)
+	}
+	query := location.Query()
+	if query.Get("client_id") != provider.ClientID || query.Get("code_challenge_method") != "S256" {
+		t.Fatal("Provider redirect is missing the client or PKCE details", location.String())
+	}
+	if query.Get("redirect_uri") != "https://gift-registry.localhost/login/oidc/callback" {
+		t.Fatal("Expected the callback as the redirect URI but got", query.Get("redirect_uri"))
+	}
+
+	login := oidcLogin{
+		challenge: query.Get("code_challenge"),
+		nonce:     query.Get("nonce"),
+		state:     query.Get("state"),
+	}
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == server.OIDCStateCookie {
+			login.cookies = append(login.cookies, cookie)
+		}
+	}
+	if len(login.cookies) == 0 {
+		t.Fatal("Expected the state cookie to be set")
+	}
+	return login
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type eventReminder struct {
+	Date         string
+	ExternalID   string
+	Name         string
+	ReminderDays int
+}
+
+type eventReminderList struct {
+	ErrorMessage string
+	Events       []eventReminder
+	MaxDays      int
+}
+
+const (
+	/* Far enough out to shop for anything, close enough to still be relevant */
+	maxReminderDays     = 60
+	reminderDaysQuery   = `SELECT reminder_days FROM event WHERE external_id = ?`
+	reminderEventsQuery = `SELECT e.external_id, e.name, e.event_date, e.reminder_days
+		FROM event e
+			INNER JOIN event_person ep ON ep.event_id = e.event_id
+		WHERE ep.person_id = ?
+			AND ep.role = 'GIVER'
+			AND e.event_date > ?
+		ORDER BY e.event_date, e.name`
+	/*
+		Only a giver can change the lead time, and only before the event. It's
+		the same for every giver, since the event only has the one setting.
+	*/
+	updateReminderDaysStatement = `UPDATE event
+		SET reminder_days = ?
+		WHERE external_id = ?
+			AND event_date > ?
+			AND EXISTS (SELECT 1 FROM event_person ep WHERE ep.event_id = event.event_id AND ep.person_id = ? AND ep.role = 'GIVER')`
+)
+
+// Lists the upcoming events the logged-in person is giving gifts for, with
+// how many days ahead they get the reminder email for each.
+func EventRemindersHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("event_reminders_handler")
+
+		personID := middleware.PersonID(res, req)
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		writeEventReminders(ctx, svr, res, personID, "")
+
+	})
+
+}
+
+// Sets how many days before an event its givers get the reminder email.
+func EventReminderUpdateHandler(svr *util.ServerUtils) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("event_reminder_update")
+
+		personID := middleware.PersonID(res, req)
+		externalID := req.PathValue("externalID")
+		span.SetAttributes(
+			attribute.Int64("person_id", personID),
+			attribute.String("event_external_id", externalID),
+		)
+
+		days, err := strconv.Atoi(strings.TrimSpace(req.FormValue("reminderDays")))
+		if err != nil || days < 1 || days > maxReminderDays {
+			span.SetAttributes(attribute.String("error_message", "invalid reminder days"))
+			writeEventReminders(ctx, svr, res, personID, "Reminders can be sent 1 to "+strconv.Itoa(maxReminderDays)+" days ahead.")
+			return
+		}
+
+		var before int
+		if err = svr.DB.QueryRow(ctx, reminderDaysQuery, externalID).Scan(&before); err != nil {
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeEventReminders(ctx, svr, res, personID, "Could not find that event.")
+			return
+		}
+
+		result, err := svr.DB.Execute(ctx, updateReminderDaysStatement, days, externalID, time.Now().UTC(), personID)
+		if err != nil {
+			svr.Logger.ErrorContext(
+				ctx,
+				"Error updating the event reminder",
+				slog.String("errorMessage", err.Error()),
+			)
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeEventReminders(ctx, svr, res, personID, "Could not update the reminder.")
+			return
+		}
+		if updated, err := result.RowsAffected(); err != nil || updated < 1 {
+			writeEventReminders(ctx, svr, res, personID, "Could not find that event.")
+			return
+		}
+
+		if before != days {
+			audit.Record(ctx, svr, personID, audit.Event{
+				Action:   audit.Update,
+				After:    map[string]int{"reminder_days": days},
+				Before:   map[string]int{"reminder_days": before},
+				Entity:   audit.EventReminder,
+				EntityID: externalID,
+			})
+		}
+
+		writeEventReminders(ctx, svr, res, personID, "")
+
+	})
+
+}
+
+func writeEventReminders(
+	ctx context.Context,
+	svr *util.ServerUtils,
+	res http.ResponseWriter,
+	personID int64,
+	errorMessage string,
+) {
+
+	span := trace.SpanFromContext(ctx)
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/event_reminders.html")
+	if err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error loading the event reminders template",
+			slog.String("errorMessage", err.Error()),
+		)
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading your reminders"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	list := eventReminderList{
+		ErrorMessage: errorMessage,
+		Events:       []eventReminder{},
+		MaxDays:      maxReminderDays,
+	}
+
+	rows, err := svr.DB.Query(ctx, reminderEventsQuery, personID, time.Now().UTC())
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the events", slog.String("errorMessage", err.Error()))
+		list.ErrorMessage = "Could not look up your events."
+	} else {
+
+		defer rows.Close()
+		for rows.Next() {
+
+			var (
+				event     eventReminder
+				eventDate time.Time
+			)
+			if err := rows.Scan(&event.ExternalID, &event.Name, &eventDate, &event.ReminderDays); err != nil {
+				svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+				continue
+			}
+			event.Date = eventDate.Format(dateFormat)
+			list.Events = append(list.Events, event)
+
+		}
+
+	}
+	span.SetAttributes(attribute.Int("event_count", len(list.Events)))
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "event-reminders", list); err != nil {
+		svr.Logger.ErrorContext(
+			ctx,
+			"Error writing template!",
+			slog.String("errorMessage", err.Error()),
+		)
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+
+}
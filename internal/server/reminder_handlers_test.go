@@ -0,0 +1,131 @@
+package server_test
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+)
+
+// TestEventReminderUpdate changes the reminder lead time for an event,
+// checking only the event's givers can change it and only to a sensible
+// number of days.
+func TestEventReminderUpdate(t *testing.T) {
+	testData := []struct {
+		days          string
+		expectedDays  int
+		expectedError bool
+		role          string
+		testName      string
+	}{
+		{
+			days:         "14",
+			expectedDays: 14,
+			role:         "GIVER",
+			testName:     "Giver sets the reminder",
+		},
+		{
+			days:          "0",
+			expectedDays:  7,
+			expectedError: true,
+			role:          "GIVER",
+			testName:      "Too few days",
+		},
+		{
+			days:          "61",
+			expectedDays:  7,
+			expectedError: true,
+			role:          "GIVER",
+			testName:      "Too many days",
+		},
+		{
+			days:          "next week",
+			expectedDays:  7,
+			expectedError: true,
+			role:          "GIVER",
+			testName:      "Not a number",
+		},
+		{
+			days:          "14",
+			expectedDays:  7,
+			expectedError: true,
+			role:          "RECIPIENT",
+			testName:      "Recipient can't set the reminder",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			userData := test.UserData{
+				Email:     "reminder-" + rand.Text() + "@localhost.com",
+				FirstName: "Early",
+				LastName:  "Shopper",
+			}
+			token, err := test.CreateSession(ctx, logger, db, userData, time.Minute*5, userAgent)
+			if err != nil {
+				t.Fatal("Could not create a test session", err)
+			}
+
+			var personID int64
+			if err = db.QueryRow(ctx, "SELECT person_id FROM session WHERE session_id = ?", test.HashSecret(token)).Scan(&personID); err != nil {
+				t.Fatal("Could not look up the test session", err)
+			}
+
+			externalID := strings.ToLower(rand.Text())
+			eventID, err := test.CreateEvent(ctx, db, test.EventData{
+				Date:       time.Now().AddDate(0, 1, 0),
+				ExternalID: externalID,
+				Name:       "Reminder test " + externalID,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = test.AddEventPerson(ctx, db, eventID, personID, data.role); err != nil {
+				t.Fatal(err)
+			}
+
+			res := submitForm(
+				t,
+				"/profile/reminders/"+externalID+"/update",
+				url.Values{"reminderDays": {data.days}},
+				[]*http.Cookie{{Name: middleware.SessionCookie, Value: token}},
+				userAgent,
+			)
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatal("Expected a 200 but got", res.StatusCode)
+			}
+			doc, err := html.Parse(res.Body)
+			if err != nil {
+				t.Fatal("Error parsing the reminders section", err)
+			}
+
+			var days int
+			if err = db.QueryRow(ctx, "SELECT reminder_days FROM event WHERE event_id = ?", eventID).Scan(&days); err != nil {
+				t.Fatal("Error reading the reminder days", err)
+			} else if days != data.expectedDays {
+				t.Fatal("Expected the reminder", data.expectedDays, "days ahead but found", days)
+			}
+
+			errorNode, found := test.CheckElement(*doc, "event-reminders-error")
+			if !found {
+				t.Fatal("Could not find the error message")
+			} else if shown := test.ElementVisible(errorNode); shown != data.expectedError {
+				t.Fatal("Expected the error message shown", data.expectedError, "but it was", shown)
+			}
+			if _, listed := test.CheckElement(*doc, "event-reminder-"+externalID); listed != (data.role == "GIVER") {
+				t.Fatal("Expected the event listed", data.role == "GIVER", "but it was", listed)
+			}
+		})
+	}
+}
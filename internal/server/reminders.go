@@ -0,0 +1,332 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gift-registry/internal/database"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type upcomingEvent struct {
+	eventDate    time.Time
+	eventID      int64
+	name         string
+	reminderDays int
+}
+
+type reminderGiver struct {
+	email    string
+	personID int64
+}
+
+const (
+	/* Reminders are checked hourly by default */
+	defaultReminderInterval     = 3600000
+	dateFormat                  = "January 2, 2006"
+	deleteReminderSentStatement = `DELETE FROM reminder_sent
+		WHERE event_id = ? AND person_id = ?`
+	/*
+		Recording the reminder BEFORE sending it means 2 instances (or a restart
+		mid-send) can't both send it. If the send fails, the record is removed so
+		the next tick tries again.
+	*/
+	insertReminderSentStatement = `INSERT INTO reminder_sent (event_id, person_id)
+		VALUES (?, ?)
+		ON CONFLICT (event_id, person_id) DO NOTHING`
+	outstandingClaimsQuery = `SELECT i.name,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name),
+			c.status
+		FROM claim c
+			INNER JOIN item i ON i.item_id = c.item_id
+			INNER JOIN person p ON p.person_id = i.person_id
+			INNER JOIN event_person ep ON ep.person_id = i.person_id
+		WHERE ep.event_id = ?
+			AND ep.role = 'RECIPIENT'
+			AND (i.event_id = ep.event_id OR i.event_id IS NULL)
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NULL
+			AND p.deleted_on IS NULL
+			AND c.person_id = ?
+			AND c.status = 'CLAIMED'
+		ORDER BY i.name`
+	reminderGiversQuery = `SELECT p.person_id, p.email
+		FROM event_person ep
+			INNER JOIN person p ON p.person_id = ep.person_id
+		WHERE ep.event_id = ?
+			AND ep.role = 'GIVER'
+			AND p.email <> ''
+			AND p.deleted_on IS NULL
+			AND NOT EXISTS (SELECT 1 FROM reminder_sent rs WHERE rs.event_id = ep.event_id AND rs.person_id = ep.person_id)`
+	unclaimedItemsQuery = `SELECT p.person_id,
+			COALESCE(NULLIF(p.display_name, ''), p.first_name),
+			i.name
+		FROM event_person ep
+			INNER JOIN person p ON p.person_id = ep.person_id
+			INNER JOIN item i ON i.person_id = ep.person_id
+		WHERE ep.event_id = ?
+			AND ep.role = 'RECIPIENT'
+			AND (i.event_id = ep.event_id OR i.event_id IS NULL)
+			AND i.archived_on IS NULL
+			AND i.deleted_on IS NULL
+			AND p.deleted_on IS NULL
+			AND NOT EXISTS (SELECT 1 FROM claim c WHERE c.item_id = i.item_id)
+			AND NOT EXISTS (SELECT 1 FROM guest_claim g WHERE g.item_id = i.item_id AND g.status = 'ACTIVE')
+		ORDER BY p.person_id, i.name`
+	upcomingEventsQuery = `SELECT event_id, name, event_date, reminder_days
+		FROM event
+		WHERE event_date > ?`
+)
+
+// StartReminders launches the scheduler that emails the givers for upcoming
+// events with what's still unclaimed and what they've claimed but haven't
+// bought yet. It runs until the given context is cancelled.
+func StartReminders(
+	ctx context.Context,
+	getenv func(string) string,
+	db database.Database,
+	logger *slog.Logger,
+	emailProvider Emailer,
+) *Scheduler {
+
+	return startScheduler(
+		ctx,
+		getenv,
+		db,
+		logger,
+		emailProvider,
+		"reminders",
+		"REMINDER_INTERVAL",
+		defaultReminderInterval,
+		(*Scheduler).sendReminders,
+	)
+
+}
+
+/*
+Finds every upcoming event whose reminder window has opened and emails each
+of its givers who hasn't already been sent a reminder for it.
+*/
+func (sch *Scheduler) sendReminders(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "sendReminders")
+	defer span.End()
+
+	now := time.Now().UTC()
+	events, err := sch.dueEvents(ctx, now)
+	if err != nil {
+		sch.svr.Logger.ErrorContext(ctx, "Error looking up events needing reminders", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+	span.SetAttributes(attribute.Int("due_events", len(events)))
+
+	sent := 0
+	for _, event := range events {
+
+		givers, err := sch.giversToRemind(ctx, event.eventID)
+		if err != nil {
+			sch.svr.Logger.ErrorContext(ctx,
+				"Error looking up the givers to remind",
+				slog.Int64("eventID", event.eventID),
+				slog.String("errorMessage", err.Error()),
+			)
+			continue
+		}
+		if len(givers) == 0 {
+			continue
+		}
+
+		recipients, err := sch.unclaimedItems(ctx, event.eventID)
+		if err != nil {
+			sch.svr.Logger.ErrorContext(ctx,
+				"Error looking up the unclaimed items for the event",
+				slog.Int64("eventID", event.eventID),
+				slog.String("errorMessage", err.Error()),
+			)
+			continue
+		}
+
+		for _, giver := range givers {
+			if sch.remind(ctx, event, giver, recipients) {
+				sent++
+			}
+		}
+
+	}
+
+	span.SetAttributes(attribute.Int("reminders_sent", sent))
+
+}
+
+/* Returns the upcoming events that are within their reminder window */
+func (sch *Scheduler) dueEvents(ctx context.Context, now time.Time) ([]upcomingEvent, error) {
+	rows, err := sch.svr.DB.Query(ctx, upcomingEventsQuery, now)
+	if err != nil {
+		return nil, fmt.Errorf("error querying upcoming events: %v", err)
+	}
+	defer rows.Close()
+
+	events := []upcomingEvent{}
+	for rows.Next() {
+
+		var event upcomingEvent
+		if err := rows.Scan(&event.eventID, &event.name, &event.eventDate, &event.reminderDays); err != nil {
+			sch.svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+
+		if !now.Before(event.eventDate.AddDate(0, 0, -event.reminderDays)) {
+			events = append(events, event)
+		}
+
+	}
+
+	return events, nil
+}
+
+func (sch *Scheduler) giversToRemind(ctx context.Context, eventID int64) ([]reminderGiver, error) {
+	rows, err := sch.svr.DB.Query(ctx, reminderGiversQuery, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying givers for event %d: %v", eventID, err)
+	}
+	defer rows.Close()
+
+	givers := []reminderGiver{}
+	for rows.Next() {
+
+		var giver reminderGiver
+		if err := rows.Scan(&giver.personID, &giver.email); err != nil {
+			sch.svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		givers = append(givers, giver)
+
+	}
+
+	return givers, nil
+}
+
+/*
+Sends a single giver their reminder for an event. Returns true if the email
+went out.
+*/
+func (sch *Scheduler) remind(
+	ctx context.Context,
+	event upcomingEvent,
+	giver reminderGiver,
+	recipients []ReminderRecipient,
+) bool {
+
+	res, err := sch.svr.DB.Execute(ctx, insertReminderSentStatement, event.eventID, giver.personID)
+	if err != nil {
+		sch.svr.Logger.ErrorContext(ctx,
+			"Error recording the reminder",
+			slog.Int64("eventID", event.eventID),
+			slog.Int64("personID", giver.personID),
+			slog.String("errorMessage", err.Error()),
+		)
+		return false
+	} else if modified, err := res.RowsAffected(); err == nil && modified == 0 {
+		/* Someone else already sent this reminder */
+		return false
+	}
+
+	claims, err := sch.outstandingClaims(ctx, event.eventID, giver.personID)
+	if err != nil {
+		sch.svr.Logger.ErrorContext(ctx,
+			"Error looking up the giver's outstanding claims",
+			slog.Int64("eventID", event.eventID),
+			slog.Int64("personID", giver.personID),
+			slog.String("errorMessage", err.Error()),
+		)
+	}
+
+	reminder := ReminderEmail{
+		Claims:     claims,
+		EventDate:  event.eventDate.Format(dateFormat),
+		EventName:  event.name,
+		Recipients: recipients,
+	}
+
+	if err = sch.emailer.SendReminderEmail(ctx, []string{giver.email}, reminder, sch.svr.Getenv); err != nil {
+		sch.svr.Logger.ErrorContext(ctx,
+			"Error sending the reminder email, will retry",
+			slog.Int64("eventID", event.eventID),
+			slog.Int64("personID", giver.personID),
+			slog.String("errorMessage", err.Error()),
+		)
+		if _, err := sch.svr.DB.Execute(ctx, deleteReminderSentStatement, event.eventID, giver.personID); err != nil {
+			sch.svr.Logger.ErrorContext(ctx,
+				"Error clearing the failed reminder record",
+				slog.Int64("eventID", event.eventID),
+				slog.Int64("personID", giver.personID),
+				slog.String("errorMessage", err.Error()),
+			)
+		}
+		return false
+	}
+
+	sch.svr.Logger.InfoContext(ctx,
+		"Sent event reminder",
+		slog.Int64("eventID", event.eventID),
+		slog.Int64("personID", giver.personID),
+	)
+	return true
+
+}
+
+func (sch *Scheduler) outstandingClaims(ctx context.Context, eventID int64, personID int64) ([]ReminderClaim, error) {
+	rows, err := sch.svr.DB.Query(ctx, outstandingClaimsQuery, eventID, personID)
+	if err != nil {
+		return []ReminderClaim{}, fmt.Errorf("error querying outstanding claims: %v", err)
+	}
+	defer rows.Close()
+
+	claims := []ReminderClaim{}
+	for rows.Next() {
+
+		var claim ReminderClaim
+		if err := rows.Scan(&claim.ItemName, &claim.Recipient, &claim.Status); err != nil {
+			sch.svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		claims = append(claims, claim)
+
+	}
+
+	return claims, nil
+}
+
+/* Returns the event's unclaimed items, grouped by recipient */
+func (sch *Scheduler) unclaimedItems(ctx context.Context, eventID int64) ([]ReminderRecipient, error) {
+	rows, err := sch.svr.DB.Query(ctx, unclaimedItemsQuery, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying unclaimed items: %v", err)
+	}
+	defer rows.Close()
+
+	recipients := []ReminderRecipient{}
+	var lastPersonID int64
+	for rows.Next() {
+
+		var personID int64
+		var recipientName, itemName string
+		if err := rows.Scan(&personID, &recipientName, &itemName); err != nil {
+			sch.svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+
+		if len(recipients) == 0 || lastPersonID != personID {
+			recipients = append(recipients, ReminderRecipient{Name: recipientName})
+			lastPersonID = personID
+		}
+		last := &recipients[len(recipients)-1]
+		last.UnclaimedItems = append(last.UnclaimedItems, itemName)
+
+	}
+
+	return recipients, nil
+}
@@ -0,0 +1,133 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gift-registry/internal/server"
+	"gift-registry/internal/test"
+)
+
+// TestReminders runs the scheduler on a short interval and confirms due
+// reminders are sent exactly once, and events outside their reminder window
+// are left alone.
+func TestReminders(t *testing.T) {
+	testData := []struct {
+		eventDate       time.Time
+		expectedClaims  int
+		expectedItems   int
+		expectedSent    int
+		externalIDStart string
+		testName        string
+	}{
+		{
+			eventDate:       time.Now().UTC().AddDate(0, 0, 3),
+			expectedClaims:  1,
+			expectedItems:   1,
+			expectedSent:    1,
+			externalIDStart: "reminder-due",
+			testName:        "Reminder due",
+		},
+		{
+			eventDate:       time.Now().UTC().AddDate(0, 1, 0),
+			expectedSent:    0,
+			externalIDStart: "reminder-not-due",
+			testName:        "Reminder not due yet",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			giverEmail := data.externalIDStart + "-giver@localhost.com"
+			giverID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:      giverEmail,
+				ExternalID: data.externalIDStart + "-giver",
+				FirstName:  "Reminder",
+				LastName:   "Giver",
+			})
+			if err != nil {
+				t.Fatal("Could not create the giver", err)
+			}
+
+			recipientID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:      data.externalIDStart + "-recipient@localhost.com",
+				ExternalID: data.externalIDStart + "-recipient",
+				FirstName:  "Reminder",
+				LastName:   "Recipient",
+			})
+			if err != nil {
+				t.Fatal("Could not create the recipient", err)
+			}
+
+			eventID, err := test.CreateEvent(ctx, db, test.EventData{
+				Date:       data.eventDate,
+				ExternalID: data.externalIDStart + "-event",
+				Name:       "Reminder party",
+			})
+			if err != nil {
+				t.Fatal("Could not create the event", err)
+			}
+
+			if err = test.AddEventPerson(ctx, db, eventID, giverID, "GIVER"); err != nil {
+				t.Fatal(err)
+			}
+			if err = test.AddEventPerson(ctx, db, eventID, recipientID, "RECIPIENT"); err != nil {
+				t.Fatal(err)
+			}
+
+			for idx, name := range []string{"Unclaimed gift", "Claimed gift"} {
+
+				itemID, err := test.CreateItem(ctx, db, test.ItemData{
+					EventID:    eventID,
+					ExternalID: data.externalIDStart + "-item-" + string(rune('a'+idx)),
+					Name:       name,
+					PersonID:   recipientID,
+				})
+				if err != nil {
+					t.Fatal("Could not create the item", err)
+				}
+
+				if name == "Claimed gift" {
+					if err = test.CreateClaim(ctx, db, itemID, giverID, "CLAIMED"); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+			}
+
+			mock := &test.EmailMock{}
+			env := map[string]string{"REMINDER_INTERVAL": "20"}
+			schedulerCtx, cancel := context.WithCancel(ctx)
+			reminders := server.StartReminders(schedulerCtx, func(name string) string { return env[name] }, db, logger, mock)
+
+			/* Let the scheduler tick several times to prove it doesn't double-send */
+			time.Sleep(500 * time.Millisecond)
+			cancel()
+
+			select {
+			case <-reminders.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Reminder scheduler didn't shut down")
+			}
+
+			sent := mock.RemindersSent(giverEmail)
+			if len(sent) != data.expectedSent {
+				t.Fatal("Expected", data.expectedSent, "reminders but got", len(sent))
+			}
+
+			if data.expectedSent == 0 {
+				return
+			}
+
+			if len(sent[0].Recipients) != 1 || len(sent[0].Recipients[0].UnclaimedItems) != data.expectedItems {
+				t.Fatal("Expected", data.expectedItems, "unclaimed items in the reminder, got", sent[0].Recipients)
+			}
+			if len(sent[0].Claims) != data.expectedClaims {
+				t.Fatal("Expected", data.expectedClaims, "outstanding claims in the reminder, got", sent[0].Claims)
+			}
+		})
+	}
+}
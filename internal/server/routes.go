@@ -1,8 +1,13 @@
 package server
 
 import (
+	"gift-registry/internal/accesstoken"
+	"gift-registry/internal/admin"
+	"gift-registry/internal/audit"
+	"gift-registry/internal/calendar"
 	"gift-registry/internal/health"
 	"gift-registry/internal/middleware"
+	"gift-registry/internal/passkey"
 	"gift-registry/internal/profile"
 	"gift-registry/internal/registry"
 	"net/http"
@@ -26,6 +31,22 @@ func registerRoutes() (http.Handler, error) {
 	handleFunc("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir(appSrv.Getenv("STATIC_FILES_DIR")+"/css"))))
 	handleFunc("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir(appSrv.Getenv("STATIC_FILES_DIR")+"/js"))))
 
+	/* Admin routes, which also need the person to be a site admin */
+	handleFunc("GET /admin", middleware.Admin(appSrv, admin.ConsoleHandler(appSrv)))
+	handleFunc("GET /admin/audit", middleware.Admin(appSrv, audit.ViewerHandler(appSrv)))
+	handleFunc("GET /admin/households", middleware.Admin(appSrv, admin.HouseholdsHandler(appSrv)))
+	handleFunc("POST /admin/households", middleware.Admin(appSrv, admin.HouseholdCreateHandler(appSrv)))
+	handleFunc("POST /admin/households/{externalID}/merge", middleware.Admin(appSrv, admin.HouseholdMergeHandler(appSrv)))
+	handleFunc("POST /admin/households/{externalID}/rename", middleware.Admin(appSrv, admin.HouseholdRenameHandler(appSrv)))
+	handleFunc("POST /admin/impersonation/stop", middleware.Admin(appSrv, admin.ImpersonationStopHandler(appSrv)))
+	handleFunc("GET /admin/people", middleware.Admin(appSrv, admin.PeopleHandler(appSrv)))
+	handleFunc("POST /admin/people", middleware.Admin(appSrv, admin.PersonCreateHandler(appSrv)))
+	handleFunc("POST /admin/people/{externalID}/disable", middleware.Admin(appSrv, admin.PersonDisableHandler(appSrv)))
+	handleFunc("POST /admin/people/{externalID}/enable", middleware.Admin(appSrv, admin.PersonEnableHandler(appSrv)))
+	handleFunc("POST /admin/people/{externalID}/impersonate", middleware.Admin(appSrv, admin.ImpersonateHandler(appSrv)))
+	handleFunc("POST /admin/people/{externalID}/logout", middleware.Admin(appSrv, admin.PersonLogoutHandler(appSrv)))
+	handleFunc("GET /admin/stats", middleware.Admin(appSrv, admin.StatsHandler(appSrv)))
+
 	/* Base routes */
 	handleFunc("GET /{$}", IndexHandler(appSrv))
 	handleFunc("GET /health", health.HealthCheckHandler(appSrv))
@@ -33,21 +54,94 @@ func registerRoutes() (http.Handler, error) {
 	/* Authentication routes */
 	handleFunc("GET /login", LoginFormHandler(appSrv))
 	handleFunc("POST /login", LoginHandler(appSrv))
+	handleFunc("GET /login/oidc", OIDCLoginHandler(appSrv))
+	handleFunc("GET /login/oidc/callback", OIDCCallbackHandler(appSrv))
+	handleFunc("POST /login/passkey", PasskeyLoginHandler(appSrv))
+	handleFunc("POST /login/passkey/options", passkey.LoginOptionsHandler(appSrv))
 	handleFunc("GET /logout", LogoutHandler(appSrv))
+	handleFunc("GET /signin/revoke", SignInRevokeLinkHandler(appSrv))
+	handleFunc("POST /signin/revoke", SignInRevokeHandler(appSrv))
 	handleFunc("POST /verify", VerificationHandler(appSrv))
+	handleFunc("GET /verify/link", VerificationLinkHandler(appSrv))
+	handleFunc("POST /verify/link", VerificationLinkConfirmHandler(appSrv))
 
-	/* Profile routes */
+	/*
+		Profile routes. Changing how the account is signed into also needs a
+		recent login. Admins viewing as someone else can look, but can't change
+		anything.
+	*/
 	handleFunc("GET /profile", profile.ProfileHandler(appSrv))
-	handleFunc("POST /profile/{externalID}", profile.ProfileUpdateHandler(appSrv))
+	handleFunc("GET /profile/account", profile.AccountHandler(appSrv))
+	handleFunc("POST /profile/account/delete", middleware.Fresh(appSrv, profile.AccountDeleteHandler(appSrv, emailer)))
+	handleFunc("GET /profile/account/delete/confirm", middleware.NoImpersonation(appSrv, profile.AccountDeleteLinkHandler(appSrv)))
+	handleFunc("POST /profile/account/delete/confirm", middleware.NoImpersonation(appSrv, profile.AccountDeleteConfirmHandler(appSrv)))
+	handleFunc("GET /profile/account/export", middleware.NoImpersonation(appSrv, profile.AccountExportHandler(appSrv)))
+	handleFunc("GET /profile/calendar", calendar.LinkHandler(appSrv))
+	handleFunc("POST /profile/calendar", middleware.NoImpersonation(appSrv, calendar.LinkCreateHandler(appSrv)))
+	handleFunc("POST /profile/calendar/revoke", middleware.NoImpersonation(appSrv, calendar.LinkRevokeHandler(appSrv)))
+	handleFunc("GET /profile/devices", DevicesHandler(appSrv))
+	handleFunc("POST /profile/devices/revoke-others", middleware.Fresh(appSrv, DeviceRevokeOthersHandler(appSrv)))
+	handleFunc("POST /profile/devices/{externalID}/revoke", middleware.Fresh(appSrv, DeviceRevokeHandler(appSrv)))
+	handleFunc("POST /profile/email/confirm", middleware.Fresh(appSrv, profile.EmailConfirmHandler(appSrv)))
+	handleFunc("GET /profile/passkeys", passkey.ListHandler(appSrv))
+	handleFunc("POST /profile/passkeys", middleware.Fresh(appSrv, passkey.RegisterHandler(appSrv)))
+	handleFunc("POST /profile/passkeys/options", middleware.Fresh(appSrv, passkey.RegisterOptionsHandler(appSrv)))
+	handleFunc("POST /profile/passkeys/{externalID}/revoke", middleware.Fresh(appSrv, passkey.RevokeHandler(appSrv)))
+	handleFunc("GET /profile/reminders", EventRemindersHandler(appSrv))
+	handleFunc("POST /profile/reminders/{externalID}/update", middleware.NoImpersonation(appSrv, EventReminderUpdateHandler(appSrv)))
+	handleFunc("GET /profile/tokens", accesstoken.ListHandler(appSrv))
+	handleFunc("POST /profile/tokens", middleware.Fresh(appSrv, accesstoken.CreateHandler(appSrv)))
+	handleFunc("POST /profile/tokens/{externalID}/revoke", middleware.NoImpersonation(appSrv, accesstoken.RevokeHandler(appSrv)))
+	handleFunc("POST /profile/{externalID}", middleware.NoImpersonation(appSrv, profile.ProfileUpdateHandler(appSrv, emailer)))
+	handleFunc("POST /profile/{externalID}/delete", middleware.NoImpersonation(appSrv, profile.ProfileDeleteHandler(appSrv)))
+	handleFunc("POST /profile/{externalID}/restore", middleware.NoImpersonation(appSrv, profile.ProfileRestoreHandler(appSrv)))
+
+	/*
+		Calendar feeds are public, the token in the file name identifies the
+		person
+	*/
+	handleFunc("GET /calendar/{file}", calendar.FeedHandler(appSrv))
 
-	/* Registry routes */
+	/*
+		Registry routes. Admins viewing as someone else can look, but can't
+		change anything.
+	*/
 	handleFunc("GET /registry", registry.RegistryHandler(appSrv))
+	handleFunc("GET /registry/alerts", registry.ClaimAlertsHandler(appSrv))
+	handleFunc("POST /registry/alerts/dismiss", middleware.NoImpersonation(appSrv, registry.ClaimAlertsDismissHandler(appSrv)))
+	handleFunc("GET /registry/history", registry.GiftHistoryHandler(appSrv))
+	handleFunc("GET /registry/items", registry.ItemsHandler(appSrv))
+	handleFunc("POST /registry/items", middleware.NoImpersonation(appSrv, registry.ItemCreateHandler(appSrv)))
+	handleFunc("POST /registry/items/{externalID}", middleware.NoImpersonation(appSrv, registry.ItemUpdateHandler(appSrv)))
+	handleFunc("POST /registry/items/{externalID}/claim", middleware.NoImpersonation(appSrv, registry.ClaimHandler(appSrv)))
+	handleFunc("POST /registry/items/{externalID}/delete", middleware.NoImpersonation(appSrv, registry.ItemDeleteHandler(appSrv)))
+	handleFunc("POST /registry/items/{externalID}/purchase", middleware.NoImpersonation(appSrv, registry.PurchaseHandler(appSrv)))
+	handleFunc("POST /registry/items/{externalID}/restore", middleware.NoImpersonation(appSrv, registry.ItemRestoreHandler(appSrv)))
+	handleFunc("POST /registry/items/{externalID}/unclaim", middleware.NoImpersonation(appSrv, registry.UnclaimHandler(appSrv)))
+	handleFunc("POST /registry/items/{externalID}/withdraw", middleware.NoImpersonation(appSrv, registry.ItemWithdrawHandler(appSrv)))
+	handleFunc("GET /registry/shares", registry.ShareLinksHandler(appSrv))
+	handleFunc("POST /registry/shares", middleware.NoImpersonation(appSrv, registry.ShareCreateHandler(appSrv)))
+	handleFunc("POST /registry/shares/{externalID}/revoke", middleware.NoImpersonation(appSrv, registry.ShareRevokeHandler(appSrv)))
+	handleFunc("GET /registry/shopping", registry.ShoppingListHandler(appSrv))
+
+	/*
+		Share links are public, the token identifies the list. Guest claims made
+		from them are managed through signed links emailed to the guest.
+	*/
+	handleFunc("GET /share/{token}", registry.SharedListHandler(appSrv))
+	handleFunc("POST /share/{token}/claim", registry.GuestClaimHandler(appSrv, emailer))
+	handleFunc("GET /guest-claims/{externalID}/{action}", registry.GuestClaimLinkHandler(appSrv))
+	handleFunc("POST /guest-claims/{externalID}/{action}", registry.GuestClaimActionHandler(appSrv))
 
 	handler := otelhttp.NewHandler(
 		middleware.Cors(
 			appSrv,
 			middleware.Telemetry(appSrv,
-				middleware.Auth(appSrv, mux),
+				middleware.RateLimit(appSrv, middleware.NewMemoryStore(),
+					middleware.CSRF(appSrv,
+						middleware.Auth(appSrv, mux),
+					),
+				),
 			),
 		),
 		"/",
@@ -56,8 +150,3 @@ func registerRoutes() (http.Handler, error) {
 	return handler, nil
 
 }
-
-/*
-TODO: MIDDLEWARES NEEDED:
-2. RATE LIMITING (TO DEAL WITH SCRIPTS TRYING TO BRUTE FORCE CONF CODES)
-*/
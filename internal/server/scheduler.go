@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"gift-registry/internal/database"
+	"gift-registry/internal/util"
+)
+
+// Scheduler runs a background job on a ticker until its context is
+// cancelled, at which point it stops the ticker and closes the channel
+// returned by Done().
+type Scheduler struct {
+	done    chan struct{}
+	emailer Emailer
+	name    string
+	svr     *util.ServerUtils
+}
+
+/*
+Builds the scheduler and launches its loop. The tick interval (in
+milliseconds) is read from the intervalEnv environment variable, falling back
+to defaultInterval.
+*/
+func startScheduler(
+	ctx context.Context,
+	getenv func(string) string,
+	db database.Database,
+	logger *slog.Logger,
+	emailProvider Emailer,
+	name string,
+	intervalEnv string,
+	defaultInterval int,
+	task func(*Scheduler, context.Context),
+) *Scheduler {
+
+	scheduler := &Scheduler{
+		done:    make(chan struct{}),
+		emailer: emailProvider,
+		name:    name,
+		svr: &util.ServerUtils{
+			DB:     db,
+			Getenv: getenv,
+			Logger: logger,
+		},
+	}
+
+	interval := defaultInterval
+	if parsed, err := strconv.Atoi(getenv(intervalEnv)); err == nil {
+		interval = parsed
+	}
+	ticker := time.NewTicker(time.Millisecond * time.Duration(interval))
+	go scheduler.run(ctx, ticker, task)
+
+	return scheduler
+
+}
+
+// Done returns a channel that's closed once the scheduler has shut down
+func (sch *Scheduler) Done() <-chan struct{} {
+	return sch.done
+}
+
+func (sch *Scheduler) run(ctx context.Context, ticker *time.Ticker, task func(*Scheduler, context.Context)) {
+	defer close(sch.done)
+	defer ticker.Stop()
+
+	for {
+		select {
+		/* Time to do the work */
+		case <-ticker.C:
+			task(sch, ctx)
+		/* The app is shutting down, stop polling */
+		case <-ctx.Done():
+			sch.svr.Logger.InfoContext(ctx, "Shutting down scheduler", slog.String("scheduler", sch.name))
+			return
+		}
+	}
+}
@@ -16,6 +16,11 @@ var (
 // Builds a new HTTP hankrdler for the application. This will be used for testing and running the server
 func NewServer(getenv func(string) string, db database.Database, logger *slog.Logger, emailProvider Emailer) (http.Handler, error) {
 
+	if err := util.CheckBaseURL(getenv); err != nil {
+		logger.Error("Server failed to start", slog.String("errorMessage", err.Error()))
+		return nil, fmt.Errorf("error starting the server: %s", err.Error())
+	}
+
 	emailer = emailProvider
 	appSrv = &util.ServerUtils{
 		DB:     db,
@@ -29,6 +29,7 @@ var (
 	emailer    server.Emailer
 	getenv     func(string) string
 	logger     *slog.Logger
+	provider   *test.OIDCProvider
 	testServer *httptest.Server
 )
 
@@ -63,10 +64,21 @@ func TestMain(m *testing.M) {
 		slog.Int64("size", copied),
 	)
 
+	provider, err = test.NewOIDCProvider("gift-registry-test", "test-client-secret")
+	if err != nil {
+		log.Fatal("Could not start the stand-in OIDC provider ", err)
+	}
+	defer provider.Server.Close()
+
 	env := map[string]string{
-		"DB_NAME":        dbPath,
-		"MIGRATIONS_DIR": filepath.Join("..", "database", "migrations"),
-		"TEMPLATES_DIR":  filepath.Join("..", "..", "cmd", "web", "templates"),
+		"APP_BASE_URL":       "https://gift-registry.localhost",
+		"DB_NAME":            dbPath,
+		"MIGRATIONS_DIR":     filepath.Join("..", "database", "migrations"),
+		"OIDC_CLIENT_ID":     provider.ClientID,
+		"OIDC_CLIENT_SECRET": provider.ClientSecret,
+		"OIDC_ISSUER":        provider.Server.URL,
+		"OIDC_PROVIDER_NAME": "Test Provider",
+		"TEMPLATES_DIR":      filepath.Join("..", "..", "cmd", "web", "templates"),
 	}
 
 	getenv = func(name string) string { return env[name] }
@@ -98,6 +110,53 @@ func TestMain(m *testing.M) {
 	os.Exit(exitCode)
 }
 
+// TestBaseURLRequired makes sure the server won't start without a full
+// APP_BASE_URL to build emailed links from.
+func TestBaseURLRequired(t *testing.T) {
+	testData := []struct {
+		baseURL       string
+		expectedError bool
+		testName      string
+	}{
+		{
+			expectedError: true,
+			testName:      "Not set",
+		},
+		{
+			baseURL:       "gifts.example.com",
+			expectedError: true,
+			testName:      "Missing scheme",
+		},
+		{
+			baseURL:       "ftp://gifts.example.com",
+			expectedError: true,
+			testName:      "Wrong scheme",
+		},
+		{
+			baseURL:       "https://gifts.example.com",
+			expectedError: false,
+			testName:      "Full address",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			env := map[string]string{
+				"APP_BASE_URL":     data.baseURL,
+				"STATIC_FILES_DIR": filepath.Join("..", "..", "cmd", "web"),
+				"TEMPLATES_DIR":    filepath.Join("..", "..", "cmd", "web", "templates"),
+			}
+			getenv := func(name string) string { return env[name] }
+
+			if _, err := server.NewServer(getenv, db, logger, emailer); (err != nil) != data.expectedError {
+				t.Fatal("Expected a startup error =", data.expectedError, "but got", err)
+			}
+		})
+	}
+}
+
 // Confirms we get a 500 bad response if we have any error reading or populating a template, simulated by intentionally misconfiguring the templates directory.
 func TestBadTemplates(t *testing.T) {
 	testData := []struct {
@@ -142,6 +201,7 @@ func TestBadTemplates(t *testing.T) {
 			t.Parallel()
 
 			env := map[string]string{
+				"APP_BASE_URL":     "https://gift-registry.localhost",
 				"STATIC_FILES_DIR": filepath.Join("..", "..", "cmd", "web"),
 				"TEMPLATES_DIR":    "templates",
 			}
@@ -164,6 +224,7 @@ func TestBadTemplates(t *testing.T) {
 			req.Header.Set("Sec-Fetch-Dest", "document")
 			req.Header.Set("Sec-Fetch-Mode", "same-origin")
 			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			test.AddCSRFToken(req)
 			res, err := http.DefaultClient.Do(req)
 			defer func() {
 				if res != nil && res.Body != nil {
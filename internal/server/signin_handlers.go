@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gift-registry/internal/audit"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/util"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SignInEmail holds the details of a new sign-in, sent to the person so they
+// can spot one that wasn't them
+type SignInEmail struct {
+	Device     string
+	IPAddress  string
+	RevokeURL  string
+	SignedInAt string
+	UserAgent  string
+}
+
+type signInRevokePage struct {
+	ErrorMessage string
+	Message      string
+	/* Passkeys can still log in, so they're listed for the person to check */
+	Passkeys  []string
+	Person    string
+	Session   string
+	Signature string
+}
+
+const (
+	/*
+		Signing out everywhere takes personal access tokens with it, or whoever
+		got in could keep using the registry from a script.
+	*/
+	deleteAccessTokensStatement = `DELETE FROM access_token WHERE person_id = ?`
+	passkeyNamesQuery           = `SELECT name FROM passkey WHERE person_id = ? ORDER BY created_on, passkey_id`
+	personExternalIDQuery       = `SELECT external_id FROM person WHERE person_id = ?`
+	personIDQuery               = `SELECT person_id FROM person WHERE external_id = ?`
+	revokeSessionsAction        = "revoke-sessions"
+	signInTimeFmt               = "January 2, 2006 3:04 PM MST"
+)
+
+// SignInRevokeLinkHandler is where the "This wasn't me" link in the sign-in
+// email lands. It only shows a button to sign out everywhere, so email
+// scanners following the link don't act on it.
+func SignInRevokeLinkHandler(svr *util.ServerUtils) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("signin_revoke_link")
+
+		page := signInRevokePage{
+			Person:    req.URL.Query().Get("person"),
+			Session:   req.URL.Query().Get("session"),
+			Signature: req.URL.Query().Get("sig"),
+		}
+		if !util.ValidSignature(svr, revokeSessionsAction, page.Person+":"+page.Session, page.Signature) {
+			svr.Logger.InfoContext(ctx, "Sign-in revoke link with a bad signature")
+			span.SetAttributes(attribute.String("error_message", "invalid revoke link"))
+			page = signInRevokePage{ErrorMessage: "This link isn't valid. Log in and sign your other devices out from your profile instead."}
+		}
+
+		writeSignInRevokePage(ctx, svr, res, page)
+	})
+}
+
+// SignInRevokeHandler signs the person out of the reported session and every
+// other one, and revokes their access tokens, if the link's signature checks
+// out. Whoever used the session will have to log in again, which takes access
+// to the person's email. Passkeys are listed rather than removed, so the
+// person can check them once they're back in.
+func SignInRevokeHandler(svr *util.ServerUtils) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetName("signin_revoke")
+
+		person := req.PostFormValue("person")
+		session := req.PostFormValue("session")
+		if !util.ValidSignature(svr, revokeSessionsAction, person+":"+session, req.PostFormValue("sig")) {
+			svr.Logger.InfoContext(ctx, "Sign-in revoke with a bad signature")
+			span.SetAttributes(attribute.String("error_message", "invalid revoke link"))
+			writeSignInRevokePage(ctx, svr, res, signInRevokePage{ErrorMessage: "This link isn't valid. Log in and sign your other devices out from your profile instead."})
+			return
+		}
+
+		var personID int64
+		if err := svr.DB.QueryRow(ctx, personIDQuery, person).Scan(&personID); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error looking up the person signing out everywhere", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+			writeSignInRevokePage(ctx, svr, res, signInRevokePage{ErrorMessage: "Could not sign you out, please try again shortly."})
+			return
+		}
+		span.SetAttributes(attribute.Int64("person_id", personID))
+
+		results, errs := svr.DB.ExecuteBatch(
+			ctx,
+			[]string{DeleteSessionForPersonStatement, deleteAccessTokensStatement},
+			[][]any{{personID}, {personID}},
+		)
+		for _, err := range errs {
+			if err != nil {
+				svr.Logger.ErrorContext(ctx, "Error revoking the person's sessions", slog.String("errorMessage", err.Error()))
+				span.SetAttributes(attribute.String("error_message", err.Error()))
+				writeSignInRevokePage(ctx, svr, res, signInRevokePage{ErrorMessage: "Could not sign you out, please try again shortly."})
+				return
+			}
+		}
+
+		revoked, err := results[0].RowsAffected()
+		if err != nil {
+			svr.Logger.WarnContext(ctx, "Error getting the count of sessions revoked", slog.String("errorMessage", err.Error()))
+		}
+		tokensRevoked, err := results[1].RowsAffected()
+		if err != nil {
+			svr.Logger.WarnContext(ctx, "Error getting the count of access tokens revoked", slog.String("errorMessage", err.Error()))
+		}
+		span.SetAttributes(attribute.Int64("revoked_count", revoked), attribute.Int64("tokens_revoked_count", tokensRevoked))
+		audit.Record(ctx, svr, personID, audit.Event{
+			Action:   audit.Revoke,
+			After:    map[string]any{"revoked": revoked, "reported": true, "tokens_revoked": tokensRevoked},
+			Entity:   audit.Session,
+			EntityID: session,
+		})
+		svr.Logger.InfoContext(ctx, "Signed a person out everywhere from a sign-in email", slog.Int64("revoked", revoked), slog.Int64("tokensRevoked", tokensRevoked))
+
+		page := signInRevokePage{Message: "You've been signed out everywhere, and your access tokens have been revoked. Log in again to get back to your gift lists."}
+		page.Passkeys, err = passkeyNames(ctx, svr, personID)
+		if err != nil {
+			svr.Logger.ErrorContext(ctx, "Error looking up the person's passkeys", slog.String("errorMessage", err.Error()))
+			span.SetAttributes(attribute.String("error_message", err.Error()))
+		}
+
+		/* This browser was one of the sessions, so it's signed out too */
+		http.SetCookie(res, &http.Cookie{Name: middleware.SessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
+		writeSignInRevokePage(ctx, svr, res, page)
+	})
+}
+
+/* Names of the passkeys that can log in to the person's account */
+func passkeyNames(ctx context.Context, svr *util.ServerUtils, personID int64) ([]string, error) {
+
+	rows, err := svr.DB.Query(ctx, passkeyNamesQuery, personID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying the passkeys: %v", err)
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			svr.Logger.ErrorContext(ctx, "Error scanning data!", slog.String("errorMessage", err.Error()))
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+
+}
+
+/*
+Lets the person know about a new session on their account. A failed send only
+gets logged, it's not worth stopping the login over.
+*/
+func sendSignInEmail(
+	ctx context.Context,
+	svr *util.ServerUtils,
+	personID int64,
+	email string,
+	sessionExternalID string,
+	signIn SignInEmail,
+	signedInAt time.Time,
+) {
+	span := trace.SpanFromContext(ctx)
+
+	personExternalID := ""
+	if err := svr.DB.QueryRow(ctx, personExternalIDQuery, personID).Scan(&personExternalID); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error looking up the person for the sign-in email", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	signIn.RevokeURL = util.AppURL(svr, revokeLink(svr, personExternalID, sessionExternalID))
+	signIn.SignedInAt = signedInAt.UTC().Format(signInTimeFmt)
+	if signIn.IPAddress == "" {
+		signIn.IPAddress = "an unknown network"
+	}
+
+	if err := emailer.SendSignInEmail(ctx, []string{email}, signIn, svr.Getenv); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error sending the sign-in email", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+}
+
+/* Builds the signed "This wasn't me" link for a session */
+func revokeLink(svr *util.ServerUtils, personExternalID string, sessionExternalID string) string {
+	return "/signin/revoke?" + url.Values{
+		"person":  {personExternalID},
+		"session": {sessionExternalID},
+		"sig":     {util.SignLink(svr, revokeSessionsAction, personExternalID+":"+sessionExternalID)},
+	}.Encode()
+}
+
+func writeSignInRevokePage(ctx context.Context, svr *util.ServerUtils, res http.ResponseWriter, page signInRevokePage) {
+	span := trace.SpanFromContext(ctx)
+
+	tmpl, err := template.ParseFiles(svr.Getenv("TEMPLATES_DIR") + "/signin_revoke.html")
+	if err != nil {
+		svr.Logger.ErrorContext(ctx, "Error loading the sign-in revoke template", slog.String("errorMessage", err.Error()))
+		res.WriteHeader(500)
+		res.Write([]byte("Error loading gift registry sign out"))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	if err = tmpl.ExecuteTemplate(res, "signin-revoke-page", page); err != nil {
+		svr.Logger.ErrorContext(ctx, "Error writing template!", slog.String("errorMessage", err.Error()))
+		span.SetAttributes(attribute.String("error_message", err.Error()))
+	}
+}
@@ -0,0 +1,168 @@
+package server_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/test"
+)
+
+// TestSignInEmail signs the same person in on 2 devices and checks each
+// sign-in is emailed to them, and the "This wasn't me" link signs both out.
+func TestSignInEmail(t *testing.T) {
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0"
+
+	testData := []struct {
+		email          string
+		revokeExpected bool
+		tamper         bool
+		testName       string
+	}{
+		{
+			email:          "signInRevoke@localhost.com",
+			revokeExpected: true,
+			testName:       "Signed out everywhere",
+		},
+		{
+			email:    "signInTampered@localhost.com",
+			tamper:   true,
+			testName: "Tampered signature",
+		},
+	}
+
+	for _, data := range testData {
+		t.Run(data.testName, func(t *testing.T) {
+			t.Parallel()
+
+			personID, err := test.CreateUser(ctx, logger, db, test.UserData{
+				Email:     data.email,
+				FirstName: "Sign",
+				LastName:  "In",
+			})
+			if err != nil {
+				t.Fatal("Could not create the test user", err)
+			}
+
+			/* Whoever got in could have left a token and a passkey behind */
+			if err = test.CreateAccessToken(ctx, db, personID, data.email+"-token"); err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Execute(ctx,
+				"INSERT INTO passkey (external_id, person_id, credential_id, public_key, algorithm, name) VALUES (?, ?, ?, ?, ?, ?)",
+				data.email+"-passkey", personID, data.email+"-credential", "key", -7, "Intruder's phone",
+			)
+			if err != nil {
+				t.Fatal("Could not create the passkey", err)
+			}
+
+			/* The verification email names the device asking for the code */
+			res := submitForm(t, "/login", url.Values{"email": {data.email}}, nil, firefox)
+			_ = res.Body.Close()
+			if device := emailer.(*test.EmailMock).LoginDeviceSent(data.email); device != "Firefox on Linux" {
+				t.Fatal("Expected the verification email to name Firefox on Linux but got", device)
+			}
+			if _, err := db.Execute(ctx, "DELETE FROM verification WHERE person_id = (SELECT person_id FROM person WHERE email = ?)", data.email); err != nil {
+				t.Fatal("Could not clear the login code", err)
+			}
+
+			for _, agent := range []string{userAgent, firefox} {
+				if err := createVerification(data.email, "sign-in-code"); err != nil {
+					t.Fatal(err)
+				}
+				res = submitForm(t, "/verify", url.Values{"code": {"sign-in-code"}, "email": {data.email}}, nil, agent)
+				_ = res.Body.Close()
+			}
+
+			sent := emailer.(*test.EmailMock).SignInsSent(data.email)
+			if len(sent) != 2 {
+				t.Fatal("Expected 2 sign-in emails but got", len(sent))
+			}
+			latest := sent[1]
+			if latest.Device != "Firefox on Linux" || latest.UserAgent != firefox || latest.SignedInAt == "" || latest.IPAddress == "" {
+				t.Fatal("Expected the sign-in email to describe the new session but got", latest)
+			}
+
+			link, err := url.Parse(latest.RevokeURL)
+			if err != nil {
+				t.Fatal("Error reading the revoke link", err)
+			} else if link.Host != "gift-registry.localhost" {
+				t.Fatal("Expected the revoke link to use the configured address but got", link)
+			}
+
+			/* Opening the link (like a scanner would) shouldn't sign anyone out */
+			res, err = http.Get(testServer.URL + link.RequestURI())
+			if err != nil {
+				t.Fatal("Error opening the revoke link", err)
+			}
+			doc, err := html.Parse(res.Body)
+			_ = res.Body.Close()
+			if err != nil {
+				t.Fatal("Error parsing the revoke page", err)
+			} else if _, found := test.CheckElement(*doc, "signin-revoke-submit"); !found {
+				t.Fatal("The revoke page is missing its sign out button")
+			}
+			if sessions := countSessions(t, data.email); sessions != 2 {
+				t.Fatal("Expected opening the link to leave both sessions but found", sessions)
+			}
+
+			form := url.Values{
+				"person":  {link.Query().Get("person")},
+				"session": {link.Query().Get("session")},
+				"sig":     {link.Query().Get("sig")},
+			}
+			if data.tamper {
+				form.Set("sig", "tampered"+form.Get("sig"))
+			}
+			res, err = http.Post(testServer.URL+"/signin/revoke", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal("Error signing out everywhere", err)
+			}
+			doc, err = html.Parse(res.Body)
+			_ = res.Body.Close()
+			if err != nil {
+				t.Fatal("Error parsing the signed out page", err)
+			}
+			if _, listed := test.CheckElement(*doc, "signin-revoke-passkeys"); listed != data.revokeExpected {
+				t.Fatal("Expected the passkeys to be listed", data.revokeExpected, "but they were", listed)
+			}
+
+			cleared := false
+			for _, cookie := range res.Cookies() {
+				if cookie.Name == middleware.SessionCookie && cookie.MaxAge < 0 {
+					cleared = true
+				}
+			}
+			if cleared != data.revokeExpected {
+				t.Fatal("Expected the session cookie to be cleared", data.revokeExpected, "but it was", cleared)
+			}
+
+			expected := 2
+			if data.revokeExpected {
+				expected = 0
+			}
+			if sessions := countSessions(t, data.email); sessions != expected {
+				t.Fatal("Expected", expected, "sessions left but found", sessions)
+			}
+
+			var tokens int
+			if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM access_token WHERE person_id = ?", personID).Scan(&tokens); err != nil {
+				t.Fatal("Error counting access tokens", err)
+			} else if (tokens == 0) != data.revokeExpected {
+				t.Fatal("Expected the access tokens to be revoked", data.revokeExpected, "but found", tokens)
+			}
+		})
+	}
+}
+
+func countSessions(t *testing.T, email string) int {
+	var sessions int
+	if err := db.QueryRow(ctx, "SELECT COUNT(*) FROM session s INNER JOIN person p ON p.person_id = s.person_id WHERE p.email = ?", email).Scan(&sessions); err != nil {
+		t.Fatal("Error counting the sessions", err)
+	}
+	return sessions
+}
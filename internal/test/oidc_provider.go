@@ -0,0 +1,187 @@
+package test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// OIDCGrant is what the stand-in provider hands out for an authorization
+// code. Claims are laid over the defaults (issuer, audience, subject and
+// timestamps), and a nil claim leaves that default out of the ID token.
+type OIDCGrant struct {
+	Challenge string
+	Claims    map[string]any
+	WrongKey  bool
+}
+
+// OIDCProvider is a stand-in OpenID Connect provider, serving discovery, its
+// key set and a token endpoint. Tests skip the provider's sign-in page: they
+// pull the state, nonce and PKCE challenge out of the app's redirect, register
+// a grant for a code, and call the app's callback with it.
+type OIDCProvider struct {
+	ClientID     string
+	ClientSecret string
+	Server       *httptest.Server
+	grants       map[string]OIDCGrant
+	key          *rsa.PrivateKey
+	lock         sync.Mutex
+	otherKey     *rsa.PrivateKey
+}
+
+const (
+	oidcKeyID = "test-key"
+)
+
+// NewOIDCProvider starts a stand-in provider that only knows the one client
+func NewOIDCProvider(clientID string, clientSecret string) (*OIDCProvider, error) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := &OIDCProvider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		grants:       map[string]OIDCGrant{},
+		key:          key,
+		otherKey:     otherKey,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("GET /jwks", provider.keys)
+	mux.HandleFunc("POST /token", provider.token)
+	provider.Server = httptest.NewServer(mux)
+	return provider, nil
+
+}
+
+// Grant registers what the token endpoint returns for the code
+func (provider *OIDCProvider) Grant(code string, grant OIDCGrant) {
+
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	provider.grants[code] = grant
+
+}
+
+func (provider *OIDCProvider) discovery(res http.ResponseWriter, req *http.Request) {
+
+	writeJSON(res, http.StatusOK, map[string]any{
+		"authorization_endpoint": provider.Server.URL + "/authorize",
+		"issuer":                 provider.Server.URL,
+		"jwks_uri":               provider.Server.URL + "/jwks",
+		"token_endpoint":         provider.Server.URL + "/token",
+	})
+
+}
+
+func (provider *OIDCProvider) keys(res http.ResponseWriter, req *http.Request) {
+
+	pub := provider.key.PublicKey
+	writeJSON(res, http.StatusOK, map[string]any{
+		"keys": []map[string]any{{
+			"alg": "RS256",
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			"kid": oidcKeyID,
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"use": "sig",
+		}},
+	})
+
+}
+
+/* Trades a code for an ID token, checking the client and PKCE verifier */
+func (provider *OIDCProvider) token(res http.ResponseWriter, req *http.Request) {
+
+	clientID, secret, ok := req.BasicAuth()
+	if !ok || clientID != provider.ClientID || secret != provider.ClientSecret {
+		writeJSON(res, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	provider.lock.Lock()
+	grant, found := provider.grants[req.PostFormValue("code")]
+	delete(provider.grants, req.PostFormValue("code"))
+	provider.lock.Unlock()
+
+	verifier := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+	if !found || req.PostFormValue("grant_type") != "authorization_code" ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.Challenge {
+		writeJSON(res, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"aud": provider.ClientID,
+		"exp": now.Add(time.Hour).Unix(),
+		"iat": now.Unix(),
+		"iss": provider.Server.URL,
+		"sub": "test-subject",
+	}
+	for name, value := range grant.Claims {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+
+	key := provider.key
+	if grant.WrongKey {
+		key = provider.otherKey
+	}
+	idToken, err := signToken(key, claims)
+	if err != nil {
+		writeJSON(res, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(res, http.StatusOK, map[string]string{"id_token": idToken, "token_type": "Bearer"})
+
+}
+
+/* Signs the claims into an RS256 JWT */
+func signToken(key *rsa.PrivateKey, claims map[string]any) (string, error) {
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": oidcKeyID, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+
+}
+
+func writeJSON(res http.ResponseWriter, status int, body any) {
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	_ = json.NewEncoder(res).Encode(body)
+
+}
@@ -8,13 +8,21 @@ import (
 	"log"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"gift-registry/internal/database"
+	"gift-registry/internal/middleware"
+	"gift-registry/internal/notification"
+	"gift-registry/internal/profile"
+	"gift-registry/internal/registry"
+	"gift-registry/internal/server"
+	"gift-registry/internal/util"
 
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
@@ -31,8 +39,37 @@ type ElementValidation struct {
 // Stub for the Emailer interface so I can validate emailing in automated
 // testing
 type EmailMock struct {
-	EmailToToken map[string]string
-	EmailToSent  map[string]bool
+	EmailToClaimAlerts map[string][]notification.ClaimAlert
+	EmailToDeletions   map[string][]profile.AccountDeletionEmail
+	EmailToDevice      map[string]string
+	EmailToDigests     map[string][]notification.Digest
+	EmailToEmailCodes  map[string][]profile.EmailChangeEmail
+	EmailToEmailNotes  map[string][]profile.EmailChangeEmail
+	EmailToGuestClaims map[string][]registry.GuestClaimEmail
+	EmailToLink        map[string]string
+	EmailToReminders   map[string][]server.ReminderEmail
+	EmailToSignIns     map[string][]server.SignInEmail
+	EmailToToken       map[string]string
+	EmailToSent        map[string]bool
+	mutex              sync.Mutex
+}
+
+// Holds the details needed to make a test event in the database
+type EventData struct {
+	Date       time.Time
+	ExternalID string
+	Name       string
+}
+
+// Holds the details needed to make a test registry item in the database
+type ItemData struct {
+	EventID    int64
+	ExternalID string
+	Name       string
+	PersonID   int64
+	PriceCents int64
+	Store      string
+	URL        string
 }
 
 // Holds the details needed to make a test user in the database
@@ -48,13 +85,228 @@ type UserData struct {
 }
 
 const (
+	CSRFToken        = "go-test-csrf-token"
 	DefaultUserAgent = "go-test-user-agent"
 	externalIDLength = 40
 )
 
-func (em *EmailMock) SendVerificationEmail(ctx context.Context, to []string, code string, getenv func(string) string) error {
+// Returns the account deletion emails sent to the given address so far
+func (em *EmailMock) AccountDeletionsSent(email string) []profile.AccountDeletionEmail {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToDeletions[email]
+}
+
+// Returns the claim alerts sent to the given address so far
+func (em *EmailMock) ClaimAlertsSent(email string) []notification.ClaimAlert {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToClaimAlerts[email]
+}
+
+// Returns the digests sent to the given address so far
+func (em *EmailMock) DigestsSent(email string) []notification.Digest {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToDigests[email]
+}
+
+// Returns the email change codes sent to the given (new) address so far
+func (em *EmailMock) EmailChangeCodesSent(email string) []profile.EmailChangeEmail {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToEmailCodes[email]
+}
+
+// Returns the email change notices sent to the given (old) address so far
+func (em *EmailMock) EmailChangeNoticesSent(email string) []profile.EmailChangeEmail {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToEmailNotes[email]
+}
+
+// Returns the guest claim emails sent to the given address so far
+func (em *EmailMock) GuestClaimsSent(email string) []registry.GuestClaimEmail {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToGuestClaims[email]
+}
+
+// Returns the device named in the latest verification email sent to the given
+// address
+func (em *EmailMock) LoginDeviceSent(email string) string {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToDevice[email]
+}
+
+// Returns the login link in the last verification email sent to the address
+func (em *EmailMock) LoginLinkSent(email string) string {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToLink[email]
+}
+
+// Returns the reminders sent to the given address so far. Reminders are sent
+// from a background goroutine, so reads need to go through the lock.
+func (em *EmailMock) RemindersSent(email string) []server.ReminderEmail {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToReminders[email]
+}
+
+// Returns the sign-in emails sent to the given address so far
+func (em *EmailMock) SignInsSent(email string) []server.SignInEmail {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	return em.EmailToSignIns[email]
+}
+
+func (em *EmailMock) SendAccountDeletionEmail(ctx context.Context, to []string, deletion profile.AccountDeletionEmail, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToDeletions == nil {
+		em.EmailToDeletions = map[string][]profile.AccountDeletionEmail{}
+	}
+
+	for _, email := range to {
+		em.EmailToDeletions[email] = append(em.EmailToDeletions[email], deletion)
+	}
+
+	return nil
+}
+
+func (em *EmailMock) SendClaimAlertEmail(ctx context.Context, to []string, alert notification.ClaimAlert, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToClaimAlerts == nil {
+		em.EmailToClaimAlerts = map[string][]notification.ClaimAlert{}
+	}
+
+	for _, email := range to {
+		em.EmailToClaimAlerts[email] = append(em.EmailToClaimAlerts[email], alert)
+	}
+
+	return nil
+}
+
+func (em *EmailMock) SendDigestEmail(ctx context.Context, to []string, digest notification.Digest, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToDigests == nil {
+		em.EmailToDigests = map[string][]notification.Digest{}
+	}
+
+	for _, email := range to {
+		em.EmailToDigests[email] = append(em.EmailToDigests[email], digest)
+	}
+
+	return nil
+}
+
+func (em *EmailMock) SendEmailChangeCode(ctx context.Context, to []string, change profile.EmailChangeEmail, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToEmailCodes == nil {
+		em.EmailToEmailCodes = map[string][]profile.EmailChangeEmail{}
+	}
+
+	for _, email := range to {
+		em.EmailToEmailCodes[email] = append(em.EmailToEmailCodes[email], change)
+	}
+
+	return nil
+}
+
+func (em *EmailMock) SendEmailChangeNotice(ctx context.Context, to []string, change profile.EmailChangeEmail, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToEmailNotes == nil {
+		em.EmailToEmailNotes = map[string][]profile.EmailChangeEmail{}
+	}
+
+	for _, email := range to {
+		em.EmailToEmailNotes[email] = append(em.EmailToEmailNotes[email], change)
+	}
+
+	return nil
+}
+
+func (em *EmailMock) SendGuestClaimEmail(ctx context.Context, to []string, claim registry.GuestClaimEmail, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToGuestClaims == nil {
+		em.EmailToGuestClaims = map[string][]registry.GuestClaimEmail{}
+	}
+
+	for _, email := range to {
+		em.EmailToGuestClaims[email] = append(em.EmailToGuestClaims[email], claim)
+	}
+
+	return nil
+}
+
+func (em *EmailMock) SendReminderEmail(ctx context.Context, to []string, reminder server.ReminderEmail, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToReminders == nil {
+		em.EmailToReminders = map[string][]server.ReminderEmail{}
+	}
+
+	for _, email := range to {
+		em.EmailToReminders[email] = append(em.EmailToReminders[email], reminder)
+	}
+
+	return nil
+}
+
+func (em *EmailMock) SendSignInEmail(ctx context.Context, to []string, signIn server.SignInEmail, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToSignIns == nil {
+		em.EmailToSignIns = map[string][]server.SignInEmail{}
+	}
+
 	for _, email := range to {
+		em.EmailToSignIns[email] = append(em.EmailToSignIns[email], signIn)
+	}
+
+	return nil
+}
 
+func (em *EmailMock) SendVerificationEmail(ctx context.Context, to []string, code string, link string, device string, getenv func(string) string) error {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.EmailToDevice == nil {
+		em.EmailToDevice = map[string]string{}
+	}
+	if em.EmailToLink == nil {
+		em.EmailToLink = map[string]string{}
+	}
+
+	for _, email := range to {
+
+		em.EmailToDevice[email] = device
+		em.EmailToLink[email] = link
 		em.EmailToToken[email] = code
 		em.EmailToSent[email] = true
 
@@ -63,6 +315,25 @@ func (em *EmailMock) SendVerificationEmail(ctx context.Context, to []string, cod
 	return nil
 }
 
+// AddCSRFToken gives the request the matching CSRF cookie and header a page
+// from the app would
+func AddCSRFToken(req *http.Request) {
+	req.AddCookie(&http.Cookie{Name: middleware.CSRFCookie, Value: CSRFToken})
+	req.Header.Set(middleware.CSRFHeader, CSRFToken)
+}
+
+// AddEventPerson invites the person to the event in the given role
+// (RECIPIENT or GIVER)
+func AddEventPerson(ctx context.Context, db database.Database, eventID int64, personID int64, role string) error {
+
+	if _, err := db.Execute(ctx, "INSERT INTO event_person (event_id, person_id, role) VALUES (?, ?, ?)", eventID, personID, role); err != nil {
+		return fmt.Errorf("could not add person %d to event %d: %v", personID, eventID, err)
+	}
+
+	return nil
+
+}
+
 func AddHouseholdPerson(ctx context.Context, logger *slog.Logger, db database.Database, userData UserData, personID int64) (int64, error) {
 
 	var householdID int64
@@ -150,6 +421,73 @@ func CleanupDatabase(targetDB string) error {
 
 }
 
+// CreateAccessToken gives the person a personal access token that can write
+// to their registry, saving its hash the way the server does
+func CreateAccessToken(ctx context.Context, db database.Database, personID int64, token string) error {
+
+	_, err := db.Execute(ctx,
+		"INSERT INTO access_token (external_id, person_id, name, token_hash, scope, expiration) VALUES (?, ?, ?, ?, ?, ?)",
+		rand.Text(), personID, "Test script", HashSecret(token), "WRITE", time.Now().UTC().Add(time.Hour),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create an access token for testing: %v", err)
+	}
+
+	return nil
+
+}
+
+// CreateCalendarToken gives the person a calendar feed token, saving its hash
+// the way the server does
+func CreateCalendarToken(ctx context.Context, db database.Database, personID int64, token string) error {
+
+	if _, err := db.Execute(ctx, "INSERT INTO calendar_token (person_id, token) VALUES (?, ?)", personID, HashSecret(token)); err != nil {
+		return fmt.Errorf("could not create a calendar token for testing: %v", err)
+	}
+
+	return nil
+
+}
+
+// CreateClaim records the given person claiming the given item with the
+// provided status.
+func CreateClaim(ctx context.Context, db database.Database, itemID int64, personID int64, status string) error {
+
+	if res, err := db.Execute(ctx, "INSERT INTO claim (item_id, person_id, status, claimed_on) VALUES (?, ?, ?, ?)", itemID, personID, status, time.Now().UTC()); err != nil {
+		return fmt.Errorf("could not create a claim record for testing: %v", err)
+	} else if added, err := res.RowsAffected(); err != nil {
+		return err
+	} else if added < 1 {
+		return fmt.Errorf("no claim record added for item %d", itemID)
+	}
+
+	return nil
+
+}
+
+// CreateEvent adds an event to the database and returns its ID
+func CreateEvent(ctx context.Context, db database.Database, eventData EventData) (int64, error) {
+
+	if eventData.ExternalID == "" {
+
+		externalID := time.Now().String()
+		eventData.ExternalID = externalID[0:externalIDLength]
+
+	}
+
+	if _, err := db.Execute(ctx, "INSERT INTO event (external_id, name, event_date) VALUES (?, ?, ?)", eventData.ExternalID, eventData.Name, eventData.Date.UTC()); err != nil {
+		return 0, fmt.Errorf("could not create an event record for testing: %v", err)
+	}
+
+	var eventID int64
+	if err := db.QueryRow(ctx, "SELECT event_id FROM event WHERE external_id = ?", eventData.ExternalID).Scan(&eventID); err != nil {
+		return 0, fmt.Errorf("error reading the created event's id: %v", err)
+	}
+
+	return eventID, nil
+
+}
+
 func CreateHousehold(ctx context.Context, logger *slog.Logger, db database.Database, userData UserData, personID int64) (int64, error) {
 	/*
 		I don't want to have to make external IDs for every test, just use a string
@@ -185,6 +523,45 @@ func CreateHousehold(ctx context.Context, logger *slog.Logger, db database.Datab
 
 }
 
+// CreateItem adds a registry item to the database and returns its ID. A 0
+// EventID leaves the item unattached to any event.
+func CreateItem(ctx context.Context, db database.Database, itemData ItemData) (int64, error) {
+
+	if itemData.ExternalID == "" {
+
+		externalID := time.Now().String()
+		itemData.ExternalID = externalID[0:externalIDLength]
+
+	}
+
+	var eventID any = nil
+	if itemData.EventID != 0 {
+		eventID = itemData.EventID
+	}
+
+	if _, err := db.Execute(
+		ctx,
+		"INSERT INTO item (external_id, person_id, event_id, name, store, url, price_cents) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		itemData.ExternalID,
+		itemData.PersonID,
+		eventID,
+		itemData.Name,
+		itemData.Store,
+		itemData.URL,
+		itemData.PriceCents,
+	); err != nil {
+		return 0, fmt.Errorf("could not create an item record for testing: %v", err)
+	}
+
+	var itemID int64
+	if err := db.QueryRow(ctx, "SELECT item_id FROM item WHERE external_id = ?", itemData.ExternalID).Scan(&itemID); err != nil {
+		return 0, fmt.Errorf("error reading the created item's id: %v", err)
+	}
+
+	return itemID, nil
+
+}
+
 func CreateSession(ctx context.Context, logger *slog.Logger, db database.Database, userData UserData, timeLeft time.Duration, userAgent string) (string, error) {
 	personID, err := CreateUser(ctx, logger, db, userData)
 	if err != nil {
@@ -197,7 +574,8 @@ func CreateSession(ctx context.Context, logger *slog.Logger, db database.Databas
 	/*
 		Write the session record and sanity check that it's there.
 	*/
-	if res, err := db.Execute(ctx, "INSERT INTO session(session_id, person_id, expiration, user_agent) VALUES (?, ?, ?, ?)", token, personID, time.Now().UTC().Add(timeLeft), userAgent); err != nil {
+	now := time.Now().UTC()
+	if res, err := db.Execute(ctx, "INSERT INTO session(session_id, external_id, person_id, expiration, user_agent, device_name, created_on, last_seen_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", HashSecret(token), rand.Text(), personID, now.Add(timeLeft), userAgent, "Test device", now, now); err != nil {
 		return "", err
 	} else if modified, err := res.RowsAffected(); err != nil {
 		return "", err
@@ -208,6 +586,23 @@ func CreateSession(ctx context.Context, logger *slog.Logger, db database.Databas
 	return token, nil
 }
 
+// CreateShareLink adds a share link for the person's list, or the event's list
+// if eventID isn't 0
+func CreateShareLink(ctx context.Context, db database.Database, token string, personID int64, eventID int64) error {
+
+	var event any
+	if eventID != 0 {
+		event = eventID
+	}
+
+	if _, err := db.Execute(ctx, "INSERT INTO share_link (external_id, token, person_id, event_id) VALUES (?, ?, ?, ?)", token+"-ext", token, personID, event); err != nil {
+		return fmt.Errorf("could not create a share link for testing: %v", err)
+	}
+
+	return nil
+
+}
+
 func CreateUser(ctx context.Context, logger *slog.Logger, db database.Database, userData UserData) (int64, error) {
 
 	id := int64(0)
@@ -308,6 +703,13 @@ func FreePort() (port int) {
 	return
 }
 
+// HashSecret hashes a session ID or verification code the way the server
+// stores it. The test servers don't set SECRET_HASH_KEY, so both sides use the
+// same per-process key.
+func HashSecret(secret string) string {
+	return util.HashSecret(&util.ServerUtils{Getenv: func(string) string { return "" }}, secret)
+}
+
 // SetupTestDatabase copies a fresh database containing just the initial
 // migrations table schema to a file with the given name to be used as the
 // database for a set of tests.
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+var (
+	/*
+		Used when LINK_SIGNING_KEY isn't set. Links signed with it stop working
+		when the app restarts, so set the variable for anything but local testing.
+	*/
+	fallbackSigningKey = rand.Text()
+	/*
+		Used when SECRET_HASH_KEY isn't set. Everyone gets logged out when the app
+		restarts, so set the variable for anything but local testing.
+	*/
+	fallbackHashKey = rand.Text()
+)
+
+// HashSecret returns the keyed hash (HMAC with SECRET_HASH_KEY) of a secret
+// handed out to a browser, like a session ID or login code. Only the hash gets
+// saved, so a copy of the database isn't enough to use any of them.
+func HashSecret(svr *ServerUtils, secret string) string {
+
+	key := svr.Getenv("SECRET_HASH_KEY")
+	if key == "" {
+		key = fallbackHashKey
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+}
+
+// SignLink signs the action and ID for a link that gets emailed out, so the
+// link can't be changed to act on someone else's record.
+func SignLink(svr *ServerUtils, action string, externalID string) string {
+
+	key := svr.Getenv("LINK_SIGNING_KEY")
+	if key == "" {
+		key = fallbackSigningKey
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(action + ":" + externalID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+}
+
+// ValidSignature checks the signature in a link matches the action and ID
+func ValidSignature(svr *ServerUtils, action string, externalID string, signature string) bool {
+	return hmac.Equal([]byte(SignLink(svr, action, externalID)), []byte(signature))
+}
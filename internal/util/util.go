@@ -1,8 +1,12 @@
 package util
 
 import (
+	"errors"
+	"fmt"
 	"gift-registry/internal/database"
 	"log/slog"
+	"net/url"
+	"strings"
 )
 
 /*
@@ -19,3 +23,25 @@ type ServerUtils struct {
 	Getenv func(string) string
 	Logger *slog.Logger
 }
+
+// AppURL builds a full URL for the path on the app's configured address
+// (APP_BASE_URL), for links that get emailed or used outside the app. The
+// request's Host header is never used, since the client controls it.
+func AppURL(svr *ServerUtils, path string) string {
+	return strings.TrimSuffix(svr.Getenv("APP_BASE_URL"), "/") + path
+}
+
+// CheckBaseURL makes sure APP_BASE_URL is set to the app's full address, so
+// the server won't start up and email links nobody can use.
+func CheckBaseURL(getenv func(string) string) error {
+
+	base, err := url.Parse(getenv("APP_BASE_URL"))
+	if err != nil {
+		return fmt.Errorf("APP_BASE_URL isn't a valid URL: %v", err)
+	} else if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return errors.New("APP_BASE_URL must be the app's full address, like https://gifts.example.com")
+	}
+
+	return nil
+
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"crypto/hmac"
+	"strings"
+	"time"
+)
+
+const (
+	// CodeLifetime is how long an emailed verification code works for
+	CodeLifetime = 5 * time.Minute
+	// MaxCodeAttempts is how many tries someone gets at entering an emailed
+	// code before they have to ask for a new one
+	MaxCodeAttempts = 3
+)
+
+// HashCode hashes an emailed verification code for storage. Codes are matched
+// regardless of case, so they're upper-cased (the way they're generated)
+// first.
+func HashCode(svr *ServerUtils, code string) string {
+	return HashSecret(svr, strings.ToUpper(code))
+}
+
+// CheckCode compares the code someone entered against the stored hash. It
+// reports whether they match, whether there'd be any tries left after this
+// one, and whether the code is still within its lifetime.
+func CheckCode(svr *ServerUtils, codeHash string, expires time.Time, attempts int, code string) (codesMatch bool, attemptsRemaining bool, beforeExpiration bool) {
+
+	codesMatch = hmac.Equal([]byte(codeHash), []byte(HashCode(svr, code)))
+	beforeExpiration = time.Now().UTC().Before(expires)
+
+	/* Adding 1 to the stored count to account for this attempt */
+	attemptsRemaining = MaxCodeAttempts-(attempts+1) > 0
+
+	return
+
+}